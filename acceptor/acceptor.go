@@ -20,7 +20,15 @@
 
 package acceptor
 
-import "net"
+import (
+	"net"
+	"time"
+
+	"github.com/topfreegames/pitaya/v2/conn/codec"
+	"github.com/topfreegames/pitaya/v2/conn/packet"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/serialize"
+)
 
 // PlayerConn iface
 type PlayerConn interface {
@@ -35,3 +43,86 @@ type Acceptor interface {
 	GetAddr() string
 	GetConnChan() chan PlayerConn
 }
+
+// DefaultMaxHandshakeSize is the default max size, in bytes, of the data of
+// the handshake packets the acceptors read from clients
+const DefaultMaxHandshakeSize = 64 * 1024
+
+// checkHandshakeSize returns ErrHandshakeTooLarge if a packet of type typ
+// whose data has size bytes is a handshake bigger than max, 0 disables it
+func checkHandshakeSize(typ packet.Type, size, max int) error {
+	if max > 0 && typ == packet.Handshake && size > max {
+		return constants.ErrHandshakeTooLarge
+	}
+	return nil
+}
+
+// SerializerProvider is implemented by acceptors that can have a default
+// serializer of their own for the agents created from their conns, a nil
+// serializer means the app serializer is used
+type SerializerProvider interface {
+	GetSerializer() serialize.Serializer
+}
+
+// ConnectionCounts holds the connection counts of an acceptor
+type ConnectionCounts struct {
+	Active int64 // connections open right now
+	Total  int64 // connections accepted since the server started
+}
+
+// NameProvider is implemented by acceptors that have a name, which tags the
+// connection counts of the acceptor
+type NameProvider interface {
+	GetName() string
+}
+
+// PacketRateLimit limits the rate of the data packets handled from each
+// connection with a token bucket (https://en.wikipedia.org/wiki/Token_bucket)
+// refilled at Rate packets per second that holds at most Burst packets. A
+// Rate of 0 disables it
+type PacketRateLimit struct {
+	Rate  float64 // packets per second
+	Burst int     // max packets handled in a burst, Rate if not positive
+	Close bool    // close the connections over the limit instead of throttling them
+}
+
+// PacketRateLimitProvider is implemented by acceptors that limit the rate of
+// the data packets handled from their connections
+type PacketRateLimitProvider interface {
+	GetPacketRateLimit() PacketRateLimit
+}
+
+// HeartbeatIntervalProvider is implemented by acceptors whose connections can
+// have a heartbeat interval other than the app one, e.g. a longer one for
+// turn based clients, 0 means the app interval is used
+type HeartbeatIntervalProvider interface {
+	GetHeartbeatInterval() time.Duration
+}
+
+// PacketFramingProvider is implemented by acceptors whose connections can
+// exchange packets in a wire format other than the Pomelo one, a nil framing
+// means the Pomelo one is used
+type PacketFramingProvider interface {
+	GetPacketFraming() codec.PacketFraming
+}
+
+// ConnState describes how the connection with a client was established
+type ConnState struct {
+	Encrypted   bool   // if the connection is over TLS
+	Subprotocol string // websocket subprotocol agreed with the client, if any
+}
+
+// ConnStateProvider is implemented by conns that can describe how they were
+// established
+type ConnStateProvider interface {
+	ConnState() ConnState
+}
+
+// GetConnState returns the state of conn, the zero value if conn can't
+// describe it
+func GetConnState(conn net.Conn) ConnState {
+	if p, ok := conn.(ConnStateProvider); ok {
+		return p.ConnState()
+	}
+	return ConnState{}
+}
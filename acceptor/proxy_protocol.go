@@ -0,0 +1,241 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package acceptor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/topfreegames/pitaya/v2/constants"
+)
+
+const (
+	// proxyV1Prefix starts the PROXY protocol v1 headers
+	proxyV1Prefix = "PROXY "
+	// proxyV1MaxLength is the max length of a PROXY protocol v1 header,
+	// including the CRLF
+	proxyV1MaxLength = 107
+	// proxyV2HeaderLength is the length of the fixed part of the PROXY
+	// protocol v2 headers, followed by the addresses
+	proxyV2HeaderLength = 16
+)
+
+// proxyV2Signature starts the PROXY protocol v2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener accepts connections that can start with a PROXY
+// protocol header
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+// NewProxyProtocolListener wraps a listener whose connections can start with
+// a PROXY protocol v1 or v2 header, e.g. the ones accepted behind a load
+// balancer, making them report the client address the header carries
+func NewProxyProtocolListener(listener net.Listener) net.Listener {
+	return &proxyProtocolListener{Listener: listener}
+}
+
+// Accept waits for and returns the next connection to the listener
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewProxyProtocolConn(conn), nil
+}
+
+// ProxyProtocolConn is a connection that can start with a PROXY protocol
+// header, which is read along with the first bytes read from it
+type ProxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	mutex      sync.RWMutex
+	remoteAddr net.Addr // client address carried by the header, nil if none
+	err        error    // error reading the header
+}
+
+// NewProxyProtocolConn returns an initialized *ProxyProtocolConn
+func NewProxyProtocolConn(conn net.Conn) *ProxyProtocolConn {
+	return &ProxyProtocolConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Read reads the data after the PROXY protocol header
+func (c *ProxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address carried by the PROXY protocol
+// header, or the remote address of the connection if there is none or it
+// was not read yet
+func (c *ProxyProtocolConn) RemoteAddr() net.Addr {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the connection wrapped by this one
+func (c *ProxyProtocolConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *ProxyProtocolConn) readHeader() {
+	addr, err := ReadProxyHeader(c.reader)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remoteAddr = addr
+	c.err = err
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header from r and returns
+// the client address it carries. It returns a nil address without reading
+// anything if r does not start with a header, and a nil address after
+// reading the header if it carries no address, e.g. for health checks of the
+// proxy itself
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		prefix, err := r.Peek(len(proxyV1Prefix))
+		if err != nil || string(prefix) != proxyV1Prefix {
+			return nil, err
+		}
+		return readProxyV1Header(r)
+	case proxyV2Signature[0]:
+		signature, err := r.Peek(len(proxyV2Signature))
+		if err != nil || !bytes.Equal(signature, proxyV2Signature) {
+			return nil, err
+		}
+		return readProxyV2Header(r)
+	}
+	return nil, nil
+}
+
+// readProxyV1Header reads a header like "PROXY TCP4 src dst sport dport\r\n"
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if len(line) > proxyV1MaxLength {
+			return nil, constants.ErrInvalidProxyHeader
+		}
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, constants.ErrInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, constants.ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads a binary header, whose addresses are sent in
+// network byte order after the signature, version, command, family and
+// length bytes
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, constants.ErrInvalidProxyHeader
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL, sent by the proxy on its own behalf
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, constants.ErrInvalidProxyHeader
+	}
+
+	var ipLength int
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		ipLength = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLength = net.IPv6len
+	default: // AF_UNSPEC or AF_UNIX, no IP address
+		return nil, nil
+	}
+	if len(addresses) < 2*ipLength+4 {
+		return nil, constants.ErrInvalidProxyHeader
+	}
+	ip := net.IP(addresses[:ipLength])
+	port := int(binary.BigEndian.Uint16(addresses[2*ipLength:]))
+	if header[13]&0x0f == 0x2 { // DGRAM
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// listen returns a TCP listener on addr, serving TLS if tlsCfg is not nil,
+// whose connections can start with a PROXY protocol header if proxyProtocol
+// is set. The header is sent before the TLS handshake
+func listen(addr string, tlsCfg *tls.Config, proxyProtocol bool) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyProtocol {
+		listener = NewProxyProtocolListener(listener)
+	}
+	if tlsCfg != nil {
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+	return listener, nil
+}
@@ -0,0 +1,112 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package acceptor
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/constants"
+)
+
+func proxyV2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, byte(len(addresses)>>8), byte(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x1f, 0x90, 0x0b, 0xb8}
+	ipv6 := append(append(append([]byte{}, net.ParseIP("2001:db8::7")...), net.ParseIP("2001:db8::1")...), 0x1f, 0x90, 0x0b, 0xb8)
+	tables := []struct {
+		name   string
+		stream []byte
+		addr   net.Addr
+		err    error
+	}{
+		{"no_header", []byte{0x01, 0x00, 0x00, 0x02}, nil, nil},
+		{"v1_tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 8080 3000\r\n"), &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 8080}, nil},
+		{"v1_tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 8080 3000\r\n"), &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 8080}, nil},
+		{"v1_unknown", []byte("PROXY UNKNOWN\r\n"), nil, nil},
+		{"v1_family_mismatch", []byte("PROXY TCP4 2001:db8::7 2001:db8::1 8080 3000\r\n"), nil, constants.ErrInvalidProxyHeader},
+		{"v1_bad_port", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 80800 3000\r\n"), nil, constants.ErrInvalidProxyHeader},
+		{"v1_too_long", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), proxyV1MaxLength)...), nil, constants.ErrInvalidProxyHeader},
+		{"v2_tcp4", proxyV2Header(0x1, 0x11, ipv4), &net.TCPAddr{IP: net.IP{203, 0, 113, 7}, Port: 8080}, nil},
+		{"v2_udp4", proxyV2Header(0x1, 0x12, ipv4), &net.UDPAddr{IP: net.IP{203, 0, 113, 7}, Port: 8080}, nil},
+		{"v2_tcp6", proxyV2Header(0x1, 0x21, ipv6), &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 8080}, nil},
+		{"v2_local", proxyV2Header(0x0, 0x00, nil), nil, nil},
+		{"v2_short_addresses", proxyV2Header(0x1, 0x21, ipv4), nil, constants.ErrInvalidProxyHeader},
+		{"v2_bad_command", proxyV2Header(0x2, 0x11, ipv4), nil, constants.ErrInvalidProxyHeader},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			addr, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(table.stream)))
+			assert.Equal(t, table.err, err)
+			assert.Equal(t, table.addr, addr)
+		})
+	}
+}
+
+func TestReadProxyHeaderKeepsTheStream(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(append([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 8080 3000\r\n"), 0x01, 0x02)))
+	_, err := ReadProxyHeader(r)
+	assert.NoError(t, err)
+	rest, err := r.Peek(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 0x02}, rest)
+
+	r = bufio.NewReader(bytes.NewReader([]byte{0x01, 0x02}))
+	_, err = ReadProxyHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, r.Buffered())
+}
+
+func TestProxyProtocolConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewProxyProtocolConn(server)
+	assert.Equal(t, server.RemoteAddr(), conn.RemoteAddr())
+	assert.Equal(t, server, conn.NetConn())
+
+	go client.Write(append([]byte("PROXY TCP6 2001:db8::7 2001:db8::1 8080 3000\r\n"), 0x01, 0x02))
+	b := make([]byte, 2)
+	n, err := conn.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 0x02}, b[:n])
+	assert.Equal(t, &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 8080}, conn.RemoteAddr())
+}
+
+func TestProxyProtocolConnInvalidHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewProxyProtocolConn(server)
+
+	go client.Write([]byte("PROXY TCP4 nope\r\n"))
+	_, err := conn.Read(make([]byte, 2))
+	assert.Equal(t, constants.ErrInvalidProxyHeader, err)
+	_, err = conn.Read(make([]byte, 2))
+	assert.Equal(t, constants.ErrInvalidProxyHeader, err)
+	assert.Equal(t, server.RemoteAddr(), conn.RemoteAddr())
+}
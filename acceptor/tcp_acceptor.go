@@ -25,29 +25,91 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"time"
 
 	"github.com/topfreegames/pitaya/v2/conn/codec"
 	"github.com/topfreegames/pitaya/v2/constants"
 	"github.com/topfreegames/pitaya/v2/logger"
+	"github.com/topfreegames/pitaya/v2/serialize"
 )
 
 // TCPAcceptor struct
 type TCPAcceptor struct {
-	addr     string
-	connChan chan PlayerConn
-	listener net.Listener
-	running  bool
-	certFile string
-	keyFile  string
+	addr       string
+	connChan   chan PlayerConn
+	listener   net.Listener
+	running    bool
+	certFile   string
+	keyFile    string
+	serializer serialize.Serializer
+	linger     int
+	name       string
+	// max size of the handshakes read from the connections, 0 disables it
+	maxHandshakeSize int
+	packetRateLimit  PacketRateLimit
+	// heartbeat interval of the connections, 0 means the app one
+	heartbeatInterval time.Duration
+	// max time to read the rest of a packet once its first byte is read, 0
+	// disables it
+	packetReadTimeout time.Duration
+	// wire format of the packets, nil means the Pomelo one
+	packetFraming codec.PacketFraming
+	// if the connections can start with a PROXY protocol header
+	proxyProtocol bool
 }
 
 type tcpPlayerConn struct {
 	net.Conn
+	linger            int
+	maxHandshakeSize  int
+	packetReadTimeout time.Duration
+	packetFraming     codec.PacketFraming
+}
+
+type lingerer interface {
+	SetLinger(sec int) error
+}
+
+// Close closes the connection, applying the acceptor linger setting first
+func (t *tcpPlayerConn) Close() error {
+	if t.linger >= 0 {
+		if err := setLinger(t.Conn, t.linger); err != nil {
+			logger.Log.Warnf("Failed to set linger of TCP connection: %s", err.Error())
+		}
+	}
+	return t.Conn.Close()
+}
+
+// NetConn returns the connection wrapped by this one
+func (t *tcpPlayerConn) NetConn() net.Conn {
+	return t.Conn
+}
+
+// ConnState returns whether the connection is over TLS
+func (t *tcpPlayerConn) ConnState() ConnState {
+	_, encrypted := t.Conn.(*tls.Conn)
+	return ConnState{Encrypted: encrypted}
+}
+
+func setLinger(conn net.Conn, sec int) error {
+	for conn != nil {
+		if l, ok := conn.(lingerer); ok {
+			return l.SetLinger(sec)
+		}
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = w.NetConn()
+	}
+	return nil
 }
 
 // GetNextMessage reads the next message available in the stream
 func (t *tcpPlayerConn) GetNextMessage() (b []byte, err error) {
-	header, err := ioutil.ReadAll(io.LimitReader(t.Conn, codec.HeadLength))
+	// idle clients are handled by the heartbeat, only the rest of a packet
+	// that was started must be read within the packet read timeout
+	header, err := ioutil.ReadAll(io.LimitReader(t.Conn, 1))
 	if err != nil {
 		return nil, err
 	}
@@ -55,13 +117,32 @@ func (t *tcpPlayerConn) GetNextMessage() (b []byte, err error) {
 	if len(header) == 0 {
 		return nil, constants.ErrConnectionClosed
 	}
-	msgSize, _, err := codec.ParseHeader(header)
+	if t.packetReadTimeout > 0 {
+		if err := t.Conn.SetReadDeadline(time.Now().Add(t.packetReadTimeout)); err != nil {
+			return nil, err
+		}
+		defer t.Conn.SetReadDeadline(time.Time{})
+	}
+	headLength, parseHeader := codec.HeadLength, codec.ParseHeader
+	if t.packetFraming != nil {
+		headLength, parseHeader = t.packetFraming.HeaderLength(), t.packetFraming.ParseHeader
+	}
+	rest, err := ioutil.ReadAll(io.LimitReader(t.Conn, int64(headLength-1)))
 	if err != nil {
+		return nil, packetReadError(err)
+	}
+	header = append(header, rest...)
+	msgSize, msgType, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	// oversized handshakes are rejected before their data is read
+	if err := checkHandshakeSize(msgType, msgSize, t.maxHandshakeSize); err != nil {
 		return nil, err
 	}
 	msgData, err := ioutil.ReadAll(io.LimitReader(t.Conn, int64(msgSize)))
 	if err != nil {
-		return nil, err
+		return nil, packetReadError(err)
 	}
 	if len(msgData) < msgSize {
 		return nil, constants.ErrReceivedMsgSmallerThanExpected
@@ -69,6 +150,15 @@ func (t *tcpPlayerConn) GetNextMessage() (b []byte, err error) {
 	return append(header, msgData...), nil
 }
 
+// packetReadError returns ErrPacketReadTimeout if err is the timeout of a
+// read of the rest of a packet, and err otherwise
+func packetReadError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return constants.ErrPacketReadTimeout
+	}
+	return err
+}
+
 // NewTCPAcceptor creates a new instance of tcp acceptor
 func NewTCPAcceptor(addr string, certs ...string) *TCPAcceptor {
 	keyFile := ""
@@ -81,11 +171,13 @@ func NewTCPAcceptor(addr string, certs ...string) *TCPAcceptor {
 	}
 
 	return &TCPAcceptor{
-		addr:     addr,
-		connChan: make(chan PlayerConn),
-		running:  false,
-		certFile: certFile,
-		keyFile:  keyFile,
+		addr:             addr,
+		connChan:         make(chan PlayerConn),
+		running:          false,
+		certFile:         certFile,
+		keyFile:          keyFile,
+		linger:           -1,
+		maxHandshakeSize: DefaultMaxHandshakeSize,
 	}
 }
 
@@ -102,6 +194,113 @@ func (a *TCPAcceptor) GetConnChan() chan PlayerConn {
 	return a.connChan
 }
 
+// SetSerializer sets the default serializer used by agents created from
+// this acceptor connections, overriding the app serializer
+func (a *TCPAcceptor) SetSerializer(serializer serialize.Serializer) {
+	a.serializer = serializer
+}
+
+// GetSerializer returns the acceptor default serializer, nil means the app
+// serializer will be used
+func (a *TCPAcceptor) GetSerializer() serialize.Serializer {
+	return a.serializer
+}
+
+// SetName sets the name of the acceptor, which tags its connection counts,
+// e.g. game or admin
+func (a *TCPAcceptor) SetName(name string) {
+	a.name = name
+}
+
+// GetName returns the name of the acceptor, tcp:// followed by its address
+// if it has no name
+func (a *TCPAcceptor) GetName() string {
+	if a.name == "" {
+		return "tcp://" + a.addr
+	}
+	return a.name
+}
+
+// SetLinger sets the linger applied to the connections of this acceptor when
+// they are closed. A negative value keeps the OS default behavior, 0 discards
+// the pending data and resets the connection and a positive value blocks the
+// close for up to that many seconds while the pending data is flushed
+func (a *TCPAcceptor) SetLinger(sec int) {
+	a.linger = sec
+}
+
+// GetLinger returns the linger applied to the connections on close
+func (a *TCPAcceptor) GetLinger() int {
+	return a.linger
+}
+
+// SetMaxHandshakeSize sets the max size, in bytes, of the handshake data
+// read from the connections of this acceptor, independent of the max packet
+// size. Connections sending bigger handshakes are rejected before the data
+// is read. 0 disables the limit
+func (a *TCPAcceptor) SetMaxHandshakeSize(size int) {
+	a.maxHandshakeSize = size
+}
+
+// SetPacketReadTimeout sets the max time the connections of this acceptor
+// can take to send the rest of a packet once its first byte is read, so a
+// client that stalls in the middle of a packet is disconnected instead of
+// holding its read goroutine. Idle clients are not affected. 0 disables it
+func (a *TCPAcceptor) SetPacketReadTimeout(timeout time.Duration) {
+	a.packetReadTimeout = timeout
+}
+
+// SetPacketRateLimit sets the max rate of the data packets handled from each
+// connection of this acceptor. The agents of the connections over it are
+// throttled, or closed if limit.Close is set
+func (a *TCPAcceptor) SetPacketRateLimit(limit PacketRateLimit) {
+	a.packetRateLimit = limit
+}
+
+// GetPacketRateLimit returns the max rate of the data packets handled from
+// each connection
+func (a *TCPAcceptor) GetPacketRateLimit() PacketRateLimit {
+	return a.packetRateLimit
+}
+
+// SetHeartbeatInterval sets the heartbeat interval of the connections of this
+// acceptor, instead of the app one, e.g. to have a realtime acceptor and a
+// turn based one with different cadences in the same server. Clients can
+// still negotiate their interval within the app bounds. 0 uses the app one
+func (a *TCPAcceptor) SetHeartbeatInterval(interval time.Duration) {
+	a.heartbeatInterval = interval
+}
+
+// GetHeartbeatInterval returns the heartbeat interval of the connections, 0
+// means the app one
+func (a *TCPAcceptor) GetHeartbeatInterval() time.Duration {
+	return a.heartbeatInterval
+}
+
+// SetPacketFraming sets the wire format of the packets exchanged with the
+// connections of this acceptor, e.g. a length prefixed protocol of an
+// internal tool. The agents of the connections encode their packets with it
+// and the handler service decodes the packets read with it. nil keeps the
+// Pomelo framing
+func (a *TCPAcceptor) SetPacketFraming(framing codec.PacketFraming) {
+	a.packetFraming = framing
+}
+
+// GetPacketFraming returns the wire format of the packets exchanged with the
+// connections, nil means the Pomelo one
+func (a *TCPAcceptor) GetPacketFraming() codec.PacketFraming {
+	return a.packetFraming
+}
+
+// SetProxyProtocol sets whether the connections of this acceptor can start
+// with a PROXY protocol v1 or v2 header, e.g. the ones accepted behind a load
+// balancer. The remote address of a connection with a header is the client
+// address the header carries, which is read along with the handshake.
+// Connections without a header keep reporting the address of their peer
+func (a *TCPAcceptor) SetProxyProtocol(enabled bool) {
+	a.proxyProtocol = enabled
+}
+
 // Stop stops the acceptor
 func (a *TCPAcceptor) Stop() {
 	a.running = false
@@ -119,7 +318,7 @@ func (a *TCPAcceptor) ListenAndServe() {
 		return
 	}
 
-	listener, err := net.Listen("tcp", a.addr)
+	listener, err := listen(a.addr, nil, a.proxyProtocol)
 	if err != nil {
 		logger.Log.Fatalf("Failed to listen: %s", err.Error())
 	}
@@ -137,7 +336,7 @@ func (a *TCPAcceptor) ListenAndServeTLS(cert, key string) {
 
 	tlsCfg := &tls.Config{Certificates: []tls.Certificate{crt}}
 
-	listener, err := tls.Listen("tcp", a.addr, tlsCfg)
+	listener, err := listen(a.addr, tlsCfg, a.proxyProtocol)
 	if err != nil {
 		logger.Log.Fatalf("Failed to listen: %s", err.Error())
 	}
@@ -156,7 +355,11 @@ func (a *TCPAcceptor) serve() {
 		}
 
 		a.connChan <- &tcpPlayerConn{
-			Conn: conn,
+			Conn:              conn,
+			linger:            a.linger,
+			maxHandshakeSize:  a.maxHandshakeSize,
+			packetReadTimeout: a.packetReadTimeout,
+			packetFraming:     a.packetFraming,
 		}
 	}
 }
@@ -21,14 +21,20 @@
 package acceptor
 
 import (
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/conn/codec"
 	"github.com/topfreegames/pitaya/v2/conn/packet"
 	"github.com/topfreegames/pitaya/v2/constants"
 	"github.com/topfreegames/pitaya/v2/helpers"
+	"github.com/topfreegames/pitaya/v2/serialize/json"
 )
 
 var tcpAcceptorTables = []struct {
@@ -91,6 +97,37 @@ func TestGetConnChan(t *testing.T) {
 	}
 }
 
+func TestSetSerializer(t *testing.T) {
+	t.Parallel()
+	a := NewTCPAcceptor("0.0.0.0:0")
+	// no serializer set means the app default is used
+	assert.Nil(t, a.GetSerializer())
+
+	serializer := json.NewSerializer()
+	a.SetSerializer(serializer)
+	assert.Equal(t, serializer, a.GetSerializer())
+}
+
+func TestTCPAcceptorName(t *testing.T) {
+	t.Parallel()
+	a := NewTCPAcceptor(":3250")
+	// acceptors without a name are named after their address
+	assert.Equal(t, "tcp://:3250", a.GetName())
+
+	a.SetName("game")
+	assert.Equal(t, "game", a.GetName())
+}
+
+func TestTCPAcceptorHeartbeatInterval(t *testing.T) {
+	t.Parallel()
+	a := NewTCPAcceptor("0.0.0.0:0")
+	// no interval set means the app one is used
+	assert.Equal(t, time.Duration(0), a.GetHeartbeatInterval())
+
+	a.SetHeartbeatInterval(time.Minute)
+	assert.Equal(t, time.Minute, a.GetHeartbeatInterval())
+}
+
 func TestListenAndServe(t *testing.T) {
 	for _, table := range tcpAcceptorTables {
 		t.Run(table.name, func(t *testing.T) {
@@ -187,6 +224,121 @@ func TestGetNextMessage(t *testing.T) {
 	}
 }
 
+func TestGetNextMessageMaxHandshakeSize(t *testing.T) {
+	tables := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"handshake_within_limit", append([]byte{0x01, 0x00, 0x00, 0x04}, []byte("{}{}")...), nil},
+		// only the header is sent, the data is never read
+		{"handshake_over_limit", []byte{0x01, 0x10, 0x00, 0x00}, constants.ErrHandshakeTooLarge},
+		{"data_over_limit", append([]byte{0x04, 0x00, 0x00, 0x08}, []byte("12345678")...), nil},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			a := NewTCPAcceptor("0.0.0.0:0")
+			a.SetMaxHandshakeSize(4)
+			go a.ListenAndServe()
+			defer a.Stop()
+			c := a.GetConnChan()
+			var conn net.Conn
+			var err error
+			helpers.ShouldEventuallyReturn(t, func() error {
+				conn, err = net.Dial("tcp", a.GetAddr())
+				return err
+			}, nil, 10*time.Millisecond, 100*time.Millisecond)
+
+			defer conn.Close()
+			playerConn := helpers.ShouldEventuallyReceive(t, c, 100*time.Millisecond).(PlayerConn)
+			_, err = conn.Write(table.data)
+			assert.NoError(t, err)
+
+			msg, err := playerConn.GetNextMessage()
+			if table.err != nil {
+				assert.Equal(t, table.err, err)
+				assert.Nil(t, msg)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, table.data, msg)
+			}
+		})
+	}
+}
+
+func TestGetNextMessagePacketReadTimeout(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	tables := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"complete_packet", append([]byte{0x04, 0x00, 0x00, 0x04}, []byte("data")...), nil},
+		{"partial_header", []byte{0x04, 0x00}, constants.ErrPacketReadTimeout},
+		{"partial_data", append([]byte{0x04, 0x00, 0x00, 0x08}, []byte("data")...), constants.ErrPacketReadTimeout},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			playerConn := &tcpPlayerConn{Conn: server, packetReadTimeout: timeout}
+
+			// the client sends the data and stalls
+			go client.Write(table.data)
+
+			start := time.Now()
+			msg, err := playerConn.GetNextMessage()
+			if table.err != nil {
+				assert.Equal(t, table.err, err)
+				assert.Nil(t, msg)
+				assert.True(t, time.Since(start) >= timeout)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, table.data, msg)
+			}
+		})
+	}
+}
+
+func TestGetNextMessagePacketReadTimeoutIdleClient(t *testing.T) {
+	timeout := 20 * time.Millisecond
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	playerConn := &tcpPlayerConn{Conn: server, packetReadTimeout: timeout}
+
+	type result struct {
+		msg []byte
+		err error
+	}
+	results := make(chan result, 2)
+	read := func() {
+		msg, err := playerConn.GetNextMessage()
+		results <- result{msg, err}
+	}
+
+	// a client that sends nothing is not timed out
+	go read()
+	helpers.ShouldAlwaysReturn(t, func() int { return len(results) }, 0, 10*time.Millisecond, 5*timeout)
+
+	data := append([]byte{0x04, 0x00, 0x00, 0x04}, []byte("data")...)
+	go client.Write(data)
+	res := helpers.ShouldEventuallyReceive(t, results).(result)
+	assert.NoError(t, res.err)
+	assert.Equal(t, data, res.msg)
+
+	// the deadline of a packet does not carry over to the next one
+	go read()
+	time.Sleep(2 * timeout)
+	go client.Write(data)
+	res = helpers.ShouldEventuallyReceive(t, results).(result)
+	assert.NoError(t, res.err)
+	assert.Equal(t, data, res.msg)
+}
+
 func TestGetNextMessageTwoMessagesInBuffer(t *testing.T) {
 	a := NewTCPAcceptor("0.0.0.0:0")
 	go a.ListenAndServe()
@@ -217,6 +369,88 @@ func TestGetNextMessageTwoMessagesInBuffer(t *testing.T) {
 	assert.Equal(t, msg2, msg)
 }
 
+// lengthPrefixedHeader parses the headers of the packets framed with their
+// type followed by the length of their data in 4 bytes
+type lengthPrefixedHeader struct {
+	codec.PacketFraming
+}
+
+func (lengthPrefixedHeader) HeaderLength() int {
+	return 5
+}
+
+func (lengthPrefixedHeader) ParseHeader(header []byte) (int, packet.Type, error) {
+	if len(header) != 5 {
+		return 0, 0, packet.ErrInvalidPomeloHeader
+	}
+	return int(binary.BigEndian.Uint32(header[1:])), packet.Type(header[0]), nil
+}
+
+func TestGetNextMessagePacketFraming(t *testing.T) {
+	a := NewTCPAcceptor("0.0.0.0:0")
+	a.SetPacketFraming(lengthPrefixedHeader{})
+	a.SetMaxHandshakeSize(2)
+	assert.Equal(t, lengthPrefixedHeader{}, a.GetPacketFraming())
+	go a.ListenAndServe()
+	defer a.Stop()
+	c := a.GetConnChan()
+	// should be able to connect within 100 milliseconds
+	var conn net.Conn
+	var err error
+	helpers.ShouldEventuallyReturn(t, func() error {
+		conn, err = net.Dial("tcp", a.GetAddr())
+		return err
+	}, nil, 10*time.Millisecond, 100*time.Millisecond)
+	defer conn.Close()
+
+	playerConn := helpers.ShouldEventuallyReceive(t, c, 100*time.Millisecond).(PlayerConn)
+	msg1 := []byte{0x04, 0x00, 0x00, 0x00, 0x02, 0x01, 0x02}
+	msg2 := []byte{0x03, 0x00, 0x00, 0x00, 0x00}
+	msg3 := []byte{0x01, 0x00, 0x00, 0x00, 0x03, 0x01, 0x02, 0x03}
+	_, err = conn.Write(append(append(msg1, msg2...), msg3...))
+	assert.NoError(t, err)
+
+	msg, err := playerConn.GetNextMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, msg1, msg)
+
+	msg, err = playerConn.GetNextMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, msg2, msg)
+
+	// the max handshake size applies to the sizes parsed by the framing
+	_, err = playerConn.GetNextMessage()
+	assert.Equal(t, constants.ErrHandshakeTooLarge, err)
+}
+
+func TestGetNextMessageProxyProtocol(t *testing.T) {
+	a := NewTCPAcceptor("0.0.0.0:0")
+	a.SetProxyProtocol(true)
+	go a.ListenAndServe()
+	defer a.Stop()
+	c := a.GetConnChan()
+	// should be able to connect within 100 milliseconds
+	var conn net.Conn
+	var err error
+	helpers.ShouldEventuallyReturn(t, func() error {
+		conn, err = net.Dial("tcp", a.GetAddr())
+		return err
+	}, nil, 10*time.Millisecond, 100*time.Millisecond)
+	defer conn.Close()
+
+	playerConn := helpers.ShouldEventuallyReceive(t, c, 100*time.Millisecond).(PlayerConn)
+	assert.Equal(t, conn.LocalAddr().String(), playerConn.RemoteAddr().String())
+
+	msg1 := []byte{0x01, 0x00, 0x00, 0x01, 0x00}
+	_, err = conn.Write(append([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 8080 3000\r\n"), msg1...))
+	assert.NoError(t, err)
+
+	msg, err := playerConn.GetNextMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, msg1, msg)
+	assert.Equal(t, "203.0.113.7:8080", playerConn.RemoteAddr().String())
+}
+
 func TestGetNextMessageEOF(t *testing.T) {
 	a := NewTCPAcceptor("0.0.0.0:0")
 	go a.ListenAndServe()
@@ -298,3 +532,82 @@ func TestGetNextMessageInParts(t *testing.T) {
 	assert.Equal(t, msg, append(part1, part2...))
 
 }
+
+type lingerRecorderConn struct {
+	net.Conn
+	linger *int
+}
+
+func (c *lingerRecorderConn) SetLinger(sec int) error {
+	*c.linger = sec
+	return nil
+}
+
+func (c *lingerRecorderConn) Close() error {
+	return nil
+}
+
+func TestTCPPlayerConnCloseAppliesLinger(t *testing.T) {
+	tables := []struct {
+		name     string
+		linger   int
+		expected int
+	}{
+		{"default", -1, 42},
+		{"reset", 0, 0},
+		{"flush", 5, 5},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			applied := 42
+			conn := &tcpPlayerConn{
+				Conn:   &lingerRecorderConn{linger: &applied},
+				linger: table.linger,
+			}
+			assert.NoError(t, conn.Close())
+			assert.Equal(t, table.expected, applied)
+		})
+	}
+}
+
+func TestTCPAcceptorLinger(t *testing.T) {
+	tables := []struct {
+		name   string
+		linger int
+		reset  bool
+	}{
+		{"default", -1, false},
+		{"reset", 0, true},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			a := NewTCPAcceptor("127.0.0.1:0")
+			assert.Equal(t, -1, a.GetLinger())
+			a.SetLinger(table.linger)
+			assert.Equal(t, table.linger, a.GetLinger())
+			go a.ListenAndServe()
+			defer a.Stop()
+			c := a.GetConnChan()
+			var conn net.Conn
+			var err error
+			helpers.ShouldEventuallyReturn(t, func() error {
+				conn, err = net.Dial("tcp", a.GetAddr())
+				return err
+			}, nil, 10*time.Millisecond, 100*time.Millisecond)
+			defer conn.Close()
+
+			playerConn := helpers.ShouldEventuallyReceive(t, c, 100*time.Millisecond).(PlayerConn)
+			assert.NoError(t, playerConn.Close())
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			if table.reset {
+				assert.True(t, errors.Is(err, syscall.ECONNRESET))
+			} else {
+				assert.Equal(t, io.EOF, err)
+			}
+		})
+	}
+}
@@ -32,15 +32,25 @@ import (
 	"github.com/topfreegames/pitaya/v2/conn/packet"
 	"github.com/topfreegames/pitaya/v2/constants"
 	"github.com/topfreegames/pitaya/v2/logger"
+	"github.com/topfreegames/pitaya/v2/serialize"
 )
 
 // WSAcceptor struct
 type WSAcceptor struct {
-	addr     string
-	connChan chan PlayerConn
-	listener net.Listener
-	certFile string
-	keyFile  string
+	addr       string
+	connChan   chan PlayerConn
+	listener   net.Listener
+	certFile   string
+	keyFile    string
+	serializer serialize.Serializer
+	name       string
+	// max size of the handshakes read from the connections, 0 disables it
+	maxHandshakeSize int
+	packetRateLimit  PacketRateLimit
+	// heartbeat interval of the connections, 0 means the app one
+	heartbeatInterval time.Duration
+	// if the connections can start with a PROXY protocol header
+	proxyProtocol bool
 }
 
 // NewWSAcceptor returns a new instance of WSAcceptor
@@ -55,10 +65,11 @@ func NewWSAcceptor(addr string, certs ...string) *WSAcceptor {
 	}
 
 	w := &WSAcceptor{
-		addr:     addr,
-		connChan: make(chan PlayerConn),
-		certFile: certFile,
-		keyFile:  keyFile,
+		addr:             addr,
+		connChan:         make(chan PlayerConn),
+		certFile:         certFile,
+		keyFile:          keyFile,
+		maxHandshakeSize: DefaultMaxHandshakeSize,
 	}
 	return w
 }
@@ -76,9 +87,80 @@ func (w *WSAcceptor) GetConnChan() chan PlayerConn {
 	return w.connChan
 }
 
+// SetSerializer sets the default serializer used by agents created from
+// this acceptor connections, overriding the app serializer
+func (w *WSAcceptor) SetSerializer(serializer serialize.Serializer) {
+	w.serializer = serializer
+}
+
+// GetSerializer returns the acceptor default serializer, nil means the app
+// serializer will be used
+func (w *WSAcceptor) GetSerializer() serialize.Serializer {
+	return w.serializer
+}
+
+// SetName sets the name of the acceptor, which tags its connection counts,
+// e.g. game or admin
+func (w *WSAcceptor) SetName(name string) {
+	w.name = name
+}
+
+// GetName returns the name of the acceptor, ws:// followed by its address if
+// it has no name
+func (w *WSAcceptor) GetName() string {
+	if w.name == "" {
+		return "ws://" + w.addr
+	}
+	return w.name
+}
+
+// SetMaxHandshakeSize sets the max size, in bytes, of the handshake data
+// read from the connections of this acceptor, independent of the max packet
+// size. Connections whose first message is bigger than a handshake of that
+// size are rejected before the message is read. 0 disables the limit
+func (w *WSAcceptor) SetMaxHandshakeSize(size int) {
+	w.maxHandshakeSize = size
+}
+
+// SetPacketRateLimit sets the max rate of the data packets handled from each
+// connection of this acceptor. The agents of the connections over it are
+// throttled, or closed if limit.Close is set
+func (w *WSAcceptor) SetPacketRateLimit(limit PacketRateLimit) {
+	w.packetRateLimit = limit
+}
+
+// GetPacketRateLimit returns the max rate of the data packets handled from
+// each connection
+func (w *WSAcceptor) GetPacketRateLimit() PacketRateLimit {
+	return w.packetRateLimit
+}
+
+// SetHeartbeatInterval sets the heartbeat interval of the connections of this
+// acceptor, instead of the app one, e.g. to have a realtime acceptor and a
+// turn based one with different cadences in the same server. Clients can
+// still negotiate their interval within the app bounds. 0 uses the app one
+func (w *WSAcceptor) SetHeartbeatInterval(interval time.Duration) {
+	w.heartbeatInterval = interval
+}
+
+// GetHeartbeatInterval returns the heartbeat interval of the connections, 0
+// means the app one
+func (w *WSAcceptor) GetHeartbeatInterval() time.Duration {
+	return w.heartbeatInterval
+}
+
+// SetProxyProtocol sets whether the connections of this acceptor can start
+// with a PROXY protocol v1 or v2 header, sent before the HTTP upgrade request
+// by a load balancer. The remote address of a connection with a header is
+// the client address the header carries
+func (w *WSAcceptor) SetProxyProtocol(enabled bool) {
+	w.proxyProtocol = enabled
+}
+
 type connHandler struct {
-	upgrader *websocket.Upgrader
-	connChan chan PlayerConn
+	upgrader         *websocket.Upgrader
+	connChan         chan PlayerConn
+	maxHandshakeSize int
 }
 
 func (h *connHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
@@ -93,6 +175,7 @@ func (h *connHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		logger.Log.Errorf("Failed to create new ws connection: %s", err.Error())
 		return
 	}
+	c.setMaxHandshakeSize(h.maxHandshakeSize)
 	h.connChan <- c
 }
 
@@ -115,7 +198,7 @@ func (w *WSAcceptor) ListenAndServe() {
 		},
 	}
 
-	listener, err := net.Listen("tcp", w.addr)
+	listener, err := listen(w.addr, nil, w.proxyProtocol)
 	if err != nil {
 		logger.Log.Fatalf("Failed to listen: %s", err.Error())
 	}
@@ -137,7 +220,7 @@ func (w *WSAcceptor) ListenAndServeTLS(cert, key string) {
 	}
 
 	tlsCfg := &tls.Config{Certificates: []tls.Certificate{crt}}
-	listener, err := tls.Listen("tcp", w.addr, tlsCfg)
+	listener, err := listen(w.addr, tlsCfg, w.proxyProtocol)
 	if err != nil {
 		logger.Log.Fatalf("Failed to listen: %s", err.Error())
 	}
@@ -149,8 +232,9 @@ func (w *WSAcceptor) serve(upgrader *websocket.Upgrader) {
 	defer w.Stop()
 
 	http.Serve(w.listener, &connHandler{
-		upgrader: upgrader,
-		connChan: w.connChan,
+		upgrader:         upgrader,
+		connChan:         w.connChan,
+		maxHandshakeSize: w.maxHandshakeSize,
 	})
 }
 
@@ -168,6 +252,10 @@ type WSConn struct {
 	conn   *websocket.Conn
 	typ    int // message type
 	reader io.Reader
+	// max size of the handshakes read, 0 disables it
+	maxHandshakeSize int
+	// if the first message, which carries the handshake, was read
+	firstRead bool
 }
 
 // NewWSConn return an initialized *WSConn
@@ -177,9 +265,34 @@ func NewWSConn(conn *websocket.Conn) (*WSConn, error) {
 	return c, nil
 }
 
+// ConnState returns whether the connection is over TLS and the subprotocol
+// agreed with the client
+func (c *WSConn) ConnState() ConnState {
+	_, encrypted := c.conn.UnderlyingConn().(*tls.Conn)
+	return ConnState{Encrypted: encrypted, Subprotocol: c.conn.Subprotocol()}
+}
+
+// setMaxHandshakeSize limits the size of the first message read from the
+// connection to a handshake of size bytes, so a bigger one is rejected by the
+// websocket reader before it is buffered. 0 disables it
+func (c *WSConn) setMaxHandshakeSize(size int) {
+	c.maxHandshakeSize = size
+	if size > 0 {
+		c.conn.SetReadLimit(int64(codec.HeadLength + size))
+	}
+}
+
 // GetNextMessage reads the next message available in the stream
 func (c *WSConn) GetNextMessage() (b []byte, err error) {
 	_, msgBytes, err := c.conn.ReadMessage()
+	if !c.firstRead {
+		c.firstRead = true
+		// the limit set for the handshake does not apply to the next messages
+		c.conn.SetReadLimit(0)
+		if err == websocket.ErrReadLimit {
+			return nil, constants.ErrHandshakeTooLarge
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -187,10 +300,13 @@ func (c *WSConn) GetNextMessage() (b []byte, err error) {
 		return nil, packet.ErrInvalidPomeloHeader
 	}
 	header := msgBytes[:codec.HeadLength]
-	msgSize, _, err := codec.ParseHeader(header)
+	msgSize, msgType, err := codec.ParseHeader(header)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkHandshakeSize(msgType, msgSize, c.maxHandshakeSize); err != nil {
+		return nil, err
+	}
 	dataLen := len(msgBytes[codec.HeadLength:])
 	if dataLen < msgSize {
 		return nil, constants.ErrReceivedMsgSmallerThanExpected
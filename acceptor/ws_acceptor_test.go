@@ -293,3 +293,63 @@ func TestWSGetNextMessageSequentially(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, msg2, msg)
 }
+
+func TestWSGetNextMessageMaxHandshakeSize(t *testing.T) {
+	tables := []struct {
+		name     string
+		messages [][]byte
+		err      error
+	}{
+		{"handshake_within_limit", [][]byte{append([]byte{0x01, 0x00, 0x00, 0x04}, []byte("{}{}")...)}, nil},
+		{"handshake_over_limit", [][]byte{append([]byte{0x01, 0x00, 0x00, 0x05}, []byte("{}{}{")...)}, constants.ErrHandshakeTooLarge},
+		{"first_message_over_limit", [][]byte{append([]byte{0x04, 0x00, 0x00, 0x05}, []byte("12345")...)}, constants.ErrHandshakeTooLarge},
+		{"data_over_limit_after_handshake", [][]byte{
+			append([]byte{0x01, 0x00, 0x00, 0x02}, []byte("{}")...),
+			append([]byte{0x04, 0x00, 0x00, 0x08}, []byte("12345678")...),
+		}, nil},
+		{"handshake_over_limit_after_handshake", [][]byte{
+			append([]byte{0x01, 0x00, 0x00, 0x02}, []byte("{}")...),
+			append([]byte{0x01, 0x00, 0x00, 0x05}, []byte("{}{}{")...),
+		}, constants.ErrHandshakeTooLarge},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			w := NewWSAcceptor("0.0.0.0:0")
+			w.SetMaxHandshakeSize(4)
+			c := w.GetConnChan()
+			defer w.Stop()
+			go w.ListenAndServe()
+
+			var conn *websocket.Conn
+			var err error
+			helpers.ShouldEventuallyReturn(t, func() error {
+				addr := fmt.Sprintf("%s://%s", "ws", w.GetAddr())
+				dialer := websocket.DefaultDialer
+				conn, _, err = dialer.Dial(addr, nil)
+				return err
+			}, nil, 10*time.Millisecond, 100*time.Millisecond)
+
+			playerConn := helpers.ShouldEventuallyReceive(t, c, 100*time.Millisecond).(*WSConn)
+			defer playerConn.Close()
+			for _, data := range table.messages {
+				assert.NoError(t, conn.WriteMessage(websocket.BinaryMessage, data))
+			}
+
+			var msg []byte
+			for range table.messages {
+				msg, err = playerConn.GetNextMessage()
+				if err != nil {
+					break
+				}
+			}
+			if table.err != nil {
+				assert.Equal(t, table.err, err)
+				assert.Nil(t, msg)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, table.messages[len(table.messages)-1], msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package acceptorwrapper
+
+import (
+	"container/list"
+	"math"
+	"time"
+
+	"github.com/topfreegames/pitaya/v2/acceptor"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/logger"
+	"github.com/topfreegames/pitaya/v2/metrics"
+)
+
+// LoadSignal returns the current load of the server as a fraction of its
+// capacity, e.g. the CPU usage or the handlers in flight over the max the
+// server handles comfortably. It is called for every message read, so it
+// must be cheap
+type LoadSignal func() float64
+
+// AdaptiveRateLimiter wraps net.Conn by applying a rate limit that adapts to
+// the load of the server, dropping the messages over it like RateLimiter.
+// While the load is at most "lowLoad" the connection can send "limit"
+// messages per "interval", as the load rises to "highLoad" the limit shrinks
+// linearly down to "minLimit", and it grows back as the load drops.
+type AdaptiveRateLimiter struct {
+	acceptor.PlayerConn
+	reporters []metrics.Reporter
+	load      LoadSignal
+	limit     int
+	minLimit  int
+	interval  time.Duration
+	lowLoad   float64
+	highLoad  float64
+	times     list.List
+}
+
+// NewAdaptiveRateLimiter returns an initialized *AdaptiveRateLimiter
+func NewAdaptiveRateLimiter(
+	reporters []metrics.Reporter,
+	conn acceptor.PlayerConn,
+	load LoadSignal,
+	limit, minLimit int,
+	interval time.Duration,
+	lowLoad, highLoad float64,
+) *AdaptiveRateLimiter {
+	r := &AdaptiveRateLimiter{
+		PlayerConn: conn,
+		reporters:  reporters,
+		load:       load,
+		limit:      limit,
+		minLimit:   minLimit,
+		interval:   interval,
+		lowLoad:    lowLoad,
+		highLoad:   highLoad,
+	}
+
+	r.times.Init()
+
+	return r
+}
+
+// GetNextMessage gets the next message in the connection
+func (r *AdaptiveRateLimiter) GetNextMessage() (msg []byte, err error) {
+	for {
+		msg, err := r.PlayerConn.GetNextMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		if r.shouldRateLimit(time.Now(), r.currentLimit()) {
+			logger.Log.Errorf("Data=%s, Error=%s", msg, constants.ErrRateLimitExceeded)
+			metrics.ReportExceededRateLimiting(r.reporters)
+			continue
+		}
+
+		return msg, err
+	}
+}
+
+// ConnState returns the state of the wrapped connection
+func (r *AdaptiveRateLimiter) ConnState() acceptor.ConnState {
+	return acceptor.GetConnState(r.PlayerConn)
+}
+
+// currentLimit returns the number of messages allowed per interval at the
+// current load
+func (r *AdaptiveRateLimiter) currentLimit() int {
+	if r.load == nil {
+		return r.limit
+	}
+
+	load := r.load()
+	if load >= r.highLoad {
+		return r.minLimit
+	}
+	if load <= r.lowLoad {
+		return r.limit
+	}
+	tightening := (load - r.lowLoad) / (r.highLoad - r.lowLoad)
+	return r.limit - int(math.Round(tightening*float64(r.limit-r.minLimit)))
+}
+
+// shouldRateLimit saves now as a time taken or returns true if limit
+// messages were already taken within the interval before now. The times
+// older than the interval are dropped, so a limit that shrank applies right
+// away and one that grew frees slots right away
+func (r *AdaptiveRateLimiter) shouldRateLimit(now time.Time, limit int) bool {
+	for front := r.times.Front(); front != nil; front = r.times.Front() {
+		if now.Sub(front.Value.(time.Time)) < r.interval {
+			break
+		}
+		r.times.Remove(front)
+	}
+
+	if r.times.Len() >= limit {
+		return true
+	}
+
+	r.times.PushBack(now)
+	return false
+}
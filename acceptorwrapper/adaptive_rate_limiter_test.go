@@ -0,0 +1,127 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package acceptorwrapper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/metrics"
+	"github.com/topfreegames/pitaya/v2/mocks"
+)
+
+func TestAdaptiveRateLimiterCurrentLimit(t *testing.T) {
+	t.Parallel()
+
+	tables := map[string]struct {
+		load     float64
+		expected int
+	}{
+		"test_idle":            {0, 20},
+		"test_at_low_load":     {0.5, 20},
+		"test_halfway":         {0.7, 13},
+		"test_near_high_load":  {0.85, 8},
+		"test_at_high_load":    {0.9, 6},
+		"test_above_high_load": {1.5, 6},
+	}
+
+	for name, table := range tables {
+		t.Run(name, func(t *testing.T) {
+			load := func() float64 { return table.load }
+			r := NewAdaptiveRateLimiter([]metrics.Reporter{}, nil, load, 20, 6, time.Second, 0.5, 0.9)
+			assert.Equal(t, table.expected, r.currentLimit())
+		})
+	}
+}
+
+func TestAdaptiveRateLimiterCurrentLimitWithoutLoadSignal(t *testing.T) {
+	t.Parallel()
+
+	r := NewAdaptiveRateLimiter([]metrics.Reporter{}, nil, nil, 20, 6, time.Second, 0.5, 0.9)
+	assert.Equal(t, 20, r.currentLimit())
+}
+
+func TestAdaptiveRateLimiterShouldRateLimit(t *testing.T) {
+	t.Parallel()
+
+	interval := time.Second
+	now := time.Now()
+	r := NewAdaptiveRateLimiter([]metrics.Reporter{}, nil, nil, 4, 2, interval, 0.5, 0.9)
+
+	r.shouldRateLimit(now.Add(-interval/2), 4)
+	r.shouldRateLimit(now, 4)
+	r.shouldRateLimit(now, 4)
+	assert.Equal(t, 3, r.times.Len())
+
+	// the messages already taken exceed the tightened limit
+	assert.True(t, r.shouldRateLimit(now, 2))
+	assert.Equal(t, 3, r.times.Len())
+
+	// once the limit relaxes the new slots are available right away
+	assert.False(t, r.shouldRateLimit(now, 4))
+	assert.True(t, r.shouldRateLimit(now, 4))
+
+	// and the slot of the oldest message is freed after the interval
+	assert.False(t, r.shouldRateLimit(now.Add(interval/2), 4))
+	assert.Equal(t, 4, r.times.Len())
+}
+
+func TestAdaptiveRateLimiterTightensUnderHighLoad(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		msg     = []byte{0x01, 0x00, 0x00, 0x01, 0x01}
+		errTest = errors.New("error")
+		load    = 0.0
+	)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	r := NewAdaptiveRateLimiter([]metrics.Reporter{}, mockConn, func() float64 { return load }, 4, 2, time.Minute, 0.5, 0.9)
+
+	// under low load the connection can send the full limit
+	mockConn.EXPECT().GetNextMessage().Return(msg, nil).Times(3)
+	for i := 0; i < 3; i++ {
+		buf, err := r.GetNextMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, msg, buf)
+	}
+
+	// under high load the limit is already exceeded, so the message is
+	// dropped and the next read returns the error that ends the loop
+	load = 1
+	mockConn.EXPECT().GetNextMessage().Return(msg, nil)
+	mockConn.EXPECT().GetNextMessage().Return(nil, errTest)
+	buf, err := r.GetNextMessage()
+	assert.Equal(t, errTest, err)
+	assert.Nil(t, buf)
+
+	// once the load drops the connection can send up to the full limit again
+	load = 0
+	mockConn.EXPECT().GetNextMessage().Return(msg, nil)
+	buf, err = r.GetNextMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, msg, buf)
+}
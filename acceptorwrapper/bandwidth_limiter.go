@@ -0,0 +1,125 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package acceptorwrapper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/topfreegames/pitaya/v2/acceptor"
+)
+
+// BandwidthLimiter wraps net.Conn by capping the bytes per second read from
+// and written to it. Each direction has a token bucket
+// (https://en.wikipedia.org/wiki/Token_bucket) that is refilled at "rate"
+// bytes per second and holds at most "burst" bytes. Traffic over the budget
+// is delayed, never dropped: reads wait before returning the message, which
+// eventually pushes back on the client through TCP, and writes wait before
+// writing. A rate of 0 disables the cap in that direction.
+type BandwidthLimiter struct {
+	acceptor.PlayerConn
+	readBucket  *tokenBucket
+	writeBucket *tokenBucket
+}
+
+// NewBandwidthLimiter returns an initialized *BandwidthLimiter
+func NewBandwidthLimiter(
+	conn acceptor.PlayerConn,
+	readRate, readBurst int,
+	writeRate, writeBurst int,
+) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		PlayerConn:  conn,
+		readBucket:  newTokenBucket(readRate, readBurst),
+		writeBucket: newTokenBucket(writeRate, writeBurst),
+	}
+}
+
+// GetNextMessage gets the next message in the connection
+func (b *BandwidthLimiter) GetNextMessage() ([]byte, error) {
+	msg, err := b.PlayerConn.GetNextMessage()
+	if err != nil {
+		return nil, err
+	}
+	b.readBucket.wait(len(msg))
+	return msg, nil
+}
+
+// Write writes data to the connection
+func (b *BandwidthLimiter) Write(data []byte) (int, error) {
+	b.writeBucket.wait(len(data))
+	return b.PlayerConn.Write(data)
+}
+
+// ConnState returns the state of the wrapped connection
+func (b *BandwidthLimiter) ConnState() acceptor.ConnState {
+	return acceptor.GetConnState(b.PlayerConn)
+}
+
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // max tokens
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, or nil if rate is not positive. A
+// burst that is not positive is set to rate
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens from the bucket, blocking until the bucket has them.
+// The bucket can go into debt so messages bigger than burst are delayed
+// proportionally to their size instead of blocking forever
+func (b *tokenBucket) wait(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mutex.Unlock()
+
+	time.Sleep(delay)
+}
@@ -0,0 +1,132 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package acceptorwrapper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/mocks"
+)
+
+func TestBandwidthLimiterThroughput(t *testing.T) {
+	t.Parallel()
+
+	var (
+		rate      = 10000
+		burst     = 1000
+		chunk     = make([]byte, 500)
+		chunks    = 20
+		expected  = time.Duration(float64(chunks*len(chunk)-burst) / float64(rate) * float64(time.Second))
+		tolerance = 150 * time.Millisecond
+	)
+
+	tables := map[string]struct {
+		limiter  func(conn *mocks.MockPlayerConn) *BandwidthLimiter
+		mock     func(conn *mocks.MockPlayerConn)
+		transfer func(b *BandwidthLimiter) error
+	}{
+		"test_read": {
+			limiter: func(conn *mocks.MockPlayerConn) *BandwidthLimiter {
+				return NewBandwidthLimiter(conn, rate, burst, 0, 0)
+			},
+			mock: func(conn *mocks.MockPlayerConn) {
+				conn.EXPECT().GetNextMessage().Return(chunk, nil).Times(chunks)
+			},
+			transfer: func(b *BandwidthLimiter) error {
+				_, err := b.GetNextMessage()
+				return err
+			},
+		},
+		"test_write": {
+			limiter: func(conn *mocks.MockPlayerConn) *BandwidthLimiter {
+				return NewBandwidthLimiter(conn, 0, 0, rate, burst)
+			},
+			mock: func(conn *mocks.MockPlayerConn) {
+				conn.EXPECT().Write(chunk).Return(len(chunk), nil).Times(chunks)
+			},
+			transfer: func(b *BandwidthLimiter) error {
+				_, err := b.Write(chunk)
+				return err
+			},
+		},
+	}
+
+	for name, table := range tables {
+		table := table
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockConn := mocks.NewMockPlayerConn(ctrl)
+			b := table.limiter(mockConn)
+			table.mock(mockConn)
+
+			start := time.Now()
+			for i := 0; i < chunks; i++ {
+				assert.NoError(t, table.transfer(b))
+			}
+			elapsed := time.Since(start)
+
+			assert.InDelta(t, float64(expected), float64(elapsed), float64(tolerance))
+		})
+	}
+}
+
+func TestBandwidthLimiterDisabled(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	chunk := make([]byte, 1000)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().GetNextMessage().Return(chunk, nil).Times(100)
+	mockConn.EXPECT().Write(chunk).Return(len(chunk), nil).Times(100)
+
+	b := NewBandwidthLimiter(mockConn, 0, 0, 0, 0)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		_, err := b.GetNextMessage()
+		assert.NoError(t, err)
+		_, err = b.Write(chunk)
+		assert.NoError(t, err)
+	}
+	assert.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
+
+func TestBandwidthLimiterGetNextMessageError(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	errTest := errors.New("error")
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().GetNextMessage().Return(nil, errTest)
+
+	b := NewBandwidthLimiter(mockConn, 100, 100, 0, 0)
+	msg, err := b.GetNextMessage()
+	assert.Nil(t, msg)
+	assert.Equal(t, errTest, err)
+}
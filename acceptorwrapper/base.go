@@ -22,6 +22,7 @@ package acceptorwrapper
 
 import (
 	"github.com/topfreegames/pitaya/v2/acceptor"
+	"github.com/topfreegames/pitaya/v2/serialize"
 )
 
 // BaseWrapper implements Wrapper by saving the acceptor as an attribute.
@@ -54,6 +55,31 @@ func (b *BaseWrapper) GetConnChan() chan acceptor.PlayerConn {
 	return b.connChan
 }
 
+// GetSerializer returns the serializer of the wrapped acceptor, if it has one
+func (b *BaseWrapper) GetSerializer() serialize.Serializer {
+	if p, ok := b.Acceptor.(acceptor.SerializerProvider); ok {
+		return p.GetSerializer()
+	}
+	return nil
+}
+
+// GetName returns the name of the wrapped acceptor, empty if it has none
+func (b *BaseWrapper) GetName() string {
+	if p, ok := b.Acceptor.(acceptor.NameProvider); ok {
+		return p.GetName()
+	}
+	return ""
+}
+
+// GetPacketRateLimit returns the packet rate limit of the wrapped acceptor,
+// if it has one
+func (b *BaseWrapper) GetPacketRateLimit() acceptor.PacketRateLimit {
+	if p, ok := b.Acceptor.(acceptor.PacketRateLimitProvider); ok {
+		return p.GetPacketRateLimit()
+	}
+	return acceptor.PacketRateLimit{}
+}
+
 func (b *BaseWrapper) pipe() {
 	for conn := range b.Acceptor.GetConnChan() {
 		b.connChan <- b.wrapConn(conn)
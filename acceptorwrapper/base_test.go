@@ -28,6 +28,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/topfreegames/pitaya/v2/mocks"
+	"github.com/topfreegames/pitaya/v2/serialize/json"
 )
 
 func TestListenAndServe(t *testing.T) {
@@ -73,3 +74,53 @@ func TestListenAndServe(t *testing.T) {
 	mockAcceptor.EXPECT().ListenAndServe().Do(func() { <-exit })
 	wrapper.ListenAndServe()
 }
+
+func TestBaseWrapperGetSerializer(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// acceptors that don't provide a serializer use the app one
+	wrapper := &BaseWrapper{Acceptor: mocks.NewMockAcceptor(ctrl)}
+	assert.Nil(t, wrapper.GetSerializer())
+
+	tcpAcceptor := acceptor.NewTCPAcceptor("0.0.0.0:0")
+	serializer := json.NewSerializer()
+	tcpAcceptor.SetSerializer(serializer)
+	wrapper = &BaseWrapper{Acceptor: tcpAcceptor}
+	assert.Equal(t, serializer, wrapper.GetSerializer())
+}
+
+func TestBaseWrapperGetPacketRateLimit(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// acceptors that don't limit the packet rate leave it unlimited
+	wrapper := &BaseWrapper{Acceptor: mocks.NewMockAcceptor(ctrl)}
+	assert.Equal(t, acceptor.PacketRateLimit{}, wrapper.GetPacketRateLimit())
+
+	limit := acceptor.PacketRateLimit{Rate: 10, Burst: 20, Close: true}
+	wsAcceptor := acceptor.NewWSAcceptor("0.0.0.0:0")
+	wsAcceptor.SetPacketRateLimit(limit)
+	wrapper = &BaseWrapper{Acceptor: wsAcceptor}
+	assert.Equal(t, limit, wrapper.GetPacketRateLimit())
+}
+
+func TestBaseWrapperGetName(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	wrapper := &BaseWrapper{Acceptor: mocks.NewMockAcceptor(ctrl)}
+	assert.Empty(t, wrapper.GetName())
+
+	wsAcceptor := acceptor.NewWSAcceptor(":3251")
+	wrapper = &BaseWrapper{Acceptor: wsAcceptor}
+	assert.Equal(t, "ws://:3251", wrapper.GetName())
+	wsAcceptor.SetName("admin")
+	assert.Equal(t, "admin", wrapper.GetName())
+}
@@ -0,0 +1,48 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package acceptorwrapper
+
+import (
+	"github.com/topfreegames/pitaya/v2/acceptor"
+)
+
+// InboundPreprocessingWrapper runs a preprocessor on the raw stream of each
+// connection received
+type InboundPreprocessingWrapper struct {
+	BaseWrapper
+}
+
+// NewInboundPreprocessingWrapper returns an instance of *InboundPreprocessingWrapper
+func NewInboundPreprocessingWrapper(preprocessor InboundPreprocessor) *InboundPreprocessingWrapper {
+	p := &InboundPreprocessingWrapper{}
+
+	p.BaseWrapper = NewBaseWrapper(func(conn acceptor.PlayerConn) acceptor.PlayerConn {
+		return NewInboundPreprocessingConn(conn, preprocessor)
+	})
+
+	return p
+}
+
+// Wrap saves acceptor as an attribute
+func (p *InboundPreprocessingWrapper) Wrap(a acceptor.Acceptor) acceptor.Acceptor {
+	p.Acceptor = a
+	return p
+}
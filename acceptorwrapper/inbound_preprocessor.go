@@ -0,0 +1,95 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package acceptorwrapper
+
+import (
+	"io"
+
+	"github.com/topfreegames/pitaya/v2/acceptor"
+	"github.com/topfreegames/pitaya/v2/conn/codec"
+	"github.com/topfreegames/pitaya/v2/constants"
+)
+
+// InboundPreprocessor reads the next chunk of the raw stream of a connection
+// and returns the bytes it carries once transformed, e.g. with the envelope
+// a proxy adds around the packets stripped. The returned bytes are framed as
+// pomelo packets, so a chunk may carry several packets or part of one
+type InboundPreprocessor func(r io.Reader) ([]byte, error)
+
+// InboundPreprocessingConn runs a preprocessor on the raw stream of the
+// connection before it is split into messages
+type InboundPreprocessingConn struct {
+	acceptor.PlayerConn
+	preprocessor InboundPreprocessor
+	buffer       []byte
+}
+
+// NewInboundPreprocessingConn returns an initialized *InboundPreprocessingConn
+func NewInboundPreprocessingConn(
+	conn acceptor.PlayerConn,
+	preprocessor InboundPreprocessor,
+) *InboundPreprocessingConn {
+	return &InboundPreprocessingConn{
+		PlayerConn:   conn,
+		preprocessor: preprocessor,
+	}
+}
+
+// GetNextMessage reads the next message available in the preprocessed stream
+func (p *InboundPreprocessingConn) GetNextMessage() ([]byte, error) {
+	if err := p.fill(codec.HeadLength); err != nil {
+		return nil, err
+	}
+	msgSize, _, err := codec.ParseHeader(p.buffer[:codec.HeadLength])
+	if err != nil {
+		return nil, err
+	}
+	if err := p.fill(codec.HeadLength + msgSize); err != nil {
+		return nil, err
+	}
+
+	msg := p.buffer[:codec.HeadLength+msgSize]
+	p.buffer = p.buffer[codec.HeadLength+msgSize:]
+	return msg, nil
+}
+
+// ConnState returns the state of the wrapped connection
+func (p *InboundPreprocessingConn) ConnState() acceptor.ConnState {
+	return acceptor.GetConnState(p.PlayerConn)
+}
+
+// fill runs the preprocessor until the buffer holds at least n bytes
+func (p *InboundPreprocessingConn) fill(n int) error {
+	for len(p.buffer) < n {
+		data, err := p.preprocessor(p.PlayerConn)
+		if err == io.EOF && len(p.buffer)+len(data) == 0 {
+			return constants.ErrConnectionClosed
+		}
+		if err == io.EOF {
+			return constants.ErrReceivedMsgSmallerThanExpected
+		}
+		if err != nil {
+			return err
+		}
+		p.buffer = append(p.buffer, data...)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package acceptorwrapper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/acceptor"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/helpers"
+)
+
+// readEnvelope reads an envelope made of a 2 bytes length prefix followed by
+// the bytes it carries
+func readEnvelope(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 2)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(prefix))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func envelope(data []byte) []byte {
+	prefix := make([]byte, 2)
+	binary.BigEndian.PutUint16(prefix, uint16(len(data)))
+	return append(prefix, data...)
+}
+
+func TestInboundPreprocessingWrapperStripsEnvelopes(t *testing.T) {
+	t.Parallel()
+
+	a := NewInboundPreprocessingWrapper(readEnvelope).Wrap(acceptor.NewTCPAcceptor("0.0.0.0:0"))
+	go a.ListenAndServe()
+	defer a.Stop()
+	c := a.GetConnChan()
+
+	var conn net.Conn
+	var err error
+	helpers.ShouldEventuallyReturn(t, func() error {
+		conn, err = net.Dial("tcp", a.GetAddr())
+		return err
+	}, nil, 10*time.Millisecond, 100*time.Millisecond)
+	defer conn.Close()
+
+	playerConn := helpers.ShouldEventuallyReceive(t, c, 100*time.Millisecond).(acceptor.PlayerConn)
+	msg1 := []byte{0x01, 0x00, 0x00, 0x01, 0x02}
+	msg2 := []byte{0x02, 0x00, 0x00, 0x02, 0x01, 0x01}
+	msg3 := []byte{0x03, 0x00, 0x00, 0x00}
+	// the first envelope carries a packet and part of the next one, which
+	// ends in the second envelope along with another packet
+	stream := append(envelope(append(msg1, msg2[:3]...)), envelope(append(msg2[3:], msg3...))...)
+	_, err = conn.Write(stream)
+	assert.NoError(t, err)
+
+	for _, expected := range [][]byte{msg1, msg2, msg3} {
+		msg, err := playerConn.GetNextMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, msg)
+	}
+
+	conn.Close()
+	_, err = playerConn.GetNextMessage()
+	assert.Equal(t, constants.ErrConnectionClosed, err)
+}
+
+func TestInboundPreprocessingConnGetNextMessage(t *testing.T) {
+	t.Parallel()
+
+	tables := map[string]struct {
+		chunks [][]byte
+		err    error
+		msg    []byte
+	}{
+		"test_message":              {[][]byte{{0x02, 0x00, 0x00, 0x01, 0x00}}, nil, []byte{0x02, 0x00, 0x00, 0x01, 0x00}},
+		"test_empty_chunk":          {[][]byte{{}, {0x02, 0x00, 0x00, 0x01, 0x00}}, nil, []byte{0x02, 0x00, 0x00, 0x01, 0x00}},
+		"test_closed":               {nil, constants.ErrConnectionClosed, nil},
+		"test_closed_mid_message":   {[][]byte{{0x02, 0x00, 0x00, 0x02, 0x00}}, constants.ErrReceivedMsgSmallerThanExpected, nil},
+		"test_invalid_header":       {[][]byte{{0x00, 0x00, 0x00, 0x00}}, errors.New("wrong packet type"), nil},
+		"test_preprocessor_failure": {[][]byte{nil}, errors.New("bad envelope"), nil},
+	}
+
+	for name, table := range tables {
+		table := table
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			calls := 0
+			conn := NewInboundPreprocessingConn(nil, func(r io.Reader) ([]byte, error) {
+				if calls == len(table.chunks) {
+					return nil, io.EOF
+				}
+				chunk := table.chunks[calls]
+				calls++
+				if chunk == nil {
+					return nil, table.err
+				}
+				return chunk, nil
+			})
+
+			msg, err := conn.GetNextMessage()
+			if table.err != nil {
+				assert.EqualError(t, err, table.err.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, table.msg, msg)
+		})
+	}
+}
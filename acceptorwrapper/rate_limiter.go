@@ -92,6 +92,11 @@ func (r *RateLimiter) GetNextMessage() (msg []byte, err error) {
 	}
 }
 
+// ConnState returns the state of the wrapped connection
+func (r *RateLimiter) ConnState() acceptor.ConnState {
+	return acceptor.GetConnState(r.PlayerConn)
+}
+
 // shouldRateLimit saves the now as time taken or returns an error if
 // in the limit of rate limiting
 func (r *RateLimiter) shouldRateLimit(now time.Time) bool {
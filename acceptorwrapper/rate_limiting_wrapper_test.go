@@ -38,3 +38,29 @@ func TestNewRateLimitingWrapper(t *testing.T) {
 	expected := NewRateLimiter(reporters, nil, 20, time.Second, false)
 	assert.Equal(t, expected, rateLimitingWrapper.wrapConn(nil))
 }
+
+func TestNewBandwidthLimitingWrapper(t *testing.T) {
+	t.Parallel()
+
+	c := config.BandwidthLimitingConfig{ReadRate: 100, ReadBurst: 200, WriteRate: 300, WriteBurst: 400}
+	bandwidthLimitingWrapper := NewBandwidthLimitingWrapper(c)
+	limiter := bandwidthLimitingWrapper.wrapConn(nil).(*BandwidthLimiter)
+	assert.Equal(t, float64(100), limiter.readBucket.rate)
+	assert.Equal(t, float64(200), limiter.readBucket.burst)
+	assert.Equal(t, float64(300), limiter.writeBucket.rate)
+	assert.Equal(t, float64(400), limiter.writeBucket.burst)
+}
+
+func TestNewAdaptiveRateLimitingWrapper(t *testing.T) {
+	t.Parallel()
+
+	c := config.AdaptiveRateLimitingConfig{Limit: 20, MinLimit: 5, Interval: time.Second, LowLoad: 0.5, HighLoad: 0.9}
+	adaptiveRateLimitingWrapper := NewAdaptiveRateLimitingWrapper([]metrics.Reporter{}, c, func() float64 { return 1 })
+	limiter := adaptiveRateLimitingWrapper.wrapConn(nil).(*AdaptiveRateLimiter)
+	assert.Equal(t, 20, limiter.limit)
+	assert.Equal(t, 5, limiter.minLimit)
+	assert.Equal(t, time.Second, limiter.interval)
+	assert.Equal(t, 0.5, limiter.lowLoad)
+	assert.Equal(t, 0.9, limiter.highLoad)
+	assert.Equal(t, 5, limiter.currentLimit())
+}
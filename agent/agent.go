@@ -22,101 +22,243 @@ package agent
 
 import (
 	"context"
+	"encoding/binary"
 	gojson "encoding/json"
 	e "errors"
 	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
 	"net"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/topfreegames/pitaya/v2/acceptor"
+	"github.com/topfreegames/pitaya/v2/cluster"
 	"github.com/topfreegames/pitaya/v2/conn/codec"
 	"github.com/topfreegames/pitaya/v2/conn/message"
 	"github.com/topfreegames/pitaya/v2/conn/packet"
 	"github.com/topfreegames/pitaya/v2/constants"
 	"github.com/topfreegames/pitaya/v2/errors"
 	"github.com/topfreegames/pitaya/v2/logger"
+	"github.com/topfreegames/pitaya/v2/logger/interfaces"
 	"github.com/topfreegames/pitaya/v2/metrics"
+	"github.com/topfreegames/pitaya/v2/networkentity"
 	"github.com/topfreegames/pitaya/v2/protos"
+	"github.com/topfreegames/pitaya/v2/route"
 	"github.com/topfreegames/pitaya/v2/serialize"
 	"github.com/topfreegames/pitaya/v2/session"
 	"github.com/topfreegames/pitaya/v2/tracing"
 	"github.com/topfreegames/pitaya/v2/util"
 	"github.com/topfreegames/pitaya/v2/util/compression"
 
+	"github.com/nats-io/nuid"
 	opentracing "github.com/opentracing/opentracing-go"
 )
 
-var (
-	// hbd contains the heartbeat packet data
-	hbd []byte
-	// hrd contains the handshake response data
-	hrd  []byte
-	once sync.Once
-)
-
 const handlerType = "handler"
 
+// flushCheckInterval is how often Flush checks for pending writes
+const flushCheckInterval = 10 * time.Millisecond
+
+// kickFlushTimeout is the max time KickWithReason waits for the kick packet
+// and the messages queued before it to be written before closing the agent
+const kickFlushTimeout = time.Second
+
+// handshakeCodeRetryLater is the handshake response code telling the client
+// to reconnect later
+const handshakeCodeRetryLater = 503
+
+// minWriteWatchdogInterval is the shortest interval at which the write
+// watchdog checks for timed out writes
+const minWriteWatchdogInterval = time.Millisecond
+
+// compressionZlib is the name of the compression algorithm the message data
+// is deflated with, sent in the handshake response to the clients that
+// negotiate compression
+const compressionZlib = "zlib"
+
+// maxClientCloseReasonLength is the max length of the disconnect reasons
+// reported by clients, longer ones are truncated to bound the metric labels
+const maxClientCloseReasonLength = 32
+
 type (
 	agentImpl struct {
 		Session            session.Session // session
 		sessionPool        session.SessionPool
-		appDieChan         chan bool         // app die channel
-		chDie              chan struct{}     // wait for close
-		chSend             chan pendingWrite // push message queue
-		chStopHeartbeat    chan struct{}     // stop heartbeats
-		chStopWrite        chan struct{}     // stop writing messages
-		closeMutex         sync.Mutex
+		appDieChan         chan bool           // app die channel
+		chCredit           chan struct{}       // notify the write loop of granted credit
+		affinityToken      string              // affinity token issued to the client in the handshake response, empty if none
+		chDie              chan struct{}       // wait for close
+		chHeartbeatReset   chan struct{}       // notify the heartbeat loop of a new interval
+		chSend             chan pendingWrite   // push message queue
+		chStopHeartbeat    chan struct{}       // stop heartbeats
+		chStopWrite        chan struct{}       // stop writing messages
+		backgroundGrace    time.Duration       // max time a backgrounded client can stay silent
+		backgroundUntil    int64               // unix nano time stamp until which the client is backgrounded
+		clientCloseReason  string              // reason the client reported for disconnecting
+		closeReason        string              // reason the server closed the connection for
+		codecMutex         sync.RWMutex        // protects encoder, heartbeatData and packetInterceptor
+		compressibility    float64             // fraction of the sent payloads whose compression ratio is reported
+		compression        string              // compression algorithm negotiated with the client, empty if none
+		compressionEncoder message.Encoder     // encodes the messages compressed once the client negotiates compression
+		compressionMin     int                 // min size of the message data compressed for clients that negotiate compression, 0 disables it
 		conn               net.Conn            // low-level conn fd
+		connMutex          sync.RWMutex        // protects conn, which the client can move to another connection
+		credit             int64               // messages the client can still receive when flow control is enabled
+		creditTimeout      time.Duration       // max time to wait for the client to grant credit, 0 waits forever
 		decoder            codec.PacketDecoder // binary decoder
+		dictReference      bool                // if clients can get the route dictionary hash instead of the dictionary
+		dictReferenced     bool                // if the handshake response carries the route dictionary hash
+		draining           int32               // 1 once a graceful close started, new messages are refused
 		encoder            codec.PacketEncoder // binary encoder
+		flowControl        int32               // 1 once the client granted credit
+		handshakeResponse  []byte              // handshake response data for the agent serializer
+		heartbeatData      []byte              // heartbeat packet data
 		heartbeatTimeout   time.Duration
-		lastAt             int64 // last heartbeat unix time stamp
+		heartbeatMin       time.Duration     // min heartbeat interval a client can negotiate
+		heartbeatMax       time.Duration     // max heartbeat interval a client can negotiate, 0 disables negotiation
+		heartbeatRetry     bool              // retry a heartbeat that failed with a transient write error on the next tick before closing
+		heartbeatFailed    bool              // if the last heartbeat write failed and is being retried, only used by the write loop
+		heartbeatMisses    uint32            // bitmask of the recent heartbeat intervals the client was silent in, latest in the lowest bit
+		heartbeatStamped   int32             // 1 once the client negotiated timestamped heartbeats
+		keepAlivePeriod    time.Duration     // period of the TCP keepalive set on the connections, 0 keeps the OS behavior
+		lastAt             int64             // last heartbeat unix time stamp
+		lastRTT            int64             // last round trip time sample in nanoseconds, 0 if unknown
+		logger             interfaces.Logger // logger with the connection fields bound
+		loggerMutex        sync.RWMutex      // protects logger
 		messageEncoder     message.Encoder
 		messagesBufferSize int // size of the pending messages buffer
 		metricsReporters   []metrics.Reporter
-		serializer         serialize.Serializer // message serializer
-		state              int32                // current agent state
+		mirror             io.Writer                   // receives a copy of the bytes written to the conn, nil if none
+		mirrorMutex        sync.Mutex                  // protects mirror
+		overflow           OverflowPolicy              // what to do with a push when chSend is full
+		packetInterceptor  PacketWriteInterceptor      // transforms the bytes written to the conn, nil if none
+		packetRateLimit    acceptor.PacketRateLimit    // max rate of the data packets handled from the client, only used by the read loop
+		packetTokens       float64                     // data packets the client can still send in the token bucket of packetRateLimit
+		packetTokensAt     time.Time                   // last time packetTokens was refilled
+		pendingWrites      int64                       // writes queued in chSend or in progress
+		reasonMutex        sync.Mutex                  // protects closeReason and clientCloseReason
+		requestTimeout     time.Duration               // max time a request sent to another server can take
+		rpcClient          cluster.RPCClient           // sends the requests to other servers
+		sendHead           *pendingWrite               // write taken from the head of chSend by a push dropping the oldest, written before the rest of chSend
+		sendMutex          sync.Mutex                  // protects sendHead and writerWaiting, held by the write loop to dequeue
+		serializationError SerializationErrorFormatter // formats the payload sent in place of one that failed to serialize, nil for the default
+		serializer         serialize.Serializer        // message serializer
+		serviceDiscovery   cluster.ServiceDiscovery
+		smoothedRTT        int64  // smoothed round trip time in nanoseconds reported by the client, 0 if unknown
+		state              int32  // current agent state
+		traceSampling      int32  // connection trace sampling decision
+		unregister         func() // removes the agent from the live agents of its factory, nil if none
+		writeStartedAt     int64  // unix nano time stamp of the write in progress, 0 if none
+		writerWaiting      bool   // if the write loop waits on an empty chSend
+		writeTimeout       time.Duration
 	}
 
 	pendingMessage struct {
-		ctx     context.Context
-		typ     message.Type // message type
-		route   string       // message route (push)
-		mid     uint         // response message id (response)
-		payload interface{}  // payload
-		err     bool         // if its an error message
+		ctx        context.Context
+		typ        message.Type         // message type
+		route      string               // message route (push)
+		mid        uint                 // response message id (response)
+		payload    interface{}          // payload
+		err        bool                 // if its an error message
+		span       context.Context      // context with the span of a push, nil if it is not traced
+		serializer serialize.Serializer // serializes the payload instead of the agent serializer, nil if none
+		overflow   *OverflowPolicy      // what to do with a push when chSend is full, nil uses the agent policy
 	}
 
 	pendingWrite struct {
-		ctx  context.Context
-		data []byte
-		err  error
+		ctx            context.Context
+		data           []byte
+		err            error
+		consumesCredit bool            // if it is a message subject to flow control
+		heartbeat      bool            // if it is a heartbeat packet
+		push           bool            // if it is a push, which the overflow policy can drop
+		span           context.Context // context with the span of a push, finished once it is written
+		queuedAt       int64           // unix nano time stamp of when it was queued to chSend
 	}
 
 	// Agent corresponds to a user and is used for storing raw Conn information
 	Agent interface {
 		GetSession() session.Session
 		Push(route string, v interface{}) error
+		PushWithContext(ctx context.Context, route string, v interface{}) error
+		PushWith(ctx context.Context, serializer serialize.Serializer, route string, v interface{}) error
 		ResponseMID(ctx context.Context, mid uint, v interface{}, isError ...bool) error
 		Close() error
+		CloseGraceful(timeout time.Duration) error
+		Reconnect(newConn net.Conn) error
+		Conn() net.Conn
 		RemoteAddr() net.Addr
 		String() string
 		GetStatus() int32
 		Kick(ctx context.Context) error
+		KickWithReason(ctx context.Context, reason interface{}) error
+		SetMirror(w io.Writer)
+		SetPacketWriteInterceptor(interceptor PacketWriteInterceptor)
+		Logger() interfaces.Logger
+		AddLogFields(fields map[string]interface{})
 		SetLastAt()
 		SetStatus(state int32)
+		CompareAndSetStatus(old, new int32) bool
 		Handle()
 		IPVersion() string
 		SendHandshakeResponse() error
+		SendHandshakeRetryResponse(retryAfter time.Duration) error
+		SendHandshakeMaintenanceResponse(retryAfter time.Duration, maintenance map[string]interface{}) error
+		HandshakeCompleted()
 		SendRequest(ctx context.Context, serverID, route string, v interface{}) (*protos.Response, error)
 		AnswerWithError(ctx context.Context, mid uint, err error)
+		GetSerializer() serialize.Serializer
+		Flush(ctx context.Context) error
+		GrantCredit(credit int64)
+		NegotiateHeartbeatInterval(proposed time.Duration) error
+		NegotiateDictionaryReference() error
+		NegotiateCompression(algorithms []string) error
+		NegotiateTimestampedHeartbeat() error
+		SetAffinityToken(token string) error
+		HandleHeartbeatEcho(data []byte)
+		SetPacketEncoder(encoder codec.PacketEncoder) error
+		SetBackgrounded()
+		SetTraceSampled(sampled bool)
+		GetTraceSampled() (sampled bool, decided bool)
+		SetRTT(rtt time.Duration)
+		RTT() time.Duration
+		SetPacketRateLimit(limit acceptor.PacketRateLimit)
+		AllowPacket() error
+		ConnectionQuality() ConnectionQuality
+		Capabilities() session.Capabilities
+		SetCloseReason(reason string)
+		SetClientCloseReason(reason string)
+		DisconnectReason() session.DisconnectReason
+		Snapshot() networkentity.Snapshot
 	}
 
 	// AgentFactory factory for creating Agent instances
 	AgentFactory interface {
-		CreateAgent(conn net.Conn) Agent
+		CreateAgent(conn net.Conn) (Agent, error)
+	}
+
+	// SerializerAgentFactory is implemented by agent factories that can create
+	// agents with a serializer other than the factory default one
+	SerializerAgentFactory interface {
+		CreateAgentWithSerializer(conn net.Conn, serializer serialize.Serializer) (Agent, error)
+	}
+
+	// HeartbeatAgentFactory is implemented by agent factories that can create
+	// agents with a heartbeat interval other than the factory default one
+	HeartbeatAgentFactory interface {
+		CreateAgentWithHeartbeat(conn net.Conn, serializer serialize.Serializer, heartbeatInterval time.Duration) (Agent, error)
+	}
+
+	// AgentIterator is implemented by agent factories that keep track of the
+	// live agents they created
+	AgentIterator interface {
+		ForEachAgent(f func(a Agent))
 	}
 
 	agentFactoryImpl struct {
@@ -128,10 +270,118 @@ type (
 		messageEncoder     message.Encoder
 		messagesBufferSize int // size of the pending messages buffer
 		metricsReporters   []metrics.Reporter
+		options            Options
 		serializer         serialize.Serializer // message serializer
+		agents             sync.Map             // live agents created by the factory, by session id
 	}
 )
 
+const (
+	traceSamplingUndecided int32 = iota
+	traceSamplingSampled
+	traceSamplingNotSampled
+)
+
+// ConnectionQuality is a coarse label of the quality of a client connection
+type ConnectionQuality string
+
+const (
+	// ConnectionQualityGood is the quality of connections without known issues
+	ConnectionQualityGood ConnectionQuality = "good"
+	// ConnectionQualityFair is the quality of connections with a high round
+	// trip time or that recently missed a heartbeat
+	ConnectionQualityFair ConnectionQuality = "fair"
+	// ConnectionQualityPoor is the quality of connections with a very high
+	// round trip time or that recently missed several heartbeats
+	ConnectionQualityPoor ConnectionQuality = "poor"
+)
+
+const (
+	fairRTT              = 150 * time.Millisecond
+	poorRTT              = 400 * time.Millisecond
+	heartbeatHistoryMask = 0xff // last 8 heartbeat intervals
+	fairMissedHeartbeats = 1
+	poorMissedHeartbeats = 3
+)
+
+// heartbeatStampSize is the size of the send time stamp carried by the
+// timestamped heartbeats, in nanoseconds since heartbeatEpoch as a big endian
+// uint64
+const heartbeatStampSize = 8
+
+// heartbeatEpoch is the reference of the timestamped heartbeats send time
+// stamps, time.Since it reads the monotonic clock
+var heartbeatEpoch = time.Now()
+
+// SerializationErrorFormatter returns the payload sent to a client in place
+// of a response or push payload that failed to serialize with err, encoded
+// with the serializer of the client. ctx is the context of the message, it
+// carries the span of traced messages
+type SerializationErrorFormatter func(ctx context.Context, serializer serialize.Serializer, route string, err error) ([]byte, error)
+
+// PacketWriteInterceptor transforms the bytes of a packet right before they
+// are written to the connection, e.g. to encrypt them or add a checksum. An
+// error closes the agent
+type PacketWriteInterceptor func(data []byte) ([]byte, error)
+
+// Options holds the optional settings of the agents, the zero value of each
+// field disables the feature it controls
+type Options struct {
+	// HeartbeatMin is the min heartbeat interval a client can negotiate
+	HeartbeatMin time.Duration
+	// HeartbeatMax is the max heartbeat interval a client can negotiate,
+	// 0 disables negotiation
+	HeartbeatMax time.Duration
+	// HeartbeatRetry makes a heartbeat that failed with a transient write
+	// error be retried on the next tick before closing the agent
+	HeartbeatRetry bool
+	// BackgroundGrace is the max time a backgrounded client can stay silent
+	BackgroundGrace time.Duration
+	// WriteTimeout is the max time a write to the connection can take, it is
+	// set as the write deadline of the connection before each write
+	WriteTimeout time.Duration
+	// CreditTimeout is the max time to wait for a client using flow control
+	// to grant credit, 0 waits forever
+	CreditTimeout time.Duration
+	// Compressibility is the fraction of the sent payloads whose compression
+	// ratio is reported
+	Compressibility float64
+	// TraceSampler makes the trace sampling decision of each connection
+	TraceSampler tracing.ConnectionSampler
+	// RPCClient sends the requests made with SendRequest
+	RPCClient cluster.RPCClient
+	// ServiceDiscovery finds the servers the requests made with SendRequest
+	// are sent to
+	ServiceDiscovery cluster.ServiceDiscovery
+	// RequestTimeout is the max time a request made with SendRequest can take
+	// if its context has no deadline, 0 waits forever
+	RequestTimeout time.Duration
+	// CompressionThreshold is the min size in bytes of the message data
+	// compressed for the clients that negotiate compression in the handshake,
+	// 0 disables the negotiation
+	CompressionThreshold int
+	// DictionaryReference lets the clients that support it get the hash of
+	// the route dictionary in the handshake response instead of the
+	// dictionary, which they fetch and cache out-of-band
+	DictionaryReference bool
+	// KeepAlivePeriod enables the TCP keepalive of the TCP connections with
+	// this period, so the OS detects dead peers before the heartbeat timeout,
+	// 0 keeps the OS behavior
+	KeepAlivePeriod time.Duration
+	// SerializationErrorFormatter formats the payloads sent in place of the
+	// ones that failed to serialize, nil sends the default error payload
+	SerializationErrorFormatter SerializationErrorFormatter
+	// Overflow is what to do with a push when the send buffer is full, a push
+	// whose context has a policy set by WithOverflowPolicy follows that one
+	Overflow OverflowPolicy
+	// PacketWriteInterceptor transforms the bytes of every packet written to
+	// the clients, nil writes them as encoded
+	PacketWriteInterceptor PacketWriteInterceptor
+	// Logger is the logger the connection fields of each agent are bound to,
+	// e.g. one with the fields of the deployment, nil uses logger.Log
+	Logger interfaces.Logger
+}
+
 // NewAgentFactory ctor
 func NewAgentFactory(
 	appDieChan chan bool,
@@ -143,6 +393,23 @@ func NewAgentFactory(
 	messagesBufferSize int,
 	sessionPool session.SessionPool,
 	metricsReporters []metrics.Reporter,
+) AgentFactory {
+	return NewAgentFactoryWithOptions(appDieChan, decoder, encoder, serializer, heartbeatTimeout, messageEncoder, messagesBufferSize, sessionPool, metricsReporters, Options{})
+}
+
+// NewAgentFactoryWithOptions returns an agent factory whose agents use the
+// given options
+func NewAgentFactoryWithOptions(
+	appDieChan chan bool,
+	decoder codec.PacketDecoder,
+	encoder codec.PacketEncoder,
+	serializer serialize.Serializer,
+	heartbeatTimeout time.Duration,
+	messageEncoder message.Encoder,
+	messagesBufferSize int,
+	sessionPool session.SessionPool,
+	metricsReporters []metrics.Reporter,
+	options Options,
 ) AgentFactory {
 	return &agentFactoryImpl{
 		appDieChan:         appDieChan,
@@ -153,13 +420,63 @@ func NewAgentFactory(
 		messagesBufferSize: messagesBufferSize,
 		sessionPool:        sessionPool,
 		metricsReporters:   metricsReporters,
+		options:            options,
 		serializer:         serializer,
 	}
 }
 
-// CreateAgent returns a new agent
-func (f *agentFactoryImpl) CreateAgent(conn net.Conn) Agent {
-	return newAgent(conn, f.decoder, f.encoder, f.serializer, f.heartbeatTimeout, f.messagesBufferSize, f.appDieChan, f.messageEncoder, f.metricsReporters, f.sessionPool)
+// CreateAgent returns a new agent using the factory default serializer
+func (f *agentFactoryImpl) CreateAgent(conn net.Conn) (Agent, error) {
+	return f.CreateAgentWithSerializer(conn, nil)
+}
+
+// CreateAgentWithSerializer returns a new agent, if serializer is nil the
+// factory default serializer is used
+func (f *agentFactoryImpl) CreateAgentWithSerializer(conn net.Conn, serializer serialize.Serializer) (Agent, error) {
+	return f.CreateAgentWithHeartbeat(conn, serializer, 0)
+}
+
+// CreateAgentWithHeartbeat returns a new agent, if serializer is nil the
+// factory default serializer is used and if heartbeatInterval is 0 the
+// factory default interval. If the factory has a trace sampler the
+// connection sampling decision is made here. If the agent can't be created,
+// which happens for every connection since the factory settings are wrong,
+// the app die channel is signaled so the server shuts down
+func (f *agentFactoryImpl) CreateAgentWithHeartbeat(conn net.Conn, serializer serialize.Serializer, heartbeatInterval time.Duration) (Agent, error) {
+	if serializer == nil {
+		serializer = f.serializer
+	}
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = f.heartbeatTimeout
+	}
+	a, err := newAgent(conn, f.decoder, f.encoder, serializer, heartbeatInterval, f.messagesBufferSize, f.appDieChan, f.messageEncoder, f.metricsReporters, f.sessionPool, f.options)
+	if err != nil {
+		if f.appDieChan != nil {
+			select {
+			case f.appDieChan <- true:
+			default:
+			}
+		}
+		return nil, err
+	}
+	if f.options.TraceSampler != nil {
+		a.SetTraceSampled(f.options.TraceSampler.Sample())
+	}
+	if impl, ok := a.(*agentImpl); ok {
+		id := impl.Session.ID()
+		f.agents.Store(id, a)
+		impl.unregister = func() { f.agents.Delete(id) }
+	}
+	return a, nil
+}
+
+// ForEachAgent calls f for each live agent created by the factory, in no
+// particular order. Agents created or closed meanwhile may be left out
+func (f *agentFactoryImpl) ForEachAgent(fn func(a Agent)) {
+	f.agents.Range(func(_, value interface{}) bool {
+		fn(value.(Agent))
+		return true
+	})
 }
 
 // NewAgent create new agent instance
@@ -174,44 +491,204 @@ func newAgent(
 	messageEncoder message.Encoder,
 	metricsReporters []metrics.Reporter,
 	sessionPool session.SessionPool,
-) Agent {
-	// initialize heartbeat and handshake data on first user connection
-	serializerName := serializer.GetName()
+	options Options,
+) (Agent, error) {
+	a, err := newAgentImpl(conn, packetDecoder, packetEncoder, serializer, heartbeatTime, messagesBufferSize, dieChan, messageEncoder, metricsReporters, options)
+	if err != nil {
+		return nil, err
+	}
+	a.sessionPool = sessionPool
 
-	once.Do(func() {
-		hbdEncode(heartbeatTime, packetEncoder, messageEncoder.IsCompressionEnabled(), serializerName)
-	})
+	// binding session
+	s := sessionPool.NewSession(a, true)
+	metrics.ReportNumberOfConnectedClients(metricsReporters, sessionPool.GetSessionCount())
+	a.Session = s
+	a.logger = newConnLogger(options.Logger, s)
+	if options.KeepAlivePeriod > 0 {
+		if err := setKeepAlive(conn, options.KeepAlivePeriod); err != nil {
+			a.Logger().Warnf("Failed to set keepalive of TCP connection: %s", err.Error())
+		}
+	}
+	return a, nil
+}
+
+// NewAgentBare returns an agent wired to conn and the codecs but bound to no
+// session, so the codecs and the write loop can be tested in isolation. The
+// agent is not added to any session pool, runs no session close callbacks and
+// its GetSession returns nil, so it can't make requests with SendRequest. It
+// fails if the handshake response of the agent can't be encoded
+func NewAgentBare(
+	conn net.Conn,
+	packetDecoder codec.PacketDecoder,
+	packetEncoder codec.PacketEncoder,
+	serializer serialize.Serializer,
+	heartbeatTime time.Duration,
+	messagesBufferSize int,
+	messageEncoder message.Encoder,
+	metricsReporters []metrics.Reporter,
+	options Options,
+) (Agent, error) {
+	a, err := newAgentImpl(conn, packetDecoder, packetEncoder, serializer, heartbeatTime, messagesBufferSize, nil, messageEncoder, metricsReporters, options)
+	if err != nil {
+		return nil, err
+	}
+	a.logger = newConnLogger(options.Logger, nil)
+	return a, nil
+}
+
+// newAgentImpl returns an agent not bound to any session, it fails if the
+// handshake response or the heartbeat packet can't be encoded
+func newAgentImpl(
+	conn net.Conn,
+	packetDecoder codec.PacketDecoder,
+	packetEncoder codec.PacketEncoder,
+	serializer serialize.Serializer,
+	heartbeatTime time.Duration,
+	messagesBufferSize int,
+	dieChan chan bool,
+	messageEncoder message.Encoder,
+	metricsReporters []metrics.Reporter,
+	options Options,
+) (*agentImpl, error) {
+	// the handshake response carries the agent serializer and heartbeat
+	// interval, so it is built for each agent
+	handshakeResponse, err := encodeHandshakeResponse(heartbeatTime, packetEncoder, messageEncoder.IsCompressionEnabled(), serializer, handshakeNegotiation{})
+	if err != nil {
+		return nil, err
+	}
+	heartbeatData, err := packetEncoder.Encode(packet.Heartbeat, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	a := &agentImpl{
 		appDieChan:         dieChan,
+		backgroundGrace:    options.BackgroundGrace,
+		chCredit:           make(chan struct{}, 1),
+		compressibility:    options.Compressibility,
+		compressionMin:     options.CompressionThreshold,
+		creditTimeout:      options.CreditTimeout,
 		chDie:              make(chan struct{}),
+		chHeartbeatReset:   make(chan struct{}, 1),
 		chSend:             make(chan pendingWrite, messagesBufferSize),
 		chStopHeartbeat:    make(chan struct{}),
 		chStopWrite:        make(chan struct{}),
 		messagesBufferSize: messagesBufferSize,
 		conn:               conn,
 		decoder:            packetDecoder,
+		dictReference:      options.DictionaryReference,
 		encoder:            packetEncoder,
+		handshakeResponse:  handshakeResponse,
+		heartbeatData:      heartbeatData,
 		heartbeatTimeout:   heartbeatTime,
+		heartbeatMin:       options.HeartbeatMin,
+		heartbeatMax:       options.HeartbeatMax,
+		heartbeatRetry:     options.HeartbeatRetry,
+		keepAlivePeriod:    options.KeepAlivePeriod,
 		lastAt:             time.Now().Unix(),
+		serializationError: options.SerializationErrorFormatter,
 		serializer:         serializer,
 		state:              constants.StatusStart,
 		messageEncoder:     messageEncoder,
 		metricsReporters:   metricsReporters,
-		sessionPool:        sessionPool,
+		overflow:           options.Overflow,
+		packetInterceptor:  options.PacketWriteInterceptor,
+		requestTimeout:     options.RequestTimeout,
+		rpcClient:          options.RPCClient,
+		serviceDiscovery:   options.ServiceDiscovery,
+		writeTimeout:       options.WriteTimeout,
 	}
+	return a, nil
+}
 
-	// binding session
-	s := sessionPool.NewSession(a, true)
-	metrics.ReportNumberOfConnectedClients(metricsReporters, sessionPool.GetSessionCount())
-	a.Session = s
-	return a
+// keepAliver is implemented by the connections that support TCP keepalive
+type keepAliver interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// netConner is implemented by the connections wrapping another one
+type netConner interface {
+	NetConn() net.Conn
+}
+
+// setKeepAlive enables the TCP keepalive of conn with the given period,
+// unwrapping it until a TCP connection is found. It does nothing for the
+// connections that aren't TCP
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	for conn != nil {
+		if k, ok := conn.(keepAliver); ok {
+			if err := k.SetKeepAlive(true); err != nil {
+				return err
+			}
+			return k.SetKeepAlivePeriod(period)
+		}
+		w, ok := conn.(netConner)
+		if !ok {
+			return nil
+		}
+		conn = w.NetConn()
+	}
+	return nil
+}
+
+// newConnLogger returns base, or logger.Log if it is nil, with the fields
+// identifying the connection bound, so every agent log line can be
+// correlated to it. The remote address is bound by bindRemoteAddr
+func newConnLogger(base interfaces.Logger, s session.Session) interfaces.Logger {
+	if base == nil {
+		base = logger.Log
+	}
+	fields := map[string]interface{}{
+		"connectionId": nuid.Next(),
+	}
+	if s != nil {
+		fields["sessionId"] = s.ID()
+	}
+	return base.WithFields(fields)
+}
+
+// bindRemoteAddr binds the remote address of conn to the logger of the agent.
+// It is only called once the handshake is read, as connections behind a PROXY
+// protocol listener report the address of the proxy until the first read
+func (a *agentImpl) bindRemoteAddr(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		a.AddLogFields(map[string]interface{}{"remoteAddr": addr.String()})
+	}
+}
+
+// Logger returns the logger of the agent, which carries the fields
+// identifying the connection and the ones added with AddLogFields
+func (a *agentImpl) Logger() interfaces.Logger {
+	a.loggerMutex.RLock()
+	defer a.loggerMutex.RUnlock()
+	return a.logger
+}
+
+// AddLogFields binds fields to the logger of the agent, so every line it
+// logs from now on carries them, e.g. the tenant of the client once it is
+// authenticated
+func (a *agentImpl) AddLogFields(fields map[string]interface{}) {
+	a.loggerMutex.Lock()
+	defer a.loggerMutex.Unlock()
+	a.logger = a.logger.WithFields(fields)
 }
 
 func (a *agentImpl) getMessageFromPendingMessage(pm pendingMessage) (*message.Message, error) {
-	payload, err := util.SerializeOrRaw(a.serializer, pm.payload)
+	payload, err := util.SerializeOrRaw(a.messageSerializer(pm), pm.payload)
 	if err != nil {
-		payload, err = util.GetErrorPayload(a.serializer, err)
+		metrics.ReportSerializationFailure(a.metricsReporters, pm.route)
+		payload, err = a.serializationErrorPayload(pm, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if a.Session != nil {
+		payload, err = a.Session.ApplyOutboundTransforms(pm.route, payload)
 		if err != nil {
 			return nil, err
 		}
@@ -229,23 +706,75 @@ func (a *agentImpl) getMessageFromPendingMessage(pm pendingMessage) (*message.Me
 	return m, nil
 }
 
+// messageSerializer returns the serializer of the payload of pm, which is
+// the agent serializer unless the message overrides it
+func (a *agentImpl) messageSerializer(pm pendingMessage) serialize.Serializer {
+	if pm.serializer != nil {
+		return pm.serializer
+	}
+	return a.serializer
+}
+
+// serializationErrorPayload returns the payload sent in place of the one of
+// pm, which failed to serialize with err
+func (a *agentImpl) serializationErrorPayload(pm pendingMessage, err error) ([]byte, error) {
+	serializer := a.messageSerializer(pm)
+	if a.serializationError == nil {
+		return util.GetErrorPayload(serializer, err)
+	}
+	ctx := pm.ctx
+	if ctx == nil {
+		ctx = pm.span
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return a.serializationError(ctx, serializer, pm.route, err)
+}
+
+// sampleCompressibility reports, for a sampled fraction of the messages, the
+// ratio the message payload would be compressed to. The message is sent as is
+func (a *agentImpl) sampleCompressibility(m *message.Message) {
+	if a.compressibility <= 0 || len(m.Data) == 0 || rand.Float64() >= a.compressibility {
+		return
+	}
+	compressed, err := compression.DeflateData(m.Data)
+	if err != nil {
+		a.Logger().Warnf("Failed to compress payload sample: %s", err.Error())
+		return
+	}
+	metrics.ReportCompressionRatio(a.metricsReporters, m.Route, float64(len(compressed))/float64(len(m.Data)))
+}
+
 func (a *agentImpl) packetEncodeMessage(m *message.Message) ([]byte, error) {
-	em, err := a.messageEncoder.Encode(m)
+	messageEncoder := a.messageEncoder
+	if a.compressionEncoder != nil && len(m.Data) >= a.compressionMin {
+		messageEncoder = a.compressionEncoder
+	}
+	em, err := messageEncoder.Encode(m)
 	if err != nil {
 		return nil, err
 	}
 
 	// packet encode
-	p, err := a.encoder.Encode(packet.Data, em)
+	p, err := a.getEncoder().Encode(packet.Data, em)
 	if err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
+// send queues a message to be written to the client. It fails with
+// ErrAgentClosed if the agent is closed or closing, so the message can be sent
+// through another frontend, and with ErrBrokenPipe if the queueing fails for
+// any other reason
 func (a *agentImpl) send(pendingMsg pendingMessage) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
+			if a.GetStatus() == constants.StatusClosed {
+				err = errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
+				return
+			}
 			err = errors.NewError(constants.ErrBrokenPipe, errors.ErrClientClosedRequest)
 		}
 	}()
@@ -255,6 +784,12 @@ func (a *agentImpl) send(pendingMsg pendingMessage) (err error) {
 	if err != nil {
 		return err
 	}
+	if m.Type == message.Push && a.Session != nil && a.Session.IsDuplicatePush(m.Route, m.Data) {
+		a.Logger().Debugf("Skipping duplicate push, UID=%s, Route=%s", a.sessionUID(), m.Route)
+		tracing.FinishSpan(pendingMsg.span, nil)
+		return nil
+	}
+	a.sampleCompressibility(m)
 
 	// packet encode
 	p, err := a.packetEncodeMessage(m)
@@ -263,42 +798,135 @@ func (a *agentImpl) send(pendingMsg pendingMessage) (err error) {
 	}
 
 	pWrite := pendingWrite{
-		ctx:  pendingMsg.ctx,
-		data: p,
+		ctx:            pendingMsg.ctx,
+		data:           p,
+		consumesCredit: true,
+		push:           m.Type == message.Push,
+		span:           pendingMsg.span,
 	}
 
 	if pendingMsg.err {
-		pWrite.err = util.GetErrorFromPayload(a.serializer, m.Data)
+		pWrite.err = util.GetErrorFromPayload(a.messageSerializer(pendingMsg), m.Data)
+	}
+
+	// chSend is never closed so we need this to don't block if agent is already closed,
+	// chDie is checked first so a closed agent never enqueues a message even if chSend
+	// has room for it
+	select {
+	case <-a.chDie:
+		return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
+	default:
+	}
+	if atomic.LoadInt32(&a.draining) == 1 {
+		return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
 	}
 
-	// chSend is never closed so we need this to don't block if agent is already closed
+	atomic.AddInt64(&a.pendingWrites, 1)
+	pWrite.queuedAt = time.Now().UnixNano()
+	if pWrite.push {
+		if err := a.enqueuePush(a.overflowPolicy(pendingMsg), pWrite); err != nil {
+			atomic.AddInt64(&a.pendingWrites, -1)
+			return err
+		}
+		return
+	}
 	select {
 	case a.chSend <- pWrite:
 	case <-a.chDie:
+		atomic.AddInt64(&a.pendingWrites, -1)
+		return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
 	}
 	return
 }
 
+// Flush waits until the messages queued for the client are written, failing
+// if the agent is closed or ctx is done before that
+func (a *agentImpl) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushCheckInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&a.pendingWrites) > 0 {
+		select {
+		case <-ticker.C:
+		case <-a.chDie:
+			return errors.NewError(constants.ErrBrokenPipe, errors.ErrClientClosedRequest)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 // GetSession returns the agent session
 func (a *agentImpl) GetSession() session.Session {
 	return a.Session
 }
 
+// sessionUID returns the uid of the agent session for logging, or an empty
+// string if the agent is bound to no session
+func (a *agentImpl) sessionUID() string {
+	if a.Session == nil {
+		return ""
+	}
+	return a.Session.UID()
+}
+
+// GetSerializer returns the agent serializer
+func (a *agentImpl) GetSerializer() serialize.Serializer {
+	return a.serializer
+}
+
 // Push implementation for NetworkEntity interface
 func (a *agentImpl) Push(route string, v interface{}) error {
+	return a.PushWithContext(context.Background(), route, v)
+}
+
+// PushWithContext pushes a message to the client like Push, tracing it with
+// a span child of the one in ctx, if any. The span is finished once the
+// message is written to the connection, so it covers the time it was queued
+func (a *agentImpl) PushWithContext(ctx context.Context, route string, v interface{}) error {
+	return a.PushWith(ctx, nil, route, v)
+}
+
+// PushWith pushes a message to the client like PushWithContext, serializing
+// v with serializer instead of the agent serializer, e.g. to keep a route
+// in JSON on a protobuf connection. A nil serializer uses the agent one
+func (a *agentImpl) PushWith(ctx context.Context, serializer serialize.Serializer, route string, v interface{}) error {
 	if a.GetStatus() == constants.StatusClosed {
-		return errors.NewError(constants.ErrBrokenPipe, errors.ErrClientClosedRequest)
+		return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
 	}
 
 	switch d := v.(type) {
 	case []byte:
-		logger.Log.Debugf("Type=Push, ID=%d, UID=%s, Route=%s, Data=%dbytes",
-			a.Session.ID(), a.Session.UID(), route, len(d))
+		a.Logger().Debugf("Type=Push, UID=%s, Route=%s, Data=%dbytes",
+			a.sessionUID(), route, len(d))
 	default:
-		logger.Log.Debugf("Type=Push, ID=%d, UID=%s, Route=%s, Data=%+v",
-			a.Session.ID(), a.Session.UID(), route, v)
+		a.Logger().Debugf("Type=Push, UID=%s, Route=%s, Data=%+v",
+			a.sessionUID(), route, v)
+	}
+
+	pendingMsg := pendingMessage{
+		typ:        message.Push,
+		route:      route,
+		payload:    v,
+		serializer: serializer,
+		overflow:   overflowPolicyFromContext(ctx),
+	}
+	parent, err := tracing.ExtractSpan(ctx)
+	if err != nil {
+		a.Logger().Warnf("failed to extract the span of the push, Route=%s: %s", route, err.Error())
+	}
+	if parent != nil {
+		pendingMsg.span = tracing.StartSpan(context.Background(), route, opentracing.Tags{
+			"span.kind": "producer",
+			"msg.type":  "push",
+			"user.id":   a.sessionUID(),
+		}, parent)
+	}
+	if err := a.send(pendingMsg); err != nil {
+		tracing.FinishSpan(pendingMsg.span, err)
+		return err
 	}
-	return a.send(pendingMessage{typ: message.Push, route: route, payload: v})
+	return nil
 }
 
 // ResponseMID implementation for NetworkEntity interface
@@ -309,7 +937,7 @@ func (a *agentImpl) ResponseMID(ctx context.Context, mid uint, v interface{}, is
 		err = isError[0]
 	}
 	if a.GetStatus() == constants.StatusClosed {
-		return errors.NewError(constants.ErrBrokenPipe, errors.ErrClientClosedRequest)
+		return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
 	}
 
 	if mid <= 0 {
@@ -318,11 +946,11 @@ func (a *agentImpl) ResponseMID(ctx context.Context, mid uint, v interface{}, is
 
 	switch d := v.(type) {
 	case []byte:
-		logger.Log.Debugf("Type=Response, ID=%d, UID=%s, MID=%d, Data=%dbytes",
-			a.Session.ID(), a.Session.UID(), mid, len(d))
+		a.Logger().Debugf("Type=Response, UID=%s, MID=%d, Data=%dbytes",
+			a.sessionUID(), mid, len(d))
 	default:
-		logger.Log.Infof("Type=Response, ID=%d, UID=%s, MID=%d, Data=%+v",
-			a.Session.ID(), a.Session.UID(), mid, v)
+		a.Logger().Infof("Type=Response, UID=%s, MID=%d, Data=%+v",
+			a.sessionUID(), mid, v)
 	}
 
 	return a.send(pendingMessage{ctx: ctx, typ: message.Response, mid: mid, payload: v, err: err})
@@ -330,42 +958,139 @@ func (a *agentImpl) ResponseMID(ctx context.Context, mid uint, v interface{}, is
 
 // Close closes the agent, cleans inner state and closes low-level connection.
 // Any blocked Read or Write operations will be unblocked and return errors.
+// The agent is marked as closed and chDie is closed before the session close
+// callbacks run, so pushes and responses made from within them always return
+// ErrAgentClosed.
 func (a *agentImpl) Close() error {
-	a.closeMutex.Lock()
-	defer a.closeMutex.Unlock()
-	if a.GetStatus() == constants.StatusClosed {
-		return constants.ErrCloseClosedSession
+	// only the call that moves the agent to closed cleans it up, so racing
+	// calls can't close the channels twice
+	for {
+		status := a.GetStatus()
+		if status == constants.StatusClosed {
+			return constants.ErrCloseClosedSession
+		}
+		if a.CompareAndSetStatus(status, constants.StatusClosed) {
+			break
+		}
+	}
+
+	a.Logger().Debugf("Session closed, UID=%s", a.sessionUID())
+
+	close(a.chStopWrite)
+	close(a.chStopHeartbeat)
+	close(a.chDie)
+	a.SetCloseReason(session.DisconnectReasonClosed)
+	reason := a.DisconnectReason()
+	metrics.ReportDisconnection(a.metricsReporters, reason.Server, reason.Client)
+	if a.Session != nil {
+		a.onSessionClosed(a.Session)
+	}
+
+	if a.sessionPool != nil {
+		metrics.ReportNumberOfConnectedClients(a.metricsReporters, a.sessionPool.GetSessionCount())
 	}
-	a.SetStatus(constants.StatusClosed)
+	if a.unregister != nil {
+		a.unregister()
+	}
+
+	return a.Conn().Close()
+}
 
-	logger.Log.Debugf("Session closed, ID=%d, UID=%s, IP=%s",
-		a.Session.ID(), a.Session.UID(), a.conn.RemoteAddr())
+// Reconnect moves the client to newConn, e.g. when a mobile client that lost
+// connectivity connects again, keeping the session and the messages queued
+// for it. The previous connection is closed, the messages are written to
+// newConn from then on, a message whose write to the previous connection
+// fails is written again to newConn, and the heartbeat deadline starts over.
+// Reading newConn is up to the caller, the read loop of the previous
+// connection stops without closing the session once it sees the agent moved.
+// It fails if newConn is nil or the agent is closed
+func (a *agentImpl) Reconnect(newConn net.Conn) error {
+	if newConn == nil {
+		return constants.ErrNilConn
+	}
+	a.connMutex.Lock()
+	if a.GetStatus() == constants.StatusClosed {
+		a.connMutex.Unlock()
+		return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
+	}
+	oldConn := a.conn
+	a.conn = newConn
+	a.connMutex.Unlock()
 
-	// prevent closing closed channel
+	if a.keepAlivePeriod > 0 {
+		if err := setKeepAlive(newConn, a.keepAlivePeriod); err != nil {
+			a.Logger().Warnf("Failed to set keepalive of TCP connection: %s", err.Error())
+		}
+	}
+	atomic.StoreInt64(&a.lastAt, time.Now().Unix())
+	atomic.StoreUint32(&a.heartbeatMisses, 0)
 	select {
-	case <-a.chDie:
-		// expect
+	case a.chHeartbeatReset <- struct{}{}:
 	default:
-		close(a.chStopWrite)
-		close(a.chStopHeartbeat)
-		close(a.chDie)
-		a.onSessionClosed(a.Session)
 	}
 
-	metrics.ReportNumberOfConnectedClients(a.metricsReporters, a.sessionPool.GetSessionCount())
+	a.bindRemoteAddr(newConn)
+	a.Logger().Debugf("Client reconnected, Remote=%s", newConn.RemoteAddr())
+	if err := oldConn.Close(); err != nil {
+		a.Logger().Debugf("Failed to close the previous connection: %s", err.Error())
+	}
+	return nil
+}
+
+// Conn returns the connection the client is currently connected through
+func (a *agentImpl) Conn() net.Conn {
+	a.connMutex.RLock()
+	defer a.connMutex.RUnlock()
+	return a.conn
+}
+
+// CloseGraceful closes the agent once the messages already queued for the
+// client are written, e.g. on rolling deploys, refusing new messages
+// meanwhile. The connection is closed anyway if they are not written within
+// timeout
+func (a *agentImpl) CloseGraceful(timeout time.Duration) error {
+	if a.GetStatus() == constants.StatusClosed {
+		return constants.ErrCloseClosedSession
+	}
+	atomic.StoreInt32(&a.draining, 1)
 
-	return a.conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := a.Flush(ctx); err != nil && ctx.Err() != nil {
+		a.Logger().Warnf("Closing the connection with %d messages not written, UID=%s",
+			atomic.LoadInt64(&a.pendingWrites), a.sessionUID())
+	}
+	return a.Close()
 }
 
 // RemoteAddr implementation for NetworkEntity interface
 // returns the remote network address.
 func (a *agentImpl) RemoteAddr() net.Addr {
-	return a.conn.RemoteAddr()
+	return a.Conn().RemoteAddr()
 }
 
 // String, implementation for Stringer interface
 func (a *agentImpl) String() string {
-	return fmt.Sprintf("Remote=%s, LastTime=%d", a.conn.RemoteAddr().String(), atomic.LoadInt64(&a.lastAt))
+	return fmt.Sprintf("Remote=%s, LastTime=%d", a.RemoteAddr().String(), atomic.LoadInt64(&a.lastAt))
+}
+
+// Snapshot returns the state of the agent at the time of the call
+func (a *agentImpl) Snapshot() networkentity.Snapshot {
+	snapshot := networkentity.Snapshot{
+		UID:           a.sessionUID(),
+		Status:        a.GetStatus(),
+		LastAt:        a.LastActivity(),
+		PendingWrites: atomic.LoadInt64(&a.pendingWrites),
+		QueuedWrites:  len(a.chSend),
+		QueueCapacity: cap(a.chSend),
+	}
+	if a.Session != nil {
+		snapshot.SessionID = a.Session.ID()
+	}
+	if addr := a.RemoteAddr(); addr != nil {
+		snapshot.RemoteAddr = addr.String()
+	}
+	return snapshot
 }
 
 // GetStatus gets the status
@@ -376,33 +1101,102 @@ func (a *agentImpl) GetStatus() int32 {
 // Kick sends a kick packet to a client
 func (a *agentImpl) Kick(ctx context.Context) error {
 	// packet encode
-	p, err := a.encoder.Encode(packet.Kick, nil)
+	p, err := a.getEncoder().Encode(packet.Kick, nil)
 	if err != nil {
 		return err
 	}
-	_, err = a.conn.Write(p)
+	_, err = a.writeConn(p)
 	return err
 }
 
+// KickWithReason sends the client a kick packet carrying reason, serialized
+// with the agent serializer unless it is a []byte, so it can tell the user why
+// it was disconnected, and closes the agent. The kick packet is queued after
+// the messages already sent, which are given up to kickFlushTimeout to be
+// written before the agent is closed
+func (a *agentImpl) KickWithReason(ctx context.Context, reason interface{}) error {
+	if a.GetStatus() == constants.StatusClosed {
+		return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
+	}
+	payload, err := util.SerializeOrRaw(a.serializer, reason)
+	if err != nil {
+		return err
+	}
+	p, err := a.getEncoder().Encode(packet.Kick, payload)
+	if err != nil {
+		return err
+	}
+
+	// the kick is not subject to flow control, the client must get it even
+	// if it ran out of credit
+	atomic.AddInt64(&a.pendingWrites, 1)
+	select {
+	case a.chSend <- pendingWrite{data: p, queuedAt: time.Now().UnixNano()}:
+	case <-a.chDie:
+		atomic.AddInt64(&a.pendingWrites, -1)
+		return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
+	}
+
+	flushCtx, cancel := context.WithTimeout(ctx, kickFlushTimeout)
+	defer cancel()
+	if err := a.Flush(flushCtx); err != nil && flushCtx.Err() == nil {
+		// the agent was closed before the kick was written
+		return err
+	}
+	return a.Close()
+}
+
+// LastActivity returns when the client was last heard from
+func (a *agentImpl) LastActivity() time.Time {
+	return time.Unix(atomic.LoadInt64(&a.lastAt), 0)
+}
+
 // SetLastAt sets the last at to now
 func (a *agentImpl) SetLastAt() {
 	atomic.StoreInt64(&a.lastAt, time.Now().Unix())
 }
 
-// SetStatus sets the agent status
+// SetStatus sets the agent status, a closed agent stays closed
 func (a *agentImpl) SetStatus(state int32) {
-	atomic.StoreInt32(&a.state, state)
+	for {
+		old := a.GetStatus()
+		if old == state {
+			return
+		}
+		if a.CompareAndSetStatus(old, state) {
+			if state == constants.StatusHandshake {
+				a.bindRemoteAddr(a.Conn())
+			}
+			return
+		}
+		if old == constants.StatusClosed {
+			a.Logger().Warnf("Refusing to move closed agent to status %d, UID=%s", state, a.sessionUID())
+			return
+		}
+	}
+}
+
+// CompareAndSetStatus sets the agent status to new if it is old, returning
+// whether it was set. A closed agent can't leave StatusClosed
+func (a *agentImpl) CompareAndSetStatus(old, new int32) bool {
+	if old == constants.StatusClosed && new != constants.StatusClosed {
+		return false
+	}
+	return atomic.CompareAndSwapInt32(&a.state, old, new)
 }
 
 // Handle handles the messages from and to a client
 func (a *agentImpl) Handle() {
 	defer func() {
 		a.Close()
-		logger.Log.Debugf("Session handle goroutine exit, SessionID=%d, UID=%s", a.Session.ID(), a.Session.UID())
+		a.Logger().Debugf("Session handle goroutine exit, UID=%s", a.sessionUID())
 	}()
 
 	go a.write()
 	go a.heartbeat()
+	if a.writeTimeout > 0 {
+		go a.writeWatchdog()
+	}
 	<-a.chDie // agent closed signal
 }
 
@@ -424,7 +1218,8 @@ func (a *agentImpl) IPVersion() string {
 }
 
 func (a *agentImpl) heartbeat() {
-	ticker := time.NewTicker(a.heartbeatTimeout)
+	ticker := time.NewTicker(a.getHeartbeatTimeout())
+	lastTick := time.Now()
 
 	defer func() {
 		ticker.Stop()
@@ -433,21 +1228,28 @@ func (a *agentImpl) heartbeat() {
 
 	for {
 		select {
-		case <-ticker.C:
-			deadline := time.Now().Add(-2 * a.heartbeatTimeout).Unix()
-			if atomic.LoadInt64(&a.lastAt) < deadline {
-				logger.Log.Debugf("Session heartbeat timeout, LastTime=%d, Deadline=%d", atomic.LoadInt64(&a.lastAt), deadline)
+		case now := <-ticker.C:
+			if a.heartbeatTimedOut(now) {
+				a.SetCloseReason(session.DisconnectReasonHeartbeatTimeout)
 				return
 			}
+			a.recordHeartbeat(atomic.LoadInt64(&a.lastAt) < lastTick.Unix())
+			lastTick = now
 
 			// chSend is never closed so we need this to don't block if agent is already closed
+			atomic.AddInt64(&a.pendingWrites, 1)
 			select {
-			case a.chSend <- pendingWrite{data: hbd}:
+			case a.chSend <- pendingWrite{data: a.getHeartbeatData(), heartbeat: true, queuedAt: time.Now().UnixNano()}:
 			case <-a.chDie:
+				atomic.AddInt64(&a.pendingWrites, -1)
 				return
 			case <-a.chStopHeartbeat:
+				atomic.AddInt64(&a.pendingWrites, -1)
 				return
 			}
+		case <-a.chHeartbeatReset:
+			ticker.Stop()
+			ticker = time.NewTicker(a.getHeartbeatTimeout())
 		case <-a.chDie:
 			return
 		case <-a.chStopHeartbeat:
@@ -456,28 +1258,396 @@ func (a *agentImpl) heartbeat() {
 	}
 }
 
-func (a *agentImpl) onSessionClosed(s session.Session) {
-	defer func() {
-		if err := recover(); err != nil {
-			logger.Log.Errorf("pitaya/onSessionClosed: %v", err)
-		}
-	}()
+func (a *agentImpl) getHeartbeatTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&a.heartbeatTimeout)))
+}
 
-	for _, fn1 := range s.GetOnCloseCallbacks() {
-		fn1()
+// NegotiateHeartbeatInterval adopts the heartbeat interval proposed by the
+// client, clamped to the range allowed by the server, for both sending
+// heartbeats and the heartbeat deadline. It must be called before the
+// handshake response is sent since the response carries the interval. It
+// does nothing if the server does not allow negotiation
+func (a *agentImpl) NegotiateHeartbeatInterval(proposed time.Duration) error {
+	if a.heartbeatMax <= 0 || proposed <= 0 {
+		return nil
 	}
-
-	for _, fn2 := range a.sessionPool.GetSessionCloseCallbacks() {
-		fn2(s)
+	interval := proposed
+	if interval < a.heartbeatMin {
+		interval = a.heartbeatMin
+	}
+	if interval > a.heartbeatMax {
+		interval = a.heartbeatMax
+	}
+	if interval == a.getHeartbeatTimeout() {
+		return nil
 	}
-}
+
+	handshakeResponse, err := a.encodeHandshakeResponse(interval, a.negotiation())
+	if err != nil {
+		return err
+	}
+	a.handshakeResponse = handshakeResponse
+	atomic.StoreInt64((*int64)(&a.heartbeatTimeout), int64(interval))
+
+	select {
+	case a.chHeartbeatReset <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// NegotiateDictionaryReference makes the handshake response carry the hash
+// of the route dictionary instead of the dictionary, for a client that
+// caches it. It must be called before the handshake response is sent and
+// does nothing if the server does not allow it
+func (a *agentImpl) NegotiateDictionaryReference() error {
+	if !a.dictReference || a.dictReferenced {
+		return nil
+	}
+	negotiation := a.negotiation()
+	negotiation.dictReference = true
+	handshakeResponse, err := a.encodeHandshakeResponse(a.getHeartbeatTimeout(), negotiation)
+	if err != nil {
+		return err
+	}
+	a.handshakeResponse = handshakeResponse
+	a.dictReferenced = true
+	return nil
+}
+
+// NegotiateCompression makes the message data over the compression threshold
+// be compressed with the first of algorithms, in the client order of
+// preference, the server supports. The handshake response carries the chosen
+// algorithm, so it must be called before it is sent. It does nothing if the
+// server does not allow it or supports none of algorithms
+func (a *agentImpl) NegotiateCompression(algorithms []string) error {
+	if a.compressionMin <= 0 || a.compression != "" {
+		return nil
+	}
+	for _, algorithm := range algorithms {
+		if algorithm != compressionZlib {
+			continue
+		}
+		negotiation := a.negotiation()
+		negotiation.compression = algorithm
+		handshakeResponse, err := a.encodeHandshakeResponse(a.getHeartbeatTimeout(), negotiation)
+		if err != nil {
+			return err
+		}
+		a.handshakeResponse = handshakeResponse
+		a.compression = algorithm
+		a.compressionEncoder = message.NewMessagesEncoder(true)
+		return nil
+	}
+	return nil
+}
+
+// NegotiateTimestampedHeartbeat makes the heartbeats sent to the client carry
+// their send time stamp, which the client echoes in its heartbeats so the
+// round trip time is measured. The handshake response tells the client it
+// was accepted, so it must be called before it is sent
+func (a *agentImpl) NegotiateTimestampedHeartbeat() error {
+	if atomic.LoadInt32(&a.heartbeatStamped) == 1 {
+		return nil
+	}
+	negotiation := a.negotiation()
+	negotiation.timestampedHeartbeat = true
+	handshakeResponse, err := a.encodeHandshakeResponse(a.getHeartbeatTimeout(), negotiation)
+	if err != nil {
+		return err
+	}
+	a.handshakeResponse = handshakeResponse
+	atomic.StoreInt32(&a.heartbeatStamped, 1)
+	return nil
+}
+
+// SetAffinityToken makes the handshake response carry the affinity token
+// the client echoes in its handshake when it reconnects, so a load balancer
+// can route it back to this server. It must be called before the handshake
+// response is sent
+func (a *agentImpl) SetAffinityToken(token string) error {
+	if token == a.affinityToken {
+		return nil
+	}
+	negotiation := a.negotiation()
+	negotiation.affinityToken = token
+	handshakeResponse, err := a.encodeHandshakeResponse(a.getHeartbeatTimeout(), negotiation)
+	if err != nil {
+		return err
+	}
+	a.handshakeResponse = handshakeResponse
+	a.affinityToken = token
+	return nil
+}
+
+// timestampedHeartbeatData returns the heartbeat packet data stamped with the
+// current time
+func (a *agentImpl) timestampedHeartbeatData() ([]byte, error) {
+	stamp := make([]byte, heartbeatStampSize)
+	binary.BigEndian.PutUint64(stamp, uint64(time.Since(heartbeatEpoch)))
+	return a.getEncoder().Encode(packet.Heartbeat, stamp)
+}
+
+// HandleHeartbeatEcho records the round trip time of the timestamped
+// heartbeat whose time stamp the client echoed in data. It does nothing if
+// the client did not negotiate timestamped heartbeats or data is not a time
+// stamp
+func (a *agentImpl) HandleHeartbeatEcho(data []byte) {
+	if atomic.LoadInt32(&a.heartbeatStamped) != 1 || len(data) != heartbeatStampSize {
+		return
+	}
+	sent := time.Duration(binary.BigEndian.Uint64(data))
+	a.SetRTT(time.Since(heartbeatEpoch) - sent)
+}
+
+// SetPacketEncoder makes the agent encode the packets sent to the client with
+// encoder, for clients whose packet framing differs from the default one. It
+// must be called before the handshake response is sent, since the response is
+// encoded with it
+func (a *agentImpl) SetPacketEncoder(encoder codec.PacketEncoder) error {
+	handshakeResponse, err := encodeHandshakeResponse(a.getHeartbeatTimeout(), encoder, a.messageEncoder.IsCompressionEnabled(), a.serializer, a.negotiation())
+	if err != nil {
+		return err
+	}
+	heartbeatData, err := encoder.Encode(packet.Heartbeat, nil)
+	if err != nil {
+		return err
+	}
+	a.codecMutex.Lock()
+	a.encoder = encoder
+	a.heartbeatData = heartbeatData
+	a.codecMutex.Unlock()
+	a.handshakeResponse = handshakeResponse
+	return nil
+}
+
+func (a *agentImpl) getEncoder() codec.PacketEncoder {
+	a.codecMutex.RLock()
+	defer a.codecMutex.RUnlock()
+	return a.encoder
+}
+
+func (a *agentImpl) getHeartbeatData() []byte {
+	a.codecMutex.RLock()
+	defer a.codecMutex.RUnlock()
+	return a.heartbeatData
+}
+
+// negotiation returns what the client negotiated so far in the handshake
+func (a *agentImpl) negotiation() handshakeNegotiation {
+	return handshakeNegotiation{
+		dictReference:        a.dictReferenced,
+		compression:          a.compression,
+		timestampedHeartbeat: atomic.LoadInt32(&a.heartbeatStamped) == 1,
+		affinityToken:        a.affinityToken,
+	}
+}
+
+// encodeHandshakeResponse returns the handshake response of the agent for the
+// heartbeat interval and what the client negotiated
+func (a *agentImpl) encodeHandshakeResponse(heartbeat time.Duration, negotiation handshakeNegotiation) ([]byte, error) {
+	return encodeHandshakeResponse(heartbeat, a.getEncoder(), a.messageEncoder.IsCompressionEnabled(), a.serializer, negotiation)
+}
+
+// heartbeatTimedOut returns whether the client has been silent for too long
+// at now, a backgrounded client is tolerated until its grace period ends
+func (a *agentImpl) heartbeatTimedOut(now time.Time) bool {
+	deadline := now.Add(-2 * a.getHeartbeatTimeout()).Unix()
+	if atomic.LoadInt64(&a.lastAt) >= deadline {
+		return false
+	}
+	if now.UnixNano() < atomic.LoadInt64(&a.backgroundUntil) {
+		return false
+	}
+	a.Logger().Debugf("Session heartbeat timeout, LastTime=%d, Deadline=%d", atomic.LoadInt64(&a.lastAt), deadline)
+	return true
+}
+
+// SetBackgrounded tolerates the client not answering heartbeats for the
+// background grace period, after it normal heartbeat rules resume. It does
+// nothing if the grace period is not configured
+func (a *agentImpl) SetBackgrounded() {
+	if a.backgroundGrace <= 0 {
+		return
+	}
+	atomic.StoreInt64(&a.backgroundUntil, time.Now().Add(a.backgroundGrace).UnixNano())
+}
+
+// writeWatchdog closes the agent if a single write to the low-level conn
+// takes longer than writeTimeout, which unblocks the blocked writer. It
+// watches every write, including heartbeats, handshake responses and kicks
+func (a *agentImpl) writeWatchdog() {
+	interval := a.writeTimeout / 2
+	if interval < minWriteWatchdogInterval {
+		interval = minWriteWatchdogInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			startedAt := atomic.LoadInt64(&a.writeStartedAt)
+			if startedAt != 0 && time.Since(time.Unix(0, startedAt)) > a.writeTimeout {
+				a.Logger().Warnf("Session write timeout, UID=%s, StartedAt=%d", a.sessionUID(), startedAt)
+				a.SetCloseReason(session.DisconnectReasonWriteTimeout)
+				a.Close()
+				return
+			}
+		case <-a.chDie:
+			return
+		}
+	}
+}
+
+// onSessionClosed runs the close callbacks of the session and then the ones
+// of the session pool, each one recovering on its own so a panicking callback
+// does not keep the following ones from running
+func (a *agentImpl) onSessionClosed(s session.Session) {
+	for i, fn1 := range s.GetOnCloseCallbacks() {
+		a.runSessionClosedCallback("session", i, fn1)
+	}
+
+	for i, fn2 := range a.sessionPool.GetSessionCloseCallbacks() {
+		fn2 := fn2
+		a.runSessionClosedCallback("pool", i, func() { fn2(s) })
+	}
+}
+
+func (a *agentImpl) runSessionClosedCallback(kind string, index int, fn func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			a.Logger().Errorf("pitaya/onSessionClosed: %s callback %d panicked: %v", kind, index, err)
+		}
+	}()
+
+	fn()
+}
+
+// HandshakeCompleted runs the handshake callbacks of the session pool, it is
+// called once the client acknowledges the handshake response, before its
+// first data packet is handled
+func (a *agentImpl) HandshakeCompleted() {
+	if a.Session == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			a.Logger().Errorf("pitaya/onHandshake: %v", err)
+		}
+	}()
+
+	for _, fn := range a.sessionPool.GetHandshakeCallbacks() {
+		fn(a.Session)
+	}
+}
 
 // SendHandshakeResponse sends a handshake response
 func (a *agentImpl) SendHandshakeResponse() error {
-	_, err := a.conn.Write(hrd)
+	_, err := a.writeConn(a.handshakeResponse)
 	return err
 }
 
+// SendHandshakeRetryResponse sends a handshake response telling the client
+// the server can't take it now and it should reconnect after retryAfter
+func (a *agentImpl) SendHandshakeRetryResponse(retryAfter time.Duration) error {
+	p, err := encodeHandshakeRetryResponse(retryAfter, nil, a.getEncoder(), a.serializer)
+	if err != nil {
+		return err
+	}
+	_, err = a.writeConn(p)
+	return err
+}
+
+// SendHandshakeMaintenanceResponse sends a handshake response telling the
+// client the server is under maintenance and it should reconnect after
+// retryAfter, with the maintenance notice in the maintenance field of sys
+func (a *agentImpl) SendHandshakeMaintenanceResponse(retryAfter time.Duration, maintenance map[string]interface{}) error {
+	p, err := encodeHandshakeRetryResponse(retryAfter, maintenance, a.getEncoder(), a.serializer)
+	if err != nil {
+		return err
+	}
+	_, err = a.writeConn(p)
+	return err
+}
+
+// SetMirror sets w to receive a copy of every packet written to the client,
+// e.g. for debugging or migrating the session, a nil w stops the mirroring.
+// Writes to w happen in line with the writes to the client, so w must not
+// block, and its errors are logged without affecting the client
+func (a *agentImpl) SetMirror(w io.Writer) {
+	a.mirrorMutex.Lock()
+	defer a.mirrorMutex.Unlock()
+	a.mirror = w
+}
+
+// writeMirror writes to the mirror, if any, a copy of data written to the conn
+func (a *agentImpl) writeMirror(data []byte) {
+	a.mirrorMutex.Lock()
+	defer a.mirrorMutex.Unlock()
+	if a.mirror == nil || len(data) == 0 {
+		return
+	}
+	if _, err := a.mirror.Write(data); err != nil {
+		a.Logger().Debugf("Failed to write to the mirror: %s", err.Error())
+	}
+}
+
+// SetPacketWriteInterceptor sets interceptor to transform the bytes of every
+// packet written to the client from now on, heartbeats, handshake responses
+// and kicks included, e.g. to encrypt the connection once keys are exchanged.
+// A nil interceptor writes the packets as encoded
+func (a *agentImpl) SetPacketWriteInterceptor(interceptor PacketWriteInterceptor) {
+	a.codecMutex.Lock()
+	defer a.codecMutex.Unlock()
+	a.packetInterceptor = interceptor
+}
+
+// writeConn writes data to the low-level conn once transformed by the packet
+// interceptor, if any. The interceptor errors are returned without writing
+// anything
+func (a *agentImpl) writeConn(data []byte) (int, error) {
+	a.codecMutex.RLock()
+	interceptor := a.packetInterceptor
+	a.codecMutex.RUnlock()
+	if interceptor != nil {
+		intercepted, err := interceptor(data)
+		if err != nil {
+			return 0, fmt.Errorf("packet write interceptor failed: %s", err.Error())
+		}
+		data = intercepted
+	}
+	return a.writeToConn(data)
+}
+
+// writeToConn writes data to the low-level conn with a deadline writeTimeout
+// from now, and the bytes written to the mirror, stamping the write start for
+// the watchdog unless another write is already being watched. The watchdog
+// covers conns that block before reaching the socket, where the deadline does
+// not apply
+func (a *agentImpl) writeToConn(data []byte) (int, error) {
+	conn := a.Conn()
+	if a.writeTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(a.writeTimeout)); err != nil {
+			a.Logger().Debugf("Failed to set write deadline: %s", err.Error())
+		}
+	}
+	stamped := atomic.CompareAndSwapInt64(&a.writeStartedAt, 0, time.Now().UnixNano())
+	n, err := conn.Write(data)
+	if stamped {
+		atomic.StoreInt64(&a.writeStartedAt, 0)
+	}
+	if err != nil && conn != a.Conn() {
+		// the client reconnected while data was written to the previous
+		// connection, so it is written in full to the new one
+		return a.writeToConn(data)
+	}
+	if n > 0 && n <= len(data) {
+		a.writeMirror(data[:n])
+	}
+	return n, err
+}
+
 func (a *agentImpl) write() {
 	// clean func
 	defer func() {
@@ -485,27 +1655,415 @@ func (a *agentImpl) write() {
 	}()
 
 	for {
-		select {
-		case pWrite := <-a.chSend:
-			// close agent if low-level Conn broken
-			if _, err := a.conn.Write(pWrite.data); err != nil {
-				tracing.FinishSpan(pWrite.ctx, err)
-				metrics.ReportTimingFromCtx(pWrite.ctx, a.metricsReporters, handlerType, err)
-				logger.Log.Errorf("Failed to write in conn: %s", err.Error())
+		pWrite, ok := a.nextWrite()
+		if !ok {
+			return
+		}
+
+		a.reportWriteScheduleDelay(pWrite)
+
+		// wait for the client to grant credit if it has run out of it
+		for pWrite.consumesCredit && !a.consumeCredit() {
+			if !a.waitCredit() {
+				return
+			}
+		}
+
+		// stamp the heartbeat right before it is written, so the round
+		// trip time measured from its echo leaves out the time it was queued
+		if pWrite.heartbeat && atomic.LoadInt32(&a.heartbeatStamped) == 1 {
+			data, err := a.timestampedHeartbeatData()
+			if err != nil {
+				a.Logger().Errorf("Failed to encode timestamped heartbeat: %s", err.Error())
 				return
 			}
-			var e error
-			tracing.FinishSpan(pWrite.ctx, e)
-			metrics.ReportTimingFromCtx(pWrite.ctx, a.metricsReporters, handlerType, pWrite.err)
-		case <-a.chStopWrite:
+			pWrite.data = data
+		}
+
+		// close agent if low-level Conn broken
+		n, err := a.writeConn(pWrite.data)
+		atomic.AddInt64(&a.pendingWrites, -1)
+		tracing.FinishSpan(pWrite.span, err)
+		if pWrite.heartbeat {
+			if err != nil && a.retryHeartbeat(n, err) {
+				a.Logger().Warnf("Failed to write heartbeat in conn, retrying on the next tick: %s", err.Error())
+				continue
+			}
+			a.heartbeatFailed = false
+		}
+		if err != nil {
+			tracing.FinishSpan(pWrite.ctx, err)
+			metrics.ReportTimingFromCtx(pWrite.ctx, a.metricsReporters, handlerType, err)
+			a.spanLogger(pWrite.span).Errorf("Failed to write in conn: %s", err.Error())
+			var netErr net.Error
+			if e.As(err, &netErr) && netErr.Timeout() {
+				a.SetCloseReason(session.DisconnectReasonWriteTimeout)
+			}
+			a.SetCloseReason(session.DisconnectReasonWriteError)
+			return
+		}
+		var writeErr error
+		tracing.FinishSpan(pWrite.ctx, writeErr)
+		metrics.ReportTimingFromCtx(pWrite.ctx, a.metricsReporters, handlerType, pWrite.err)
+	}
+}
+
+// nextWrite returns the next write of the write loop, the one taken from the
+// head of chSend by enqueueDroppingOldest if any, and false once the loop
+// must stop. The head of chSend is only taken with sendMutex held while the
+// loop doesn't wait, so the writes are always written in the order queued
+func (a *agentImpl) nextWrite() (pendingWrite, bool) {
+	a.sendMutex.Lock()
+	if a.sendHead != nil {
+		pWrite := *a.sendHead
+		a.sendHead = nil
+		a.sendMutex.Unlock()
+		return pWrite, true
+	}
+	select {
+	case pWrite := <-a.chSend:
+		a.sendMutex.Unlock()
+		return pWrite, true
+	default:
+	}
+	a.writerWaiting = true
+	a.sendMutex.Unlock()
+
+	select {
+	case pWrite := <-a.chSend:
+		a.sendMutex.Lock()
+		a.writerWaiting = false
+		a.sendMutex.Unlock()
+		return pWrite, true
+	case <-a.chStopWrite:
+		return pendingWrite{}, false
+	}
+}
+
+// reportWriteScheduleDelay reports the time pWrite waited in chSend before
+// the write loop dequeued it, which grows when the loop is scheduled late
+func (a *agentImpl) reportWriteScheduleDelay(pWrite pendingWrite) {
+	if pWrite.queuedAt == 0 || len(a.metricsReporters) == 0 {
+		return
+	}
+	metrics.ReportWriteScheduleDelay(a.metricsReporters, time.Duration(time.Now().UnixNano()-pWrite.queuedAt))
+}
+
+// spanLogger returns the agent logger with the span in ctx bound, so the
+// logs of a traced push can be correlated to its trace
+func (a *agentImpl) spanLogger(ctx context.Context) interfaces.Logger {
+	if ctx == nil {
+		return a.Logger()
+	}
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return a.Logger()
+	}
+	return a.Logger().WithField("span", span.Context())
+}
+
+// retryHeartbeat returns whether a heartbeat write that failed with err
+// after writing n bytes is retried on the next tick instead of closing the
+// agent. Only transient errors that wrote nothing, keeping the stream framing
+// intact, are retried and only once in a row
+func (a *agentImpl) retryHeartbeat(n int, err error) bool {
+	if !a.heartbeatRetry || a.heartbeatFailed || n > 0 || !isTransientWriteError(err) {
+		return false
+	}
+	a.heartbeatFailed = true
+	return true
+}
+
+// isTransientWriteError returns whether err is a write error a live
+// connection can recover from, such as a full send buffer
+func isTransientWriteError(err error) bool {
+	if e.Is(err, syscall.EAGAIN) || e.Is(err, syscall.EWOULDBLOCK) || e.Is(err, syscall.ENOBUFS) {
+		return true
+	}
+	var netErr net.Error
+	return e.As(err, &netErr) && netErr.Timeout()
+}
+
+// GrantCredit grants the client credit for receiving more messages, the first
+// grant enables flow control for the agent, after which messages are only
+// written while there is credit left
+func (a *agentImpl) GrantCredit(credit int64) {
+	if credit <= 0 {
+		return
+	}
+	for {
+		current := atomic.LoadInt64(&a.credit)
+		granted := current + credit
+		if granted < current {
+			granted = math.MaxInt64
+		}
+		if atomic.CompareAndSwapInt64(&a.credit, current, granted) {
+			break
+		}
+	}
+	atomic.StoreInt32(&a.flowControl, 1)
+
+	select {
+	case a.chCredit <- struct{}{}:
+	default:
+	}
+}
+
+// SetTraceSampled sets whether the requests made through the agent are traced
+func (a *agentImpl) SetTraceSampled(sampled bool) {
+	decision := traceSamplingNotSampled
+	if sampled {
+		decision = traceSamplingSampled
+	}
+	atomic.StoreInt32(&a.traceSampling, decision)
+}
+
+// GetTraceSampled returns whether the requests made through the agent are
+// traced and if a sampling decision was made for the connection at all
+func (a *agentImpl) GetTraceSampled() (sampled bool, decided bool) {
+	decision := atomic.LoadInt32(&a.traceSampling)
+	return decision == traceSamplingSampled, decision != traceSamplingUndecided
+}
+
+// consumeCredit consumes one credit and returns whether a message can be written
+func (a *agentImpl) consumeCredit() bool {
+	if atomic.LoadInt32(&a.flowControl) == 0 {
+		return true
+	}
+	for {
+		current := atomic.LoadInt64(&a.credit)
+		if current == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&a.credit, current, current-1) {
+			return true
+		}
+	}
+}
+
+// waitCredit waits for the client to grant credit and returns whether the
+// write loop can go on. If no credit is granted within creditTimeout the
+// client is considered stuck and the agent is closed
+func (a *agentImpl) waitCredit() bool {
+	var timeout <-chan time.Time
+	if a.creditTimeout > 0 {
+		timer := time.NewTimer(a.creditTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-a.chCredit:
+		return true
+	case <-timeout:
+		a.Logger().Warnf("Session credit timeout, UID=%s", a.sessionUID())
+		a.SetCloseReason(session.DisconnectReasonCreditTimeout)
+		return false
+	case <-a.chStopWrite:
+		return false
+	}
+}
+
+// SetPacketRateLimit limits the rate of the data packets handled from the
+// client, the bucket starts full. It must be called from the goroutine
+// reading the connection, before the packets are handled
+func (a *agentImpl) SetPacketRateLimit(limit acceptor.PacketRateLimit) {
+	if limit.Burst <= 0 {
+		limit.Burst = int(math.Ceil(limit.Rate))
+	}
+	a.packetRateLimit = limit
+	a.packetTokens = float64(limit.Burst)
+	a.packetTokensAt = time.Now()
+}
+
+// AllowPacket takes a token for a data packet read from the client. If the
+// client is over the packet rate limit it waits for the token, or returns
+// ErrRateLimitExceeded if the limit closes the clients over it. The wait ends
+// with ErrAgentClosed if the agent is closed meanwhile. It must be called from
+// the goroutine reading the connection
+func (a *agentImpl) AllowPacket() error {
+	limit := a.packetRateLimit
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	a.packetTokens += now.Sub(a.packetTokensAt).Seconds() * limit.Rate
+	if a.packetTokens > float64(limit.Burst) {
+		a.packetTokens = float64(limit.Burst)
+	}
+	a.packetTokensAt = now
+	if a.packetTokens >= 1 {
+		a.packetTokens--
+		return nil
+	}
+
+	metrics.ReportExceededRateLimiting(a.metricsReporters)
+	if limit.Close {
+		return constants.ErrRateLimitExceeded
+	}
+	a.packetTokens--
+	timer := time.NewTimer(time.Duration(-a.packetTokens / limit.Rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-a.chDie:
+		return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
+	}
+}
+
+// SetRTT records a round trip time sample measured by the client or from a
+// timestamped heartbeat echo, the samples are smoothed so a single spike does
+// not change the quality
+func (a *agentImpl) SetRTT(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	atomic.StoreInt64(&a.lastRTT, int64(rtt))
+	for {
+		old := atomic.LoadInt64(&a.smoothedRTT)
+		smoothed := int64(rtt)
+		if old > 0 {
+			smoothed = old + (int64(rtt)-old)/8
+		}
+		if atomic.CompareAndSwapInt64(&a.smoothedRTT, old, smoothed) {
 			return
 		}
 	}
 }
 
-// SendRequest sends a request to a server
-func (a *agentImpl) SendRequest(ctx context.Context, serverID, route string, v interface{}) (*protos.Response, error) {
-	return nil, e.New("not implemented")
+// RTT returns the last round trip time sample of the client connection, or 0
+// if none was measured yet
+func (a *agentImpl) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&a.lastRTT))
+}
+
+// recordHeartbeat records whether the client was silent during the last
+// heartbeat interval, it is only called by the heartbeat loop
+func (a *agentImpl) recordHeartbeat(missed bool) {
+	misses := atomic.LoadUint32(&a.heartbeatMisses) << 1 & heartbeatHistoryMask
+	if missed {
+		misses |= 1
+	}
+	atomic.StoreUint32(&a.heartbeatMisses, misses)
+}
+
+// ConnectionQuality classifies the client connection from its smoothed round
+// trip time and the heartbeats it missed in the last intervals, taking the
+// worst of both
+func (a *agentImpl) ConnectionQuality() ConnectionQuality {
+	rtt := time.Duration(atomic.LoadInt64(&a.smoothedRTT))
+	missed := bits.OnesCount32(atomic.LoadUint32(&a.heartbeatMisses))
+	switch {
+	case rtt >= poorRTT || missed >= poorMissedHeartbeats:
+		return ConnectionQualityPoor
+	case rtt >= fairRTT || missed >= fairMissedHeartbeats:
+		return ConnectionQualityFair
+	default:
+		return ConnectionQualityGood
+	}
+}
+
+// SetCloseReason sets the reason the server closes the connection for. Only
+// the first reason set is kept, since the later ones are consequences of it,
+// e.g. the read error caused by closing the connection on a heartbeat timeout
+func (a *agentImpl) SetCloseReason(reason string) {
+	a.reasonMutex.Lock()
+	defer a.reasonMutex.Unlock()
+
+	if a.closeReason == "" {
+		a.closeReason = reason
+	}
+}
+
+// SetClientCloseReason sets the reason the client reported for disconnecting
+func (a *agentImpl) SetClientCloseReason(reason string) {
+	if len(reason) > maxClientCloseReasonLength {
+		reason = reason[:maxClientCloseReasonLength]
+	}
+
+	a.reasonMutex.Lock()
+	defer a.reasonMutex.Unlock()
+
+	a.clientCloseReason = reason
+}
+
+// DisconnectReason returns why the client disconnected, as detected by the
+// server and as reported by the client
+func (a *agentImpl) DisconnectReason() session.DisconnectReason {
+	a.reasonMutex.Lock()
+	defer a.reasonMutex.Unlock()
+
+	return session.DisconnectReason{Server: a.closeReason, Client: a.clientCloseReason}
+}
+
+// Capabilities returns the feature set agreed with the client, from the agent
+// settings, the connection and the handshake data the client sent. It is
+// built on every call, so it reflects the credit granted after the handshake
+func (a *agentImpl) Capabilities() session.Capabilities {
+	connState := acceptor.GetConnState(a.Conn())
+	capabilities := session.Capabilities{
+		Serializer:           a.serializer.GetName(),
+		Compression:          a.messageEncoder.IsCompressionEnabled() || a.compression != "",
+		Encryption:           connState.Encrypted,
+		Subprotocol:          connState.Subprotocol,
+		HeartbeatInterval:    a.getHeartbeatTimeout(),
+		FlowControl:          atomic.LoadInt32(&a.flowControl) == 1,
+		TimestampedHeartbeat: atomic.LoadInt32(&a.heartbeatStamped) == 1,
+	}
+	if a.Session == nil {
+		return capabilities
+	}
+	if handshakeData := a.Session.GetHandshakeData(); handshakeData != nil {
+		capabilities.ProtocolVersion = handshakeData.Sys.ProtocolVersion
+	}
+	return capabilities
+}
+
+// SendRequest sends a request to the server serverID on behalf of the
+// client, carrying the session so the server handles it as if the client
+// made it. v is serialized with the agent serializer unless it is a []byte.
+// If ctx has no deadline the request fails after the request timeout
+func (a *agentImpl) SendRequest(ctx context.Context, serverID, reqRoute string, v interface{}) (*protos.Response, error) {
+	if a.GetStatus() == constants.StatusClosed {
+		return nil, errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
+	}
+	if a.Session == nil {
+		return nil, constants.ErrSessionNotFound
+	}
+	if a.rpcClient == nil {
+		return nil, constants.ErrRPCClientNotInitialized
+	}
+	if a.serviceDiscovery == nil {
+		return nil, constants.ErrServiceDiscoveryNotInitialized
+	}
+
+	r, err := route.Decode(reqRoute)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := util.SerializeOrRaw(a.serializer, v)
+	if err != nil {
+		return nil, err
+	}
+	server, err := a.serviceDiscovery.GetServer(serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok && a.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.requestTimeout)
+		defer cancel()
+	}
+
+	msg := &message.Message{
+		Type:  message.Request,
+		Route: reqRoute,
+		Data:  payload,
+	}
+	return a.rpcClient.Call(ctx, protos.RPCType_Sys, r, a.Session, msg, server)
 }
 
 // AnswerWithError answers with an error
@@ -525,33 +2083,95 @@ func (a *agentImpl) AnswerWithError(ctx context.Context, mid uint, err error) {
 	}
 	p, e := util.GetErrorPayload(a.serializer, err)
 	if e != nil {
-		logger.Log.Errorf("error answering the user with an error: %s", e.Error())
+		a.Logger().Errorf("error answering the user with an error: %s", e.Error())
 		return
 	}
-	e = a.Session.ResponseMID(ctx, mid, p, true)
+	e = a.ResponseMID(ctx, mid, p, true)
 	if e != nil {
-		logger.Log.Errorf("error answering the user with an error: %s", e.Error())
+		a.Logger().Errorf("error answering the user with an error: %s", e.Error())
 	}
 }
 
-func hbdEncode(heartbeatTimeout time.Duration, packetEncoder codec.PacketEncoder, dataCompression bool, serializerName string) {
+func encodeHandshakeRetryResponse(retryAfter time.Duration, maintenance map[string]interface{}, packetEncoder codec.PacketEncoder, serializer serialize.Serializer) ([]byte, error) {
+	sys := map[string]interface{}{
+		"retryAfter": retryAfter.Seconds(),
+	}
+	if maintenance != nil {
+		sys["maintenance"] = maintenance
+	}
+	hData := map[string]interface{}{
+		"code": handshakeCodeRetryLater,
+		"sys":  sys,
+	}
+	data, err := marshalHandshake(serializer, hData)
+	if err != nil {
+		return nil, err
+	}
+	return packetEncoder.Encode(packet.Handshake, data)
+}
+
+// EncodeHandshake returns the handshake response packet an agent using
+// serializer sends to its clients, for the given heartbeat interval and route
+// dictionary, so client SDKs can generate fixtures without a live connection.
+// The packet is encoded with the Pomelo packet encoder and not compressed,
+// which is what the agents send when message compression is disabled
+func EncodeHandshake(serializer serialize.Serializer, heartbeat time.Duration, dictionary map[string]uint16) ([]byte, error) {
+	sys := map[string]interface{}{"dict": dictionary}
+	return encodeHandshake(heartbeat, sys, codec.NewPomeloPacketEncoder(), false, serializer)
+}
+
+// handshakeNegotiation holds what a client negotiated in the handshake that
+// the handshake response carries
+type handshakeNegotiation struct {
+	dictReference        bool   // send the route dictionary hash instead of the dictionary
+	compression          string // compression algorithm of the message data, empty if none
+	timestampedHeartbeat bool   // the heartbeats carry their send time stamp
+	affinityToken        string // token the client echoes on reconnect to be routed back to this server, empty if none
+}
+
+// encodeHandshakeResponse returns the handshake response packet carrying the
+// route dictionary, or its hash, and the negotiated compression algorithm
+func encodeHandshakeResponse(heartbeatTimeout time.Duration, packetEncoder codec.PacketEncoder, dataCompression bool, serializer serialize.Serializer, negotiation handshakeNegotiation) ([]byte, error) {
+	sys := map[string]interface{}{}
+	if negotiation.dictReference {
+		sys["dictHash"] = message.GetDictionaryHash()
+	} else {
+		sys["dict"] = message.GetDictionary()
+	}
+	if negotiation.compression != "" {
+		sys["compression"] = negotiation.compression
+	}
+	if negotiation.timestampedHeartbeat {
+		sys["timestampedHeartbeat"] = true
+	}
+	if negotiation.affinityToken != "" {
+		sys["affinityToken"] = negotiation.affinityToken
+	}
+	return encodeHandshake(heartbeatTimeout, sys, packetEncoder, dataCompression, serializer)
+}
+
+// encodeHandshake returns the handshake response packet with sys, encoded
+// with serializer if it implements serialize.HandshakeMarshaler and to JSON
+// otherwise
+func encodeHandshake(heartbeatTimeout time.Duration, sys map[string]interface{}, packetEncoder codec.PacketEncoder, dataCompression bool, serializer serialize.Serializer) ([]byte, error) {
+	sys["heartbeat"] = heartbeatTimeout.Seconds()
+	sys["serializer"] = serializer.GetName()
+	if err := validateHandshakeData(sys); err != nil {
+		return nil, err
+	}
 	hData := map[string]interface{}{
 		"code": 200,
-		"sys": map[string]interface{}{
-			"heartbeat":  heartbeatTimeout.Seconds(),
-			"dict":       message.GetDictionary(),
-			"serializer": serializerName,
-		},
+		"sys":  sys,
 	}
-	data, err := gojson.Marshal(hData)
+	data, err := marshalHandshake(serializer, hData)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	if dataCompression {
 		compressedData, err := compression.DeflateData(data)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		if len(compressedData) < len(data) {
@@ -559,25 +2179,46 @@ func hbdEncode(heartbeatTimeout time.Duration, packetEncoder codec.PacketEncoder
 		}
 	}
 
-	hrd, err = packetEncoder.Encode(packet.Handshake, data)
-	if err != nil {
-		panic(err)
+	return packetEncoder.Encode(packet.Handshake, data)
+}
+
+// marshalHandshake encodes the handshake data with serializer if it
+// implements serialize.HandshakeMarshaler and to JSON otherwise
+func marshalHandshake(serializer serialize.Serializer, data map[string]interface{}) ([]byte, error) {
+	if m, ok := serializer.(serialize.HandshakeMarshaler); ok {
+		return m.MarshalHandshake(data)
 	}
+	return gojson.Marshal(data)
+}
 
-	hbd, err = packetEncoder.Encode(packet.Heartbeat, nil)
-	if err != nil {
-		panic(err)
+// validateHandshakeData returns ErrInvalidHandshakeData if data has a value
+// that can't be encoded to JSON, a NaN or infinite float
+func validateHandshakeData(data interface{}) error {
+	switch v := data.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return constants.ErrInvalidHandshakeData
+		}
+	case float32:
+		return validateHandshakeData(float64(v))
+	case map[string]interface{}:
+		for _, value := range v {
+			if err := validateHandshakeData(value); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
 }
 
 func (a *agentImpl) reportChannelSize() {
 	chSendCapacity := a.messagesBufferSize - len(a.chSend)
 	if chSendCapacity == 0 {
-		logger.Log.Warnf("chSend is at maximum capacity")
+		a.Logger().Warnf("chSend is at maximum capacity")
 	}
 	for _, mr := range a.metricsReporters {
 		if err := mr.ReportGauge(metrics.ChannelCapacity, map[string]string{"channel": "agent_chsend"}, float64(chSendCapacity)); err != nil {
-			logger.Log.Warnf("failed to report chSend channel capaacity: %s", err.Error())
+			a.Logger().Warnf("failed to report chSend channel capaacity: %s", err.Error())
 		}
 	}
 }
@@ -156,6 +156,9 @@ func (a *Remote) Close() error { return nil }
 // RemoteAddr returns the remote address of the user
 func (a *Remote) RemoteAddr() net.Addr { return nil }
 
+// GetSerializer returns the serializer used for messages sent to the user
+func (a *Remote) GetSerializer() serialize.Serializer { return a.serializer }
+
 func (a *Remote) serialize(m pendingMessage) ([]byte, error) {
 	payload, err := util.SerializeOrRaw(a.serializer, m.payload)
 	if err != nil {
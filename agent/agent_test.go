@@ -21,18 +21,35 @@
 package agent
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	gojson "encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"net"
+	"os"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/acceptor"
+	"github.com/topfreegames/pitaya/v2/cluster"
+	clustermocks "github.com/topfreegames/pitaya/v2/cluster/mocks"
+	"github.com/topfreegames/pitaya/v2/conn/codec"
 	codecmocks "github.com/topfreegames/pitaya/v2/conn/codec/mocks"
 	"github.com/topfreegames/pitaya/v2/conn/message"
 	messagemocks "github.com/topfreegames/pitaya/v2/conn/message/mocks"
@@ -41,12 +58,22 @@ import (
 	pcontext "github.com/topfreegames/pitaya/v2/context"
 	e "github.com/topfreegames/pitaya/v2/errors"
 	"github.com/topfreegames/pitaya/v2/helpers"
+	"github.com/topfreegames/pitaya/v2/logger"
+	logruswrapper "github.com/topfreegames/pitaya/v2/logger/logrus"
 	"github.com/topfreegames/pitaya/v2/metrics"
 	metricsmocks "github.com/topfreegames/pitaya/v2/metrics/mocks"
 	"github.com/topfreegames/pitaya/v2/mocks"
+	"github.com/topfreegames/pitaya/v2/networkentity"
 	"github.com/topfreegames/pitaya/v2/protos"
+	"github.com/topfreegames/pitaya/v2/route"
+	"github.com/topfreegames/pitaya/v2/serialize"
+	"github.com/topfreegames/pitaya/v2/serialize/json"
 	serializemocks "github.com/topfreegames/pitaya/v2/serialize/mocks"
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
 	"github.com/topfreegames/pitaya/v2/session"
+	"github.com/topfreegames/pitaya/v2/tracing"
+	"github.com/topfreegames/pitaya/v2/util"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type mockAddr struct{}
@@ -60,6 +87,39 @@ func heartbeatAndHandshakeMocks(mockEncoder *codecmocks.MockPacketEncoder) {
 	mockEncoder.EXPECT().Encode(packet.Type(packet.Heartbeat), gomock.Nil()).AnyTimes()
 }
 
+// receivePendingWrite receives the next write queued to ag, with the time
+// stamp of when it was queued cleared so it can be compared
+func receivePendingWrite(t *testing.T, ag *agentImpl, timeouts ...time.Duration) pendingWrite {
+	t.Helper()
+	pWrite := helpers.ShouldEventuallyReceive(t, ag.chSend, timeouts...).(pendingWrite)
+	assert.NotZero(t, pWrite.queuedAt)
+	pWrite.queuedAt = 0
+	return pWrite
+}
+
+// mustNewAgent returns a new agent, failing the test if it can't be created
+func mustNewAgent(
+	t *testing.T,
+	conn net.Conn,
+	packetDecoder codec.PacketDecoder,
+	packetEncoder codec.PacketEncoder,
+	serializer serialize.Serializer,
+	heartbeatTime time.Duration,
+	messagesBufferSize int,
+	dieChan chan bool,
+	messageEncoder message.Encoder,
+	metricsReporters []metrics.Reporter,
+	sessionPool session.SessionPool,
+	options Options,
+) Agent {
+	t.Helper()
+	a, err := newAgent(conn, packetDecoder, packetEncoder, serializer, heartbeatTime, messagesBufferSize, dieChan, messageEncoder, metricsReporters, sessionPool, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
 func getCtxWithRequestKeys() context.Context {
 	ctx := pcontext.AddToPropagateCtx(context.Background(), constants.StartTimeKey, time.Now().UnixNano())
 	return pcontext.AddToPropagateCtx(ctx, constants.RouteKey, "route")
@@ -80,22 +140,23 @@ func TestNewAgent(t *testing.T) {
 
 	mockConn := mocks.NewMockPlayerConn(ctrl)
 
+	// each agent encodes its own handshake response and heartbeat packet
 	mockEncoder.EXPECT().Encode(gomock.Any(), gomock.Not(gomock.Nil())).Do(
 		func(typ packet.Type, d []byte) {
 			// cannot compare inside the expect because they are equivalent but not equal
 			assert.EqualValues(t, packet.Handshake, typ)
-		})
+		}).Times(2)
 	mockEncoder.EXPECT().Encode(gomock.Any(), gomock.Nil()).Do(
 		func(typ packet.Type, d []byte) {
 			assert.EqualValues(t, packet.Heartbeat, typ)
-		})
+		}).Times(2)
 	messageEncoder := message.NewMessagesEncoder(false)
 
 	mockMetricsReporters := []metrics.Reporter{mockMetricsReporter}
 	sessionPool := session.NewSessionPool()
 
 	mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
-	ag := newAgent(mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool, Options{}).(*agentImpl)
 	assert.NotNil(t, ag)
 	assert.IsType(t, make(chan struct{}), ag.chDie)
 	assert.IsType(t, make(chan pendingWrite), ag.chSend)
@@ -114,10 +175,54 @@ func TestNewAgent(t *testing.T) {
 	assert.NotNil(t, ag.Session)
 	assert.True(t, ag.Session.GetIsFrontend())
 
-	// second call should no call hdb encode
 	mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
-	ag = newAgent(nil, nil, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool).(*agentImpl)
+	ag = mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool, Options{}).(*agentImpl)
+	assert.NotNil(t, ag)
+}
+
+func TestNewAgentBare(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName()
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	messageEncoder := message.NewMessagesEncoder(false)
+
+	// no connected clients gauge is reported, the agent joins no session pool
+	a, err := NewAgentBare(mockConn, nil, mockEncoder, mockSerializer, time.Second, 10, messageEncoder, nil, Options{})
+	assert.NoError(t, err)
+	ag := a.(*agentImpl)
 	assert.NotNil(t, ag)
+	assert.Nil(t, ag.GetSession())
+	assert.Nil(t, ag.sessionPool)
+
+	// duplicate pushes are only skipped by sessions
+	msg := &message.Message{Type: message.Push, Route: "route", Data: []byte("ok")}
+	em, err := messageEncoder.Encode(msg)
+	assert.NoError(t, err)
+	mockEncoder.EXPECT().Encode(packet.Type(packet.Data), em).Return([]byte("packet"), nil).Times(2)
+	written := make(chan struct{}, 2)
+	mockConn.EXPECT().Write([]byte("packet")).DoAndReturn(func(d []byte) (int, error) {
+		written <- struct{}{}
+		return len(d), nil
+	}).Times(2)
+	go ag.write()
+
+	assert.NoError(t, ag.Push("route", []byte("ok")))
+	assert.NoError(t, ag.Push("route", []byte("ok")))
+	for i := 0; i < 2; i++ {
+		helpers.ShouldEventuallyReceive(t, written)
+	}
+
+	_, err = ag.SendRequest(context.Background(), "connector-1", "connector.handler.method", []byte("ok"))
+	assert.Equal(t, constants.ErrSessionNotFound, err)
+
+	mockConn.EXPECT().Close()
+	assert.NoError(t, ag.Close())
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
 }
 
 func TestKick(t *testing.T) {
@@ -131,6 +236,7 @@ func TestKick(t *testing.T) {
 	hbTime := time.Second
 
 	mockConn := mocks.NewMockPlayerConn(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
 	mockEncoder.EXPECT().Encode(gomock.Any(), gomock.Nil()).Do(
 		func(typ packet.Type, d []byte) {
 			assert.EqualValues(t, packet.Kick, typ)
@@ -141,12 +247,219 @@ func TestKick(t *testing.T) {
 	mockSerializer.EXPECT().GetName()
 
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, nil, sessionPool)
+	ag := mustNewAgent(t, mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, nil, sessionPool, Options{})
 	c := context.Background()
 	err := ag.Kick(c)
 	assert.NoError(t, err)
 }
 
+func TestAgentKickWithReason(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	packetEncoder := codec.NewPomeloPacketEncoder()
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, packetEncoder, json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	var written []*packet.Packet
+	mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(func(d []byte) (int, error) {
+		packets, err := codec.NewPomeloPacketDecoder().Decode(d)
+		assert.NoError(t, err)
+		written = append(written, packets...)
+		return len(d), nil
+	}).Times(2)
+	mockConn.EXPECT().Close()
+
+	// the messages sent before the kick are written before it
+	assert.NoError(t, ag.Push("route", []byte("bye")))
+	go ag.write()
+
+	err := ag.KickWithReason(context.Background(), map[string]string{"reason": "banned"})
+	assert.NoError(t, err)
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+	assert.Len(t, written, 2)
+	assert.EqualValues(t, packet.Data, written[0].Type)
+	assert.EqualValues(t, packet.Kick, written[1].Type)
+	assert.Equal(t, []byte(`{"reason":"banned"}`), written[1].Data)
+
+	err = ag.KickWithReason(context.Background(), "banned")
+	assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), err)
+}
+
+func TestAgentCloseGraceful(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	// the messages queued before the close are written before the conn is closed
+	written := 0
+	mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(func(d []byte) (int, error) {
+		written++
+		return len(d), nil
+	}).Times(2)
+	mockConn.EXPECT().Close()
+	assert.NoError(t, ag.Push("route", []byte("first")))
+	assert.NoError(t, ag.Push("route", []byte("second")))
+	go ag.write()
+
+	assert.NoError(t, ag.CloseGraceful(time.Second))
+	assert.Equal(t, 2, written)
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+
+	err := ag.Push("route", []byte("late"))
+	assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), err)
+	assert.Equal(t, constants.ErrCloseClosedSession, ag.CloseGraceful(time.Second))
+}
+
+func TestAgentCloseGracefulTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	// nothing writes the queued message, so the conn is closed on the timeout
+	mockConn.EXPECT().Close()
+	assert.NoError(t, ag.Push("route", []byte("stuck")))
+
+	start := time.Now()
+	assert.NoError(t, ag.CloseGraceful(50*time.Millisecond))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+}
+
+func TestAgentCloseGracefulRefusesNewMessages(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	mockConn.EXPECT().Close()
+	assert.NoError(t, ag.Push("route", []byte("stuck")))
+	done := make(chan error)
+	go func() {
+		done <- ag.CloseGraceful(time.Second)
+	}()
+
+	helpers.ShouldEventuallyReturn(t, func() int32 { return atomic.LoadInt32(&ag.draining) }, int32(1))
+	err := ag.Push("route", []byte("refused"))
+	assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), err)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&ag.pendingWrites))
+
+	// the message queued before the close is still written
+	mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(func(d []byte) (int, error) { return len(d), nil })
+	go ag.write()
+	assert.NoError(t, <-done)
+}
+
+func TestAgentPushWithContext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+	go ag.write()
+
+	parent := tracer.StartSpan("handler")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+	mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(func(d []byte) (int, error) {
+		// the span of the push is only finished once the message is written
+		assert.Empty(t, tracer.FinishedSpans())
+		return len(d), nil
+	})
+	assert.NoError(t, ag.PushWithContext(ctx, "room.update", []byte("traced")))
+	assert.NoError(t, ag.Flush(context.Background()))
+
+	spans := tracer.FinishedSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "room.update", spans[0].OperationName)
+	assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).TraceID, spans[0].SpanContext.TraceID)
+	assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, spans[0].ParentID)
+	assert.Equal(t, "push", spans[0].Tag("msg.type"))
+	assert.Nil(t, spans[0].Tag("error"))
+
+	// pushes without a span in the context are not traced
+	tracer.Reset()
+	mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(func(d []byte) (int, error) { return len(d), nil })
+	assert.NoError(t, ag.Push("room.update", []byte("not traced")))
+	assert.NoError(t, ag.Flush(context.Background()))
+	assert.Empty(t, tracer.FinishedSpans())
+
+	// the span of a push that fails to be written carries the error
+	mockConn.EXPECT().Write(gomock.Any()).Return(0, errors.New("broken pipe"))
+	mockConn.EXPECT().Close()
+	assert.NoError(t, ag.PushWithContext(ctx, "room.update", []byte("failed")))
+	helpers.ShouldEventuallyReturn(t, func() int { return len(tracer.FinishedSpans()) }, 1)
+	assert.Equal(t, true, tracer.FinishedSpans()[0].Tag("error"))
+
+	// so does the span of a push to a closed agent
+	tracer.Reset()
+	helpers.ShouldEventuallyReturn(t, func() int32 { return ag.GetStatus() }, constants.StatusClosed)
+	// as if the push raced with Close and passed the status check
+	atomic.StoreInt32(&ag.state, constants.StatusWorking)
+	err := ag.PushWithContext(ctx, "room.update", []byte("closed"))
+	assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), err)
+	assert.Len(t, tracer.FinishedSpans(), 1)
+	assert.Equal(t, true, tracer.FinishedSpans()[0].Tag("error"))
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("mirror failed") }
+
+func TestAgentSetMirror(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	var conn bytes.Buffer
+	mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(conn.Write).Times(3)
+	// the client closed the conn before the last write
+	mockConn.EXPECT().Write(gomock.Any()).Return(0, errors.New("use of closed network connection"))
+
+	var mirror bytes.Buffer
+	ag.SetMirror(&mirror)
+	assert.NoError(t, ag.SendHandshakeResponse())
+	go ag.write()
+	assert.NoError(t, ag.Push("route", []byte("mirrored")))
+	assert.NoError(t, ag.Flush(context.Background()))
+	assert.Equal(t, conn.Bytes(), mirror.Bytes())
+
+	// mirror errors don't affect the client
+	ag.SetMirror(failingWriter{})
+	assert.NoError(t, ag.Push("route", []byte("not mirrored")))
+	assert.NoError(t, ag.Flush(context.Background()))
+
+	// only the bytes written to the client are mirrored
+	ag.SetMirror(&mirror)
+	mirrored := mirror.Len()
+	mockConn.EXPECT().Close()
+	assert.NoError(t, ag.Push("route", []byte("not written")))
+	helpers.ShouldEventuallyReturn(t, func() int32 { return ag.GetStatus() }, constants.StatusClosed)
+	assert.Equal(t, mirrored, mirror.Len())
+}
+
 func TestAgentSend(t *testing.T) {
 	tables := []struct {
 		name string
@@ -172,7 +485,7 @@ func TestAgentSend(t *testing.T) {
 			mockConn := mocks.NewMockPlayerConn(ctrl)
 			mockSerializer.EXPECT().GetName()
 			sessionPool := session.NewSessionPool()
-			ag := newAgent(mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, nil, sessionPool).(*agentImpl)
+			ag := mustNewAgent(t, mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 			assert.NotNil(t, ag)
 
 			if table.err != nil {
@@ -189,19 +502,77 @@ func TestAgentSend(t *testing.T) {
 			assert.Equal(t, table.err, err)
 
 			expectedWrite := pendingWrite{
-				ctx:  nil,
-				data: expectedBytes,
-				err:  nil,
+				ctx:            nil,
+				data:           expectedBytes,
+				err:            nil,
+				consumesCredit: true,
 			}
 
 			if table.err == nil {
-				recv := helpers.ShouldEventuallyReceive(t, ag.chSend).(pendingWrite)
+				recv := receivePendingWrite(t, ag)
 				assert.Equal(t, expectedWrite, recv)
 			}
 		})
 	}
 }
 
+func TestAgentWriteScheduleDelay(t *testing.T) {
+	tables := []struct {
+		name       string
+		writeDelay time.Duration
+	}{
+		{"write_loop_running", 0},
+		{"write_loop_scheduled_late", 100 * time.Millisecond},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockConn := mocks.NewMockPlayerConn(ctrl)
+			mockConn.EXPECT().RemoteAddr().AnyTimes()
+			mockConn.EXPECT().Close().MaxTimes(1)
+			written := make(chan struct{}, 1)
+			mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
+				written <- struct{}{}
+				return len(b), nil
+			})
+
+			mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+			mockMetricsReporter.EXPECT().ReportGauge(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+			mockMetricsReporter.EXPECT().ReportCount(metrics.Disconnections, gomock.Any(), gomock.Any()).MaxTimes(1)
+			delays := make(chan float64, 1)
+			mockMetricsReporter.EXPECT().ReportSummary(metrics.WriteScheduleDelay, map[string]string{}, gomock.Any()).Do(
+				func(metric string, tags map[string]string, value float64) {
+					delays <- value
+				})
+
+			sessionPool := session.NewSessionPool()
+			ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), 10*time.Second, 10, nil, message.NewMessagesEncoder(false), []metrics.Reporter{mockMetricsReporter}, sessionPool, Options{}).(*agentImpl)
+			defer ag.Close()
+
+			if table.writeDelay == 0 {
+				go ag.write()
+			}
+			assert.NoError(t, ag.Push("route", []byte("data")))
+			if table.writeDelay > 0 {
+				// the message waits in chSend until the write loop runs
+				time.Sleep(table.writeDelay)
+				go ag.write()
+			}
+
+			helpers.ShouldEventuallyReceive(t, written)
+			delay := time.Duration(helpers.ShouldEventuallyReceive(t, delays).(float64))
+			if table.writeDelay > 0 {
+				assert.True(t, delay >= table.writeDelay, "delay %s should be at least %s", delay, table.writeDelay)
+			} else {
+				assert.True(t, delay < 50*time.Millisecond, "delay %s should be short", delay)
+			}
+		})
+	}
+}
+
 func TestAgentSendSerializeErr(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -219,6 +590,7 @@ func TestAgentSendSerializeErr(t *testing.T) {
 		encoder:          mockEncoder,
 		heartbeatTimeout: time.Second,
 		lastAt:           time.Now().Unix(),
+		logger:           logger.Log,
 		serializer:       mockSerializer,
 		messageEncoder:   messageEncoder,
 		metricsReporters: mockMetricsReporters,
@@ -237,6 +609,7 @@ func TestAgentSendSerializeErr(t *testing.T) {
 	}
 	expectedErr := errors.New("noo")
 	mockSerializer.EXPECT().Marshal(expected.payload).Return(nil, expectedErr)
+	mockMetricsReporter.EXPECT().ReportCount(metrics.SerializationFailures, map[string]string{"route": expected.route}, float64(1))
 
 	expectedBT := []byte("bla")
 	mockSerializer.EXPECT().Marshal(&protos.Error{
@@ -263,11 +636,113 @@ func TestAgentSendSerializeErr(t *testing.T) {
 	})
 	go ag.write()
 	mockMetricsReporter.EXPECT().ReportGauge(gomock.Any(), gomock.Any(), gomock.Any())
+	mockMetricsReporter.EXPECT().ReportSummary(metrics.WriteScheduleDelay, gomock.Any(), gomock.Any())
 	ag.send(expected)
 	wg.Wait()
 
 }
 
+func TestAgentSerializationErrorFormatter(t *testing.T) {
+	formatter := func(ctx context.Context, serializer serialize.Serializer, route string, err error) ([]byte, error) {
+		if serializer.GetName() == "protobuf" {
+			return serializer.Marshal(&protos.Error{Code: "PIT-SER", Msg: route})
+		}
+		return serializer.Marshal(map[string]string{"code": "PIT-SER", "route": route, "traceId": ctx.Value(constants.RequestIDKey).(string)})
+	}
+	protoPayload, err := protobuf.NewSerializer().Marshal(&protos.Error{Code: "PIT-SER", Msg: "room.join"})
+	assert.NoError(t, err)
+	_, serializeErr := json.NewSerializer().Marshal(make(chan int))
+	assert.Error(t, serializeErr)
+	defaultPayload, err := util.GetErrorPayload(json.NewSerializer(), serializeErr)
+	assert.NoError(t, err)
+
+	tables := []struct {
+		name       string
+		serializer serialize.Serializer
+		formatter  SerializationErrorFormatter
+		payload    interface{}
+		expected   []byte
+		err        error
+	}{
+		{"json", json.NewSerializer(), formatter, make(chan int), []byte(`{"code":"PIT-SER","route":"room.join","traceId":"trace"}`), nil},
+		{"protobuf", protobuf.NewSerializer(), formatter, "not a proto", protoPayload, nil},
+		{"default", json.NewSerializer(), nil, make(chan int), defaultPayload, nil},
+		{"formatter_error", json.NewSerializer(), func(context.Context, serialize.Serializer, string, error) ([]byte, error) {
+			return nil, errors.New("formatter failed")
+		}, make(chan int), nil, errors.New("formatter failed")},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+			mockMetricsReporter.EXPECT().ReportCount(metrics.SerializationFailures, map[string]string{"route": "room.join"}, float64(1))
+			ag := &agentImpl{
+				logger:             logger.Log,
+				metricsReporters:   []metrics.Reporter{mockMetricsReporter},
+				serializationError: table.formatter,
+				serializer:         table.serializer,
+			}
+
+			m, err := ag.getMessageFromPendingMessage(pendingMessage{
+				ctx:     context.WithValue(context.Background(), constants.RequestIDKey, "trace"),
+				typ:     message.Response,
+				route:   "room.join",
+				payload: table.payload,
+			})
+			assert.Equal(t, table.err, err)
+			if table.err == nil {
+				assert.Equal(t, table.expected, m.Data)
+			}
+		})
+	}
+}
+
+func TestAgentOutboundTransformsOnlyAffectTheirSession(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	sessionPool := session.NewSessionPool()
+	transformed := &agentImpl{
+		logger:     logger.Log,
+		serializer: mockSerializer,
+		Session:    sessionPool.NewSession(nil, true),
+	}
+	untouched := &agentImpl{
+		logger:     logger.Log,
+		serializer: mockSerializer,
+		Session:    sessionPool.NewSession(nil, true),
+	}
+
+	pm := pendingMessage{
+		typ:     message.Push,
+		route:   uuid.New().String(),
+		payload: someStruct{A: "bla"},
+	}
+	mockSerializer.EXPECT().Marshal(pm.payload).Return([]byte("secret"), nil).Times(3)
+
+	transformed.Session.AddOutboundTransform("redact", func(route string, payload []byte) ([]byte, error) {
+		assert.Equal(t, pm.route, route)
+		return []byte("redacted"), nil
+	})
+
+	m, err := transformed.getMessageFromPendingMessage(pm)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("redacted"), m.Data)
+
+	m, err = untouched.getMessageFromPendingMessage(pm)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), m.Data)
+
+	transformed.Session.RemoveOutboundTransform("redact")
+	m, err = transformed.getMessageFromPendingMessage(pm)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), m.Data)
+}
+
 func TestAgentPushFailsIfClosedAgent(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -280,11 +755,11 @@ func TestAgentPushFailsIfClosedAgent(t *testing.T) {
 	messageEncoder := message.NewMessagesEncoder(false)
 
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(nil, nil, mockEncoder, mockSerializer, time.Second, 10, nil, messageEncoder, nil, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 10, nil, messageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 	assert.NotNil(t, ag)
 	ag.state = constants.StatusClosed
 	err := ag.Push("", nil)
-	assert.Equal(t, e.NewError(constants.ErrBrokenPipe, e.ErrClientClosedRequest), err)
+	assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), err)
 }
 
 func TestAgentPushStruct(t *testing.T) {
@@ -314,7 +789,7 @@ func TestAgentPushStruct(t *testing.T) {
 			mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
 			mockSerializer.EXPECT().GetName()
 			sessionPool := session.NewSessionPool()
-			ag := newAgent(mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool).(*agentImpl)
+			ag := mustNewAgent(t, mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool, Options{}).(*agentImpl)
 			assert.NotNil(t, ag)
 
 			expectedBytes := []byte("hello")
@@ -327,7 +802,7 @@ func TestAgentPushStruct(t *testing.T) {
 			assert.NoError(t, err)
 			mockSerializer.EXPECT().Marshal(table.data).Return(expectedBytes, nil)
 			mockEncoder.EXPECT().Encode(packet.Type(packet.Data), em).Return(expectedBytes, nil)
-			expectedWrite := pendingWrite{ctx: nil, data: expectedBytes, err: nil}
+			expectedWrite := pendingWrite{ctx: nil, data: expectedBytes, err: nil, consumesCredit: true, push: true}
 
 			if table.err != nil {
 				close(ag.chSend)
@@ -338,7 +813,7 @@ func TestAgentPushStruct(t *testing.T) {
 			assert.Equal(t, table.err, err)
 
 			if table.err == nil {
-				recvData := helpers.ShouldEventuallyReceive(t, ag.chSend).(pendingWrite)
+				recvData := receivePendingWrite(t, ag)
 				assert.Equal(t, expectedWrite, recvData)
 			}
 		})
@@ -373,7 +848,7 @@ func TestAgentPush(t *testing.T) {
 			mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
 			mockSerializer.EXPECT().GetName()
 			sessionPool := session.NewSessionPool()
-			ag := newAgent(mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool).(*agentImpl)
+			ag := mustNewAgent(t, mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool, Options{}).(*agentImpl)
 			assert.NotNil(t, ag)
 
 			expectedBytes := []byte("hello")
@@ -385,7 +860,7 @@ func TestAgentPush(t *testing.T) {
 			em, err := messageEncoder.Encode(msg)
 			assert.NoError(t, err)
 			mockEncoder.EXPECT().Encode(packet.Type(packet.Data), em).Return(expectedBytes, nil)
-			expectedWrite := pendingWrite{ctx: nil, data: expectedBytes, err: nil}
+			expectedWrite := pendingWrite{ctx: nil, data: expectedBytes, err: nil, consumesCredit: true, push: true}
 
 			if table.err != nil {
 				close(ag.chSend)
@@ -396,13 +871,143 @@ func TestAgentPush(t *testing.T) {
 			assert.Equal(t, table.err, err)
 
 			if table.err == nil {
-				recvData := helpers.ShouldEventuallyReceive(t, ag.chSend).(pendingWrite)
+				recvData := receivePendingWrite(t, ag)
 				assert.Equal(t, expectedWrite, recvData)
 			}
 		})
 	}
 }
 
+func TestAgentPushWith(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockDecoder := codecmocks.NewMockPacketDecoder(ctrl)
+	messageEncoder := message.NewMessagesEncoder(false)
+	mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
+	mockSerializer.EXPECT().GetName()
+	ag := mustNewAgent(t, mockConn, mockDecoder, mockEncoder, mockSerializer, time.Second, 10, make(chan bool), messageEncoder, []metrics.Reporter{mockMetricsReporter}, session.NewSessionPool(), Options{}).(*agentImpl)
+
+	em, err := messageEncoder.Encode(&message.Message{
+		Type:  message.Push,
+		Route: "debug.state",
+		Data:  []byte(`{"players":2}`),
+	})
+	assert.NoError(t, err)
+	mockEncoder.EXPECT().Encode(packet.Type(packet.Data), em).Return([]byte("hello"), nil)
+	mockMetricsReporter.EXPECT().ReportGauge(metrics.ChannelCapacity, gomock.Any(), float64(10))
+
+	err = ag.PushWith(context.Background(), json.NewSerializer(), "debug.state", map[string]int{"players": 2})
+	assert.NoError(t, err)
+	assert.Equal(t, pendingWrite{data: []byte("hello"), consumesCredit: true, push: true}, receivePendingWrite(t, ag))
+}
+
+func TestAgentPushWithSerializationError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	_, serializeErr := json.NewSerializer().Marshal(make(chan int))
+	assert.Error(t, serializeErr)
+	expected, err := util.GetErrorPayload(json.NewSerializer(), serializeErr)
+	assert.NoError(t, err)
+
+	mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+	mockMetricsReporter.EXPECT().ReportCount(metrics.SerializationFailures, map[string]string{"route": "debug.state"}, float64(1))
+	ag := &agentImpl{
+		logger:           logger.Log,
+		metricsReporters: []metrics.Reporter{mockMetricsReporter},
+		serializer:       protobuf.NewSerializer(),
+	}
+
+	m, err := ag.getMessageFromPendingMessage(pendingMessage{
+		typ:        message.Push,
+		route:      "debug.state",
+		payload:    make(chan int),
+		serializer: json.NewSerializer(),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, m.Data)
+}
+
+func TestAgentSendReportsCompressionRatio(t *testing.T) {
+	tables := []struct {
+		name            string
+		compressibility float64
+		reported        bool
+	}{
+		{"sampled", 1, true},
+		{"sampling_disabled", 0, false},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+			mockMetricsReporters := []metrics.Reporter{mockMetricsReporter}
+			mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
+			sessionPool := session.NewSessionPool()
+			ag := mustNewAgent(t, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), mockMetricsReporters, sessionPool, Options{Compressibility: table.compressibility}).(*agentImpl)
+
+			payload := []byte(strings.Repeat("compressible payload ", 50))
+			mockMetricsReporter.EXPECT().ReportGauge(metrics.ChannelCapacity, gomock.Any(), float64(10))
+			if table.reported {
+				mockMetricsReporter.EXPECT().ReportSummary(metrics.CompressionRatio, map[string]string{"route": "room.push"}, gomock.Any()).Do(
+					func(metric string, tags map[string]string, ratio float64) {
+						assert.True(t, ratio > 0)
+						assert.True(t, ratio < 0.5)
+					})
+			}
+
+			err := ag.send(pendingMessage{typ: message.Push, route: "room.push", payload: payload})
+			assert.NoError(t, err)
+
+			// the payload is still sent uncompressed
+			pWrite := receivePendingWrite(t, ag)
+			assert.Contains(t, string(pWrite.data), string(payload))
+		})
+	}
+}
+
+func TestAgentPushSkipsConsecutiveDuplicates(t *testing.T) {
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+	ag.Session.DedupPushes("game.state")
+
+	pushes := []struct {
+		route string
+		data  string
+		sent  bool
+	}{
+		{"game.state", "a", true},
+		{"game.state", "a", false},
+		{"game.event", "a", true},
+		{"game.event", "a", true},
+		{"game.state", "b", true},
+		{"game.state", "a", true},
+		{"game.state", "a", false},
+	}
+	for i, p := range pushes {
+		assert.NoError(t, ag.Push(p.route, []byte(p.data)))
+		if p.sent {
+			assert.Len(t, ag.chSend, 1, "push %d", i)
+			<-ag.chSend
+		} else {
+			assert.Len(t, ag.chSend, 0, "push %d", i)
+		}
+	}
+
+	ag.Session.StopDedupPushes("game.state")
+	assert.NoError(t, ag.Push("game.state", []byte("a")))
+	assert.Len(t, ag.chSend, 1)
+}
+
 func TestAgentPushFullChannel(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -420,7 +1025,7 @@ func TestAgentPushFullChannel(t *testing.T) {
 	mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
 	mockSerializer.EXPECT().GetName()
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 0, dieChan, messageEncoder, mockMetricsReporters, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 0, dieChan, messageEncoder, mockMetricsReporters, sessionPool, Options{}).(*agentImpl)
 	assert.NotNil(t, ag)
 
 	mockMetricsReporter.EXPECT().ReportGauge(metrics.ChannelCapacity, gomock.Any(), float64(0))
@@ -448,6 +1053,7 @@ func TestAgentResponseMIDFailsIfClosedAgent(t *testing.T) {
 	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
 	heartbeatAndHandshakeMocks(mockEncoder)
 	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 	mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
 
 	mockSerializer := serializemocks.NewMockSerializer(ctrl)
@@ -456,13 +1062,13 @@ func TestAgentResponseMIDFailsIfClosedAgent(t *testing.T) {
 	mockMetricsReporters := []metrics.Reporter{mockMetricsReporter}
 	mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(nil, nil, mockEncoder, mockSerializer, time.Second, 10, nil, mockMessageEncoder, mockMetricsReporters, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 10, nil, mockMessageEncoder, mockMetricsReporters, sessionPool, Options{}).(*agentImpl)
 	assert.NotNil(t, ag)
 	ag.state = constants.StatusClosed
 
 	ctx := getCtxWithRequestKeys()
 	err := ag.ResponseMID(ctx, 1, nil)
-	assert.Equal(t, e.NewError(constants.ErrBrokenPipe, e.ErrClientClosedRequest), err)
+	assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), err)
 }
 
 func TestAgentResponseMID(t *testing.T) {
@@ -500,7 +1106,7 @@ func TestAgentResponseMID(t *testing.T) {
 			mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
 			mockSerializer.EXPECT().GetName()
 			sessionPool := session.NewSessionPool()
-			ag := newAgent(mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool).(*agentImpl)
+			ag := mustNewAgent(t, mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool, Options{}).(*agentImpl)
 			assert.NotNil(t, ag)
 
 			ctx := getCtxWithRequestKeys()
@@ -516,7 +1122,7 @@ func TestAgentResponseMID(t *testing.T) {
 			if reflect.TypeOf(table.data) != reflect.TypeOf([]byte{}) {
 				mockSerializer.EXPECT().Marshal(table.data).Return([]byte("ok"), nil)
 			}
-			expected := pendingWrite{ctx: ctx, data: []byte("ok!"), err: nil}
+			expected := pendingWrite{ctx: ctx, data: []byte("ok!"), err: nil, consumesCredit: true}
 			var err error
 			if table.msgErr {
 				err = ag.ResponseMID(ctx, table.mid, table.data, table.msgErr)
@@ -526,7 +1132,7 @@ func TestAgentResponseMID(t *testing.T) {
 			assert.Equal(t, table.err, err)
 
 			if table.err == nil {
-				recv := helpers.ShouldEventuallyReceive(t, ag.chSend).(pendingWrite)
+				recv := receivePendingWrite(t, ag)
 				assert.Equal(t, expected.ctx, recv.ctx)
 				assert.Equal(t, expected.data, recv.data)
 				if table.msgErr {
@@ -537,6 +1143,20 @@ func TestAgentResponseMID(t *testing.T) {
 	}
 }
 
+func TestAgentSendErrorWithMessageSerializer(t *testing.T) {
+	ag := mustNewAgent(t, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, session.NewSessionPool(), Options{}).(*agentImpl)
+	serializer := protobuf.NewSerializer()
+	payload, err := serializer.Marshal(&protos.Error{Code: "GAME-404", Msg: "not found"})
+	assert.NoError(t, err)
+
+	// the error is decoded with the serializer the payload was encoded with,
+	// not the agent one
+	err = ag.send(pendingMessage{ctx: context.Background(), typ: message.Response, mid: 1, payload: payload, err: true, serializer: serializer})
+	assert.NoError(t, err)
+	recv := receivePendingWrite(t, ag)
+	assert.Equal(t, &e.Error{Code: "GAME-404", Message: "not found"}, recv.err)
+}
+
 func TestAgentResponseMIDFullChannel(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -555,7 +1175,7 @@ func TestAgentResponseMIDFullChannel(t *testing.T) {
 	mockSerializer.EXPECT().GetName()
 	mockEncoder.EXPECT().Encode(packet.Type(packet.Data), gomock.Any())
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 0, dieChan, messageEncoder, mockMetricsReporters, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 0, dieChan, messageEncoder, mockMetricsReporters, sessionPool, Options{}).(*agentImpl)
 	assert.NotNil(t, ag)
 	mockMetricsReporters[0].(*metricsmocks.MockReporter).EXPECT().ReportGauge(metrics.ChannelCapacity, gomock.Any(), float64(0))
 	go func() {
@@ -572,11 +1192,12 @@ func TestAgentCloseFailsIfAlreadyClosed(t *testing.T) {
 	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
 	heartbeatAndHandshakeMocks(mockEncoder)
 	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 	mockSerializer := serializemocks.NewMockSerializer(ctrl)
 	mockSerializer.EXPECT().GetName()
 
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(nil, nil, mockEncoder, mockSerializer, time.Second, 10, nil, mockMessageEncoder, nil, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 10, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 	assert.NotNil(t, ag)
 	ag.state = constants.StatusClosed
 	err := ag.Close()
@@ -591,11 +1212,12 @@ func TestAgentClose(t *testing.T) {
 	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
 	heartbeatAndHandshakeMocks(mockEncoder)
 	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 	mockSerializer := serializemocks.NewMockSerializer(ctrl)
 	mockSerializer.EXPECT().GetName()
 
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 	assert.NotNil(t, ag)
 
 	expected := false
@@ -620,7 +1242,6 @@ func TestAgentClose(t *testing.T) {
 		}
 	}()
 
-	mockConn.EXPECT().RemoteAddr()
 	mockConn.EXPECT().Close()
 	err = ag.Close()
 	assert.NoError(t, err)
@@ -631,19 +1252,284 @@ func TestAgentClose(t *testing.T) {
 		true, 50*time.Millisecond, 500*time.Millisecond)
 }
 
-func TestAgentRemoteAddr(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
+func TestAgentCloseReportsDisconnectReason(t *testing.T) {
+	tables := []struct {
+		name         string
+		serverReason string
+		clientReason string
+		expected     session.DisconnectReason
+	}{
+		{"closed_by_server", "", "", session.DisconnectReason{Server: session.DisconnectReasonClosed}},
+		{"server_detected", session.DisconnectReasonHeartbeatTimeout, "", session.DisconnectReason{Server: session.DisconnectReasonHeartbeatTimeout}},
+		{"client_reported", session.DisconnectReasonConnectionClosed, "logout", session.DisconnectReason{Server: session.DisconnectReasonConnectionClosed, Client: "logout"}},
+		{"client_reported_truncated", session.DisconnectReasonConnectionClosed, strings.Repeat("a", 40), session.DisconnectReason{Server: session.DisconnectReasonConnectionClosed, Client: strings.Repeat("a", maxClientCloseReasonLength)}},
+	}
 
-	mockConn := mocks.NewMockPlayerConn(ctrl)
-	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
-	heartbeatAndHandshakeMocks(mockEncoder)
-	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
-	mockSerializer := serializemocks.NewMockSerializer(ctrl)
-	mockSerializer.EXPECT().GetName()
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockConn := mocks.NewMockPlayerConn(ctrl)
+			mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+			heartbeatAndHandshakeMocks(mockEncoder)
+			mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+			mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
+			mockSerializer := serializemocks.NewMockSerializer(ctrl)
+			mockSerializer.EXPECT().GetName()
+			mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+			// on creation and on close
+			mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any()).Times(2)
+
+			sessionPool := session.NewSessionPool()
+			ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, []metrics.Reporter{mockMetricsReporter}, sessionPool, Options{}).(*agentImpl)
+
+			if table.clientReason != "" {
+				ag.SetClientCloseReason(table.clientReason)
+			}
+			if table.serverReason != "" {
+				ag.SetCloseReason(table.serverReason)
+				// only the first reason is kept
+				ag.SetCloseReason(session.DisconnectReasonReadError)
+			}
+
+			var onCloseReason session.DisconnectReason
+			err := ag.Session.OnClose(func() { onCloseReason = ag.Session.DisconnectReason() })
+			assert.NoError(t, err)
+
+			tags := map[string]string{"reason": table.expected.Server, "client_reason": table.expected.Client}
+			mockMetricsReporter.EXPECT().ReportCount(metrics.Disconnections, tags, float64(1))
+			mockConn.EXPECT().Close()
+			err = ag.Close()
+			assert.NoError(t, err)
+			assert.Equal(t, table.expected, onCloseReason)
+			assert.Equal(t, table.expected, ag.DisconnectReason())
+		})
+	}
+}
+
+func TestAgentSendRequest(t *testing.T) {
+	tables := []struct {
+		name           string
+		closed         bool
+		noRPCClient    bool
+		ctxTimeout     time.Duration
+		requestTimeout time.Duration
+		errGetServer   error
+		err            error
+	}{
+		{"success", false, false, 0, time.Second, nil, nil},
+		{"success_ctx_deadline", false, false, time.Minute, time.Second, nil, nil},
+		{"success_no_timeout", false, false, 0, 0, nil, nil},
+		{"failed_closed", true, false, 0, time.Second, nil, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest)},
+		{"failed_no_rpc_client", false, true, 0, time.Second, nil, constants.ErrRPCClientNotInitialized},
+		{"failed_get_server", false, false, 0, time.Second, errors.New("get sv"), errors.New("get sv")},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockConn := mocks.NewMockPlayerConn(ctrl)
+			mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+			heartbeatAndHandshakeMocks(mockEncoder)
+			mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+			mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
+			mockRPCClient := clustermocks.NewMockRPCClient(ctrl)
+			mockSD := clustermocks.NewMockServiceDiscovery(ctrl)
+
+			options := Options{ServiceDiscovery: mockSD, RequestTimeout: table.requestTimeout}
+			if !table.noRPCClient {
+				options.RPCClient = mockRPCClient
+			}
+			ag := mustNewAgent(t, mockConn, nil, mockEncoder, json.NewSerializer(), time.Second, 0, nil, mockMessageEncoder, nil, session.NewSessionPool(), options).(*agentImpl)
+			err := ag.Session.Bind(nil, "uid")
+			assert.NoError(t, err)
+			if table.closed {
+				ag.SetStatus(constants.StatusClosed)
+			}
+
+			ctx := context.Background()
+			var deadline time.Time
+			if table.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, table.ctxTimeout)
+				defer cancel()
+				deadline, _ = ctx.Deadline()
+			}
+
+			expected := &protos.Response{Data: []byte("resp")}
+			sv := &cluster.Server{ID: "connector-1", Type: "connector"}
+			if !table.closed && !table.noRPCClient {
+				mockSD.EXPECT().GetServer(sv.ID).Return(sv, table.errGetServer)
+			}
+			if table.err == nil {
+				start := time.Now()
+				mockRPCClient.EXPECT().Call(gomock.Any(), protos.RPCType_Sys, gomock.Any(), ag.Session, gomock.Any(), sv).DoAndReturn(
+					func(ctx context.Context, rpcType protos.RPCType, r *route.Route, s session.Session, msg *message.Message, server *cluster.Server) (*protos.Response, error) {
+						assert.Equal(t, "connector.room.join", r.String())
+						assert.Equal(t, message.Request, msg.Type)
+						assert.Equal(t, []byte(`{"A":"ok"}`), msg.Data)
+						assert.Equal(t, "uid", s.UID())
+						ctxDeadline, ok := ctx.Deadline()
+						switch {
+						case table.ctxTimeout > 0:
+							assert.Equal(t, deadline, ctxDeadline)
+						case table.requestTimeout > 0:
+							assert.True(t, ok)
+							assert.WithinDuration(t, start.Add(table.requestTimeout), ctxDeadline, 100*time.Millisecond)
+						default:
+							assert.False(t, ok)
+						}
+						return expected, nil
+					})
+			}
+
+			resp, err := ag.SendRequest(ctx, sv.ID, "connector.room.join", &someStruct{A: "ok"})
+			assert.Equal(t, table.err, err)
+			if table.err == nil {
+				assert.Equal(t, expected, resp)
+			}
+		})
+	}
+}
+
+func TestAgentPushFromOnCloseCallback(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockEncoder.EXPECT().Encode(packet.Type(packet.Data), gomock.Any()).Return([]byte("data"), nil).AnyTimes()
+	messageEncoder := message.NewMessagesEncoder(false)
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName()
+
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, time.Second, 10, nil, messageEncoder, nil, sessionPool, Options{}).(*agentImpl)
+	assert.NotNil(t, ag)
+
+	var callbackErr, poolCallbackErr error
+	err := ag.Session.OnClose(func() {
+		callbackErr = ag.Session.Push("route", []byte("bye"))
+	})
+	assert.NoError(t, err)
+	sessionPool.OnSessionClose(func(s session.Session) {
+		if s == ag.Session {
+			poolCallbackErr = s.Push("route", []byte("bye"))
+		}
+	})
+
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	mockConn.EXPECT().Close()
+
+	// other goroutines keep pushing while the agent closes
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := ag.Push("route", []byte("data"))
+			if err != nil {
+				assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), err)
+			}
+		}()
+	}
+
+	assert.NotPanics(t, func() { ag.Close() })
+	wg.Wait()
+
+	expectedErr := e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest)
+	assert.Equal(t, expectedErr, callbackErr)
+	assert.Equal(t, expectedErr, poolCallbackErr)
+}
+
+func TestAgentSendFailsAfterChDieIsClosed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockEncoder.EXPECT().Encode(packet.Type(packet.Data), gomock.Any()).Return([]byte("data"), nil).AnyTimes()
+	messageEncoder := message.NewMessagesEncoder(false)
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName()
+
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 10, nil, messageEncoder, nil, sessionPool, Options{}).(*agentImpl)
+	assert.NotNil(t, ag)
+
+	// chSend has room for the message, but the agent is already dying
+	close(ag.chDie)
+	for i := 0; i < 10; i++ {
+		err := ag.send(pendingMessage{typ: message.Push, route: "route", payload: []byte("data")})
+		assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), err)
+	}
+	assert.Len(t, ag.chSend, 0)
+}
+
+func TestAgentCloseWhileMessagesAreEncoded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	encoding := make(chan struct{}, 1)
+	mockEncoder.EXPECT().Encode(packet.Type(packet.Data), gomock.Any()).DoAndReturn(func(typ packet.Type, data []byte) ([]byte, error) {
+		select {
+		case encoding <- struct{}{}:
+		default:
+		}
+		time.Sleep(time.Millisecond)
+		return []byte("data"), nil
+	}).AnyTimes()
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	mockConn.EXPECT().Write(gomock.Any()).Return(4, nil).AnyTimes()
+	mockConn.EXPECT().Close()
+
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, json.NewSerializer(), 10*time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+	go ag.Handle()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				err := ag.Push("route", []byte("data"))
+				if err != nil {
+					assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), err)
+				}
+			}
+		}()
+	}
+
+	// close the agent while pushes are being encoded, the pushes must fail
+	// with ErrAgentClosed instead of panicking
+	<-encoding
+	assert.NoError(t, ag.Close())
+	wg.Wait()
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+}
+
+func TestAgentRemoteAddr(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName()
 
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool)
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{})
 	assert.NotNil(t, ag)
 
 	expected := &mockAddr{}
@@ -652,6 +1538,151 @@ func TestAgentRemoteAddr(t *testing.T) {
 	assert.Equal(t, expected, addr)
 }
 
+func TestAgentReconnect(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oldConn := mocks.NewMockPlayerConn(ctrl)
+	oldConn.EXPECT().RemoteAddr().AnyTimes()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, oldConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+	s := ag.GetSession()
+	atomic.StoreInt64(&ag.lastAt, time.Now().Add(-time.Minute).Unix())
+	atomic.StoreUint32(&ag.heartbeatMisses, 0x7)
+
+	newConn := mocks.NewMockPlayerConn(ctrl)
+	newConn.EXPECT().RemoteAddr().Return(&mockAddr{}).AnyTimes()
+	oldConn.EXPECT().Close()
+	assert.NoError(t, ag.Reconnect(newConn))
+
+	assert.Equal(t, newConn, ag.Conn())
+	assert.Equal(t, s, ag.GetSession())
+	assert.False(t, ag.heartbeatTimedOut(time.Now()))
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&ag.heartbeatMisses))
+	select {
+	case <-ag.chHeartbeatReset:
+	default:
+		t.Fatal("heartbeat was not reset")
+	}
+
+	var written bytes.Buffer
+	newConn.EXPECT().Write(gomock.Any()).DoAndReturn(written.Write)
+	go ag.write()
+	assert.NoError(t, ag.Push("route", []byte("after reconnect")))
+	assert.NoError(t, ag.Flush(context.Background()))
+	assert.Contains(t, written.String(), "after reconnect")
+
+	newConn.EXPECT().Close()
+	assert.NoError(t, ag.Close())
+	assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), ag.Reconnect(mocks.NewMockPlayerConn(ctrl)))
+}
+
+func TestAgentReconnectNilConn(t *testing.T) {
+	ag := mustNewAgent(t, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, session.NewSessionPool(), Options{}).(*agentImpl)
+	assert.Equal(t, constants.ErrNilConn, ag.Reconnect(nil))
+}
+
+func TestAgentReconnectDuringWrite(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oldConn := mocks.NewMockPlayerConn(ctrl)
+	oldConn.EXPECT().RemoteAddr().AnyTimes()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, oldConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	newConn := mocks.NewMockPlayerConn(ctrl)
+	newConn.EXPECT().RemoteAddr().Return(&mockAddr{}).AnyTimes()
+	oldConn.EXPECT().Close().Return(nil)
+	// the client reconnects while the data is written to the old conn
+	oldConn.EXPECT().Write([]byte("data")).DoAndReturn(func(b []byte) (int, error) {
+		assert.NoError(t, ag.Reconnect(newConn))
+		return 2, errors.New("use of closed network connection")
+	})
+	newConn.EXPECT().Write([]byte("data")).Return(4, nil)
+
+	n, err := ag.writeConn([]byte("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+}
+
+func TestAgentPacketWriteInterceptor(t *testing.T) {
+	checksum := func(data []byte) ([]byte, error) {
+		return append(data, byte(len(data))), nil
+	}
+	failing := func(data []byte) ([]byte, error) {
+		return nil, errors.New("no key")
+	}
+	tables := []struct {
+		name        string
+		interceptor PacketWriteInterceptor
+		written     []byte
+		err         bool
+	}{
+		{"none", nil, []byte("data"), false},
+		{"transform", checksum, []byte("data\x04"), false},
+		{"error", failing, nil, true},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockConn := mocks.NewMockPlayerConn(ctrl)
+			mockConn.EXPECT().RemoteAddr().AnyTimes()
+			ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, session.NewSessionPool(), Options{PacketWriteInterceptor: table.interceptor}).(*agentImpl)
+			mirror := &bytes.Buffer{}
+			ag.SetMirror(mirror)
+
+			if table.written != nil {
+				mockConn.EXPECT().Write(table.written).Return(len(table.written), nil)
+			}
+			n, err := ag.writeConn([]byte("data"))
+			assert.Equal(t, table.err, err != nil)
+			assert.Equal(t, len(table.written), n)
+			assert.Equal(t, len(table.written), mirror.Len())
+		})
+	}
+}
+
+func TestAgentSetPacketWriteInterceptor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, session.NewSessionPool(), Options{}).(*agentImpl)
+
+	mockConn.EXPECT().Write([]byte("data")).Return(4, nil)
+	_, err := ag.writeConn([]byte("data"))
+	assert.NoError(t, err)
+
+	ag.SetPacketWriteInterceptor(func(data []byte) ([]byte, error) {
+		return bytes.ToUpper(data), nil
+	})
+	mockConn.EXPECT().Write([]byte("DATA")).Return(4, nil)
+	_, err = ag.writeConn([]byte("data"))
+	assert.NoError(t, err)
+}
+
+func TestAgentWriteClosesOnPacketWriteInterceptorError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, session.NewSessionPool(), Options{}).(*agentImpl)
+	ag.SetPacketWriteInterceptor(func(data []byte) ([]byte, error) {
+		return nil, errors.New("no key")
+	})
+
+	assert.NoError(t, ag.Push("route", []byte("data")))
+	mockConn.EXPECT().Close()
+	ag.write()
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+}
+
 func TestAgentString(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -660,11 +1691,12 @@ func TestAgentString(t *testing.T) {
 	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
 	heartbeatAndHandshakeMocks(mockEncoder)
 	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 	mockSerializer := serializemocks.NewMockSerializer(ctrl)
 	mockSerializer.EXPECT().GetName()
 
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 	assert.NotNil(t, ag)
 
 	mockConn.EXPECT().RemoteAddr().Return(&mockAddr{})
@@ -673,6 +1705,32 @@ func TestAgentString(t *testing.T) {
 	assert.Equal(t, expected, str)
 }
 
+func TestAgentSnapshot(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+	assert.NoError(t, ag.Session.Bind(context.Background(), "player-1"))
+	ag.SetStatus(constants.StatusWorking)
+	atomic.StoreInt64(&ag.lastAt, 1700000000)
+	atomic.AddInt64(&ag.pendingWrites, 2)
+	ag.chSend <- pendingWrite{data: []byte("queued")}
+
+	mockConn.EXPECT().RemoteAddr().Return(&mockAddr{})
+	assert.Equal(t, networkentity.Snapshot{
+		SessionID:     ag.Session.ID(),
+		UID:           "player-1",
+		RemoteAddr:    "remote-string",
+		Status:        constants.StatusWorking,
+		LastAt:        time.Unix(1700000000, 0),
+		PendingWrites: 2,
+		QueuedWrites:  1,
+		QueueCapacity: 10,
+	}, ag.Snapshot())
+}
+
 func TestAgentGetStatus(t *testing.T) {
 	tables := []struct {
 		name   string
@@ -691,12 +1749,13 @@ func TestAgentGetStatus(t *testing.T) {
 			mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
 			heartbeatAndHandshakeMocks(mockEncoder)
 			mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+			mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 
 			mockSerializer := serializemocks.NewMockSerializer(ctrl)
 			mockSerializer.EXPECT().GetName()
 
 			sessionPool := session.NewSessionPool()
-			ag := newAgent(mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool).(*agentImpl)
+			ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 			assert.NotNil(t, ag)
 
 			ag.state = table.status
@@ -714,11 +1773,12 @@ func TestAgentSetLastAt(t *testing.T) {
 	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
 	heartbeatAndHandshakeMocks(mockEncoder)
 	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 	mockSerializer := serializemocks.NewMockSerializer(ctrl)
 	mockSerializer.EXPECT().GetName()
 
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(nil, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 	assert.NotNil(t, ag)
 
 	ag.lastAt = 0
@@ -743,11 +1803,12 @@ func TestAgentSetStatus(t *testing.T) {
 			mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
 			heartbeatAndHandshakeMocks(mockEncoder)
 			mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+			mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 			mockSerializer := serializemocks.NewMockSerializer(ctrl)
 			mockSerializer.EXPECT().GetName()
 
 			sessionPool := session.NewSessionPool()
-			ag := newAgent(nil, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool).(*agentImpl)
+			ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 			assert.NotNil(t, ag)
 
 			ag.SetStatus(table.status)
@@ -756,16 +1817,82 @@ func TestAgentSetStatus(t *testing.T) {
 	}
 }
 
+func TestAgentSetStatusKeepsClosedAgentClosed(t *testing.T) {
+	ag := &agentImpl{logger: logger.Log}
+	ag.SetStatus(constants.StatusWorking)
+	ag.SetStatus(constants.StatusClosed)
+	ag.SetStatus(constants.StatusWorking)
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+}
+
+func TestAgentCompareAndSetStatus(t *testing.T) {
+	tables := []struct {
+		name     string
+		current  int32
+		old      int32
+		new      int32
+		set      bool
+		expected int32
+	}{
+		{"matching_old", constants.StatusStart, constants.StatusStart, constants.StatusHandshake, true, constants.StatusHandshake},
+		{"stale_old", constants.StatusWorking, constants.StatusHandshake, constants.StatusWorking, false, constants.StatusWorking},
+		{"close", constants.StatusWorking, constants.StatusWorking, constants.StatusClosed, true, constants.StatusClosed},
+		{"resurrect_closed", constants.StatusClosed, constants.StatusClosed, constants.StatusWorking, false, constants.StatusClosed},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ag := &agentImpl{state: table.current}
+			assert.Equal(t, table.set, ag.CompareAndSetStatus(table.old, table.new))
+			assert.Equal(t, table.expected, ag.GetStatus())
+		})
+	}
+}
+
+func TestAgentConcurrentCloseCleansUpOnce(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 0, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	var closed int32
+	assert.NoError(t, ag.Session.OnClose(func() { atomic.AddInt32(&closed, 1) }))
+	mockConn.EXPECT().Close().Times(1)
+
+	var wg sync.WaitGroup
+	var succeeded int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ag.Close(); err == nil {
+				atomic.AddInt32(&succeeded, 1)
+			} else {
+				assert.Equal(t, constants.ErrCloseClosedSession, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), succeeded)
+	assert.Equal(t, int32(1), closed)
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+}
+
 func TestOnSessionClosed(t *testing.T) {
 	ctrl := gomock.NewController(t)
 
 	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
 	heartbeatAndHandshakeMocks(mockEncoder)
 	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 	mockSerializer := serializemocks.NewMockSerializer(ctrl)
 	mockSerializer.EXPECT().GetName()
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(nil, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 
 	ss := sessionPool.NewSession(nil, true)
 
@@ -784,10 +1911,11 @@ func TestOnSessionClosedRecoversIfPanic(t *testing.T) {
 	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
 	heartbeatAndHandshakeMocks(mockEncoder)
 	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 	mockSerializer := serializemocks.NewMockSerializer(ctrl)
 	mockSerializer.EXPECT().GetName()
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(nil, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 
 	ss := sessionPool.NewSession(nil, true)
 
@@ -803,6 +1931,53 @@ func TestOnSessionClosedRecoversIfPanic(t *testing.T) {
 	assert.True(t, expected)
 }
 
+func TestOnSessionClosedRunsCallbacksAfterPanic(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
+
+	ss := sessionPool.NewSession(nil, true)
+
+	var called []string
+	assert.NoError(t, ss.OnClose(func() { panic("oh noes") }))
+	assert.NoError(t, ss.OnClose(func() { called = append(called, "session") }))
+	sessionPool.OnSessionClose(func(s session.Session) { panic("oh noes") })
+	sessionPool.OnSessionClose(func(s session.Session) {
+		assert.Equal(t, ss, s)
+		called = append(called, "pool")
+	})
+
+	assert.NotPanics(t, func() { ag.onSessionClosed(ss) })
+	assert.Equal(t, []string{"session", "pool"}, called)
+}
+
+func TestAgentHandshakeCompleted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
+
+	var handshaken []session.Session
+	sessionPool.OnHandshake(func(s session.Session) { handshaken = append(handshaken, s) })
+	sessionPool.OnHandshake(func(s session.Session) { panic("oh noes") })
+
+	assert.NotPanics(t, ag.HandshakeCompleted)
+	assert.Equal(t, []session.Session{ag.Session}, handshaken)
+}
+
 func TestAgentSendHandshakeResponse(t *testing.T) {
 	tables := []struct {
 		name string
@@ -821,24 +1996,139 @@ func TestAgentSendHandshakeResponse(t *testing.T) {
 			mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
 			heartbeatAndHandshakeMocks(mockEncoder)
 			mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+			mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 			mockSerializer := serializemocks.NewMockSerializer(ctrl)
 			mockSerializer.EXPECT().GetName()
 
 			sessionPool := session.NewSessionPool()
-			ag := newAgent(mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool)
+			ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, time.Second, 0, nil, mockMessageEncoder, nil, sessionPool, Options{})
 			assert.NotNil(t, ag)
 
-			mockConn.EXPECT().Write(hrd).Return(0, table.err)
+			mockConn.EXPECT().Write(ag.(*agentImpl).handshakeResponse).Return(0, table.err)
 			err := ag.SendHandshakeResponse()
 			assert.Equal(t, table.err, err)
 		})
 	}
 }
 
-func TestAnswerWithError(t *testing.T) {
-	tables := []struct {
-		name          string
-		getPayloadErr error
+func TestEncodeHandshakeMatchesAgentHandshake(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	serializer := json.NewSerializer()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), serializer, 30*time.Second, 1, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{})
+
+	expected, err := EncodeHandshake(serializer, 30*time.Second, message.GetDictionary())
+	assert.NoError(t, err)
+
+	mockConn.EXPECT().Write(expected).Return(len(expected), nil)
+	err = ag.SendHandshakeResponse()
+	assert.NoError(t, err)
+}
+
+func TestEncodeHandshake(t *testing.T) {
+	dictionary := map[string]uint16{"room.join": 1, "room.leave": 2}
+	handshake, err := EncodeHandshake(json.NewSerializer(), 30*time.Second, dictionary)
+	assert.NoError(t, err)
+
+	again, err := EncodeHandshake(json.NewSerializer(), 30*time.Second, dictionary)
+	assert.NoError(t, err)
+	assert.Equal(t, handshake, again)
+
+	packets, err := codec.NewPomeloPacketDecoder().Decode(handshake)
+	assert.NoError(t, err)
+	assert.Len(t, packets, 1)
+	assert.Equal(t, packet.Type(packet.Handshake), packets[0].Type)
+	assert.JSONEq(t, `{"code":200,"sys":{"heartbeat":30,"dict":{"room.join":1,"room.leave":2},"serializer":"json"}}`, string(packets[0].Data))
+}
+
+func TestEncodeHandshakeHandshakeMarshaler(t *testing.T) {
+	dictionary := map[string]uint16{"room.join": 1}
+	handshake, err := EncodeHandshake(protobuf.NewHandshakeSerializer(), 30*time.Second, dictionary)
+	assert.NoError(t, err)
+
+	packets, err := codec.NewPomeloPacketDecoder().Decode(handshake)
+	assert.NoError(t, err)
+	assert.Len(t, packets, 1)
+	assert.Equal(t, packet.Type(packet.Handshake), packets[0].Type)
+
+	decoded := &structpb.Struct{}
+	assert.NoError(t, protobuf.NewSerializer().Unmarshal(packets[0].Data, decoded))
+	assert.Equal(t, map[string]interface{}{
+		"code": float64(200),
+		"sys": map[string]interface{}{
+			"heartbeat":  float64(30),
+			"dict":       map[string]interface{}{"room.join": float64(1)},
+			"serializer": "protobuf",
+		},
+	}, decoded.AsMap())
+
+	// the plain protobuf serializer doesn't encode handshakes
+	handshake, err = EncodeHandshake(protobuf.NewSerializer(), 30*time.Second, dictionary)
+	assert.NoError(t, err)
+	packets, err = codec.NewPomeloPacketDecoder().Decode(handshake)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"code":200,"sys":{"heartbeat":30,"dict":{"room.join":1},"serializer":"protobuf"}}`, string(packets[0].Data))
+}
+
+func TestAgentSendHandshakeRetryResponse(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	packetEncoder := codec.NewPomeloPacketEncoder()
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, packetEncoder, json.NewSerializer(), time.Second, 0, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{})
+
+	var written []byte
+	mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(func(d []byte) (int, error) {
+		written = d
+		return len(d), nil
+	})
+	err := ag.SendHandshakeRetryResponse(30 * time.Second)
+	assert.NoError(t, err)
+
+	packets, err := codec.NewPomeloPacketDecoder().Decode(written)
+	assert.NoError(t, err)
+	assert.Len(t, packets, 1)
+	assert.Equal(t, packet.Type(packet.Handshake), packets[0].Type)
+	assert.JSONEq(t, `{"code":503,"sys":{"retryAfter":30}}`, string(packets[0].Data))
+}
+
+func TestAgentSendHandshakeMaintenanceResponse(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	packetEncoder := codec.NewPomeloPacketEncoder()
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, packetEncoder, json.NewSerializer(), time.Second, 0, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{})
+
+	var written []byte
+	mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(func(d []byte) (int, error) {
+		written = d
+		return len(d), nil
+	})
+	err := ag.SendHandshakeMaintenanceResponse(time.Hour, map[string]interface{}{
+		"message": "scheduled maintenance",
+		"start":   int64(1793588400),
+		"end":     int64(1793595600),
+	})
+	assert.NoError(t, err)
+
+	packets, err := codec.NewPomeloPacketDecoder().Decode(written)
+	assert.NoError(t, err)
+	assert.Len(t, packets, 1)
+	assert.Equal(t, packet.Type(packet.Handshake), packets[0].Type)
+	assert.JSONEq(t, `{"code":503,"sys":{"retryAfter":3600,"maintenance":{"message":"scheduled maintenance","start":1793588400,"end":1793595600}}}`, string(packets[0].Data))
+}
+
+func TestAnswerWithError(t *testing.T) {
+	tables := []struct {
+		name          string
+		getPayloadErr error
 		resErr        error
 		err           error
 	}{
@@ -858,7 +2148,7 @@ func TestAnswerWithError(t *testing.T) {
 			messageEncoder := message.NewMessagesEncoder(false)
 			mockSerializer.EXPECT().GetName()
 			sessionPool := session.NewSessionPool()
-			ag := newAgent(nil, nil, mockEncoder, mockSerializer, time.Second, 1, nil, messageEncoder, nil, sessionPool).(*agentImpl)
+			ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 1, nil, messageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 			assert.NotNil(t, ag)
 
 			mockSerializer.EXPECT().Marshal(gomock.Any()).Return(nil, table.getPayloadErr)
@@ -882,9 +2172,10 @@ func TestAgentHeartbeat(t *testing.T) {
 	heartbeatAndHandshakeMocks(mockEncoder)
 	mockConn := mocks.NewMockPlayerConn(ctrl)
 	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
 	mockSerializer.EXPECT().GetName()
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, nil, mockEncoder, mockSerializer, 1*time.Second, 1, nil, mockMessageEncoder, nil, sessionPool).(*agentImpl)
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 1*time.Second, 1, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
 	assert.NotNil(t, ag)
 
 	mockConn.EXPECT().RemoteAddr().MaxTimes(1)
@@ -902,49 +2193,137 @@ func TestAgentHeartbeat(t *testing.T) {
 
 	go ag.heartbeat()
 	for i := 0; i < 2; i++ {
-		pWrite := helpers.ShouldEventuallyReceive(t, ag.chSend, 1100*time.Millisecond).(pendingWrite)
-		assert.Equal(t, pendingWrite{data: hbd}, pWrite)
+		pWrite := receivePendingWrite(t, ag, 1100*time.Millisecond)
+		assert.Equal(t, pendingWrite{data: ag.heartbeatData, heartbeat: true}, pWrite)
 	}
 	helpers.ShouldEventuallyReturn(t, func() bool { return die }, true, 500*time.Millisecond, 5*time.Second)
 }
 
-func TestAgentHeartbeatExitsIfConnError(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
+func TestAgentHeartbeatTimedOut(t *testing.T) {
+	now := time.Now()
+	tables := []struct {
+		name            string
+		lastAt          time.Time
+		backgroundGrace time.Duration
+		backgrounded    bool
+		checkAt         time.Time
+		timedOut        bool
+	}{
+		{"recent_heartbeat", now, 10 * time.Second, false, now, false},
+		{"silent", now.Add(-3 * time.Second), 10 * time.Second, false, now, true},
+		{"silent_backgrounded", now.Add(-3 * time.Second), 10 * time.Second, true, now.Add(5 * time.Second), false},
+		{"silent_after_background_grace", now.Add(-3 * time.Second), 10 * time.Second, true, now.Add(11 * time.Second), true},
+		{"background_grace_disabled", now.Add(-3 * time.Second), 0, true, now, true},
+	}
 
-	mockSerializer := serializemocks.NewMockSerializer(ctrl)
-	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
-	heartbeatAndHandshakeMocks(mockEncoder)
-	mockConn := mocks.NewMockPlayerConn(ctrl)
-	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
-	mockSerializer.EXPECT().GetName()
-	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, nil, mockEncoder, mockSerializer, 1*time.Second, 1, nil, mockMessageEncoder, nil, sessionPool).(*agentImpl)
-	assert.NotNil(t, ag)
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ag := &agentImpl{
+				backgroundGrace:  table.backgroundGrace,
+				heartbeatTimeout: time.Second,
+				lastAt:           table.lastAt.Unix(),
+				logger:           logger.Log,
+			}
+			if table.backgrounded {
+				ag.SetBackgrounded()
+			}
+			assert.Equal(t, table.timedOut, ag.heartbeatTimedOut(table.checkAt))
+		})
+	}
+}
 
-	mockConn.EXPECT().RemoteAddr().MaxTimes(1)
-	mockConn.EXPECT().Close().MaxTimes(1)
+func TestAgentAllowPacket(t *testing.T) {
+	t.Run("unlimited", func(t *testing.T) {
+		ag := &agentImpl{}
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, ag.AllowPacket())
+		}
+	})
 
-	die := false
-	go func() {
-		for {
-			select {
-			case <-ag.chDie:
-				die = true
-			}
+	t.Run("close", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+		ag := &agentImpl{metricsReporters: []metrics.Reporter{mockMetricsReporter}}
+		ag.SetPacketRateLimit(acceptor.PacketRateLimit{Rate: 1, Burst: 3, Close: true})
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, ag.AllowPacket())
 		}
-	}()
 
-	go ag.heartbeat()
-	for i := 0; i < 2; i++ {
-		pWrite := helpers.ShouldEventuallyReceive(t, ag.chSend, 1100*time.Millisecond).(pendingWrite)
-		assert.Equal(t, pendingWrite{data: hbd}, pWrite)
+		mockMetricsReporter.EXPECT().ReportCount(metrics.ExceededRateLimiting, map[string]string{}, float64(1))
+		assert.Equal(t, constants.ErrRateLimitExceeded, ag.AllowPacket())
+	})
+
+	t.Run("throttle", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+		ag := &agentImpl{metricsReporters: []metrics.Reporter{mockMetricsReporter}}
+		// the burst defaults to the rate
+		ag.SetPacketRateLimit(acceptor.PacketRateLimit{Rate: 20})
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, ag.AllowPacket())
+		}
+
+		mockMetricsReporter.EXPECT().ReportCount(metrics.ExceededRateLimiting, map[string]string{}, float64(1)).Times(2)
+		start := time.Now()
+		assert.NoError(t, ag.AllowPacket())
+		assert.NoError(t, ag.AllowPacket())
+		assert.InDelta(t, 100*time.Millisecond, time.Since(start), float64(40*time.Millisecond))
+	})
+
+	t.Run("closed_while_throttled", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+		ag := &agentImpl{metricsReporters: []metrics.Reporter{mockMetricsReporter}, chDie: make(chan struct{})}
+		ag.SetPacketRateLimit(acceptor.PacketRateLimit{Rate: 1, Burst: 1})
+		assert.NoError(t, ag.AllowPacket())
+
+		mockMetricsReporter.EXPECT().ReportCount(metrics.ExceededRateLimiting, map[string]string{}, float64(1))
+		close(ag.chDie)
+		start := time.Now()
+		assert.Equal(t, e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), ag.AllowPacket())
+		assert.True(t, time.Since(start) < 100*time.Millisecond)
+	})
+}
+
+func TestAgentConnectionQuality(t *testing.T) {
+	tables := []struct {
+		name    string
+		rtts    []time.Duration
+		misses  []bool
+		quality ConnectionQuality
+	}{
+		{"no_signals", nil, nil, ConnectionQualityGood},
+		{"low_rtt", []time.Duration{50 * time.Millisecond}, nil, ConnectionQualityGood},
+		{"high_rtt", []time.Duration{200 * time.Millisecond}, nil, ConnectionQualityFair},
+		{"very_high_rtt", []time.Duration{time.Second}, nil, ConnectionQualityPoor},
+		{"rtt_spike_is_smoothed", []time.Duration{50 * time.Millisecond, time.Second}, nil, ConnectionQualityFair},
+		{"missed_heartbeat", nil, []bool{false, true, false}, ConnectionQualityFair},
+		{"missed_heartbeats", nil, []bool{true, false, true, true}, ConnectionQualityPoor},
+		{"old_missed_heartbeats_are_forgotten", nil, []bool{true, true, true, false, false, false, false, false, false, false, false}, ConnectionQualityGood},
+		{"worst_of_both", []time.Duration{200 * time.Millisecond}, []bool{true, true, true}, ConnectionQualityPoor},
 	}
 
-	helpers.ShouldEventuallyReturn(t, func() bool { return die }, true, 500*time.Millisecond, 2*time.Second)
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ag := &agentImpl{logger: logger.Log}
+			for _, rtt := range table.rtts {
+				ag.SetRTT(rtt)
+			}
+			for _, missed := range table.misses {
+				ag.recordHeartbeat(missed)
+			}
+			assert.Equal(t, table.quality, ag.ConnectionQuality())
+		})
+	}
 }
 
-func TestAgentHeartbeatExitsOnStopHeartbeat(t *testing.T) {
+func TestAgentHeartbeatRecordsMissedHeartbeats(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
@@ -954,157 +2333,1255 @@ func TestAgentHeartbeatExitsOnStopHeartbeat(t *testing.T) {
 	mockConn := mocks.NewMockPlayerConn(ctrl)
 	messageEncoder := message.NewMessagesEncoder(false)
 
-	mockConn.EXPECT().RemoteAddr().MaxTimes(1)
+	mockConn.EXPECT().RemoteAddr().MaxTimes(2)
 	mockConn.EXPECT().Close().MaxTimes(1)
 
 	mockSerializer.EXPECT().GetName()
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, nil, mockEncoder, mockSerializer, 1*time.Second, 1, nil, messageEncoder, nil, sessionPool).(*agentImpl)
-	assert.NotNil(t, ag)
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 10*time.Millisecond, 10, nil, messageEncoder, nil, sessionPool, Options{BackgroundGrace: time.Hour}).(*agentImpl)
+	assert.Equal(t, ConnectionQualityGood, ag.ConnectionQuality())
 
-	go func() {
-		time.Sleep(500 * time.Millisecond)
-		ag.Close()
-	}()
+	// a backgrounded client is not timed out, so it keeps missing heartbeats
+	ag.SetBackgrounded()
+	atomic.StoreInt64(&ag.lastAt, 0)
 
-	ag.heartbeat()
+	go ag.heartbeat()
+	helpers.ShouldEventuallyReturn(t, func() ConnectionQuality {
+		return ag.ConnectionQuality()
+	}, ConnectionQualityPoor)
+	ag.Close()
 }
 
-func TestAgentWriteChSend(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
+func TestAgentLastActivity(t *testing.T) {
+	lastAt := time.Now().Add(-time.Minute).Unix()
+	var ag networkentity.StatusReporter = &agentImpl{lastAt: lastAt, state: constants.StatusWorking}
+	assert.Equal(t, time.Unix(lastAt, 0), ag.LastActivity())
+	assert.Equal(t, constants.StatusWorking, ag.GetStatus())
+}
 
-	mockSerializer := serializemocks.NewMockSerializer(ctrl)
-	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
-	mockConn := mocks.NewMockPlayerConn(ctrl)
-	messageEncoder := message.NewMessagesEncoder(false)
-	mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
-	mockMetricsReporters := []metrics.Reporter{mockMetricsReporter}
-	ag := &agentImpl{ // avoid heartbeat and handshake to fully test serialize
-		conn:             mockConn,
-		chSend:           make(chan pendingWrite, 1),
-		encoder:          mockEncoder,
-		heartbeatTimeout: time.Second,
-		lastAt:           time.Now().Unix(),
-		serializer:       mockSerializer,
-		messageEncoder:   messageEncoder,
-		metricsReporters: mockMetricsReporters,
-	}
-	ctx := getCtxWithRequestKeys()
-	mockMetricsReporters[0].(*metricsmocks.MockReporter).EXPECT().ReportSummary(metrics.ResponseTime, gomock.Any(), gomock.Any())
+type connStateConn struct {
+	net.Conn
+	state acceptor.ConnState
+}
 
-	expectedPacket := []byte("final")
+func (c *connStateConn) ConnState() acceptor.ConnState {
+	return c.state
+}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	mockConn.EXPECT().Write(expectedPacket).Do(func(b []byte) {
-		wg.Done()
-	})
-	go ag.write()
-	ag.chSend <- pendingWrite{ctx: ctx, data: expectedPacket, err: nil}
-	wg.Wait()
+func pipeConn() net.Conn {
+	conn, _ := net.Pipe()
+	return conn
 }
 
-func TestAgentHandle(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
+type keepAliveConn struct {
+	net.Conn
+	keepAlive bool
+	period    time.Duration
+}
 
-	mockSerializer := serializemocks.NewMockSerializer(ctrl)
-	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
-	heartbeatAndHandshakeMocks(mockEncoder)
-	mockConn := mocks.NewMockPlayerConn(ctrl)
-	messageEncoder := message.NewMessagesEncoder(false)
-	mockSerializer.EXPECT().GetName()
-	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, nil, mockEncoder, mockSerializer, 1*time.Second, 1, nil, messageEncoder, nil, sessionPool).(*agentImpl)
-	assert.NotNil(t, ag)
+func (c *keepAliveConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = keepalive
+	return nil
+}
 
-	go ag.Handle()
-	expectedBytes := []byte("bla")
+func (c *keepAliveConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
 
-	// Sends two heartbeats and then times out
-	mockConn.EXPECT().Write(hbd).Return(0, nil).Times(2)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	closed := false
-	go func() {
-		for {
-			select {
-			case <-ag.chDie:
-				closed = true
-			}
-		}
-	}()
+type wrapperConn struct {
+	net.Conn
+}
 
-	mockConn.EXPECT().Write(expectedBytes).Return(0, nil).Do(func(d []byte) {
-		wg.Done()
-	})
+func (c *wrapperConn) NetConn() net.Conn {
+	return c.Conn
+}
 
-	// ag.Close on method exit
-	mockConn.EXPECT().RemoteAddr().MaxTimes(1)
-	mockConn.EXPECT().Close().MaxTimes(1)
+func TestSetKeepAlive(t *testing.T) {
+	t.Run("tcp_conn", func(t *testing.T) {
+		conn := &keepAliveConn{Conn: pipeConn()}
+		assert.NoError(t, setKeepAlive(conn, 10*time.Second))
+		assert.True(t, conn.keepAlive)
+		assert.Equal(t, 10*time.Second, conn.period)
+	})
 
-	ag.chSend <- pendingWrite{ctx: nil, data: expectedBytes, err: nil}
+	t.Run("wrapped_tcp_conn", func(t *testing.T) {
+		conn := &keepAliveConn{Conn: pipeConn()}
+		assert.NoError(t, setKeepAlive(&wrapperConn{&wrapperConn{conn}}, 10*time.Second))
+		assert.True(t, conn.keepAlive)
+		assert.Equal(t, 10*time.Second, conn.period)
+	})
 
-	wg.Wait()
-	helpers.ShouldEventuallyReturn(t, func() bool { return closed }, true, 50*time.Millisecond, 5*time.Second)
+	t.Run("not_tcp_conn", func(t *testing.T) {
+		assert.NoError(t, setKeepAlive(pipeConn(), 10*time.Second))
+		assert.NoError(t, setKeepAlive(&wrapperConn{pipeConn()}, 10*time.Second))
+	})
 }
 
-func TestNatsRPCServerReportMetrics(t *testing.T) {
+func TestNewAgentSetsKeepAlive(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
+	conn := &keepAliveConn{Conn: pipeConn()}
 	mockSerializer := serializemocks.NewMockSerializer(ctrl)
 	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
-	heartbeatAndHandshakeMocks(mockEncoder)
 	mockDecoder := codecmocks.NewMockPacketDecoder(ctrl)
-	dieChan := make(chan bool)
-	hbTime := time.Second
 	messageEncoder := message.NewMessagesEncoder(false)
-	mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
-	mockMetricsReporters := []metrics.Reporter{mockMetricsReporter}
-	mockConn := mocks.NewMockPlayerConn(ctrl)
-	mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
-	mockSerializer.EXPECT().GetName()
 	sessionPool := session.NewSessionPool()
-	ag := newAgent(mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool).(*agentImpl)
-	assert.NotNil(t, ag)
-
-	ag.messagesBufferSize = 0
 
-	ag.chSend <- pendingWrite{}
+	mockSerializer.EXPECT().GetName().AnyTimes()
+	mockEncoder.EXPECT().Encode(gomock.Any(), gomock.Any()).AnyTimes()
 
-	mockMetricsReporter.EXPECT().ReportGauge(metrics.ChannelCapacity, gomock.Any(), float64(-1)) // because buffersize is 0 and chan sz is 1
-	ag.reportChannelSize()
+	mustNewAgent(t, conn, mockDecoder, mockEncoder, mockSerializer, time.Second, 10, nil, messageEncoder, nil, sessionPool, Options{KeepAlivePeriod: 15 * time.Second})
+	assert.True(t, conn.keepAlive)
+	assert.Equal(t, 15*time.Second, conn.period)
 }
 
-type customMockAddr struct{ network, str string }
+func TestAgentCapabilities(t *testing.T) {
+	tables := []struct {
+		name          string
+		conn          net.Conn
+		compression   bool
+		handshakeData *session.HandshakeData
+		credit        int64
+		capabilities  session.Capabilities
+	}{
+		{"before_handshake", nil, false, nil, 0, session.Capabilities{Serializer: "json", HeartbeatInterval: time.Second}},
+		{"compression", nil, true, &session.HandshakeData{}, 0, session.Capabilities{Serializer: "json", Compression: true, HeartbeatInterval: time.Second}},
+		{"protocol_version", nil, false, &session.HandshakeData{Sys: session.HandshakeClientData{ProtocolVersion: "2"}}, 0, session.Capabilities{Serializer: "json", ProtocolVersion: "2", HeartbeatInterval: time.Second}},
+		{"flow_control", nil, false, &session.HandshakeData{}, 10, session.Capabilities{Serializer: "json", HeartbeatInterval: time.Second, FlowControl: true}},
+		{"encrypted_conn", &connStateConn{Conn: pipeConn(), state: acceptor.ConnState{Encrypted: true, Subprotocol: "pitaya.v2"}}, false, &session.HandshakeData{}, 0, session.Capabilities{Serializer: "json", Encryption: true, Subprotocol: "pitaya.v2", HeartbeatInterval: time.Second}},
+	}
 
-func (m *customMockAddr) Network() string { return m.network }
-func (m *customMockAddr) String() string  { return m.str }
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			sessionPool := session.NewSessionPool()
+			ag := mustNewAgent(t, table.conn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(table.compression), nil, sessionPool, Options{})
+			ag.GetSession().SetHandshakeData(table.handshakeData)
+			ag.GrantCredit(table.credit)
+			assert.Equal(t, table.capabilities, ag.Capabilities())
+			assert.Equal(t, table.capabilities, ag.GetSession().Capabilities())
+		})
+	}
+}
 
-func TestIPVersion(t *testing.T) {
+func TestAgentNegotiateHeartbeatInterval(t *testing.T) {
 	tables := []struct {
-		addr      string
-		ipVersion string
+		name       string
+		min        time.Duration
+		max        time.Duration
+		proposed   time.Duration
+		interval   time.Duration
+		negotiated bool
 	}{
-		{"127.0.0.1:80", constants.IPv4},
-		{"1.2.3.4:3333", constants.IPv4},
-		{"::1:3333", constants.IPv6},
-		{"2001:db8:0000:1:1:1:1:1:3333", constants.IPv6},
+		{"negotiation_disabled", 0, 0, 60 * time.Second, 30 * time.Second, false},
+		{"within_range", 10 * time.Second, 120 * time.Second, 60 * time.Second, 60 * time.Second, true},
+		{"below_min", 10 * time.Second, 120 * time.Second, time.Second, 10 * time.Second, true},
+		{"above_max", 10 * time.Second, 120 * time.Second, 300 * time.Second, 120 * time.Second, true},
 	}
 
 	for _, table := range tables {
-		t.Run("test_"+table.addr, func(t *testing.T) {
-			ctrl := gomock.NewController(t)
-			defer ctrl.Finish()
-			mockConn := mocks.NewMockPlayerConn(ctrl)
-			mockAddr := &customMockAddr{str: table.addr}
+		t.Run(table.name, func(t *testing.T) {
+			packetEncoder := codec.NewPomeloPacketEncoder()
+			serializer := json.NewSerializer()
+			messageEncoder := message.NewMessagesEncoder(false)
+			sessionPool := session.NewSessionPool()
+			ag := mustNewAgent(t, nil, nil, packetEncoder, serializer, 30*time.Second, 1, nil, messageEncoder, nil, sessionPool, Options{HeartbeatMin: table.min, HeartbeatMax: table.max}).(*agentImpl)
+			handshakeResponse := ag.handshakeResponse
 
-			mockConn.EXPECT().RemoteAddr().Return(mockAddr)
-			a := &agentImpl{conn: mockConn}
+			err := ag.NegotiateHeartbeatInterval(table.proposed)
+			assert.NoError(t, err)
+			assert.Equal(t, table.interval, ag.getHeartbeatTimeout())
 
-			assert.Equal(t, table.ipVersion, a.IPVersion())
+			if table.negotiated {
+				expected, err := encodeHandshakeResponse(table.interval, packetEncoder, false, serializer, handshakeNegotiation{})
+				assert.NoError(t, err)
+				assert.Equal(t, expected, ag.handshakeResponse)
+				assert.Len(t, ag.chHeartbeatReset, 1)
+			} else {
+				assert.Equal(t, handshakeResponse, ag.handshakeResponse)
+				assert.Len(t, ag.chHeartbeatReset, 0)
+			}
 		})
 	}
 }
+
+func TestAgentNegotiateDictionaryReference(t *testing.T) {
+	tables := []struct {
+		name       string
+		enabled    bool
+		referenced bool
+	}{
+		{"reference_disabled", false, false},
+		{"reference_enabled", true, true},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			packetEncoder := codec.NewPomeloPacketEncoder()
+			serializer := json.NewSerializer()
+			sessionPool := session.NewSessionPool()
+			ag := mustNewAgent(t, nil, nil, packetEncoder, serializer, 30*time.Second, 1, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{HeartbeatMax: time.Minute, DictionaryReference: table.enabled}).(*agentImpl)
+
+			assert.NoError(t, ag.NegotiateDictionaryReference())
+			// the heartbeat negotiation keeps the dictionary reference
+			assert.NoError(t, ag.NegotiateHeartbeatInterval(time.Minute))
+
+			packets, err := codec.NewPomeloPacketDecoder().Decode(ag.handshakeResponse)
+			assert.NoError(t, err)
+			assert.Len(t, packets, 1)
+			var response struct {
+				Sys struct {
+					Heartbeat float64           `json:"heartbeat"`
+					Dict      map[string]uint16 `json:"dict"`
+					DictHash  string            `json:"dictHash"`
+				} `json:"sys"`
+			}
+			assert.NoError(t, gojson.Unmarshal(packets[0].Data, &response))
+			assert.Equal(t, float64(60), response.Sys.Heartbeat)
+			if table.referenced {
+				assert.Nil(t, response.Sys.Dict)
+				assert.Equal(t, message.GetDictionaryHash(), response.Sys.DictHash)
+			} else {
+				assert.NotNil(t, response.Sys.Dict)
+				assert.Empty(t, response.Sys.DictHash)
+			}
+		})
+	}
+}
+
+func TestAgentNegotiateCompression(t *testing.T) {
+	tables := []struct {
+		name        string
+		threshold   int
+		algorithms  []string
+		compression string
+	}{
+		{"compression_disabled", 0, []string{"zlib"}, ""},
+		{"unsupported_algorithm", 16, []string{"gzip"}, ""},
+		{"negotiated", 16, []string{"gzip", "zlib"}, "zlib"},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			packetEncoder := codec.NewPomeloPacketEncoder()
+			packetDecoder := codec.NewPomeloPacketDecoder()
+			sessionPool := session.NewSessionPool()
+			ag := mustNewAgent(t, nil, nil, packetEncoder, json.NewSerializer(), 30*time.Second, 1, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{CompressionThreshold: table.threshold}).(*agentImpl)
+
+			assert.NoError(t, ag.NegotiateCompression(table.algorithms))
+			assert.Equal(t, table.compression != "", ag.Capabilities().Compression)
+
+			packets, err := packetDecoder.Decode(ag.handshakeResponse)
+			assert.NoError(t, err)
+			var response struct {
+				Sys struct {
+					Compression string `json:"compression"`
+				} `json:"sys"`
+			}
+			assert.NoError(t, gojson.Unmarshal(packets[0].Data, &response))
+			assert.Equal(t, table.compression, response.Sys.Compression)
+
+			// only the message data over the threshold is compressed
+			for _, data := range [][]byte{[]byte("small"), []byte(strings.Repeat("compressible", 10))} {
+				p, err := ag.packetEncodeMessage(&message.Message{Type: message.Push, Route: "route", Data: data})
+				assert.NoError(t, err)
+				packets, err := packetDecoder.Decode(p)
+				assert.NoError(t, err)
+				compressed := packets[0].Data[0]&0x10 != 0 // gzip flag
+				assert.Equal(t, table.compression != "" && len(data) >= table.threshold, compressed)
+
+				m, err := message.Decode(packets[0].Data)
+				assert.NoError(t, err)
+				assert.Equal(t, data, m.Data)
+			}
+		})
+	}
+}
+
+func TestAgentNegotiateTimestampedHeartbeat(t *testing.T) {
+	packetDecoder := codec.NewPomeloPacketDecoder()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), 30*time.Second, 1, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+	assert.False(t, ag.Capabilities().TimestampedHeartbeat)
+
+	assert.NoError(t, ag.NegotiateTimestampedHeartbeat())
+	assert.True(t, ag.Capabilities().TimestampedHeartbeat)
+
+	packets, err := packetDecoder.Decode(ag.handshakeResponse)
+	assert.NoError(t, err)
+	var response struct {
+		Sys struct {
+			TimestampedHeartbeat bool `json:"timestampedHeartbeat"`
+		} `json:"sys"`
+	}
+	assert.NoError(t, gojson.Unmarshal(packets[0].Data, &response))
+	assert.True(t, response.Sys.TimestampedHeartbeat)
+
+	before := time.Since(heartbeatEpoch)
+	data, err := ag.timestampedHeartbeatData()
+	assert.NoError(t, err)
+	packets, err = packetDecoder.Decode(data)
+	assert.NoError(t, err)
+	assert.Len(t, packets, 1)
+	assert.Equal(t, packet.Type(packet.Heartbeat), packets[0].Type)
+	assert.Len(t, packets[0].Data, heartbeatStampSize)
+	assert.True(t, time.Duration(binary.BigEndian.Uint64(packets[0].Data)) >= before)
+}
+
+func TestAgentSetAffinityToken(t *testing.T) {
+	packetDecoder := codec.NewPomeloPacketDecoder()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), 30*time.Second, 1, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+	assert.NoError(t, ag.NegotiateTimestampedHeartbeat())
+
+	assert.NoError(t, ag.SetAffinityToken("token"))
+
+	packets, err := packetDecoder.Decode(ag.handshakeResponse)
+	assert.NoError(t, err)
+	var response struct {
+		Sys struct {
+			AffinityToken        string `json:"affinityToken"`
+			TimestampedHeartbeat bool   `json:"timestampedHeartbeat"`
+		} `json:"sys"`
+	}
+	assert.NoError(t, gojson.Unmarshal(packets[0].Data, &response))
+	assert.Equal(t, "token", response.Sys.AffinityToken)
+	assert.True(t, response.Sys.TimestampedHeartbeat)
+}
+
+func TestAgentHandleHeartbeatEcho(t *testing.T) {
+	stamp := func(sent time.Duration) []byte {
+		data := make([]byte, heartbeatStampSize)
+		binary.BigEndian.PutUint64(data, uint64(sent))
+		return data
+	}
+	sent := time.Since(heartbeatEpoch) - 50*time.Millisecond
+
+	tables := []struct {
+		name       string
+		negotiated bool
+		data       []byte
+		measured   bool
+	}{
+		{"not_negotiated", false, stamp(sent), false},
+		{"echo", true, stamp(sent), true},
+		{"not_a_stamp", true, []byte("hbd"), false},
+		{"stamp_from_the_future", true, stamp(time.Since(heartbeatEpoch) + time.Hour), false},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ag := &agentImpl{logger: logger.Log}
+			if table.negotiated {
+				ag.heartbeatStamped = 1
+			}
+
+			ag.HandleHeartbeatEcho(table.data)
+			if table.measured {
+				assert.True(t, ag.RTT() >= 50*time.Millisecond)
+				assert.True(t, ag.RTT() < time.Second)
+			} else {
+				assert.Equal(t, time.Duration(0), ag.RTT())
+			}
+		})
+	}
+}
+
+func TestAgentRTT(t *testing.T) {
+	ag := &agentImpl{logger: logger.Log}
+	assert.Equal(t, time.Duration(0), ag.RTT())
+
+	ag.SetRTT(50 * time.Millisecond)
+	ag.SetRTT(time.Second)
+	assert.Equal(t, time.Second, ag.RTT())
+
+	ag.SetRTT(0)
+	assert.Equal(t, time.Second, ag.RTT())
+}
+
+func TestAgentWriteStampsHeartbeats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), 10*time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+	assert.NoError(t, ag.NegotiateTimestampedHeartbeat())
+
+	written := make(chan []byte, 1)
+	mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(func(d []byte) (int, error) {
+		written <- d
+		return len(d), nil
+	})
+
+	go ag.write()
+	atomic.AddInt64(&ag.pendingWrites, 1)
+	ag.chSend <- pendingWrite{data: ag.getHeartbeatData(), heartbeat: true}
+
+	select {
+	case data := <-written:
+		packets, err := codec.NewPomeloPacketDecoder().Decode(data)
+		assert.NoError(t, err)
+		assert.Len(t, packets, 1)
+		assert.Equal(t, packet.Type(packet.Heartbeat), packets[0].Type)
+		assert.Len(t, packets[0].Data, heartbeatStampSize)
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat was not written")
+	}
+
+	mockConn.EXPECT().Close()
+	ag.Close()
+}
+
+// legacyPacketEncoder frames the packets with a leading marker byte
+type legacyPacketEncoder struct {
+	codec.PacketEncoder
+}
+
+func (e *legacyPacketEncoder) Encode(typ packet.Type, data []byte) ([]byte, error) {
+	p, err := e.PacketEncoder.Encode(typ, data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{0xff}, p...), nil
+}
+
+func TestAgentSetPacketEncoder(t *testing.T) {
+	packetDecoder := codec.NewPomeloPacketDecoder()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), 30*time.Second, 1, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	assert.NoError(t, ag.SetPacketEncoder(&legacyPacketEncoder{codec.NewPomeloPacketEncoder()}))
+
+	p, err := ag.packetEncodeMessage(&message.Message{Type: message.Push, Route: "route", Data: []byte("data")})
+	assert.NoError(t, err)
+	for _, data := range [][]byte{ag.handshakeResponse, ag.getHeartbeatData(), p} {
+		assert.Equal(t, byte(0xff), data[0])
+		packets, err := packetDecoder.Decode(data[1:])
+		assert.NoError(t, err)
+		assert.Len(t, packets, 1)
+	}
+}
+
+func TestAgentHeartbeatUsesNegotiatedInterval(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	mockConn.EXPECT().Close().MaxTimes(1)
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), 10*time.Second, 1, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{HeartbeatMax: time.Second}).(*agentImpl)
+	defer ag.Close()
+
+	go ag.heartbeat()
+	err := ag.NegotiateHeartbeatInterval(200 * time.Millisecond)
+	assert.NoError(t, err)
+
+	pWrite := receivePendingWrite(t, ag, 500*time.Millisecond)
+	assert.Equal(t, pendingWrite{data: ag.heartbeatData, heartbeat: true}, pWrite)
+}
+
+func TestAgentHeartbeatExitsIfConnError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockMessageEncoder := messagemocks.NewMockEncoder(ctrl)
+	mockMessageEncoder.EXPECT().IsCompressionEnabled().AnyTimes()
+	mockSerializer.EXPECT().GetName()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 1*time.Second, 1, nil, mockMessageEncoder, nil, sessionPool, Options{}).(*agentImpl)
+	assert.NotNil(t, ag)
+
+	mockConn.EXPECT().RemoteAddr().MaxTimes(1)
+	mockConn.EXPECT().Close().MaxTimes(1)
+
+	die := false
+	go func() {
+		for {
+			select {
+			case <-ag.chDie:
+				die = true
+			}
+		}
+	}()
+
+	go ag.heartbeat()
+	for i := 0; i < 2; i++ {
+		pWrite := receivePendingWrite(t, ag, 1100*time.Millisecond)
+		assert.Equal(t, pendingWrite{data: ag.heartbeatData, heartbeat: true}, pWrite)
+	}
+
+	helpers.ShouldEventuallyReturn(t, func() bool { return die }, true, 500*time.Millisecond, 2*time.Second)
+}
+
+func TestAgentHeartbeatExitsOnStopHeartbeat(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	messageEncoder := message.NewMessagesEncoder(false)
+
+	mockConn.EXPECT().RemoteAddr().MaxTimes(1)
+	mockConn.EXPECT().Close().MaxTimes(1)
+
+	mockSerializer.EXPECT().GetName()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 1*time.Second, 1, nil, messageEncoder, nil, sessionPool, Options{}).(*agentImpl)
+	assert.NotNil(t, ag)
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		ag.Close()
+	}()
+
+	ag.heartbeat()
+}
+
+func TestAgentWriteChSend(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	messageEncoder := message.NewMessagesEncoder(false)
+	mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+	mockMetricsReporters := []metrics.Reporter{mockMetricsReporter}
+	ag := &agentImpl{ // avoid heartbeat and handshake to fully test serialize
+		conn:             mockConn,
+		chSend:           make(chan pendingWrite, 1),
+		encoder:          mockEncoder,
+		heartbeatTimeout: time.Second,
+		lastAt:           time.Now().Unix(),
+		logger:           logger.Log,
+		serializer:       mockSerializer,
+		messageEncoder:   messageEncoder,
+		metricsReporters: mockMetricsReporters,
+	}
+	ctx := getCtxWithRequestKeys()
+	mockMetricsReporters[0].(*metricsmocks.MockReporter).EXPECT().ReportSummary(metrics.ResponseTime, gomock.Any(), gomock.Any())
+
+	expectedPacket := []byte("final")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mockConn.EXPECT().Write(expectedPacket).Do(func(b []byte) {
+		wg.Done()
+	})
+	go ag.write()
+	ag.chSend <- pendingWrite{ctx: ctx, data: expectedPacket, err: nil}
+	wg.Wait()
+}
+
+func TestAgentFlush(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	// nothing queued
+	assert.NoError(t, ag.Flush(context.Background()))
+
+	// queued but not written yet
+	err := ag.Push("route", []byte("data"))
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, ag.Flush(ctx))
+
+	mockConn.EXPECT().Write(gomock.Any()).Return(0, nil)
+	go ag.write()
+	assert.NoError(t, ag.Flush(context.Background()))
+	assert.EqualValues(t, 0, atomic.LoadInt64(&ag.pendingWrites))
+}
+
+func TestAgentHandle(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	messageEncoder := message.NewMessagesEncoder(false)
+	mockSerializer.EXPECT().GetName()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 1*time.Second, 1, nil, messageEncoder, nil, sessionPool, Options{}).(*agentImpl)
+	assert.NotNil(t, ag)
+
+	go ag.Handle()
+	expectedBytes := []byte("bla")
+
+	// Sends two heartbeats and then times out
+	mockConn.EXPECT().Write(ag.heartbeatData).Return(0, nil).Times(2)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	closed := false
+	go func() {
+		for {
+			select {
+			case <-ag.chDie:
+				closed = true
+			}
+		}
+	}()
+
+	mockConn.EXPECT().Write(expectedBytes).Return(0, nil).Do(func(d []byte) {
+		wg.Done()
+	})
+
+	// ag.Close on method exit
+	mockConn.EXPECT().RemoteAddr().MaxTimes(1)
+	mockConn.EXPECT().Close().MaxTimes(1)
+
+	ag.chSend <- pendingWrite{ctx: nil, data: expectedBytes, err: nil}
+
+	wg.Wait()
+	helpers.ShouldEventuallyReturn(t, func() bool { return closed }, true, 50*time.Millisecond, 5*time.Second)
+}
+
+func TestAgentWriteWatchdog(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	messageEncoder := message.NewMessagesEncoder(false)
+	mockSerializer.EXPECT().GetName()
+	sessionPool := session.NewSessionPool()
+	writeTimeout := 100 * time.Millisecond
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 10*time.Second, 1, nil, messageEncoder, nil, sessionPool, Options{WriteTimeout: writeTimeout}).(*agentImpl)
+	assert.NotNil(t, ag)
+
+	// the client stopped reading and the deadline does not apply, e.g. the
+	// write is throttled, so the write blocks until the conn is closed
+	mockConn.EXPECT().SetWriteDeadline(gomock.Any()).AnyTimes()
+	unblock := make(chan struct{})
+	writeStartedAt := make(chan time.Time, 1)
+	mockConn.EXPECT().Write([]byte("bla")).DoAndReturn(func(d []byte) (int, error) {
+		writeStartedAt <- time.Now()
+		<-unblock
+		return 0, errors.New("use of closed network connection")
+	})
+	var closedAt time.Time
+	mockConn.EXPECT().Close().DoAndReturn(func() error {
+		closedAt = time.Now()
+		close(unblock)
+		return nil
+	})
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+
+	go ag.Handle()
+	ag.chSend <- pendingWrite{ctx: nil, data: []byte("bla"), err: nil}
+
+	select {
+	case <-unblock:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog did not close the conn")
+	}
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+	assert.True(t, closedAt.Sub(<-writeStartedAt) >= writeTimeout)
+	helpers.ShouldEventuallyReturn(t, func() int64 { return atomic.LoadInt64(&ag.writeStartedAt) }, int64(0))
+}
+
+func TestAgentWriteWatchdogHandshake(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	messageEncoder := message.NewMessagesEncoder(false)
+	mockSerializer.EXPECT().GetName()
+	sessionPool := session.NewSessionPool()
+	// shorter than the minimum watchdog interval
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 10*time.Second, 1, nil, messageEncoder, nil, sessionPool, Options{WriteTimeout: time.Nanosecond}).(*agentImpl)
+	assert.NotNil(t, ag)
+
+	mockConn.EXPECT().SetWriteDeadline(gomock.Any()).AnyTimes()
+	unblock := make(chan struct{})
+	mockConn.EXPECT().Write(ag.handshakeResponse).DoAndReturn(func(d []byte) (int, error) {
+		<-unblock
+		return 0, errors.New("use of closed network connection")
+	})
+	mockConn.EXPECT().Close().DoAndReturn(func() error {
+		close(unblock)
+		return nil
+	})
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+
+	go ag.Handle()
+	assert.Error(t, ag.SendHandshakeResponse())
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+	assert.EqualValues(t, 0, atomic.LoadInt64(&ag.writeStartedAt))
+}
+
+func TestAgentWriteDeadline(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	messageEncoder := message.NewMessagesEncoder(false)
+	mockSerializer.EXPECT().GetName()
+	sessionPool := session.NewSessionPool()
+	writeTimeout := time.Minute
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 10*time.Second, 1, nil, messageEncoder, nil, sessionPool, Options{WriteTimeout: writeTimeout}).(*agentImpl)
+	assert.NotNil(t, ag)
+
+	var deadline time.Time
+	setAt := time.Now()
+	gomock.InOrder(
+		mockConn.EXPECT().SetWriteDeadline(gomock.Any()).Do(func(t time.Time) { deadline = t }),
+		mockConn.EXPECT().Write([]byte("bla")).Return(0, timeoutError{}),
+	)
+	mockConn.EXPECT().Close()
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+
+	go ag.write()
+	ag.chSend <- pendingWrite{ctx: nil, data: []byte("bla"), err: nil}
+
+	helpers.ShouldEventuallyReturn(t, func() int32 { return ag.GetStatus() }, constants.StatusClosed)
+	assert.False(t, deadline.Before(setAt.Add(writeTimeout)))
+	assert.Equal(t, session.DisconnectReasonWriteTimeout, ag.DisconnectReason().Server)
+}
+
+func TestAgentGrantCredit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName()
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, nil, nil, mockEncoder, mockSerializer, time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	// flow control is disabled until the client grants credit
+	for i := 0; i < 5; i++ {
+		assert.True(t, ag.consumeCredit())
+	}
+
+	ag.GrantCredit(0)
+	ag.GrantCredit(-1)
+	assert.True(t, ag.consumeCredit())
+
+	ag.GrantCredit(2)
+	ag.GrantCredit(1)
+	assert.EqualValues(t, 3, atomic.LoadInt64(&ag.credit))
+	for i := 0; i < 3; i++ {
+		assert.True(t, ag.consumeCredit())
+	}
+	assert.False(t, ag.consumeCredit())
+	assert.EqualValues(t, 0, atomic.LoadInt64(&ag.credit))
+
+	// credit saturates instead of overflowing
+	ag.GrantCredit(math.MaxInt64)
+	ag.GrantCredit(math.MaxInt64)
+	assert.EqualValues(t, int64(math.MaxInt64), atomic.LoadInt64(&ag.credit))
+}
+
+func TestAgentWriteClosesOnCreditTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName()
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockEncoder.EXPECT().Encode(packet.Type(packet.Data), gomock.Any()).Return([]byte("data"), nil).AnyTimes()
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 10*time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{CreditTimeout: 50 * time.Millisecond}).(*agentImpl)
+
+	closed := make(chan struct{})
+	mockConn.EXPECT().Write([]byte("data")).Return(4, nil)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	mockConn.EXPECT().Close().Do(func() { close(closed) })
+
+	ag.GrantCredit(1)
+	go ag.write()
+
+	for i := 0; i < 2; i++ {
+		err := ag.Push("route", []byte("data"))
+		assert.NoError(t, err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("agent was not closed after the credit timeout")
+	}
+	assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestAgentWriteRetriesTransientHeartbeatErrors(t *testing.T) {
+	type heartbeatWrite struct {
+		n   int
+		err error
+	}
+	eagain := &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EAGAIN)}
+	epipe := &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}
+	tables := []struct {
+		name   string
+		retry  bool
+		writes []heartbeatWrite
+		closed bool
+	}{
+		{"transient_then_ok", true, []heartbeatWrite{{0, eagain}, {1, nil}, {0, eagain}, {1, nil}}, false},
+		{"timeout_then_ok", true, []heartbeatWrite{{0, timeoutError{}}, {1, nil}}, false},
+		{"transient_then_fatal", true, []heartbeatWrite{{0, eagain}, {0, epipe}}, true},
+		{"transient_twice", true, []heartbeatWrite{{0, eagain}, {0, eagain}}, true},
+		{"partially_written", true, []heartbeatWrite{{1, eagain}}, true},
+		{"fatal", true, []heartbeatWrite{{0, epipe}}, true},
+		{"retry_disabled", false, []heartbeatWrite{{0, eagain}}, true},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockSerializer := serializemocks.NewMockSerializer(ctrl)
+			mockSerializer.EXPECT().GetName()
+			mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+			heartbeatAndHandshakeMocks(mockEncoder)
+			mockConn := mocks.NewMockPlayerConn(ctrl)
+			sessionPool := session.NewSessionPool()
+			ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 10*time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{HeartbeatRetry: table.retry}).(*agentImpl)
+
+			var calls []*gomock.Call
+			for _, w := range table.writes {
+				calls = append(calls, mockConn.EXPECT().Write(ag.heartbeatData).Return(w.n, w.err))
+			}
+			gomock.InOrder(calls...)
+			closed := make(chan struct{})
+			mockConn.EXPECT().Close().Do(func() { close(closed) })
+
+			go ag.write()
+			for range table.writes {
+				atomic.AddInt64(&ag.pendingWrites, 1)
+				ag.chSend <- pendingWrite{data: ag.heartbeatData, heartbeat: true}
+			}
+
+			if table.closed {
+				select {
+				case <-closed:
+				case <-time.After(time.Second):
+					t.Fatal("agent was not closed after the heartbeat write error")
+				}
+				assert.Equal(t, constants.StatusClosed, ag.GetStatus())
+				return
+			}
+			helpers.ShouldEventuallyReturn(t, func() int64 {
+				return atomic.LoadInt64(&ag.pendingWrites)
+			}, int64(0))
+			assert.NotEqual(t, constants.StatusClosed, ag.GetStatus())
+			ag.Close()
+		})
+	}
+}
+
+func TestAgentWritePausesWithoutCredit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName()
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockEncoder.EXPECT().Encode(packet.Type(packet.Data), gomock.Any()).Return([]byte("data"), nil).AnyTimes()
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, mockEncoder, mockSerializer, 10*time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	written := make(chan struct{}, 10)
+	mockConn.EXPECT().Write([]byte("data")).DoAndReturn(func(d []byte) (int, error) {
+		written <- struct{}{}
+		return len(d), nil
+	}).Times(3)
+	mockConn.EXPECT().RemoteAddr().AnyTimes()
+	mockConn.EXPECT().Close()
+
+	ag.GrantCredit(2)
+	go ag.Handle()
+	defer ag.Close()
+
+	for i := 0; i < 3; i++ {
+		err := ag.Push("route", []byte("data"))
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-written:
+		case <-time.After(time.Second):
+			t.Fatal("message with credit was not written")
+		}
+	}
+
+	// no credit left, the third message must wait
+	select {
+	case <-written:
+		t.Fatal("message was written without credit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ag.GrantCredit(1)
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("message was not written after credit was granted")
+	}
+}
+
+func TestNatsRPCServerReportMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	heartbeatAndHandshakeMocks(mockEncoder)
+	mockDecoder := codecmocks.NewMockPacketDecoder(ctrl)
+	dieChan := make(chan bool)
+	hbTime := time.Second
+	messageEncoder := message.NewMessagesEncoder(false)
+	mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+	mockMetricsReporters := []metrics.Reporter{mockMetricsReporter}
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockMetricsReporter.EXPECT().ReportGauge(metrics.ConnectedClients, gomock.Any(), gomock.Any())
+	mockSerializer.EXPECT().GetName()
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, mockDecoder, mockEncoder, mockSerializer, hbTime, 10, dieChan, messageEncoder, mockMetricsReporters, sessionPool, Options{}).(*agentImpl)
+	assert.NotNil(t, ag)
+
+	ag.messagesBufferSize = 0
+
+	ag.chSend <- pendingWrite{}
+
+	mockMetricsReporter.EXPECT().ReportGauge(metrics.ChannelCapacity, gomock.Any(), float64(-1)) // because buffersize is 0 and chan sz is 1
+	ag.reportChannelSize()
+}
+
+type customMockAddr struct{ network, str string }
+
+func (m *customMockAddr) Network() string { return m.network }
+func (m *customMockAddr) String() string  { return m.str }
+
+func TestIPVersion(t *testing.T) {
+	tables := []struct {
+		addr      string
+		ipVersion string
+	}{
+		{"127.0.0.1:80", constants.IPv4},
+		{"1.2.3.4:3333", constants.IPv4},
+		{"::1:3333", constants.IPv6},
+		{"2001:db8:0000:1:1:1:1:1:3333", constants.IPv6},
+	}
+
+	for _, table := range tables {
+		t.Run("test_"+table.addr, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mockConn := mocks.NewMockPlayerConn(ctrl)
+			mockAddr := &customMockAddr{str: table.addr}
+
+			mockConn.EXPECT().RemoteAddr().Return(mockAddr)
+			a := &agentImpl{conn: mockConn}
+
+			assert.Equal(t, table.ipVersion, a.IPVersion())
+		})
+	}
+}
+
+func TestAgentFactoryCreateAgentSerializer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	defaultSerializer := serializemocks.NewMockSerializer(ctrl)
+	defaultSerializer.EXPECT().GetName().Return("default").AnyTimes()
+	overrideSerializer := serializemocks.NewMockSerializer(ctrl)
+	overrideSerializer.EXPECT().GetName().Return("override").AnyTimes()
+
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	mockEncoder.EXPECT().Encode(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(typ packet.Type, d []byte) ([]byte, error) {
+			return d, nil
+		}).AnyTimes()
+
+	factory := NewAgentFactory(nil, nil, mockEncoder, defaultSerializer, time.Second, message.NewMessagesEncoder(false), 0, session.NewSessionPool(), nil)
+
+	a, err := factory.CreateAgent(nil)
+	assert.NoError(t, err)
+	defaultAgent := a.(*agentImpl)
+	assert.Equal(t, defaultSerializer, defaultAgent.GetSerializer())
+	assert.Contains(t, string(defaultAgent.handshakeResponse), `"serializer":"default"`)
+
+	a, err = factory.(SerializerAgentFactory).CreateAgentWithSerializer(nil, overrideSerializer)
+	assert.NoError(t, err)
+	overrideAgent := a.(*agentImpl)
+	assert.Equal(t, overrideSerializer, overrideAgent.GetSerializer())
+	assert.Contains(t, string(overrideAgent.handshakeResponse), `"serializer":"override"`)
+}
+
+func TestAgentFactoryCreateAgentWithHeartbeat(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	mockEncoder.EXPECT().Encode(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(typ packet.Type, d []byte) ([]byte, error) {
+			return d, nil
+		}).AnyTimes()
+
+	factory := NewAgentFactory(nil, nil, mockEncoder, json.NewSerializer(), time.Second, message.NewMessagesEncoder(false), 0, session.NewSessionPool(), nil)
+
+	a, err := factory.(HeartbeatAgentFactory).CreateAgentWithHeartbeat(nil, nil, time.Minute)
+	assert.NoError(t, err)
+	slowAgent := a.(*agentImpl)
+	assert.Equal(t, time.Minute, slowAgent.heartbeatTimeout)
+	assert.Contains(t, string(slowAgent.handshakeResponse), `"heartbeat":60`)
+
+	// 0 keeps the factory interval
+	a, err = factory.(HeartbeatAgentFactory).CreateAgentWithHeartbeat(nil, nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, a.(*agentImpl).heartbeatTimeout)
+}
+
+func TestAgentFactoryForEachAgent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	factory := NewAgentFactory(nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, message.NewMessagesEncoder(false), 0, session.NewSessionPool(), nil)
+
+	var conns []*mocks.MockPlayerConn
+	var agents []Agent
+	for i := 0; i < 2; i++ {
+		mockConn := mocks.NewMockPlayerConn(ctrl)
+		a, err := factory.CreateAgent(mockConn)
+		assert.NoError(t, err)
+		conns = append(conns, mockConn)
+		agents = append(agents, a)
+	}
+
+	live := func() []Agent {
+		var live []Agent
+		factory.(AgentIterator).ForEachAgent(func(a Agent) {
+			live = append(live, a)
+		})
+		return live
+	}
+	assert.ElementsMatch(t, agents, live())
+
+	conns[0].EXPECT().Close()
+	assert.NoError(t, agents[0].Close())
+	assert.Equal(t, []Agent{agents[1]}, live())
+}
+
+func TestAgentFactoryCreateAgentFailure(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName().Return("json").AnyTimes()
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	encodeErr := errors.New("encode failed")
+	mockEncoder.EXPECT().Encode(gomock.Any(), gomock.Any()).Return(nil, encodeErr)
+
+	dieChan := make(chan bool, 1)
+	sessionPool := session.NewSessionPool()
+	factory := NewAgentFactory(dieChan, nil, mockEncoder, mockSerializer, time.Second, message.NewMessagesEncoder(false), 0, sessionPool, nil)
+
+	a, err := factory.CreateAgent(nil)
+	assert.Equal(t, encodeErr, err)
+	assert.Nil(t, a)
+	// no session is created for the agent and the app is told to die
+	assert.Equal(t, int64(0), sessionPool.GetSessionCount())
+	helpers.ShouldEventuallyReceive(t, dieChan)
+}
+
+func TestEncodeHandshakeInvalidData(t *testing.T) {
+	tables := []struct {
+		name string
+		sys  map[string]interface{}
+		err  error
+	}{
+		{"valid", map[string]interface{}{"dict": map[string]uint16{"route": 1}, "rate": 0.5}, nil},
+		{"nan", map[string]interface{}{"rate": math.NaN()}, constants.ErrInvalidHandshakeData},
+		{"infinite", map[string]interface{}{"rate": float32(math.Inf(1))}, constants.ErrInvalidHandshakeData},
+		{"nested_nan", map[string]interface{}{"limits": map[string]interface{}{"rate": math.NaN()}}, constants.ErrInvalidHandshakeData},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			data, err := encodeHandshake(time.Second, table.sys, codec.NewPomeloPacketEncoder(), false, json.NewSerializer())
+			assert.Equal(t, table.err, err)
+			if table.err == nil {
+				assert.NotEmpty(t, data)
+			} else {
+				assert.Nil(t, data)
+			}
+		})
+	}
+}
+
+func TestAgentFactoryCreateAgentTraceSampling(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName().Return("json").AnyTimes()
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	mockEncoder.EXPECT().Encode(gomock.Any(), gomock.Any()).AnyTimes()
+
+	tables := []struct {
+		name    string
+		sampler tracing.ConnectionSampler
+		sampled bool
+		decided bool
+	}{
+		{"no_sampler", nil, false, false},
+		{"sampled", tracing.NewProbabilisticConnectionSampler(1), true, true},
+		{"not_sampled", tracing.NewProbabilisticConnectionSampler(0), false, true},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			factory := NewAgentFactoryWithOptions(nil, nil, mockEncoder, mockSerializer, time.Second, message.NewMessagesEncoder(false), 0, session.NewSessionPool(), nil, Options{TraceSampler: table.sampler})
+			a, err := factory.CreateAgent(nil)
+			assert.NoError(t, err)
+
+			sampled, decided := a.GetTraceSampled()
+			assert.Equal(t, table.sampled, sampled)
+			assert.Equal(t, table.decided, decided)
+		})
+	}
+}
+
+func TestAgentSetTraceSampled(t *testing.T) {
+	a := &agentImpl{}
+
+	_, decided := a.GetTraceSampled()
+	assert.False(t, decided)
+
+	a.SetTraceSampled(true)
+	sampled, decided := a.GetTraceSampled()
+	assert.True(t, sampled)
+	assert.True(t, decided)
+
+	a.SetTraceSampled(false)
+	sampled, decided = a.GetTraceSampled()
+	assert.False(t, sampled)
+	assert.True(t, decided)
+}
+
+func TestAgentSessionSerializerName(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockEncoder := codecmocks.NewMockPacketEncoder(ctrl)
+	mockEncoder.EXPECT().Encode(gomock.Any(), gomock.Any()).AnyTimes()
+
+	tables := []struct {
+		name       string
+		serializer serialize.Serializer
+	}{
+		{"json", json.NewSerializer()},
+		{"protobuf", protobuf.NewSerializer()},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ag := mustNewAgent(t, nil, nil, mockEncoder, table.serializer, time.Second, 1, nil, message.NewMessagesEncoder(false), nil, session.NewSessionPool(), Options{})
+			assert.Equal(t, table.name, ag.GetSession().SerializerName())
+		})
+	}
+}
+
+func TestAgentLogsCarryConnectionFields(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	l, hook := logrustest.NewNullLogger()
+	l.Level = logrus.DebugLevel
+	defaultLogger := logger.Log
+	logger.SetLogger(logruswrapper.NewWithLogger(l))
+	defer logger.SetLogger(defaultLogger)
+
+	mockConn := mocks.NewMockPlayerConn(ctrl)
+	mockConn.EXPECT().RemoteAddr().Return(&customMockAddr{str: "127.0.0.1:3250"})
+	sessionPool := session.NewSessionPool()
+	ag := mustNewAgent(t, mockConn, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+	other := mustNewAgent(t, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, sessionPool, Options{}).(*agentImpl)
+
+	err := ag.Push("route", []byte("data"))
+	assert.NoError(t, err)
+	entry := hook.LastEntry()
+	assert.NotNil(t, entry)
+	connID := entry.Data["connectionId"]
+	assert.NotEmpty(t, connID)
+	assert.Equal(t, ag.Session.ID(), entry.Data["sessionId"])
+	// the remote address is only bound once the handshake is read, as a
+	// PROXY protocol conn reports the address of the proxy until then
+	assert.NotContains(t, entry.Data, "remoteAddr")
+
+	ag.SetStatus(constants.StatusHandshake)
+	err = ag.Push("route", []byte("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:3250", hook.LastEntry().Data["remoteAddr"])
+
+	err = ag.ResponseMID(context.Background(), 1, []byte("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, connID, hook.LastEntry().Data["connectionId"])
+
+	err = other.Push("route", []byte("data"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, connID, hook.LastEntry().Data["connectionId"])
+	assert.NotContains(t, hook.LastEntry().Data, "remoteAddr")
+}
+
+func TestAgentLoggerFields(t *testing.T) {
+	l, hook := logrustest.NewNullLogger()
+	l.Level = logrus.DebugLevel
+	base := logruswrapper.NewWithLogger(l).WithField("region", "eu")
+	ag := mustNewAgent(t, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 10, nil, message.NewMessagesEncoder(false), nil, session.NewSessionPool(), Options{Logger: base}).(*agentImpl)
+
+	assert.NoError(t, ag.Push("route", []byte("data")))
+	entry := hook.LastEntry()
+	assert.NotNil(t, entry)
+	assert.Equal(t, "eu", entry.Data["region"])
+	assert.Equal(t, ag.Session.ID(), entry.Data["sessionId"])
+	assert.NotContains(t, entry.Data, "tenant")
+
+	ag.AddLogFields(map[string]interface{}{"tenant": "acme"})
+	assert.NoError(t, ag.Push("route", []byte("data")))
+	entry = hook.LastEntry()
+	assert.Equal(t, "eu", entry.Data["region"])
+	assert.Equal(t, "acme", entry.Data["tenant"])
+	assert.Equal(t, ag.Session.ID(), entry.Data["sessionId"])
+
+	ag.Logger().Info("from the app")
+	assert.Equal(t, "acme", hook.LastEntry().Data["tenant"])
+}
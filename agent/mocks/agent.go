@@ -7,11 +7,18 @@ package mocks
 import (
 	context "context"
 	gomock "github.com/golang/mock/gomock"
+	acceptor "github.com/topfreegames/pitaya/v2/acceptor"
 	agent "github.com/topfreegames/pitaya/v2/agent"
+	codec "github.com/topfreegames/pitaya/v2/conn/codec"
+	interfaces "github.com/topfreegames/pitaya/v2/logger/interfaces"
+	networkentity "github.com/topfreegames/pitaya/v2/networkentity"
 	protos "github.com/topfreegames/pitaya/v2/protos"
+	serialize "github.com/topfreegames/pitaya/v2/serialize"
 	session "github.com/topfreegames/pitaya/v2/session"
+	io "io"
 	net "net"
 	reflect "reflect"
+	time "time"
 )
 
 // MockAgent is a mock of Agent interface
@@ -37,6 +44,32 @@ func (m *MockAgent) EXPECT() *MockAgentMockRecorder {
 	return m.recorder
 }
 
+// AddLogFields mocks base method
+func (m *MockAgent) AddLogFields(arg0 map[string]interface{}) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "AddLogFields", arg0)
+}
+
+// AddLogFields indicates an expected call of AddLogFields
+func (mr *MockAgentMockRecorder) AddLogFields(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddLogFields", reflect.TypeOf((*MockAgent)(nil).AddLogFields), arg0)
+}
+
+// AllowPacket mocks base method
+func (m *MockAgent) AllowPacket() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AllowPacket")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AllowPacket indicates an expected call of AllowPacket
+func (mr *MockAgentMockRecorder) AllowPacket() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AllowPacket", reflect.TypeOf((*MockAgent)(nil).AllowPacket))
+}
+
 // AnswerWithError mocks base method
 func (m *MockAgent) AnswerWithError(arg0 context.Context, arg1 uint, arg2 error) {
 	m.ctrl.T.Helper()
@@ -49,6 +82,20 @@ func (mr *MockAgentMockRecorder) AnswerWithError(arg0, arg1, arg2 interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AnswerWithError", reflect.TypeOf((*MockAgent)(nil).AnswerWithError), arg0, arg1, arg2)
 }
 
+// Capabilities mocks base method
+func (m *MockAgent) Capabilities() session.Capabilities {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Capabilities")
+	ret0, _ := ret[0].(session.Capabilities)
+	return ret0
+}
+
+// Capabilities indicates an expected call of Capabilities
+func (mr *MockAgentMockRecorder) Capabilities() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Capabilities", reflect.TypeOf((*MockAgent)(nil).Capabilities))
+}
+
 // Close mocks base method
 func (m *MockAgent) Close() error {
 	m.ctrl.T.Helper()
@@ -63,6 +110,104 @@ func (mr *MockAgentMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockAgent)(nil).Close))
 }
 
+// CloseGraceful mocks base method
+func (m *MockAgent) CloseGraceful(arg0 time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CloseGraceful", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CloseGraceful indicates an expected call of CloseGraceful
+func (mr *MockAgentMockRecorder) CloseGraceful(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseGraceful", reflect.TypeOf((*MockAgent)(nil).CloseGraceful), arg0)
+}
+
+// CompareAndSetStatus mocks base method
+func (m *MockAgent) CompareAndSetStatus(arg0, arg1 int32) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompareAndSetStatus", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// CompareAndSetStatus indicates an expected call of CompareAndSetStatus
+func (mr *MockAgentMockRecorder) CompareAndSetStatus(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompareAndSetStatus", reflect.TypeOf((*MockAgent)(nil).CompareAndSetStatus), arg0, arg1)
+}
+
+// Conn mocks base method
+func (m *MockAgent) Conn() net.Conn {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Conn")
+	ret0, _ := ret[0].(net.Conn)
+	return ret0
+}
+
+// Conn indicates an expected call of Conn
+func (mr *MockAgentMockRecorder) Conn() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Conn", reflect.TypeOf((*MockAgent)(nil).Conn))
+}
+
+// ConnectionQuality mocks base method
+func (m *MockAgent) ConnectionQuality() agent.ConnectionQuality {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConnectionQuality")
+	ret0, _ := ret[0].(agent.ConnectionQuality)
+	return ret0
+}
+
+// ConnectionQuality indicates an expected call of ConnectionQuality
+func (mr *MockAgentMockRecorder) ConnectionQuality() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConnectionQuality", reflect.TypeOf((*MockAgent)(nil).ConnectionQuality))
+}
+
+// DisconnectReason mocks base method
+func (m *MockAgent) DisconnectReason() session.DisconnectReason {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DisconnectReason")
+	ret0, _ := ret[0].(session.DisconnectReason)
+	return ret0
+}
+
+// DisconnectReason indicates an expected call of DisconnectReason
+func (mr *MockAgentMockRecorder) DisconnectReason() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DisconnectReason", reflect.TypeOf((*MockAgent)(nil).DisconnectReason))
+}
+
+// Flush mocks base method
+func (m *MockAgent) Flush(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Flush", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Flush indicates an expected call of Flush
+func (mr *MockAgentMockRecorder) Flush(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Flush", reflect.TypeOf((*MockAgent)(nil).Flush), arg0)
+}
+
+// GetSerializer mocks base method
+func (m *MockAgent) GetSerializer() serialize.Serializer {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSerializer")
+	ret0, _ := ret[0].(serialize.Serializer)
+	return ret0
+}
+
+// GetSerializer indicates an expected call of GetSerializer
+func (mr *MockAgentMockRecorder) GetSerializer() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSerializer", reflect.TypeOf((*MockAgent)(nil).GetSerializer))
+}
+
 // GetSession mocks base method
 func (m *MockAgent) GetSession() session.Session {
 	m.ctrl.T.Helper()
@@ -91,6 +236,33 @@ func (mr *MockAgentMockRecorder) GetStatus() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStatus", reflect.TypeOf((*MockAgent)(nil).GetStatus))
 }
 
+// GetTraceSampled mocks base method
+func (m *MockAgent) GetTraceSampled() (bool, bool) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTraceSampled")
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// GetTraceSampled indicates an expected call of GetTraceSampled
+func (mr *MockAgentMockRecorder) GetTraceSampled() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTraceSampled", reflect.TypeOf((*MockAgent)(nil).GetTraceSampled))
+}
+
+// GrantCredit mocks base method
+func (m *MockAgent) GrantCredit(arg0 int64) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "GrantCredit", arg0)
+}
+
+// GrantCredit indicates an expected call of GrantCredit
+func (mr *MockAgentMockRecorder) GrantCredit(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GrantCredit", reflect.TypeOf((*MockAgent)(nil).GrantCredit), arg0)
+}
+
 // Handle mocks base method
 func (m *MockAgent) Handle() {
 	m.ctrl.T.Helper()
@@ -103,6 +275,30 @@ func (mr *MockAgentMockRecorder) Handle() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Handle", reflect.TypeOf((*MockAgent)(nil).Handle))
 }
 
+// HandleHeartbeatEcho mocks base method
+func (m *MockAgent) HandleHeartbeatEcho(arg0 []byte) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "HandleHeartbeatEcho", arg0)
+}
+
+// HandleHeartbeatEcho indicates an expected call of HandleHeartbeatEcho
+func (mr *MockAgentMockRecorder) HandleHeartbeatEcho(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleHeartbeatEcho", reflect.TypeOf((*MockAgent)(nil).HandleHeartbeatEcho), arg0)
+}
+
+// HandshakeCompleted mocks base method
+func (m *MockAgent) HandshakeCompleted() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "HandshakeCompleted")
+}
+
+// HandshakeCompleted indicates an expected call of HandshakeCompleted
+func (mr *MockAgentMockRecorder) HandshakeCompleted() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandshakeCompleted", reflect.TypeOf((*MockAgent)(nil).HandshakeCompleted))
+}
+
 // IPVersion mocks base method
 func (m *MockAgent) IPVersion() string {
 	m.ctrl.T.Helper()
@@ -131,6 +327,90 @@ func (mr *MockAgentMockRecorder) Kick(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Kick", reflect.TypeOf((*MockAgent)(nil).Kick), arg0)
 }
 
+// KickWithReason mocks base method
+func (m *MockAgent) KickWithReason(arg0 context.Context, arg1 interface{}) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "KickWithReason", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// KickWithReason indicates an expected call of KickWithReason
+func (mr *MockAgentMockRecorder) KickWithReason(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "KickWithReason", reflect.TypeOf((*MockAgent)(nil).KickWithReason), arg0, arg1)
+}
+
+// Logger mocks base method
+func (m *MockAgent) Logger() interfaces.Logger {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Logger")
+	ret0, _ := ret[0].(interfaces.Logger)
+	return ret0
+}
+
+// Logger indicates an expected call of Logger
+func (mr *MockAgentMockRecorder) Logger() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Logger", reflect.TypeOf((*MockAgent)(nil).Logger))
+}
+
+// NegotiateCompression mocks base method
+func (m *MockAgent) NegotiateCompression(arg0 []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NegotiateCompression", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// NegotiateCompression indicates an expected call of NegotiateCompression
+func (mr *MockAgentMockRecorder) NegotiateCompression(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NegotiateCompression", reflect.TypeOf((*MockAgent)(nil).NegotiateCompression), arg0)
+}
+
+// NegotiateDictionaryReference mocks base method
+func (m *MockAgent) NegotiateDictionaryReference() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NegotiateDictionaryReference")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// NegotiateDictionaryReference indicates an expected call of NegotiateDictionaryReference
+func (mr *MockAgentMockRecorder) NegotiateDictionaryReference() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NegotiateDictionaryReference", reflect.TypeOf((*MockAgent)(nil).NegotiateDictionaryReference))
+}
+
+// NegotiateHeartbeatInterval mocks base method
+func (m *MockAgent) NegotiateHeartbeatInterval(arg0 time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NegotiateHeartbeatInterval", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// NegotiateHeartbeatInterval indicates an expected call of NegotiateHeartbeatInterval
+func (mr *MockAgentMockRecorder) NegotiateHeartbeatInterval(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NegotiateHeartbeatInterval", reflect.TypeOf((*MockAgent)(nil).NegotiateHeartbeatInterval), arg0)
+}
+
+// NegotiateTimestampedHeartbeat mocks base method
+func (m *MockAgent) NegotiateTimestampedHeartbeat() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NegotiateTimestampedHeartbeat")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// NegotiateTimestampedHeartbeat indicates an expected call of NegotiateTimestampedHeartbeat
+func (mr *MockAgentMockRecorder) NegotiateTimestampedHeartbeat() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NegotiateTimestampedHeartbeat", reflect.TypeOf((*MockAgent)(nil).NegotiateTimestampedHeartbeat))
+}
+
 // Push mocks base method
 func (m *MockAgent) Push(arg0 string, arg1 interface{}) error {
 	m.ctrl.T.Helper()
@@ -145,6 +425,62 @@ func (mr *MockAgentMockRecorder) Push(arg0, arg1 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Push", reflect.TypeOf((*MockAgent)(nil).Push), arg0, arg1)
 }
 
+// PushWith mocks base method
+func (m *MockAgent) PushWith(arg0 context.Context, arg1 serialize.Serializer, arg2 string, arg3 interface{}) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PushWith", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PushWith indicates an expected call of PushWith
+func (mr *MockAgentMockRecorder) PushWith(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushWith", reflect.TypeOf((*MockAgent)(nil).PushWith), arg0, arg1, arg2, arg3)
+}
+
+// PushWithContext mocks base method
+func (m *MockAgent) PushWithContext(arg0 context.Context, arg1 string, arg2 interface{}) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PushWithContext", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PushWithContext indicates an expected call of PushWithContext
+func (mr *MockAgentMockRecorder) PushWithContext(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushWithContext", reflect.TypeOf((*MockAgent)(nil).PushWithContext), arg0, arg1, arg2)
+}
+
+// RTT mocks base method
+func (m *MockAgent) RTT() time.Duration {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RTT")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// RTT indicates an expected call of RTT
+func (mr *MockAgentMockRecorder) RTT() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RTT", reflect.TypeOf((*MockAgent)(nil).RTT))
+}
+
+// Reconnect mocks base method
+func (m *MockAgent) Reconnect(arg0 net.Conn) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Reconnect", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Reconnect indicates an expected call of Reconnect
+func (mr *MockAgentMockRecorder) Reconnect(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reconnect", reflect.TypeOf((*MockAgent)(nil).Reconnect), arg0)
+}
+
 // RemoteAddr mocks base method
 func (m *MockAgent) RemoteAddr() net.Addr {
 	m.ctrl.T.Helper()
@@ -178,6 +514,20 @@ func (mr *MockAgentMockRecorder) ResponseMID(arg0, arg1, arg2 interface{}, arg3
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResponseMID", reflect.TypeOf((*MockAgent)(nil).ResponseMID), varargs...)
 }
 
+// SendHandshakeMaintenanceResponse mocks base method
+func (m *MockAgent) SendHandshakeMaintenanceResponse(arg0 time.Duration, arg1 map[string]interface{}) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendHandshakeMaintenanceResponse", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SendHandshakeMaintenanceResponse indicates an expected call of SendHandshakeMaintenanceResponse
+func (mr *MockAgentMockRecorder) SendHandshakeMaintenanceResponse(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendHandshakeMaintenanceResponse", reflect.TypeOf((*MockAgent)(nil).SendHandshakeMaintenanceResponse), arg0, arg1)
+}
+
 // SendHandshakeResponse mocks base method
 func (m *MockAgent) SendHandshakeResponse() error {
 	m.ctrl.T.Helper()
@@ -192,6 +542,20 @@ func (mr *MockAgentMockRecorder) SendHandshakeResponse() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendHandshakeResponse", reflect.TypeOf((*MockAgent)(nil).SendHandshakeResponse))
 }
 
+// SendHandshakeRetryResponse mocks base method
+func (m *MockAgent) SendHandshakeRetryResponse(arg0 time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendHandshakeRetryResponse", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SendHandshakeRetryResponse indicates an expected call of SendHandshakeRetryResponse
+func (mr *MockAgentMockRecorder) SendHandshakeRetryResponse(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendHandshakeRetryResponse", reflect.TypeOf((*MockAgent)(nil).SendHandshakeRetryResponse), arg0)
+}
+
 // SendRequest mocks base method
 func (m *MockAgent) SendRequest(arg0 context.Context, arg1, arg2 string, arg3 interface{}) (*protos.Response, error) {
 	m.ctrl.T.Helper()
@@ -207,6 +571,56 @@ func (mr *MockAgentMockRecorder) SendRequest(arg0, arg1, arg2, arg3 interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendRequest", reflect.TypeOf((*MockAgent)(nil).SendRequest), arg0, arg1, arg2, arg3)
 }
 
+// SetAffinityToken mocks base method
+func (m *MockAgent) SetAffinityToken(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetAffinityToken", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetAffinityToken indicates an expected call of SetAffinityToken
+func (mr *MockAgentMockRecorder) SetAffinityToken(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetAffinityToken", reflect.TypeOf((*MockAgent)(nil).SetAffinityToken), arg0)
+}
+
+// SetBackgrounded mocks base method
+func (m *MockAgent) SetBackgrounded() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetBackgrounded")
+}
+
+// SetBackgrounded indicates an expected call of SetBackgrounded
+func (mr *MockAgentMockRecorder) SetBackgrounded() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBackgrounded", reflect.TypeOf((*MockAgent)(nil).SetBackgrounded))
+}
+
+// SetClientCloseReason mocks base method
+func (m *MockAgent) SetClientCloseReason(arg0 string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetClientCloseReason", arg0)
+}
+
+// SetClientCloseReason indicates an expected call of SetClientCloseReason
+func (mr *MockAgentMockRecorder) SetClientCloseReason(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetClientCloseReason", reflect.TypeOf((*MockAgent)(nil).SetClientCloseReason), arg0)
+}
+
+// SetCloseReason mocks base method
+func (m *MockAgent) SetCloseReason(arg0 string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetCloseReason", arg0)
+}
+
+// SetCloseReason indicates an expected call of SetCloseReason
+func (mr *MockAgentMockRecorder) SetCloseReason(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCloseReason", reflect.TypeOf((*MockAgent)(nil).SetCloseReason), arg0)
+}
+
 // SetLastAt mocks base method
 func (m *MockAgent) SetLastAt() {
 	m.ctrl.T.Helper()
@@ -219,6 +633,68 @@ func (mr *MockAgentMockRecorder) SetLastAt() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetLastAt", reflect.TypeOf((*MockAgent)(nil).SetLastAt))
 }
 
+// SetMirror mocks base method
+func (m *MockAgent) SetMirror(arg0 io.Writer) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetMirror", arg0)
+}
+
+// SetMirror indicates an expected call of SetMirror
+func (mr *MockAgentMockRecorder) SetMirror(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMirror", reflect.TypeOf((*MockAgent)(nil).SetMirror), arg0)
+}
+
+// SetPacketEncoder mocks base method
+func (m *MockAgent) SetPacketEncoder(arg0 codec.PacketEncoder) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetPacketEncoder", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetPacketEncoder indicates an expected call of SetPacketEncoder
+func (mr *MockAgentMockRecorder) SetPacketEncoder(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPacketEncoder", reflect.TypeOf((*MockAgent)(nil).SetPacketEncoder), arg0)
+}
+
+// SetPacketRateLimit mocks base method
+func (m *MockAgent) SetPacketRateLimit(arg0 acceptor.PacketRateLimit) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetPacketRateLimit", arg0)
+}
+
+// SetPacketRateLimit indicates an expected call of SetPacketRateLimit
+func (mr *MockAgentMockRecorder) SetPacketRateLimit(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPacketRateLimit", reflect.TypeOf((*MockAgent)(nil).SetPacketRateLimit), arg0)
+}
+
+// SetPacketWriteInterceptor mocks base method
+func (m *MockAgent) SetPacketWriteInterceptor(arg0 agent.PacketWriteInterceptor) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetPacketWriteInterceptor", arg0)
+}
+
+// SetPacketWriteInterceptor indicates an expected call of SetPacketWriteInterceptor
+func (mr *MockAgentMockRecorder) SetPacketWriteInterceptor(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPacketWriteInterceptor", reflect.TypeOf((*MockAgent)(nil).SetPacketWriteInterceptor), arg0)
+}
+
+// SetRTT mocks base method
+func (m *MockAgent) SetRTT(arg0 time.Duration) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetRTT", arg0)
+}
+
+// SetRTT indicates an expected call of SetRTT
+func (mr *MockAgentMockRecorder) SetRTT(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRTT", reflect.TypeOf((*MockAgent)(nil).SetRTT), arg0)
+}
+
 // SetStatus mocks base method
 func (m *MockAgent) SetStatus(arg0 int32) {
 	m.ctrl.T.Helper()
@@ -231,6 +707,32 @@ func (mr *MockAgentMockRecorder) SetStatus(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetStatus", reflect.TypeOf((*MockAgent)(nil).SetStatus), arg0)
 }
 
+// SetTraceSampled mocks base method
+func (m *MockAgent) SetTraceSampled(arg0 bool) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetTraceSampled", arg0)
+}
+
+// SetTraceSampled indicates an expected call of SetTraceSampled
+func (mr *MockAgentMockRecorder) SetTraceSampled(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTraceSampled", reflect.TypeOf((*MockAgent)(nil).SetTraceSampled), arg0)
+}
+
+// Snapshot mocks base method
+func (m *MockAgent) Snapshot() networkentity.Snapshot {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Snapshot")
+	ret0, _ := ret[0].(networkentity.Snapshot)
+	return ret0
+}
+
+// Snapshot indicates an expected call of Snapshot
+func (mr *MockAgentMockRecorder) Snapshot() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Snapshot", reflect.TypeOf((*MockAgent)(nil).Snapshot))
+}
+
 // String mocks base method
 func (m *MockAgent) String() string {
 	m.ctrl.T.Helper()
@@ -269,11 +771,12 @@ func (m *MockAgentFactory) EXPECT() *MockAgentFactoryMockRecorder {
 }
 
 // CreateAgent mocks base method
-func (m *MockAgentFactory) CreateAgent(arg0 net.Conn) agent.Agent {
+func (m *MockAgentFactory) CreateAgent(arg0 net.Conn) (agent.Agent, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "CreateAgent", arg0)
 	ret0, _ := ret[0].(agent.Agent)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // CreateAgent indicates an expected call of CreateAgent
@@ -0,0 +1,202 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package agent
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/errors"
+	"github.com/topfreegames/pitaya/v2/metrics"
+	"github.com/topfreegames/pitaya/v2/tracing"
+)
+
+// OverflowAction is what an agent does with a push when its queue of
+// messages to send is full
+type OverflowAction string
+
+const (
+	// OverflowActionBlock waits for room in the queue
+	OverflowActionBlock OverflowAction = "block"
+	// OverflowActionError refuses the push with constants.ErrBufferExceed
+	OverflowActionError OverflowAction = "error"
+	// OverflowActionDropOldest drops the queued push at the head to make
+	// room, waiting for room like block when the head is not a push
+	OverflowActionDropOldest OverflowAction = "dropoldest"
+)
+
+// OverflowPolicy controls what happens to a push when the queue of messages
+// to send to the client is full, the zero value blocks until there is room.
+// Responses, kicks and heartbeats always wait for room
+type OverflowPolicy struct {
+	Action OverflowAction
+	// Timeout is the max time a push waits for room with OverflowActionBlock
+	// before failing with constants.ErrBufferExceed, 0 waits forever
+	Timeout time.Duration
+}
+
+var (
+	// OverflowError refuses the pushes that don't fit in the queue
+	OverflowError = OverflowPolicy{Action: OverflowActionError}
+	// OverflowDropOldest drops the oldest queued pushes to queue the new ones
+	OverflowDropOldest = OverflowPolicy{Action: OverflowActionDropOldest}
+)
+
+// OverflowBlock waits up to timeout for room in the queue, 0 waits forever
+func OverflowBlock(timeout time.Duration) OverflowPolicy {
+	return OverflowPolicy{Action: OverflowActionBlock, Timeout: timeout}
+}
+
+// ParseOverflowPolicy returns the policy with the given action name, e.g.
+// from the configuration. timeout is only used by the block action
+func ParseOverflowPolicy(action string, timeout time.Duration) (OverflowPolicy, error) {
+	switch OverflowAction(strings.ToLower(action)) {
+	case "", OverflowActionBlock:
+		return OverflowBlock(timeout), nil
+	case OverflowActionError:
+		return OverflowError, nil
+	case OverflowActionDropOldest:
+		return OverflowDropOldest, nil
+	}
+	return OverflowPolicy{}, constants.ErrUnknownOverflowPolicy
+}
+
+type overflowPolicyKey struct{}
+
+// WithOverflowPolicy returns a copy of ctx making the pushes sent with it
+// follow policy instead of the agent one, e.g. to block on critical pushes
+// of an agent that drops the oldest ones
+func WithOverflowPolicy(ctx context.Context, policy OverflowPolicy) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, overflowPolicyKey{}, policy)
+}
+
+// overflowPolicyFromContext returns the policy set in ctx by
+// WithOverflowPolicy, nil if none
+func overflowPolicyFromContext(ctx context.Context) *OverflowPolicy {
+	if ctx == nil {
+		return nil
+	}
+	if policy, ok := ctx.Value(overflowPolicyKey{}).(OverflowPolicy); ok {
+		return &policy
+	}
+	return nil
+}
+
+// overflowPolicy returns the policy of a pending push
+func (a *agentImpl) overflowPolicy(pendingMsg pendingMessage) OverflowPolicy {
+	if pendingMsg.overflow != nil {
+		return *pendingMsg.overflow
+	}
+	return a.overflow
+}
+
+// enqueuePush queues the write of a push, following policy if chSend is full
+func (a *agentImpl) enqueuePush(policy OverflowPolicy, pWrite pendingWrite) error {
+	switch policy.Action {
+	case OverflowActionError:
+		select {
+		case a.chSend <- pWrite:
+			return nil
+		case <-a.chDie:
+			return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
+		default:
+			metrics.ReportDroppedPush(a.metricsReporters, string(OverflowActionError))
+			return constants.ErrBufferExceed
+		}
+	case OverflowActionDropOldest:
+		return a.enqueueDroppingOldest(pWrite)
+	}
+
+	var timeout <-chan time.Time
+	if policy.Timeout > 0 {
+		timer := time.NewTimer(policy.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case a.chSend <- pWrite:
+		return nil
+	case <-a.chDie:
+		return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
+	case <-timeout:
+		metrics.ReportDroppedPush(a.metricsReporters, string(OverflowActionBlock))
+		return constants.ErrBufferExceed
+	}
+}
+
+// enqueueDroppingOldest makes room in a full chSend by dropping the push at
+// its head. Other writes are never dropped nor moved, if the head is one of
+// them it waits for room like OverflowBlock
+func (a *agentImpl) enqueueDroppingOldest(pWrite pendingWrite) error {
+	for {
+		select {
+		case a.chSend <- pWrite:
+			return nil
+		case <-a.chDie:
+			return errors.NewError(constants.ErrAgentClosed, errors.ErrClientClosedRequest)
+		default:
+		}
+
+		if !a.dropHeadPush() {
+			return a.enqueuePush(OverflowBlock(0), pWrite)
+		}
+	}
+}
+
+// dropHeadPush drops the write at the head of chSend if it is a push, and
+// keeps it in sendHead for the write loop to write next otherwise. It returns
+// whether there may be room in chSend now
+func (a *agentImpl) dropHeadPush() bool {
+	a.sendMutex.Lock()
+	defer a.sendMutex.Unlock()
+	if a.writerWaiting {
+		// the write loop is about to take the head
+		return false
+	}
+	if a.sendHead == nil {
+		select {
+		case head := <-a.chSend:
+			a.sendHead = &head
+		default:
+			return true
+		}
+	}
+	if !a.sendHead.push {
+		return false
+	}
+	a.dropWrite(*a.sendHead)
+	a.sendHead = nil
+	return true
+}
+
+// dropWrite discards a write taken out of chSend
+func (a *agentImpl) dropWrite(pWrite pendingWrite) {
+	atomic.AddInt64(&a.pendingWrites, -1)
+	tracing.FinishSpan(pWrite.span, constants.ErrBufferExceed)
+	metrics.ReportDroppedPush(a.metricsReporters, string(OverflowActionDropOldest))
+	a.Logger().Debugf("Dropped a queued push of a full send buffer, UID=%s", a.sessionUID())
+}
@@ -0,0 +1,157 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/conn/codec"
+	"github.com/topfreegames/pitaya/v2/conn/message"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/metrics"
+	metricsmocks "github.com/topfreegames/pitaya/v2/metrics/mocks"
+	"github.com/topfreegames/pitaya/v2/serialize/json"
+	"github.com/topfreegames/pitaya/v2/session"
+)
+
+func newOverflowTestAgent(t *testing.T, policy OverflowPolicy) *agentImpl {
+	t.Helper()
+	return mustNewAgent(t, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), time.Second, 2, nil, message.NewMessagesEncoder(false), nil, session.NewSessionPool(), Options{Overflow: policy}).(*agentImpl)
+}
+
+func queuedRoutes(ag *agentImpl, routes ...string) []string {
+	queued := []string{}
+	for len(ag.chSend) > 0 {
+		pWrite := <-ag.chSend
+		for _, route := range routes {
+			if bytes.Contains(pWrite.data, []byte(route)) {
+				queued = append(queued, route)
+			}
+		}
+	}
+	return queued
+}
+
+func TestAgentPushOverflowPolicy(t *testing.T) {
+	tables := []struct {
+		name   string
+		policy OverflowPolicy
+		err    error
+		queued []string
+	}{
+		{"error", OverflowError, constants.ErrBufferExceed, []string{"r.a", "r.b"}},
+		{"drop_oldest", OverflowDropOldest, nil, []string{"r.b", "r.c"}},
+		{"block_timeout", OverflowBlock(10 * time.Millisecond), constants.ErrBufferExceed, []string{"r.a", "r.b"}},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ag := newOverflowTestAgent(t, table.policy)
+			mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+			mockMetricsReporter.EXPECT().ReportGauge(metrics.ChannelCapacity, gomock.Any(), gomock.Any()).AnyTimes()
+			mockMetricsReporter.EXPECT().ReportCount(metrics.DroppedPushes, map[string]string{"policy": string(table.policy.Action)}, float64(1))
+			ag.metricsReporters = []metrics.Reporter{mockMetricsReporter}
+			assert.NoError(t, ag.Push("r.a", []byte("data")))
+			assert.NoError(t, ag.Push("r.b", []byte("data")))
+
+			assert.Equal(t, table.err, ag.Push("r.c", []byte("data")))
+			assert.EqualValues(t, 2, atomic.LoadInt64(&ag.pendingWrites))
+			assert.Equal(t, table.queued, queuedRoutes(ag, "r.a", "r.b", "r.c"))
+		})
+	}
+}
+
+func TestAgentPushOverflowDropOldestKeepsOtherWrites(t *testing.T) {
+	ag := newOverflowTestAgent(t, OverflowDropOldest)
+	assert.NoError(t, ag.ResponseMID(context.Background(), 1, []byte("data")))
+	assert.NoError(t, ag.Push("r.a", []byte("data")))
+
+	// the response at the head is kept aside to be written first, neither
+	// dropped nor queued again, and r.b takes its slot
+	pushed := make(chan error)
+	go func() {
+		pushed <- ag.Push("r.b", []byte("data"))
+	}()
+	assert.NoError(t, <-pushed)
+	assert.NotNil(t, ag.sendHead)
+
+	pushed = make(chan error)
+	go func() {
+		pushed <- ag.Push("r.c", []byte("data"))
+	}()
+	// with a response at the head r.c waits for room like OverflowBlock
+	select {
+	case <-pushed:
+		t.Fatal("push did not wait for room")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// the write loop writes the response before the pushes queued after it
+	for _, route := range []string{"", "r.a"} {
+		pWrite, ok := ag.nextWrite()
+		assert.True(t, ok)
+		assert.Equal(t, route != "", pWrite.push)
+		assert.True(t, bytes.Contains(pWrite.data, []byte(route)))
+	}
+	assert.NoError(t, <-pushed)
+	assert.Equal(t, []string{"r.b", "r.c"}, queuedRoutes(ag, "r.a", "r.b", "r.c"))
+}
+
+func TestAgentPushOverflowPolicyFromContext(t *testing.T) {
+	ag := newOverflowTestAgent(t, OverflowDropOldest)
+	assert.NoError(t, ag.Push("r.a", []byte("data")))
+	assert.NoError(t, ag.Push("r.b", []byte("data")))
+
+	ctx := WithOverflowPolicy(context.Background(), OverflowError)
+	assert.Equal(t, constants.ErrBufferExceed, ag.PushWithContext(ctx, "r.c", []byte("data")))
+	assert.Equal(t, []string{"r.a", "r.b"}, queuedRoutes(ag, "r.a", "r.b", "r.c"))
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	tables := []struct {
+		action string
+		policy OverflowPolicy
+		err    error
+	}{
+		{"", OverflowBlock(time.Second), nil},
+		{"block", OverflowBlock(time.Second), nil},
+		{"error", OverflowError, nil},
+		{"DropOldest", OverflowDropOldest, nil},
+		{"drop", OverflowPolicy{}, constants.ErrUnknownOverflowPolicy},
+	}
+
+	for _, table := range tables {
+		t.Run(table.action, func(t *testing.T) {
+			policy, err := ParseOverflowPolicy(table.action, time.Second)
+			assert.Equal(t, table.err, err)
+			assert.Equal(t, table.policy, policy)
+		})
+	}
+}
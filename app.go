@@ -22,6 +22,7 @@ package pitaya
 
 import (
 	"context"
+	"io"
 	"os"
 	"os/signal"
 	"reflect"
@@ -33,6 +34,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/topfreegames/pitaya/v2/acceptor"
+	"github.com/topfreegames/pitaya/v2/agent"
 	"github.com/topfreegames/pitaya/v2/cluster"
 	"github.com/topfreegames/pitaya/v2/component"
 	"github.com/topfreegames/pitaya/v2/config"
@@ -47,14 +49,17 @@ import (
 	logging "github.com/topfreegames/pitaya/v2/logger/interfaces"
 	"github.com/topfreegames/pitaya/v2/metrics"
 	mods "github.com/topfreegames/pitaya/v2/modules"
+	"github.com/topfreegames/pitaya/v2/networkentity"
 	"github.com/topfreegames/pitaya/v2/remote"
 	"github.com/topfreegames/pitaya/v2/router"
 	"github.com/topfreegames/pitaya/v2/serialize"
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
 	"github.com/topfreegames/pitaya/v2/service"
 	"github.com/topfreegames/pitaya/v2/session"
 	"github.com/topfreegames/pitaya/v2/timer"
 	"github.com/topfreegames/pitaya/v2/tracing"
 	"github.com/topfreegames/pitaya/v2/worker"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 // ServerMode represents a server mode
@@ -82,8 +87,16 @@ type Pitaya interface {
 	GetSessionFromCtx(ctx context.Context) session.Session
 	Start()
 	SetDictionary(dict map[string]uint16) error
+	GetRouteUsage() []message.RouteUsage
 	AddRoute(serverType string, routingFunction router.RoutingFunc) error
 	Shutdown()
+	NotifyShutdown(eta time.Duration)
+	DumpSessions(w io.Writer) error
+	InvalidateResponseCache(route string, keys ...string)
+	SetReady()
+	HandlersInFlight() int64
+	AcceptorConnections() map[string]acceptor.ConnectionCounts
+	ForEachAgent(f func(a networkentity.NetworkEntity, snapshot networkentity.Snapshot))
 	StartWorker()
 	RegisterRPCJob(rpcJob worker.RPCJob) error
 	Documentation(getPtrNames bool) (map[string]interface{}, error)
@@ -353,7 +366,7 @@ func (app *App) listen() {
 		a := acc
 		go func() {
 			for conn := range a.GetConnChan() {
-				go app.handlerService.Handle(conn)
+				go app.handlerService.HandleWithAcceptor(conn, a)
 			}
 		}()
 
@@ -385,6 +398,12 @@ func (app *App) SetDictionary(dict map[string]uint16) error {
 	return message.SetDictionary(dict)
 }
 
+// GetRouteUsage returns the route dictionary along with how many messages
+// carried each route compressed with its dictionary code or as a full string
+func (app *App) GetRouteUsage() []message.RouteUsage {
+	return message.GetRouteUsage()
+}
+
 // AddRoute adds a routing function to a server type
 func (app *App) AddRoute(
 	serverType string,
@@ -410,6 +429,90 @@ func (app *App) Shutdown() {
 	}
 }
 
+// shutdownNotification is the message pushed to clients on NotifyShutdown,
+// eta is in milliseconds
+type shutdownNotification struct {
+	ETA int64 `json:"eta"`
+}
+
+// newShutdownNotification returns the shutdown notification for a client
+// using the given serializer, protobuf clients get a google.protobuf.Struct
+// since the serializer can only marshal proto messages
+func newShutdownNotification(serializerName string, eta time.Duration) interface{} {
+	if serializerName == protobuf.NewSerializer().GetName() {
+		return &structpb.Struct{Fields: map[string]*structpb.Value{
+			"eta": structpb.NewNumberValue(float64(eta.Milliseconds())),
+		}}
+	}
+	return &shutdownNotification{ETA: eta.Milliseconds()}
+}
+
+// NotifyShutdown pushes a shutdown notification with the given eta to all
+// sessions connected to this server and then shuts it down, after the
+// notifications are written to the clients or the eta has passed
+func (app *App) NotifyShutdown(eta time.Duration) {
+	app.sessionPool.ForEachSession(func(s session.Session) {
+		if err := s.Push(constants.ShutdownRoute, newShutdownNotification(s.SerializerName(), eta)); err != nil {
+			logger.Log.Errorf("Session push shutdown notification error, ID=%d, UID=%s, Error=%s",
+				s.ID(), s.UID(), err.Error())
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), eta)
+	defer cancel()
+	app.sessionPool.ForEachSession(func(s session.Session) {
+		if err := s.Flush(ctx); err != nil {
+			logger.Log.Warnf("Session shutdown notification not flushed, ID=%d, UID=%s, Error=%s",
+				s.ID(), s.UID(), err.Error())
+		}
+	})
+	app.Shutdown()
+}
+
+// DumpSessions writes a snapshot of the sessions of the server to w, one
+// JSON object per line with the session uid, data keys, status and last
+// activity, e.g. for post-incident analysis
+func (app *App) DumpSessions(w io.Writer) error {
+	return app.sessionPool.DumpSessions(w)
+}
+
+// InvalidateResponseCache drops the responses of route cached under keys, or
+// every response of route if no key is given, e.g. after the data it returns
+// changed. Routes are in the service.method format
+func (app *App) InvalidateResponseCache(route string, keys ...string) {
+	app.handlerService.InvalidateResponseCache(route, keys...)
+}
+
+// HandlersInFlight returns the number of handlers of every route executing
+// on the server, e.g. to build the load signal of the adaptive rate limiting
+// wrapper
+func (app *App) HandlersInFlight() int64 {
+	return app.handlerService.HandlersInFlight()
+}
+
+// AcceptorConnections returns the number of connections open right now and
+// accepted since the server started on each acceptor of the server, by
+// acceptor name, e.g. to find out which port is overloaded
+func (app *App) AcceptorConnections() map[string]acceptor.ConnectionCounts {
+	return app.handlerService.AcceptorConnections()
+}
+
+// ForEachAgent calls f for each client connected to the server, in no
+// particular order, with a snapshot of its connection, e.g. for admin
+// endpoints listing the connected clients. The client can be kicked or
+// disconnected through a
+func (app *App) ForEachAgent(f func(a networkentity.NetworkEntity, snapshot networkentity.Snapshot)) {
+	app.handlerService.ForEachAgent(func(a agent.Agent) {
+		f(a, a.Snapshot())
+	})
+}
+
+// SetReady signals that the server finished warming up, after it the routes
+// configured in pitaya.handler.warmup.routes stop being rejected
+func (app *App) SetReady() {
+	app.handlerService.SetReady()
+}
+
 // Error creates a new error with a code, message and metadata
 func Error(err error, code string, metadata ...map[string]string) *errors.Error {
 	return errors.NewError(err, code, metadata...)
@@ -425,6 +528,45 @@ func (app *App) GetSessionFromCtx(ctx context.Context) session.Session {
 	return sessionVal.(session.Session)
 }
 
+// GetProgressFromCtx retrieves the progress handle of the request being
+// handled from a given context. It is only available to requests handled
+// by frontend servers, returning nil otherwise
+func GetProgressFromCtx(ctx context.Context) *session.Progress {
+	progressVal := ctx.Value(constants.ProgressCtxKey)
+	if progressVal == nil {
+		return nil
+	}
+	return progressVal.(*session.Progress)
+}
+
+// GetIdempotencyStoreFromCtx retrieves the store used to detect the retries
+// of requests from a given context, nil if the app has none
+func GetIdempotencyStoreFromCtx(ctx context.Context) service.IdempotencyStore {
+	storeVal := ctx.Value(constants.IdempotencyStoreCtxKey)
+	if storeVal == nil {
+		return nil
+	}
+	return storeVal.(service.IdempotencyStore)
+}
+
+// IsDuplicateRequest records the idempotency key of the request being handled
+// in the idempotency store and returns whether it was already recorded, in
+// which case the request is a retry that must not be run again. Keys are
+// scoped by the uid of the session, requests without a key are never
+// duplicates
+func IsDuplicateRequest(ctx context.Context) (bool, error) {
+	key := pcontext.GetIdempotencyKey(ctx)
+	store := GetIdempotencyStoreFromCtx(ctx)
+	if key == "" || store == nil {
+		return false, nil
+	}
+	uid := ""
+	if s, ok := ctx.Value(constants.SessionCtxKey).(session.Session); ok && s != nil {
+		uid = s.UID()
+	}
+	return store.MarkSeen(ctx, uid+"/"+key)
+}
+
 // GetDefaultLoggerFromCtx returns the default logger from the given context
 func GetDefaultLoggerFromCtx(ctx context.Context) logging.Logger {
 	l := ctx.Value(constants.LoggerCtxKey)
@@ -455,6 +597,25 @@ func GetFromPropagateCtx(ctx context.Context, key string) interface{} {
 	return pcontext.GetFromPropagateCtx(ctx, key)
 }
 
+// IsDryRun returns whether the request being handled is a dry run, in which
+// case the handler must only validate it, without side effects
+func IsDryRun(ctx context.Context) bool {
+	return pcontext.IsDryRun(ctx)
+}
+
+// GetIdempotencyKey returns the idempotency key the client set on the request
+// being handled, empty if none was set
+func GetIdempotencyKey(ctx context.Context) string {
+	return pcontext.GetIdempotencyKey(ctx)
+}
+
+// GetConnectionQuality returns the quality of the connection of the client
+// that made the request being handled, so handlers can adapt to it, e.g. by
+// reducing the update rate for poor connections. It is empty if unknown
+func GetConnectionQuality(ctx context.Context) agent.ConnectionQuality {
+	return agent.ConnectionQuality(pcontext.GetConnectionQuality(ctx))
+}
+
 // ExtractSpan retrieves an opentracing span context from the given context
 // The span context can be received directly or via an RPC call
 func ExtractSpan(ctx context.Context) (opentracing.SpanContext, error) {
@@ -22,6 +22,7 @@ package pitaya
 
 import (
 	"context"
+	encjson "encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -38,16 +39,25 @@ import (
 	"github.com/topfreegames/pitaya/v2/acceptor"
 	"github.com/topfreegames/pitaya/v2/cluster"
 	"github.com/topfreegames/pitaya/v2/config"
+	"github.com/topfreegames/pitaya/v2/conn/codec"
 	"github.com/topfreegames/pitaya/v2/conn/message"
+	"github.com/topfreegames/pitaya/v2/conn/packet"
 	"github.com/topfreegames/pitaya/v2/constants"
 	e "github.com/topfreegames/pitaya/v2/errors"
 	"github.com/topfreegames/pitaya/v2/helpers"
 	"github.com/topfreegames/pitaya/v2/logger"
 	"github.com/topfreegames/pitaya/v2/logger/logrus"
+	acceptormocks "github.com/topfreegames/pitaya/v2/mocks"
 	"github.com/topfreegames/pitaya/v2/route"
 	"github.com/topfreegames/pitaya/v2/router"
+	"github.com/topfreegames/pitaya/v2/serialize"
+	"github.com/topfreegames/pitaya/v2/serialize/json"
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
+	"github.com/topfreegames/pitaya/v2/service"
+	"github.com/topfreegames/pitaya/v2/session"
 	"github.com/topfreegames/pitaya/v2/session/mocks"
 	"github.com/topfreegames/pitaya/v2/timer"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 var (
@@ -206,6 +216,109 @@ func TestShutdown(t *testing.T) {
 	<-app.dieChan
 }
 
+func TestNotifyShutdown(t *testing.T) {
+	tables := []struct {
+		name       string
+		serializer serialize.Serializer
+		decode     func(t *testing.T, data []byte) float64
+	}{
+		{"json", json.NewSerializer(), func(t *testing.T, data []byte) float64 {
+			notification := &shutdownNotification{}
+			assert.NoError(t, json.NewSerializer().Unmarshal(data, notification))
+			return float64(notification.ETA)
+		}},
+		{"protobuf", protobuf.NewSerializer(), func(t *testing.T, data []byte) float64 {
+			notification := &structpb.Struct{}
+			assert.NoError(t, protobuf.NewSerializer().Unmarshal(data, notification))
+			return notification.Fields["eta"].GetNumberValue()
+		}},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			builderConfig := config.NewDefaultBuilderConfig()
+			builder := NewDefaultBuilder(true, "testtype", Standalone, map[string]string{}, *builderConfig)
+			builder.Serializer = table.serializer
+			app := builder.Build().(*App)
+
+			written := make(chan []byte, 1)
+			closed := make(chan struct{})
+			mockConn := acceptormocks.NewMockPlayerConn(ctrl)
+			mockConn.EXPECT().RemoteAddr().Return(&net.TCPAddr{}).AnyTimes()
+			mockConn.EXPECT().GetNextMessage().DoAndReturn(func() ([]byte, error) {
+				<-closed
+				return nil, constants.ErrConnectionClosed
+			})
+			mockConn.EXPECT().Write(gomock.Any()).DoAndReturn(func(b []byte) (int, error) {
+				// the notification must be written before the server shuts down
+				select {
+				case <-app.dieChan:
+					t.Error("shutdown began before the notification was written")
+				default:
+				}
+				written <- b
+				return len(b), nil
+			})
+			mockConn.EXPECT().Close().Do(func() { close(closed) }).Return(nil)
+			go app.handlerService.Handle(mockConn)
+			helpers.ShouldEventuallyReturn(t, func() int64 {
+				return app.sessionPool.GetSessionCount()
+			}, int64(1))
+
+			app.NotifyShutdown(time.Second)
+			<-app.dieChan
+			app.sessionPool.CloseAll()
+
+			var data []byte
+			select {
+			case data = <-written:
+			default:
+				t.Fatal("shutdown notification was not written")
+			}
+			packets, err := codec.NewPomeloPacketDecoder().Decode(data)
+			assert.NoError(t, err)
+			assert.Len(t, packets, 1)
+			msg, err := message.Decode(packets[0].Data)
+			assert.NoError(t, err)
+			assert.Equal(t, constants.ShutdownRoute, msg.Route)
+			assert.Equal(t, float64(1000), table.decode(t, msg.Data))
+		})
+	}
+}
+
+func TestNotifyShutdownWaitsAtMostETA(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	builderConfig := config.NewDefaultBuilderConfig()
+	mockSessionPool := mocks.NewMockSessionPool(ctrl)
+	builder := NewDefaultBuilder(true, "testtype", Standalone, map[string]string{}, *builderConfig)
+	builder.SessionPool = mockSessionPool
+	app := builder.Build().(*App)
+
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().SerializerName().Return("json")
+	mockSession.EXPECT().Push(constants.ShutdownRoute, &shutdownNotification{ETA: 50}).Return(nil)
+	// a client that never reads must not hold the shutdown for longer than the eta
+	mockSession.EXPECT().Flush(gomock.Any()).DoAndReturn(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	mockSession.EXPECT().ID().Return(int64(1))
+	mockSession.EXPECT().UID().Return("uid")
+	mockSessionPool.EXPECT().ForEachSession(gomock.Any()).Do(func(f func(s session.Session)) {
+		f(mockSession)
+	}).Times(2)
+
+	start := time.Now()
+	app.NotifyShutdown(50 * time.Millisecond)
+	<-app.dieChan
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
 func TestConfigureDefaultMetricsReporter(t *testing.T) {
 	tables := []struct {
 		enabled bool
@@ -292,6 +405,65 @@ func TestStartAndListenStandalone(t *testing.T) {
 	}, nil, 10*time.Millisecond, 100*time.Millisecond)
 }
 
+func TestStartAndListenAcceptorSerializers(t *testing.T) {
+	builderConfig := config.NewDefaultBuilderConfig()
+
+	jsonAcc := acceptor.NewTCPAcceptor("0.0.0.0:0")
+	protobufAcc := acceptor.NewTCPAcceptor("0.0.0.0:0")
+	protobufAcc.SetSerializer(protobuf.NewSerializer())
+	builder := NewDefaultBuilder(true, "testtype", Standalone, map[string]string{}, *builderConfig)
+	builder.AddAcceptor(jsonAcc)
+	builder.AddAcceptor(protobufAcc)
+	app := builder.Build().(*App)
+
+	go func() {
+		app.Start()
+	}()
+	helpers.ShouldEventuallyReturn(t, func() bool {
+		return app.running
+	}, true)
+
+	tables := []struct {
+		name       string
+		acc        *acceptor.TCPAcceptor
+		serializer string
+	}{
+		{"app_serializer", jsonAcc, "json"},
+		{"acceptor_serializer", protobufAcc, "protobuf"},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			helpers.ShouldEventuallyReturn(t, func() bool {
+				return table.acc.GetAddr() != ""
+			}, true)
+			conn, err := net.Dial("tcp", table.acc.GetAddr())
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			handshake, err := codec.NewPomeloPacketEncoder().Encode(packet.Handshake, []byte(`{"sys":{"platform":"mac"}}`))
+			assert.NoError(t, err)
+			_, err = conn.Write(handshake)
+			assert.NoError(t, err)
+
+			buf := make([]byte, 4096)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(buf)
+			assert.NoError(t, err)
+			packets, err := codec.NewPomeloPacketDecoder().Decode(buf[:n])
+			assert.NoError(t, err)
+			assert.Len(t, packets, 1)
+
+			res := &struct {
+				Sys struct {
+					Serializer string `json:"serializer"`
+				} `json:"sys"`
+			}{}
+			assert.NoError(t, encjson.Unmarshal(packets[0].Data, res))
+			assert.Equal(t, table.serializer, res.Sys.Serializer)
+		})
+	}
+}
+
 func TestStartAndListenCluster(t *testing.T) {
 	es, cli := helpers.GetTestEtcd(t)
 	defer es.Terminate(t)
@@ -405,6 +577,37 @@ func TestGetFromPropagateCtx(t *testing.T) {
 	assert.Equal(t, "val", val)
 }
 
+func TestIsDuplicateRequest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mocks.NewMockSession(ctrl)
+	ss.EXPECT().UID().Return("uid").AnyTimes()
+	other := mocks.NewMockSession(ctrl)
+	other.EXPECT().UID().Return("other").AnyTimes()
+
+	store := service.NewMemoryIdempotencyStore(time.Minute)
+	ctx := context.WithValue(context.Background(), constants.IdempotencyStoreCtxKey, store)
+	ctx = AddToPropagateCtx(ctx, constants.IdempotencyKeyKey, "purchase-1")
+	assert.Equal(t, "purchase-1", GetIdempotencyKey(ctx))
+	assert.Equal(t, store, GetIdempotencyStoreFromCtx(ctx))
+
+	duplicate, err := IsDuplicateRequest(context.WithValue(ctx, constants.SessionCtxKey, ss))
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+
+	duplicate, err = IsDuplicateRequest(context.WithValue(ctx, constants.SessionCtxKey, ss))
+	assert.NoError(t, err)
+	assert.True(t, duplicate)
+
+	duplicate, err = IsDuplicateRequest(context.WithValue(ctx, constants.SessionCtxKey, other))
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+
+	duplicate, err = IsDuplicateRequest(context.WithValue(context.Background(), constants.IdempotencyStoreCtxKey, store))
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+	assert.Nil(t, GetIdempotencyStoreFromCtx(context.Background()))
+}
+
 func TestExtractSpan(t *testing.T) {
 	span := opentracing.StartSpan("op", opentracing.ChildOf(nil))
 	ctx := opentracing.ContextWithSpan(context.Background(), span)
@@ -1,6 +1,8 @@
 package pitaya
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/topfreegames/pitaya/v2/acceptor"
 	"github.com/topfreegames/pitaya/v2/agent"
@@ -19,29 +21,57 @@ import (
 	"github.com/topfreegames/pitaya/v2/serialize/json"
 	"github.com/topfreegames/pitaya/v2/service"
 	"github.com/topfreegames/pitaya/v2/session"
+	"github.com/topfreegames/pitaya/v2/tracing"
+	"github.com/topfreegames/pitaya/v2/util"
 	"github.com/topfreegames/pitaya/v2/worker"
 )
 
 // Builder holds dependency instances for a pitaya App
 type Builder struct {
-	acceptors        []acceptor.Acceptor
-	Config           config.BuilderConfig
-	DieChan          chan bool
-	PacketDecoder    codec.PacketDecoder
-	PacketEncoder    codec.PacketEncoder
-	MessageEncoder   *message.MessagesEncoder
-	Serializer       serialize.Serializer
-	Router           *router.Router
-	RPCClient        cluster.RPCClient
-	RPCServer        cluster.RPCServer
-	MetricsReporters []metrics.Reporter
-	Server           *cluster.Server
-	ServerMode       ServerMode
-	ServiceDiscovery cluster.ServiceDiscovery
-	Groups           groups.GroupService
-	SessionPool      session.SessionPool
-	Worker           *worker.Worker
-	HandlerHooks     *pipeline.HandlerHooks
+	acceptors         []acceptor.Acceptor
+	Config            config.BuilderConfig
+	DieChan           chan bool
+	PacketDecoder     codec.PacketDecoder
+	PacketEncoder     codec.PacketEncoder
+	MessageEncoder    *message.MessagesEncoder
+	Serializer        serialize.Serializer
+	Router            *router.Router
+	RPCClient         cluster.RPCClient
+	RPCServer         cluster.RPCServer
+	MetricsReporters  []metrics.Reporter
+	Server            *cluster.Server
+	ServerMode        ServerMode
+	ServiceDiscovery  cluster.ServiceDiscovery
+	Groups            groups.GroupService
+	SessionPool       session.SessionPool
+	Worker            *worker.Worker
+	HandlerHooks      *pipeline.HandlerHooks
+	ClientSerializers []serialize.Serializer
+	// ResponseCacheKeys holds the cache key functions of the routes cached
+	// with pitaya.handler.cache, by route
+	ResponseCacheKeys map[string]service.ResponseCacheKeyFunc
+	// AuditSink receives the audit records of the routes audited with
+	// pitaya.handler.audit.routes, no route is audited if it is nil
+	AuditSink service.AuditSink
+	// AuditSanitizers holds the functions returning the request payloads of
+	// the audited routes as they are recorded, by route. The payloads of the
+	// routes without one are not recorded
+	AuditSanitizers map[string]service.AuditSanitizer
+	// IdempotencyStore records the idempotency keys of the requests handled,
+	// if it is nil the keys are kept in memory for pitaya.handler.idempotency.ttl
+	IdempotencyStore service.IdempotencyStore
+	// ClientCodecs holds the packet codecs of the clients whose packet framing
+	// differs from the default one, by the protocol version they declare in
+	// the handshake
+	ClientCodecs map[string]service.PacketCodec
+	// SerializationErrorFormatter formats the payloads sent to the clients in
+	// place of the responses and pushes that failed to serialize, the error
+	// payload of util.GetErrorPayload is sent if it is nil
+	SerializationErrorFormatter agent.SerializationErrorFormatter
+	// PacketWriteInterceptor transforms the bytes of every packet written to
+	// the clients, e.g. to encrypt them, the packets are written as encoded if
+	// it is nil
+	PacketWriteInterceptor agent.PacketWriteInterceptor
 }
 
 // PitayaBuilder Builder interface
@@ -145,6 +175,12 @@ func NewBuilder(isFrontend bool,
 		metricsReporters = addDefaultStatsd(statsdConfig, metricsReporters, serverType)
 	}
 
+	if resilient := config.Pitaya.Metrics.Resilient; resilient.Enabled {
+		for i, reporter := range metricsReporters {
+			metricsReporters[i] = metrics.NewResilientReporter(reporter, resilient.BufferSize, resilient.ErrorLogInterval)
+		}
+	}
+
 	handlerHooks := pipeline.NewHandlerHooks()
 	if config.DefaultPipelines.StructValidation.Enabled {
 		configureDefaultPipelines(handlerHooks)
@@ -216,7 +252,25 @@ func (builder *Builder) AddAcceptor(ac acceptor.Acceptor) {
 
 // Build returns a valid App instance
 func (builder *Builder) Build() Pitaya {
+	sampleRates := map[string]int{}
+	for _, sampling := range builder.Config.Pitaya.Metrics.Sampling {
+		sampleRates[sampling.Route] = sampling.Rate
+	}
+	metrics.SetRouteSampleRates(sampleRates)
+
 	handlerPool := service.NewHandlerPool()
+	handlerPool.SetWarmupRoutes(builder.Config.Pitaya.Handler.Warmup.Routes)
+	handlerPool.SetMetricsReporters(builder.MetricsReporters)
+	auditedRoutes := map[string]service.AuditSanitizer{}
+	for _, r := range builder.Config.Pitaya.Handler.Audit.Routes {
+		auditedRoutes[r] = builder.AuditSanitizers[r]
+	}
+	handlerPool.SetAuditedRoutes(builder.AuditSink, auditedRoutes)
+	idempotencyStore := builder.IdempotencyStore
+	if idempotencyStore == nil {
+		idempotencyStore = service.NewMemoryIdempotencyStore(builder.Config.Pitaya.Handler.Idempotency.TTL)
+	}
+	handlerPool.SetIdempotencyStore(idempotencyStore)
 	var remoteService *service.RemoteService
 	if builder.ServerMode == Standalone {
 		if builder.ServiceDiscovery != nil || builder.RPCClient != nil || builder.RPCServer != nil {
@@ -243,10 +297,30 @@ func (builder *Builder) Build() Pitaya {
 			handlerPool,
 		)
 
+		for _, acc := range builder.acceptors {
+			if p, ok := acc.(acceptor.SerializerProvider); ok && p.GetSerializer() != nil {
+				remoteService.AddSerializer(p.GetSerializer())
+			}
+		}
+		for _, serializer := range builder.ClientSerializers {
+			remoteService.AddSerializer(serializer)
+		}
+
 		builder.RPCServer.SetPitayaServer(remoteService)
 	}
 
-	agentFactory := agent.NewAgentFactory(builder.DieChan,
+	var traceSampler tracing.ConnectionSampler
+	if builder.Config.Pitaya.Tracing.ConnectionSampling.Enabled {
+		traceSampler = tracing.NewProbabilisticConnectionSampler(builder.Config.Pitaya.Tracing.ConnectionSampling.Rate)
+	}
+
+	overflow := builder.Config.Pitaya.Buffer.Agent.Overflow
+	overflowPolicy, err := agent.ParseOverflowPolicy(overflow.Policy, overflow.Timeout)
+	if err != nil {
+		logger.Log.Fatalf("invalid agent overflow policy %q: %s", overflow.Policy, err.Error())
+	}
+
+	agentFactory := agent.NewAgentFactoryWithOptions(builder.DieChan,
 		builder.PacketDecoder,
 		builder.PacketEncoder,
 		builder.Serializer,
@@ -255,6 +329,25 @@ func (builder *Builder) Build() Pitaya {
 		builder.Config.Pitaya.Buffer.Agent.Messages,
 		builder.SessionPool,
 		builder.MetricsReporters,
+		agent.Options{
+			HeartbeatMin:                builder.Config.Pitaya.Heartbeat.MinInterval,
+			HeartbeatMax:                builder.Config.Pitaya.Heartbeat.MaxInterval,
+			HeartbeatRetry:              builder.Config.Pitaya.Heartbeat.RetryTransientWriteError,
+			BackgroundGrace:             builder.Config.Pitaya.Heartbeat.BackgroundGrace,
+			WriteTimeout:                builder.Config.Pitaya.Conn.WriteTimeout,
+			CreditTimeout:               builder.Config.Pitaya.Conn.CreditTimeout,
+			Compressibility:             builder.Config.Pitaya.Metrics.Compressibility.Rate,
+			TraceSampler:                traceSampler,
+			RPCClient:                   builder.RPCClient,
+			ServiceDiscovery:            builder.ServiceDiscovery,
+			RequestTimeout:              builder.Config.Pitaya.Conn.RequestTimeout,
+			DictionaryReference:         builder.Config.Pitaya.Conn.DictionaryReference,
+			CompressionThreshold:        builder.Config.Pitaya.Conn.CompressionThreshold,
+			KeepAlivePeriod:             builder.Config.Pitaya.Conn.KeepAlivePeriod,
+			SerializationErrorFormatter: builder.SerializationErrorFormatter,
+			Overflow:                    overflowPolicy,
+			PacketWriteInterceptor:      builder.PacketWriteInterceptor,
+		},
 	)
 
 	handlerService := service.NewHandlerService(
@@ -270,6 +363,50 @@ func (builder *Builder) Build() Pitaya {
 		handlerPool,
 	)
 
+	routeTimeouts := map[string]time.Duration{}
+	for _, timeout := range builder.Config.Pitaya.Handler.Timeouts {
+		routeTimeouts[timeout.Route] = timeout.Timeout
+	}
+	handlerService.SetRouteTimeouts(routeTimeouts)
+	routeQuotas := map[string]service.RouteQuota{}
+	for _, quota := range builder.Config.Pitaya.Handler.Quotas {
+		routeQuotas[quota.Route] = service.RouteQuota{Limit: quota.Limit, Window: quota.Window}
+	}
+	handlerService.SetRouteQuotas(builder.SessionPool, routeQuotas)
+	responseCaches := map[string]service.ResponseCache{}
+	for _, cache := range builder.Config.Pitaya.Handler.Cache {
+		responseCaches[cache.Route] = service.ResponseCache{TTL: cache.TTL, Key: builder.ResponseCacheKeys[cache.Route]}
+	}
+	handlerService.SetResponseCaches(responseCaches)
+	deprecations := map[string]string{}
+	for _, deprecation := range builder.Config.Pitaya.Handler.Deprecations {
+		deprecations[deprecation.Route] = deprecation.Message
+	}
+	handlerService.SetRouteDeprecations(deprecations)
+	handlerService.SetClientCodecs(builder.ClientCodecs)
+	handlerService.SetSoftCapacity(
+		builder.SessionPool,
+		builder.Config.Pitaya.Conn.SoftCapacity.Sessions,
+		builder.Config.Pitaya.Conn.SoftCapacity.RetryAfter,
+	)
+	maintenance := make([]service.MaintenanceWindow, 0, len(builder.Config.Pitaya.Conn.Maintenance.Windows))
+	for _, window := range builder.Config.Pitaya.Conn.Maintenance.Windows {
+		start, err := time.Parse(time.RFC3339, window.Start)
+		if err != nil {
+			logger.Log.Fatalf("invalid start of maintenance window: %s", err.Error())
+		}
+		end, err := time.Parse(time.RFC3339, window.End)
+		if err != nil {
+			logger.Log.Fatalf("invalid end of maintenance window: %s", err.Error())
+		}
+		maintenance = append(maintenance, service.MaintenanceWindow{Start: start, End: end, Message: window.Message})
+	}
+	handlerService.SetMaintenanceWindows(maintenance, builder.Config.Pitaya.Conn.Maintenance.Reject)
+	handlerService.SetAffinityTokens([]byte(builder.Config.Pitaya.Conn.Affinity.Key), builder.Config.Pitaya.Conn.Affinity.TTL)
+	if err := util.SetErrorPayloadFormat(util.ErrorPayloadFormat(builder.Config.Pitaya.Handler.Errors.Format)); err != nil {
+		logger.Log.Fatalf("invalid error payload format %q: %s", builder.Config.Pitaya.Handler.Errors.Format, err.Error())
+	}
+
 	return NewApp(
 		builder.ServerMode,
 		builder.Serializer,
@@ -289,6 +289,9 @@ func (c *Client) readPackets(buf *bytes.Buffer) ([]*packet.Packet, error) {
 	totalProcessed := 0
 	for _, p := range packets {
 		totalProcessed += codec.HeadLength + p.Length
+		if p.Flags != 0 {
+			totalProcessed += codec.FlagsLength
+		}
 	}
 	buf.Next(totalProcessed)
 
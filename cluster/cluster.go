@@ -22,6 +22,7 @@ package cluster
 
 import (
 	"context"
+	"time"
 
 	"github.com/topfreegames/pitaya/v2/conn/message"
 	"github.com/topfreegames/pitaya/v2/constants"
@@ -50,6 +51,14 @@ type RPCClient interface {
 	interfaces.Module
 }
 
+// PushBatcher is implemented by the RPC clients that can send the pushes to
+// the users connected to the same frontend server in a single RPC, it returns
+// the uids of the users whose push failed. Only the GRPCClient batches, the
+// NATSRPCClient sends each push in its own message
+type PushBatcher interface {
+	SendPushes(frontendSv *Server, pushes []*protos.Push) []string
+}
+
 // SDListener interface
 type SDListener interface {
 	AddServer(*Server)
@@ -77,6 +86,23 @@ const (
 	DEL
 )
 
+// getRequestTimeout returns the timeout to be used by a request made with ctx,
+// capping timeout at the remaining budget if ctx has a deadline
+func getRequestTimeout(ctx context.Context, timeout time.Duration) (time.Duration, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout, nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0, constants.ErrRequestDeadlineExceeded
+	}
+	if remaining < timeout {
+		return remaining, nil
+	}
+	return timeout, nil
+}
+
 func buildRequest(
 	ctx context.Context,
 	rpcType protos.RPCType,
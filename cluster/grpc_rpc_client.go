@@ -24,6 +24,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
@@ -40,6 +41,9 @@ import (
 	"github.com/topfreegames/pitaya/v2/session"
 	"github.com/topfreegames/pitaya/v2/tracing"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 )
 
 // GRPCClient rpc client struct
@@ -50,6 +54,7 @@ type GRPCClient struct {
 	infoRetriever    InfoRetriever
 	lazy             bool
 	metricsReporters []metrics.Reporter
+	poolSize         int
 	reqTimeout       time.Duration
 	server           *Server
 }
@@ -71,11 +76,19 @@ func NewGRPCClient(
 
 	gs.dialTimeout = config.DialTimeout
 	gs.lazy = config.LazyConnection
+	gs.poolSize = config.PoolSize
 	gs.reqTimeout = config.RequestTimeout
 
 	return gs, nil
 }
 
+// grpcClientPool keeps the connections to a server, handing them out in
+// turns so the RPCs to that server are spread over them
+type grpcClientPool struct {
+	clients []*grpcClient
+	next    uint32
+}
+
 type grpcClient struct {
 	address   string
 	cli       protos.PitayaClient
@@ -116,12 +129,17 @@ func (gs *GRPCClient) Call(
 	ctx = tracing.StartSpan(ctx, "GRPC RPC Call", tags, parent)
 	defer tracing.FinishSpan(ctx, err)
 
+	timeout, err := getRequestTimeout(ctx, gs.reqTimeout)
+	if err != nil {
+		return nil, err
+	}
+
 	req, err := buildRequest(ctx, rpcType, route, session, msg, gs.server)
 	if err != nil {
 		return nil, err
 	}
 
-	ctxT, done := context.WithTimeout(ctx, gs.reqTimeout)
+	ctxT, done := context.WithTimeout(ctx, timeout)
 	defer done()
 
 	if gs.metricsReporters != nil {
@@ -131,7 +149,7 @@ func (gs *GRPCClient) Call(
 		defer metrics.ReportTimingFromCtx(ctxT, gs.metricsReporters, "rpc", err)
 	}
 
-	res, err := c.(*grpcClient).call(ctxT, &req)
+	res, err := c.(*grpcClientPool).get().call(ctxT, &req)
 	if err != nil {
 		return nil, err
 	}
@@ -168,7 +186,7 @@ func (gs *GRPCClient) BroadcastSessionBind(uid string) error {
 			}
 			ctxT, done := context.WithTimeout(context.Background(), gs.reqTimeout)
 			defer done()
-			err := c.(*grpcClient).sessionBindRemote(ctxT, msg)
+			err := c.(*grpcClientPool).get().sessionBindRemote(ctxT, msg)
 			return err
 		}
 	}
@@ -192,7 +210,7 @@ func (gs *GRPCClient) SendKick(userID string, serverType string, kick *protos.Ki
 	if c, ok := gs.clientMap.Load(svID); ok {
 		ctxT, done := context.WithTimeout(context.Background(), gs.reqTimeout)
 		defer done()
-		err := c.(*grpcClient).sendKick(ctxT, kick)
+		err := c.(*grpcClientPool).get().sendKick(ctxT, kick)
 		return err
 	}
 	return constants.ErrNoConnectionToServer
@@ -201,28 +219,97 @@ func (gs *GRPCClient) SendKick(userID string, serverType string, kick *protos.Ki
 // SendPush sends a message to an user, if you dont know the serverID that the user is connected to, you need to set a BindingStorage when creating the client
 // TODO: Jaeger?
 func (gs *GRPCClient) SendPush(userID string, frontendSv *Server, push *protos.Push) error {
-	var svID string
-	var err error
-	if frontendSv.ID != "" {
-		svID = frontendSv.ID
-	} else {
-		if gs.bindingStorage == nil {
-			return constants.ErrNoBindingStorageModule
-		}
-		svID, err = gs.bindingStorage.GetUserFrontendID(userID, frontendSv.Type)
-		if err != nil {
-			return err
-		}
+	svID, err := gs.frontendID(userID, frontendSv)
+	if err != nil {
+		return err
 	}
 	if c, ok := gs.clientMap.Load(svID); ok {
 		ctxT, done := context.WithTimeout(context.Background(), gs.reqTimeout)
 		defer done()
-		err := c.(*grpcClient).pushToUser(ctxT, push)
+		err := c.(*grpcClientPool).get().pushToUser(ctxT, push)
 		return err
 	}
 	return constants.ErrNoConnectionToServer
 }
 
+// SendPushes sends the pushes to their users with a single RPC to each
+// frontend server the users are connected to, instead of one per user. The
+// frontend servers are found like in SendPush, and the pushes to servers
+// without batches are sent one by one. It returns the uids of the users whose
+// push failed
+func (gs *GRPCClient) SendPushes(frontendSv *Server, pushes []*protos.Push) []string {
+	var failed []string
+	batches := map[string][]*protos.Push{}
+	for _, push := range pushes {
+		svID, err := gs.frontendID(push.GetUid(), frontendSv)
+		if err != nil {
+			logger.Log.Errorf("[grpc client] failed to find the frontend server of user %s: %s", push.GetUid(), err.Error())
+			failed = append(failed, push.GetUid())
+			continue
+		}
+		batches[svID] = append(batches[svID], push)
+	}
+	for svID, batch := range batches {
+		failed = append(failed, gs.sendPushBatch(svID, batch)...)
+	}
+	return failed
+}
+
+// sendPushBatch sends the pushes to the users connected to the server svID,
+// one by one if the server can't handle batches. It returns the uids of the
+// users whose push failed
+func (gs *GRPCClient) sendPushBatch(svID string, batch []*protos.Push) []string {
+	uids := func(pushes []*protos.Push) []string {
+		uids := make([]string, 0, len(pushes))
+		for _, push := range pushes {
+			uids = append(uids, push.GetUid())
+		}
+		return uids
+	}
+
+	c, ok := gs.clientMap.Load(svID)
+	if !ok {
+		logger.Log.Errorf("[grpc client] failed to push to %d users of server %s: %s", len(batch), svID, constants.ErrNoConnectionToServer.Error())
+		return uids(batch)
+	}
+	ctxT, done := context.WithTimeout(context.Background(), gs.reqTimeout)
+	defer done()
+	client := c.(*grpcClientPool).get()
+	answer, err := client.pushToUsers(ctxT, &protos.PushBatch{Pushes: batch})
+	if status.Code(err) == codes.Unimplemented {
+		// the server runs a version without batches, each push gets its own
+		// timeout so the last ones of a large batch don't time out
+		var failed []string
+		for _, push := range batch {
+			pushCtx, pushDone := context.WithTimeout(context.Background(), gs.reqTimeout)
+			err := client.pushToUser(pushCtx, push)
+			pushDone()
+			if err != nil {
+				failed = append(failed, push.GetUid())
+			}
+		}
+		return failed
+	}
+	if err != nil {
+		logger.Log.Errorf("[grpc client] failed to push to %d users of server %s: %s", len(batch), svID, err.Error())
+		return uids(batch)
+	}
+	return answer.GetFailedUids()
+}
+
+// frontendID returns the id of the frontend server userID is connected to,
+// which is the one of frontendSv if it is set, or the one the binding
+// storage has for the type of frontendSv
+func (gs *GRPCClient) frontendID(userID string, frontendSv *Server) (string, error) {
+	if frontendSv.ID != "" {
+		return frontendSv.ID, nil
+	}
+	if gs.bindingStorage == nil {
+		return "", constants.ErrNoBindingStorageModule
+	}
+	return gs.bindingStorage.GetUserFrontendID(userID, frontendSv.Type)
+}
+
 // AddServer is called when a new server is discovered
 func (gs *GRPCClient) AddServer(sv *Server) {
 	var host, port, portKey string
@@ -240,7 +327,7 @@ func (gs *GRPCClient) AddServer(sv *Server) {
 	}
 
 	address := fmt.Sprintf("%s:%s", host, port)
-	client := &grpcClient{address: address}
+	client := newGRPCClientPool(address, gs.poolSize)
 	if !gs.lazy {
 		if err := client.connect(); err != nil {
 			logger.Log.Errorf("[grpc client] unable to connect to server %s at %s: %v", sv.ID, address, err)
@@ -253,7 +340,7 @@ func (gs *GRPCClient) AddServer(sv *Server) {
 // RemoveServer is called when a server is removed
 func (gs *GRPCClient) RemoveServer(sv *Server) {
 	if c, ok := gs.clientMap.Load(sv.ID); ok {
-		c.(*grpcClient).disconnect()
+		c.(*grpcClientPool).disconnect()
 		gs.clientMap.Delete(sv.ID)
 		logger.Log.Debugf("[grpc client] removed server %s", sv.ID)
 	}
@@ -299,11 +386,56 @@ func (gs *GRPCClient) getServerHost(sv *Server) (host, portKey string) {
 	return externalHost, constants.GRPCExternalPortKey
 }
 
+func newGRPCClientPool(address string, size int) *grpcClientPool {
+	if size < 1 {
+		size = 1
+	}
+	pool := &grpcClientPool{clients: make([]*grpcClient, size)}
+	for i := range pool.clients {
+		pool.clients[i] = &grpcClient{address: address}
+	}
+	return pool
+}
+
+// get returns the next connection of the pool, skipping the ones gRPC is
+// reconnecting after a failure while there are healthy ones
+func (p *grpcClientPool) get() *grpcClient {
+	n := atomic.AddUint32(&p.next, 1) - 1
+	size := uint32(len(p.clients))
+	for i := uint32(0); i < size; i++ {
+		if gc := p.clients[(n+i)%size]; gc.healthy() {
+			return gc
+		}
+	}
+	return p.clients[n%size]
+}
+
+func (p *grpcClientPool) connect() error {
+	for _, gc := range p.clients {
+		if err := gc.connect(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *grpcClientPool) disconnect() {
+	for _, gc := range p.clients {
+		gc.disconnect()
+	}
+}
+
 func (gc *grpcClient) connect() error {
+	_, err := gc.client()
+	return err
+}
+
+// client returns the client of the connection, dialing it first if needed
+func (gc *grpcClient) client() (protos.PitayaClient, error) {
 	gc.lock.Lock()
 	defer gc.lock.Unlock()
 	if gc.connected {
-		return nil
+		return gc.cli, nil
 	}
 
 	conn, err := grpc.Dial(
@@ -311,13 +443,13 @@ func (gc *grpcClient) connect() error {
 		grpc.WithInsecure(),
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	c := protos.NewPitayaClient(conn)
 	gc.cli = c
 	gc.conn = conn
 	gc.connected = true
-	return nil
+	return c, nil
 }
 
 func (gc *grpcClient) disconnect() {
@@ -329,41 +461,54 @@ func (gc *grpcClient) disconnect() {
 	gc.lock.Unlock()
 }
 
+// healthy reports whether the connection is not failing, gRPC reconnects a
+// failed connection by itself with backoff, until then it is not healthy.
+// A connection not dialed yet is healthy
+func (gc *grpcClient) healthy() bool {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	return !gc.connected || gc.conn == nil || gc.conn.GetState() != connectivity.TransientFailure
+}
+
 func (gc *grpcClient) pushToUser(ctx context.Context, push *protos.Push) error {
-	if !gc.connected {
-		if err := gc.connect(); err != nil {
-			return err
-		}
+	cli, err := gc.client()
+	if err != nil {
+		return err
 	}
-	_, err := gc.cli.PushToUser(ctx, push)
+	_, err = cli.PushToUser(ctx, push)
 	return err
 }
 
+func (gc *grpcClient) pushToUsers(ctx context.Context, batch *protos.PushBatch) (*protos.PushBatchAnswer, error) {
+	cli, err := gc.client()
+	if err != nil {
+		return nil, err
+	}
+	return cli.PushToUsers(ctx, batch)
+}
+
 func (gc *grpcClient) call(ctx context.Context, req *protos.Request) (*protos.Response, error) {
-	if !gc.connected {
-		if err := gc.connect(); err != nil {
-			return nil, err
-		}
+	cli, err := gc.client()
+	if err != nil {
+		return nil, err
 	}
-	return gc.cli.Call(ctx, req)
+	return cli.Call(ctx, req)
 }
 
 func (gc *grpcClient) sessionBindRemote(ctx context.Context, req *protos.BindMsg) error {
-	if !gc.connected {
-		if err := gc.connect(); err != nil {
-			return err
-		}
+	cli, err := gc.client()
+	if err != nil {
+		return err
 	}
-	_, err := gc.cli.SessionBindRemote(ctx, req)
+	_, err = cli.SessionBindRemote(ctx, req)
 	return err
 }
 
 func (gc *grpcClient) sendKick(ctx context.Context, req *protos.KickMsg) error {
-	if !gc.connected {
-		if err := gc.connect(); err != nil {
-			return err
-		}
+	cli, err := gc.client()
+	if err != nil {
+		return err
 	}
-	_, err := gc.cli.KickUser(ctx, req)
+	_, err = cli.KickUser(ctx, req)
 	return err
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
@@ -19,6 +20,9 @@ import (
 	"github.com/topfreegames/pitaya/v2/route"
 	sessionmocks "github.com/topfreegames/pitaya/v2/session/mocks"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 )
 
 func getRPCClient(c config.GRPCClientConfig) (*GRPCClient, error) {
@@ -40,10 +44,10 @@ func TestCall(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockPitayaClient := protosmocks.NewMockPitayaClient(ctrl)
-	g.clientMap.Store(g.server.ID, &grpcClient{
+	g.clientMap.Store(g.server.ID, &grpcClientPool{clients: []*grpcClient{{
 		cli:       mockPitayaClient,
 		connected: true,
-	})
+	}}})
 
 	uid := "someuid"
 	msg := &message.Message{
@@ -102,7 +106,7 @@ func TestBroadcastSessionBind(t *testing.T) {
 			//mockPitayaClient := protosmocks.NewMockPitayaClient(ctrl)
 
 			if table.bindingStorage != nil {
-				g.clientMap.Store(g.server.ID, &grpcClient{connected: true, cli: mockPitayaClient})
+				g.clientMap.Store(g.server.ID, &grpcClientPool{clients: []*grpcClient{{connected: true, cli: mockPitayaClient}}})
 
 				g.bindingStorage = mockBindingStorage
 				mockBindingStorage.EXPECT().GetUserFrontendID(uid, gomock.Any()).DoAndReturn(func(u, svType string) (string, error) {
@@ -160,7 +164,7 @@ func TestSendKick(t *testing.T) {
 			assert.NoError(t, err)
 
 			if table.bindingStorage != nil {
-				g.clientMap.Store(table.sv.ID, &grpcClient{connected: true, cli: mockPitayaClient})
+				g.clientMap.Store(table.sv.ID, &grpcClientPool{clients: []*grpcClient{{connected: true, cli: mockPitayaClient}}})
 				g.bindingStorage = table.bindingStorage
 				mockBindingStorage.EXPECT().GetUserFrontendID(table.userID, gomock.Any()).DoAndReturn(func(u, svType string) (string, error) {
 					assert.Equal(t, table.userID, u)
@@ -220,7 +224,7 @@ func TestSendPush(t *testing.T) {
 			uid := "someuid"
 
 			if table.bindingStorage != nil && table.sv.ID == "" {
-				g.clientMap.Store(table.sv.ID, &grpcClient{connected: true, cli: mockPitayaClient})
+				g.clientMap.Store(table.sv.ID, &grpcClientPool{clients: []*grpcClient{{connected: true, cli: mockPitayaClient}}})
 				g.bindingStorage = table.bindingStorage
 				mockBindingStorage.EXPECT().GetUserFrontendID(uid, gomock.Any()).DoAndReturn(func(u, svType string) (string, error) {
 					assert.Equal(t, uid, u)
@@ -234,7 +238,7 @@ func TestSendPush(t *testing.T) {
 					assert.Equal(t, msg.Data, []byte{0x01})
 				})
 			} else if table.bindingStorage == nil && table.sv.ID != "" {
-				g.clientMap.Store(table.sv.ID, &grpcClient{connected: true, cli: mockPitayaClient})
+				g.clientMap.Store(table.sv.ID, &grpcClientPool{clients: []*grpcClient{{connected: true, cli: mockPitayaClient}}})
 				mockPitayaClient.EXPECT().PushToUser(gomock.Any(), gomock.Any()).Do(func(ctx context.Context, msg *protos.Push) {
 					assert.Equal(t, uid, msg.Uid)
 					assert.Equal(t, msg.Route, "sv.svc.mth")
@@ -259,6 +263,68 @@ func TestSendPush(t *testing.T) {
 	}
 }
 
+func TestSendPushes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockBindingStorage := mocks.NewMockBindingStorage(ctrl)
+	client1 := protosmocks.NewMockPitayaClient(ctrl)
+	client2 := protosmocks.NewMockPitayaClient(ctrl)
+
+	g, err := getRPCClient(*config.NewDefaultGRPCClientConfig())
+	assert.NoError(t, err)
+	g.bindingStorage = mockBindingStorage
+	g.clientMap.Store("sv1", &grpcClientPool{clients: []*grpcClient{{connected: true, cli: client1}}})
+	g.clientMap.Store("sv2", &grpcClientPool{clients: []*grpcClient{{connected: true, cli: client2}}})
+
+	frontends := map[string]string{"uid1": "sv1", "uid2": "sv2", "uid3": "sv1", "uid4": "sv3"}
+	pushes := []*protos.Push{}
+	for _, uid := range []string{"uid1", "uid2", "uid3", "uid4", "uid5"} {
+		pushes = append(pushes, &protos.Push{Route: "sv.svc.mth", Uid: uid, Data: []byte{0x01}})
+	}
+	mockBindingStorage.EXPECT().GetUserFrontendID(gomock.Any(), "connector").DoAndReturn(func(uid, svType string) (string, error) {
+		if svID, ok := frontends[uid]; ok {
+			return svID, nil
+		}
+		return "", constants.ErrSessionNotFound
+	}).Times(len(pushes))
+
+	client1.EXPECT().PushToUsers(gomock.Any(), &protos.PushBatch{Pushes: []*protos.Push{pushes[0], pushes[2]}}).Return(&protos.PushBatchAnswer{FailedUids: []string{"uid3"}}, nil)
+	client2.EXPECT().PushToUsers(gomock.Any(), &protos.PushBatch{Pushes: []*protos.Push{pushes[1]}}).Return(&protos.PushBatchAnswer{}, nil)
+
+	failed := g.SendPushes(&Server{Type: "connector"}, pushes)
+	assert.ElementsMatch(t, []string{"uid3", "uid4", "uid5"}, failed)
+}
+
+func TestSendPushesToServerWithoutBatches(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockPitayaClient := protosmocks.NewMockPitayaClient(ctrl)
+
+	g, err := getRPCClient(*config.NewDefaultGRPCClientConfig())
+	assert.NoError(t, err)
+	g.clientMap.Store("sv1", &grpcClientPool{clients: []*grpcClient{{connected: true, cli: mockPitayaClient}}})
+
+	push1 := &protos.Push{Route: "sv.svc.mth", Uid: "uid1"}
+	push2 := &protos.Push{Route: "sv.svc.mth", Uid: "uid2"}
+	mockPitayaClient.EXPECT().PushToUsers(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.Unimplemented, "unknown method PushToUsers"))
+	var firstCtx context.Context
+	mockPitayaClient.EXPECT().PushToUser(gomock.Any(), push1).DoAndReturn(
+		func(ctx context.Context, push *protos.Push, opts ...grpc.CallOption) (*protos.Response, error) {
+			firstCtx = ctx
+			return &protos.Response{}, nil
+		})
+	mockPitayaClient.EXPECT().PushToUser(gomock.Any(), push2).DoAndReturn(
+		func(ctx context.Context, push *protos.Push, opts ...grpc.CallOption) (*protos.Response, error) {
+			// each push has its own timeout
+			assert.Error(t, firstCtx.Err())
+			assert.NoError(t, ctx.Err())
+			return nil, constants.ErrSessionNotFound
+		})
+
+	failed := g.SendPushes(&Server{ID: "sv1", Type: "connector"}, []*protos.Push{push1, push2})
+	assert.Equal(t, []string{"uid2"}, failed)
+}
+
 func TestAddServer(t *testing.T) {
 	t.Run("try-connect", func(t *testing.T) {
 		// listen
@@ -294,7 +360,7 @@ func TestAddServer(t *testing.T) {
 		sv, ok := g.clientMap.Load(server.ID)
 		assert.NotNil(t, sv)
 		assert.True(t, ok)
-		cli := sv.(*grpcClient)
+		cli := sv.(*grpcClientPool).clients[0]
 		assert.True(t, cli.connected)
 		assert.NotNil(t, cli.cli)
 	})
@@ -335,7 +401,7 @@ func TestAddServer(t *testing.T) {
 		sv, ok := g.clientMap.Load(server.ID)
 		assert.NotNil(t, sv)
 		assert.True(t, ok)
-		cli := sv.(*grpcClient)
+		cli := sv.(*grpcClientPool).clients[0]
 		assert.False(t, cli.connected)
 		assert.Nil(t, cli.cli)
 	})
@@ -446,3 +512,111 @@ func TestRemoveServer(t *testing.T) {
 	assert.Nil(t, sv)
 	assert.False(t, ok)
 }
+
+func startPoolTestServer(t *testing.T, ctrl *gomock.Controller, port int) (*Server, *GRPCServer, *protosmocks.MockPitayaServer) {
+	server := &Server{
+		ID:   "someid",
+		Type: "sometype",
+		Metadata: map[string]string{
+			constants.GRPCHostKey: "localhost",
+			constants.GRPCPortKey: fmt.Sprintf("%d", port),
+		},
+		Frontend: true,
+	}
+	gs, err := NewGRPCServer(config.GRPCServerConfig{Port: port}, server, []metrics.Reporter{})
+	assert.NoError(t, err)
+	mockPitayaServer := protosmocks.NewMockPitayaServer(ctrl)
+	gs.SetPitayaServer(mockPitayaServer)
+	assert.NoError(t, gs.Init())
+	return server, gs, mockPitayaServer
+}
+
+func TestGRPCClientPoolReusesConnections(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	server, gs, mockPitayaServer := startPoolTestServer(t, ctrl, helpers.GetFreePort(t))
+	defer gs.Shutdown()
+	mockPitayaServer.EXPECT().PushToUser(gomock.Any(), gomock.Any()).Return(&protos.Response{}, nil).Times(6)
+
+	clientConfig := config.NewDefaultGRPCClientConfig()
+	clientConfig.PoolSize = 2
+	clientConfig.LazyConnection = true
+	g, err := getRPCClient(*clientConfig)
+	assert.NoError(t, err)
+	g.AddServer(server)
+
+	c, ok := g.clientMap.Load(server.ID)
+	assert.True(t, ok)
+	pool := c.(*grpcClientPool)
+	assert.Len(t, pool.clients, 2)
+
+	conns := map[*grpc.ClientConn]int{}
+	for i := 0; i < 6; i++ {
+		err := g.SendPush("someuid", server, &protos.Push{Route: "sv.svc.mth", Uid: "someuid"})
+		assert.NoError(t, err)
+		for _, cli := range pool.clients {
+			if cli.conn != nil {
+				conns[cli.conn]++
+			}
+		}
+	}
+	// both connections are dialed once and then used in turns
+	assert.Len(t, conns, 2)
+	assert.Equal(t, 6, conns[pool.clients[0].conn])
+	assert.Equal(t, 5, conns[pool.clients[1].conn])
+}
+
+func TestGRPCClientPoolKeepsFailedConnections(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	port := helpers.GetFreePort(t)
+	server, gs, mockPitayaServer := startPoolTestServer(t, ctrl, port)
+	mockPitayaServer.EXPECT().PushToUser(gomock.Any(), gomock.Any()).Return(&protos.Response{}, nil)
+
+	g, err := getRPCClient(*config.NewDefaultGRPCClientConfig())
+	assert.NoError(t, err)
+	g.AddServer(server)
+
+	c, _ := g.clientMap.Load(server.ID)
+	cli := c.(*grpcClientPool).clients[0]
+	push := &protos.Push{Route: "sv.svc.mth", Uid: "someuid"}
+
+	assert.NoError(t, g.SendPush("someuid", server, push))
+	conn := cli.conn
+
+	gs.Shutdown()
+	err = g.SendPush("someuid", server, push)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	// the connection is left for gRPC to reconnect
+	assert.True(t, cli.connected)
+	assert.NotEqual(t, connectivity.Shutdown, conn.GetState())
+
+	_, gs, mockPitayaServer = startPoolTestServer(t, ctrl, port)
+	defer gs.Shutdown()
+	mockPitayaServer.EXPECT().PushToUser(gomock.Any(), gomock.Any()).Return(&protos.Response{}, nil)
+
+	helpers.ShouldEventuallyReturn(t, func() error {
+		return g.SendPush("someuid", server, push)
+	}, nil, 100*time.Millisecond, 5*time.Second)
+	assert.Equal(t, conn, cli.conn)
+}
+
+func TestGRPCClientPoolSkipsFailingConnections(t *testing.T) {
+	failing := &grpcClient{address: fmt.Sprintf("localhost:%d", helpers.GetFreePort(t))}
+	assert.NoError(t, failing.connect())
+	defer failing.disconnect()
+	helpers.ShouldEventuallyReturn(t, func() connectivity.State {
+		return failing.conn.GetState()
+	}, connectivity.TransientFailure, 10*time.Millisecond, 5*time.Second)
+
+	healthy := &grpcClient{address: "localhost:0"}
+	pool := &grpcClientPool{clients: []*grpcClient{failing, healthy}}
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, healthy, pool.get())
+	}
+
+	allFailing := &grpcClientPool{clients: []*grpcClient{failing}}
+	assert.Equal(t, failing, allFailing.get())
+}
@@ -155,6 +155,10 @@ func (ns *NatsRPCClient) Call(
 		err = constants.ErrRPCClientNotInitialized
 		return nil, err
 	}
+	timeout, err := getRequestTimeout(ctx, ns.reqTimeout)
+	if err != nil {
+		return nil, err
+	}
 	req, err := buildRequest(ctx, rpcType, route, session, msg, ns.server)
 	if err != nil {
 		return nil, err
@@ -175,7 +179,7 @@ func (ns *NatsRPCClient) Call(
 			metrics.ReportTimingFromCtx(ctx, ns.metricsReporters, typ, err)
 		}()
 	}
-	m, err = ns.conn.Request(getChannel(server.Type, server.ID), marshalledData, ns.reqTimeout)
+	m, err = ns.conn.Request(getChannel(server.Type, server.ID), marshalledData, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -391,6 +391,98 @@ func TestNatsRPCClientBuildRequest(t *testing.T) {
 	}
 }
 
+func TestGetRequestTimeout(t *testing.T) {
+	reqTimeout := time.Second
+	tables := []struct {
+		name     string
+		budget   time.Duration
+		deadline bool
+		err      error
+	}{
+		{"no_deadline", 0, false, nil},
+		{"budget_bigger_than_timeout", 10 * time.Second, true, nil},
+		{"budget_smaller_than_timeout", 300 * time.Millisecond, true, nil},
+		{"budget_exhausted", -time.Millisecond, true, constants.ErrRequestDeadlineExceeded},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctx := context.Background()
+			if table.deadline {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, table.budget)
+				defer cancel()
+			}
+
+			timeout, err := getRequestTimeout(ctx, reqTimeout)
+			assert.Equal(t, table.err, err)
+			if table.err != nil {
+				return
+			}
+			if table.deadline && table.budget < reqTimeout {
+				assert.True(t, timeout <= table.budget)
+				assert.InDelta(t, table.budget, timeout, float64(50*time.Millisecond))
+			} else {
+				assert.Equal(t, reqTimeout, timeout)
+			}
+		})
+	}
+}
+
+func TestNatsRPCClientCallShouldFailIfDeadlineExceeded(t *testing.T) {
+	config := config.NewDefaultNatsRPCClientConfig()
+	sv := getServer()
+	rpcClient, _ := NewNatsRPCClient(*config, sv, nil, nil)
+	rpcClient.Init()
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	res, err := rpcClient.Call(ctx, protos.RPCType_Sys, nil, nil, nil, sv)
+	assert.Equal(t, constants.ErrRequestDeadlineExceeded, err)
+	assert.Nil(t, res)
+}
+
+func TestNatsRPCClientCallShouldUseRemainingBudget(t *testing.T) {
+	s := helpers.GetTestNatsServer(t)
+	sv := getServer()
+	defer s.Shutdown()
+	cfg := config.NewDefaultNatsRPCClientConfig()
+	cfg.Connect = fmt.Sprintf("nats://%s", s.Addr())
+	cfg.RequestTimeout = 5 * time.Second
+	rpcClient, _ := NewNatsRPCClient(*cfg, sv, nil, nil)
+	err := rpcClient.Init()
+	assert.NoError(t, err)
+
+	rt := route.NewRoute("sv", "svc", "method")
+	msg := &message.Message{
+		Type: message.Request,
+		ID:   uint(123),
+		Data: []byte("data"),
+	}
+
+	// the subscriber never answers, so the request can only end when the budget is over
+	sv2 := getServer()
+	sv2.Type = uuid.New().String()
+	sv2.ID = uuid.New().String()
+	conn, err := setupNatsConn(fmt.Sprintf("nats://%s", s.Addr()), nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	subs, err := conn.Subscribe(getChannel(sv2.Type, sv2.ID), func(m *nats.Msg) {})
+	assert.NoError(t, err)
+	defer subs.Unsubscribe()
+	conn.Flush()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	res, err := rpcClient.Call(ctx, protos.RPCType_User, rt, nil, msg, sv2)
+	assert.Nil(t, res)
+	assert.Equal(t, nats.ErrTimeout, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
 func TestNatsRPCClientCallShouldFailIfNotRunning(t *testing.T) {
 	config := config.NewDefaultNatsRPCClientConfig()
 	sv := getServer()
@@ -137,8 +137,13 @@ func suitableRemoteMethods(typ reflect.Type, nameFunc func(string) string) map[s
 	return methods
 }
 
-func suitableHandlerMethods(typ reflect.Type, nameFunc func(string) string) map[string]*Handler {
-	methods := make(map[string]*Handler)
+// suitableHandlerMethods returns the handler methods of typ by name. When a
+// request and a notify method end up with the same name, e.g. through
+// nameFunc, the request one is returned in methods and the notify one in
+// notifyMethods, so the route can dispatch on the message type
+func suitableHandlerMethods(typ reflect.Type, nameFunc func(string) string) (methods, notifyMethods map[string]*Handler) {
+	methods = make(map[string]*Handler)
+	notifyMethods = make(map[string]*Handler)
 	for m := 0; m < typ.NumMethod(); m++ {
 		method := typ.Method(m)
 		mt := method.Type
@@ -166,8 +171,15 @@ func suitableHandlerMethods(typ reflect.Type, nameFunc func(string) string) map[
 			if mt.NumIn() == 3 {
 				handler.Type = mt.In(2)
 			}
+			if other, ok := methods[mn]; ok && other.MessageType != msgType {
+				if msgType == message.Notify {
+					notifyMethods[mn] = handler
+					continue
+				}
+				notifyMethods[mn] = other
+			}
 			methods[mn] = handler
 		}
 	}
-	return methods
+	return methods, notifyMethods
 }
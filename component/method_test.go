@@ -27,6 +27,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/conn/message"
 	"github.com/topfreegames/pitaya/v2/protos/test"
 )
 
@@ -152,7 +153,7 @@ func TestSuitableHandlerMethods(t *testing.T) {
 
 	for _, table := range tables {
 		t.Run(table.name, func(t *testing.T) {
-			out := suitableHandlerMethods(reflect.TypeOf(tObj), table.nameFunc)
+			out, _ := suitableHandlerMethods(reflect.TypeOf(tObj), table.nameFunc)
 			for _, r := range table.outKeys {
 				val, ok := out[r]
 				assert.True(t, ok)
@@ -163,3 +164,21 @@ func TestSuitableHandlerMethods(t *testing.T) {
 	}
 
 }
+
+func TestSuitableHandlerMethodsSharedName(t *testing.T) {
+	t.Parallel()
+	nameFunc := func(name string) string {
+		if strings.HasPrefix(name, "ExportedHandlerWithSessionAnd") {
+			return "shared"
+		}
+		return name
+	}
+	tObj := &TestType{}
+
+	out, notifyOut := suitableHandlerMethods(reflect.TypeOf(tObj), nameFunc)
+	assert.Len(t, notifyOut, 1)
+	assert.Equal(t, message.Request, out["shared"].MessageType)
+	assert.Equal(t, message.Notify, notifyOut["shared"].MessageType)
+	assert.Equal(t, "ExportedHandlerWithSessionAndRawWithNoOuts", notifyOut["shared"].Method.Name)
+	assert.NotContains(t, notifyOut, "ExportedHandlerWithOnlySession")
+}
@@ -22,8 +22,9 @@ package component
 
 type (
 	options struct {
-		name     string              // component name
-		nameFunc func(string) string // rename handler name
+		name        string              // component name
+		nameFunc    func(string) string // rename handler name
+		methodNames map[string]string   // handler names by method name, they take precedence over nameFunc
 	}
 
 	// Option used to customize handler
@@ -44,3 +45,23 @@ func WithNameFunc(fn func(string) string) Option {
 		opt.nameFunc = fn
 	}
 }
+
+// WithMethodNames overrides the handler names of the methods in names, by
+// method name, e.g. to keep a route when its method is renamed. The other
+// methods are named by WithNameFunc, if set
+func WithMethodNames(names map[string]string) Option {
+	return func(opt *options) {
+		opt.methodNames = names
+	}
+}
+
+// methodName returns the handler name of the method with the given name
+func (opt *options) methodName(name string) string {
+	if renamed, ok := opt.methodNames[name]; ok {
+		return renamed
+	}
+	if opt.nameFunc != nil {
+		return opt.nameFunc(name)
+	}
+	return name
+}
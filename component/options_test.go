@@ -43,3 +43,14 @@ func TestWithNameFunc(t *testing.T) {
 	WithNameFunc(nameFunc)(opt)
 	assert.Equal(t, opt.nameFunc(name), strings.ToUpper(name))
 }
+
+func TestWithMethodNames(t *testing.T) {
+	opt := &options{}
+	WithMethodNames(map[string]string{"HandlePurchaseV2": "purchase"})(opt)
+	assert.Equal(t, "purchase", opt.methodName("HandlePurchaseV2"))
+	assert.Equal(t, "Refund", opt.methodName("Refund"))
+
+	WithNameFunc(strings.ToLower)(opt)
+	assert.Equal(t, "purchase", opt.methodName("HandlePurchaseV2"))
+	assert.Equal(t, "refund", opt.methodName("Refund"))
+}
@@ -49,12 +49,13 @@ type (
 	// Service implements a specific service, some of it's methods will be
 	// called when the correspond events is occurred.
 	Service struct {
-		Name     string              // name of service
-		Type     reflect.Type        // type of the receiver
-		Receiver reflect.Value       // receiver of methods for the service
-		Handlers map[string]*Handler // registered methods
-		Remotes  map[string]*Remote  // registered remote methods
-		Options  options             // options
+		Name           string              // name of service
+		Type           reflect.Type        // type of the receiver
+		Receiver       reflect.Value       // receiver of methods for the service
+		Handlers       map[string]*Handler // registered methods
+		NotifyHandlers map[string]*Handler // notify methods sharing their name with a request method
+		Remotes        map[string]*Remote  // registered remote methods
+		Options        options             // options
 	}
 )
 
@@ -98,12 +99,12 @@ func (s *Service) ExtractHandler() error {
 	}
 
 	// Install the methods
-	s.Handlers = suitableHandlerMethods(s.Type, s.Options.nameFunc)
+	s.Handlers, s.NotifyHandlers = suitableHandlerMethods(s.Type, s.Options.methodName)
 
 	if len(s.Handlers) == 0 {
 		str := ""
 		// To help the user, see if a pointer receiver would work.
-		method := suitableHandlerMethods(reflect.PtrTo(s.Type), s.Options.nameFunc)
+		method, _ := suitableHandlerMethods(reflect.PtrTo(s.Type), s.Options.methodName)
 		if len(method) != 0 {
 			str = "type " + s.Name + " has no exported methods of handler type (hint: pass a pointer to value of that type)"
 		} else {
@@ -115,6 +116,9 @@ func (s *Service) ExtractHandler() error {
 	for i := range s.Handlers {
 		s.Handlers[i].Receiver = s.Receiver
 	}
+	for i := range s.NotifyHandlers {
+		s.NotifyHandlers[i].Receiver = s.Receiver
+	}
 
 	return nil
 }
@@ -135,12 +139,12 @@ func (s *Service) ExtractRemote() error {
 	}
 
 	// Install the methods
-	s.Remotes = suitableRemoteMethods(s.Type, s.Options.nameFunc)
+	s.Remotes = suitableRemoteMethods(s.Type, s.Options.methodName)
 
 	if len(s.Remotes) == 0 {
 		str := ""
 		// To help the user, see if a pointer receiver would work.
-		method := suitableRemoteMethods(reflect.PtrTo(s.Type), s.Options.nameFunc)
+		method := suitableRemoteMethods(reflect.PtrTo(s.Type), s.Options.methodName)
 		if len(method) != 0 {
 			str = "type " + s.Name + " has no exported methods of remote type (hint: pass a pointer to value of that type)"
 		} else {
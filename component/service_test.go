@@ -112,6 +112,14 @@ func TestExtractRemote(t *testing.T) {
 	}
 }
 
+func TestExtractRemoteWithMethodNames(t *testing.T) {
+	svc := NewService(&TestType{}, []Option{WithMethodNames(map[string]string{"ExportedRemotePointerOut": "pointerOut"})})
+	assert.NoError(t, svc.ExtractRemote())
+	assert.Contains(t, svc.Remotes, "pointerOut")
+	assert.Contains(t, svc.Remotes, "ExportedRemoteRawOut")
+	assert.NotContains(t, svc.Remotes, "ExportedRemotePointerOut")
+}
+
 func TestValidateMessageType(t *testing.T) {
 	mtTables := []struct {
 		name       string
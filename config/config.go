@@ -10,16 +10,40 @@ import (
 // PitayaConfig provides configuration for a pitaya app
 type PitayaConfig struct {
 	Heartbeat struct {
-		Interval time.Duration
+		Interval                 time.Duration
+		BackgroundGrace          time.Duration
+		MinInterval              time.Duration
+		MaxInterval              time.Duration
+		RetryTransientWriteError bool
 	}
 	Handler struct {
 		Messages struct {
 			Compression bool
 		}
+		Timeouts     []RouteTimeoutConfig
+		Quotas       []RouteQuotaConfig
+		Cache        []RouteCacheConfig
+		Deprecations []RouteDeprecationConfig
+		Warmup       struct {
+			Routes []string
+		}
+		Audit struct {
+			Routes []string
+		}
+		Idempotency struct {
+			TTL time.Duration
+		}
+		Errors struct {
+			Format string
+		}
 	}
 	Buffer struct {
 		Agent struct {
 			Messages int
+			Overflow struct {
+				Policy  string
+				Timeout time.Duration
+			}
 		}
 		Handler struct {
 			LocalProcess  int
@@ -35,30 +59,162 @@ type PitayaConfig struct {
 		Unique bool
 	}
 	Metrics struct {
-		Period time.Duration
+		Period          time.Duration
+		Sampling        []RouteSamplingConfig
+		Compressibility struct {
+			Rate float64
+		}
+		Resilient struct {
+			Enabled          bool
+			BufferSize       int
+			ErrorLogInterval time.Duration
+		}
+	}
+	Conn struct {
+		WriteTimeout         time.Duration
+		CreditTimeout        time.Duration
+		RequestTimeout       time.Duration
+		DictionaryReference  bool
+		CompressionThreshold int
+		KeepAlivePeriod      time.Duration
+		SoftCapacity         struct {
+			Sessions   int64
+			RetryAfter time.Duration
+		}
+		Maintenance struct {
+			Reject  bool
+			Windows []MaintenanceWindowConfig
+		}
+		Affinity struct {
+			Key string
+			TTL time.Duration
+		}
+	}
+	Tracing struct {
+		ConnectionSampling struct {
+			Enabled bool
+			Rate    float64
+		}
 	}
 }
 
+// RouteSamplingConfig provides the metrics sample rate for a route, only
+// 1 in Rate of the route timings is reported
+type RouteSamplingConfig struct {
+	Route string
+	Rate  int
+}
+
+// RouteTimeoutConfig provides the max time the handler of a route can take
+type RouteTimeoutConfig struct {
+	Route   string
+	Timeout time.Duration
+}
+
+// RouteQuotaConfig provides the max number of calls each session can make to
+// a route within a sliding time window
+type RouteQuotaConfig struct {
+	Route  string
+	Limit  int
+	Window time.Duration
+}
+
+// RouteCacheConfig provides the time the responses of a route are cached for
+type RouteCacheConfig struct {
+	Route string
+	TTL   time.Duration
+}
+
+// RouteDeprecationConfig provides the warning sent to the clients calling a
+// deprecated route
+type RouteDeprecationConfig struct {
+	Route   string
+	Message string
+}
+
+// MaintenanceWindowConfig provides a period during which the server is under
+// maintenance, with its start and end in the RFC 3339 format, and the
+// message sent to the clients connecting in it
+type MaintenanceWindowConfig struct {
+	Start   string
+	End     string
+	Message string
+}
+
 // NewDefaultPitayaConfig provides default configuration for Pitaya App
 func NewDefaultPitayaConfig() *PitayaConfig {
 	return &PitayaConfig{
-		Heartbeat: struct{ Interval time.Duration }{
-			Interval: time.Duration(30 * time.Second),
+		Heartbeat: struct {
+			Interval                 time.Duration
+			BackgroundGrace          time.Duration
+			MinInterval              time.Duration
+			MaxInterval              time.Duration
+			RetryTransientWriteError bool
+		}{
+			Interval:                 time.Duration(30 * time.Second),
+			BackgroundGrace:          0,
+			MinInterval:              0,
+			MaxInterval:              0,
+			RetryTransientWriteError: false,
 		},
 		Handler: struct {
 			Messages struct {
 				Compression bool
 			}
+			Timeouts     []RouteTimeoutConfig
+			Quotas       []RouteQuotaConfig
+			Cache        []RouteCacheConfig
+			Deprecations []RouteDeprecationConfig
+			Warmup       struct {
+				Routes []string
+			}
+			Audit struct {
+				Routes []string
+			}
+			Idempotency struct {
+				TTL time.Duration
+			}
+			Errors struct {
+				Format string
+			}
 		}{
 			Messages: struct {
 				Compression bool
 			}{
 				Compression: true,
 			},
+			Timeouts:     []RouteTimeoutConfig{},
+			Quotas:       []RouteQuotaConfig{},
+			Cache:        []RouteCacheConfig{},
+			Deprecations: []RouteDeprecationConfig{},
+			Warmup: struct {
+				Routes []string
+			}{
+				Routes: []string{},
+			},
+			Audit: struct {
+				Routes []string
+			}{
+				Routes: []string{},
+			},
+			Idempotency: struct {
+				TTL time.Duration
+			}{
+				TTL: 24 * time.Hour,
+			},
+			Errors: struct {
+				Format string
+			}{
+				Format: "default",
+			},
 		},
 		Buffer: struct {
 			Agent struct {
 				Messages int
+				Overflow struct {
+					Policy  string
+					Timeout time.Duration
+				}
 			}
 			Handler struct {
 				LocalProcess  int
@@ -67,8 +223,18 @@ func NewDefaultPitayaConfig() *PitayaConfig {
 		}{
 			Agent: struct {
 				Messages int
+				Overflow struct {
+					Policy  string
+					Timeout time.Duration
+				}
 			}{
 				Messages: 100,
+				Overflow: struct {
+					Policy  string
+					Timeout time.Duration
+				}{
+					Policy: "block",
+				},
 			},
 			Handler: struct {
 				LocalProcess  int
@@ -95,9 +261,95 @@ func NewDefaultPitayaConfig() *PitayaConfig {
 			Unique: true,
 		},
 		Metrics: struct {
-			Period time.Duration
+			Period          time.Duration
+			Sampling        []RouteSamplingConfig
+			Compressibility struct {
+				Rate float64
+			}
+			Resilient struct {
+				Enabled          bool
+				BufferSize       int
+				ErrorLogInterval time.Duration
+			}
 		}{
-			Period: time.Duration(15 * time.Second),
+			Period:   time.Duration(15 * time.Second),
+			Sampling: []RouteSamplingConfig{},
+			Compressibility: struct {
+				Rate float64
+			}{
+				Rate: 0,
+			},
+			Resilient: struct {
+				Enabled          bool
+				BufferSize       int
+				ErrorLogInterval time.Duration
+			}{
+				Enabled:          false,
+				BufferSize:       1000,
+				ErrorLogInterval: time.Duration(1 * time.Minute),
+			},
+		},
+		Conn: struct {
+			WriteTimeout         time.Duration
+			CreditTimeout        time.Duration
+			RequestTimeout       time.Duration
+			DictionaryReference  bool
+			CompressionThreshold int
+			KeepAlivePeriod      time.Duration
+			SoftCapacity         struct {
+				Sessions   int64
+				RetryAfter time.Duration
+			}
+			Maintenance struct {
+				Reject  bool
+				Windows []MaintenanceWindowConfig
+			}
+			Affinity struct {
+				Key string
+				TTL time.Duration
+			}
+		}{
+			WriteTimeout:         0,
+			CreditTimeout:        0,
+			RequestTimeout:       time.Duration(5 * time.Second),
+			DictionaryReference:  false,
+			CompressionThreshold: 0,
+			KeepAlivePeriod:      0,
+			SoftCapacity: struct {
+				Sessions   int64
+				RetryAfter time.Duration
+			}{
+				Sessions:   0,
+				RetryAfter: time.Duration(30 * time.Second),
+			},
+			Maintenance: struct {
+				Reject  bool
+				Windows []MaintenanceWindowConfig
+			}{
+				Reject:  false,
+				Windows: []MaintenanceWindowConfig{},
+			},
+			Affinity: struct {
+				Key string
+				TTL time.Duration
+			}{
+				Key: "",
+				TTL: time.Duration(24 * time.Hour),
+			},
+		},
+		Tracing: struct {
+			ConnectionSampling struct {
+				Enabled bool
+				Rate    float64
+			}
+		}{
+			ConnectionSampling: struct {
+				Enabled bool
+				Rate    float64
+			}{
+				Enabled: false,
+				Rate:    1,
+			},
 		},
 	}
 }
@@ -180,6 +432,7 @@ func NewBuilderConfig(config *Config) *BuilderConfig {
 type GRPCClientConfig struct {
 	DialTimeout    time.Duration
 	LazyConnection bool
+	PoolSize       int
 	RequestTimeout time.Duration
 }
 
@@ -188,6 +441,7 @@ func NewDefaultGRPCClientConfig() *GRPCClientConfig {
 	return &GRPCClientConfig{
 		DialTimeout:    time.Duration(5 * time.Second),
 		LazyConnection: false,
+		PoolSize:       1,
 		RequestTimeout: time.Duration(5 * time.Second),
 	}
 }
@@ -616,6 +870,63 @@ func NewETCDBindingConfig(config *Config) *ETCDBindingConfig {
 	return conf
 }
 
+// BandwidthLimitingConfig caps the bytes per second of each connection,
+// a rate of 0 disables the cap in that direction
+type BandwidthLimitingConfig struct {
+	ReadRate   int
+	ReadBurst  int
+	WriteRate  int
+	WriteBurst int
+}
+
+// NewDefaultBandwidthLimitingConfig bandwidth limiting default config
+func NewDefaultBandwidthLimitingConfig() *BandwidthLimitingConfig {
+	return &BandwidthLimitingConfig{
+		ReadRate:   0,
+		ReadBurst:  0,
+		WriteRate:  0,
+		WriteBurst: 0,
+	}
+}
+
+// NewBandwidthLimitingConfig reads from config to build bandwidth limiting configuration
+func NewBandwidthLimitingConfig(config *Config) *BandwidthLimitingConfig {
+	conf := NewDefaultBandwidthLimitingConfig()
+	if err := config.UnmarshalKey("pitaya.conn.bandwidthlimiting", &conf); err != nil {
+		panic(err)
+	}
+	return conf
+}
+
+// AdaptiveRateLimitingConfig load adaptive rate limits config
+type AdaptiveRateLimitingConfig struct {
+	Limit    int
+	MinLimit int
+	Interval time.Duration
+	LowLoad  float64
+	HighLoad float64
+}
+
+// NewDefaultAdaptiveRateLimitingConfig load adaptive rate limits default config
+func NewDefaultAdaptiveRateLimitingConfig() *AdaptiveRateLimitingConfig {
+	return &AdaptiveRateLimitingConfig{
+		Limit:    20,
+		MinLimit: 5,
+		Interval: time.Duration(time.Second),
+		LowLoad:  0.5,
+		HighLoad: 0.9,
+	}
+}
+
+// NewAdaptiveRateLimitingConfig reads from config to build load adaptive rate limiting configuration
+func NewAdaptiveRateLimitingConfig(config *Config) *AdaptiveRateLimitingConfig {
+	conf := NewDefaultAdaptiveRateLimitingConfig()
+	if err := config.UnmarshalKey("pitaya.conn.adaptiveratelimiting", &conf); err != nil {
+		panic(err)
+	}
+	return conf
+}
+
 // RateLimitingConfig rate limits config
 type RateLimitingConfig struct {
 	Limit        int
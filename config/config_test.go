@@ -179,3 +179,18 @@ func TestGet(t *testing.T) {
 		})
 	}
 }
+
+func TestNewPitayaConfigMetricsSampling(t *testing.T) {
+	t.Parallel()
+
+	cfg := viper.New()
+	cfg.Set("pitaya.metrics.sampling", []map[string]interface{}{
+		{"route": "room.room.move", "rate": 100},
+	})
+
+	conf := NewPitayaConfig(NewConfig(cfg))
+	assert.Equal(t, []RouteSamplingConfig{{Route: "room.room.move", Rate: 100}}, conf.Metrics.Sampling)
+
+	conf = NewPitayaConfig(NewConfig())
+	assert.Empty(t, conf.Metrics.Sampling)
+}
@@ -64,11 +64,15 @@ func (c *Config) fillDefaultValues() {
 	groupServiceConfig := NewDefaultMemoryGroupConfig()
 	etcdGroupServiceConfig := NewDefaultEtcdGroupServiceConfig()
 	rateLimitingConfig := NewDefaultRateLimitingConfig()
+	bandwidthLimitingConfig := NewDefaultBandwidthLimitingConfig()
+	adaptiveRateLimitingConfig := NewDefaultAdaptiveRateLimitingConfig()
 	infoRetrieverConfig := NewDefaultInfoRetrieverConfig()
 	etcdBindingConfig := NewDefaultETCDBindingConfig()
 
 	defaultsMap := map[string]interface{}{
-		"pitaya.buffer.agent.messages": pitayaConfig.Buffer.Agent.Messages,
+		"pitaya.buffer.agent.messages":         pitayaConfig.Buffer.Agent.Messages,
+		"pitaya.buffer.agent.overflow.policy":  pitayaConfig.Buffer.Agent.Overflow.Policy,
+		"pitaya.buffer.agent.overflow.timeout": pitayaConfig.Buffer.Agent.Overflow.Timeout,
 		// the max buffer size that nats will accept, if this buffer overflows, messages will begin to be dropped
 		"pitaya.buffer.handler.localprocess":                    pitayaConfig.Buffer.Handler.LocalProcess,
 		"pitaya.buffer.handler.remoteprocess":                   pitayaConfig.Buffer.Handler.RemoteProcess,
@@ -76,6 +80,7 @@ func (c *Config) fillDefaultValues() {
 		"pitaya.cluster.rpc.client.grpc.dialtimeout":            grpcRPCClientConfig.DialTimeout,
 		"pitaya.cluster.rpc.client.grpc.requesttimeout":         grpcRPCClientConfig.RequestTimeout,
 		"pitaya.cluster.rpc.client.grpc.lazyconnection":         grpcRPCClientConfig.LazyConnection,
+		"pitaya.cluster.rpc.client.grpc.poolsize":               grpcRPCClientConfig.PoolSize,
 		"pitaya.cluster.rpc.client.nats.connect":                natsRPCClientConfig.Connect,
 		"pitaya.cluster.rpc.client.nats.connectiontimeout":      natsRPCClientConfig.ConnectionTimeout,
 		"pitaya.cluster.rpc.client.nats.maxreconnectionretries": natsRPCClientConfig.MaxReconnectionRetries,
@@ -112,11 +117,28 @@ func (c *Config) fillDefaultValues() {
 		"pitaya.groups.etcd.transactiontimeout":            etcdGroupServiceConfig.TransactionTimeout,
 		"pitaya.groups.memory.tickduration":                groupServiceConfig.TickDuration,
 		"pitaya.handler.messages.compression":              pitayaConfig.Handler.Messages.Compression,
+		"pitaya.handler.timeouts":                          pitayaConfig.Handler.Timeouts,
+		"pitaya.handler.quotas":                            pitayaConfig.Handler.Quotas,
+		"pitaya.handler.cache":                             pitayaConfig.Handler.Cache,
+		"pitaya.handler.deprecations":                      pitayaConfig.Handler.Deprecations,
+		"pitaya.handler.warmup.routes":                     pitayaConfig.Handler.Warmup.Routes,
+		"pitaya.handler.audit.routes":                      pitayaConfig.Handler.Audit.Routes,
+		"pitaya.handler.idempotency.ttl":                   pitayaConfig.Handler.Idempotency.TTL,
+		"pitaya.handler.errors.format":                     pitayaConfig.Handler.Errors.Format,
 		"pitaya.heartbeat.interval":                        pitayaConfig.Heartbeat.Interval,
+		"pitaya.heartbeat.backgroundgrace":                 pitayaConfig.Heartbeat.BackgroundGrace,
+		"pitaya.heartbeat.mininterval":                     pitayaConfig.Heartbeat.MinInterval,
+		"pitaya.heartbeat.maxinterval":                     pitayaConfig.Heartbeat.MaxInterval,
+		"pitaya.heartbeat.retrytransientwriteerror":        pitayaConfig.Heartbeat.RetryTransientWriteError,
 		"pitaya.metrics.prometheus.additionalTags":         prometheusConfig.Prometheus.AdditionalLabels,
 		"pitaya.metrics.constTags":                         prometheusConfig.ConstLabels,
 		"pitaya.metrics.custom":                            customMetricsSpec,
 		"pitaya.metrics.periodicMetrics.period":            pitayaConfig.Metrics.Period,
+		"pitaya.metrics.sampling":                          pitayaConfig.Metrics.Sampling,
+		"pitaya.metrics.compressibility.rate":              pitayaConfig.Metrics.Compressibility.Rate,
+		"pitaya.metrics.resilient.enabled":                 pitayaConfig.Metrics.Resilient.Enabled,
+		"pitaya.metrics.resilient.buffersize":              pitayaConfig.Metrics.Resilient.BufferSize,
+		"pitaya.metrics.resilient.errorloginterval":        pitayaConfig.Metrics.Resilient.ErrorLogInterval,
 		"pitaya.metrics.prometheus.enabled":                builderConfig.Metrics.Prometheus.Enabled,
 		"pitaya.metrics.prometheus.port":                   prometheusConfig.Prometheus.Port,
 		"pitaya.metrics.statsd.enabled":                    builderConfig.Metrics.Statsd.Enabled,
@@ -130,7 +152,30 @@ func (c *Config) fillDefaultValues() {
 		"pitaya.conn.ratelimiting.limit":                   rateLimitingConfig.Limit,
 		"pitaya.conn.ratelimiting.interval":                rateLimitingConfig.Interval,
 		"pitaya.conn.ratelimiting.forcedisable":            rateLimitingConfig.ForceDisable,
+		"pitaya.conn.bandwidthlimiting.readrate":           bandwidthLimitingConfig.ReadRate,
+		"pitaya.conn.bandwidthlimiting.readburst":          bandwidthLimitingConfig.ReadBurst,
+		"pitaya.conn.bandwidthlimiting.writerate":          bandwidthLimitingConfig.WriteRate,
+		"pitaya.conn.bandwidthlimiting.writeburst":         bandwidthLimitingConfig.WriteBurst,
+		"pitaya.conn.adaptiveratelimiting.limit":           adaptiveRateLimitingConfig.Limit,
+		"pitaya.conn.adaptiveratelimiting.minlimit":        adaptiveRateLimitingConfig.MinLimit,
+		"pitaya.conn.adaptiveratelimiting.interval":        adaptiveRateLimitingConfig.Interval,
+		"pitaya.conn.adaptiveratelimiting.lowload":         adaptiveRateLimitingConfig.LowLoad,
+		"pitaya.conn.adaptiveratelimiting.highload":        adaptiveRateLimitingConfig.HighLoad,
+		"pitaya.conn.writetimeout":                         pitayaConfig.Conn.WriteTimeout,
+		"pitaya.conn.credittimeout":                        pitayaConfig.Conn.CreditTimeout,
+		"pitaya.conn.requesttimeout":                       pitayaConfig.Conn.RequestTimeout,
+		"pitaya.conn.dictionaryreference":                  pitayaConfig.Conn.DictionaryReference,
+		"pitaya.conn.compressionthreshold":                 pitayaConfig.Conn.CompressionThreshold,
+		"pitaya.conn.keepaliveperiod":                      pitayaConfig.Conn.KeepAlivePeriod,
+		"pitaya.conn.softcapacity.sessions":                pitayaConfig.Conn.SoftCapacity.Sessions,
+		"pitaya.conn.softcapacity.retryafter":              pitayaConfig.Conn.SoftCapacity.RetryAfter,
+		"pitaya.conn.maintenance.reject":                   pitayaConfig.Conn.Maintenance.Reject,
+		"pitaya.conn.maintenance.windows":                  pitayaConfig.Conn.Maintenance.Windows,
+		"pitaya.conn.affinity.key":                         pitayaConfig.Conn.Affinity.Key,
+		"pitaya.conn.affinity.ttl":                         pitayaConfig.Conn.Affinity.TTL,
 		"pitaya.session.unique":                            pitayaConfig.Session.Unique,
+		"pitaya.tracing.connectionsampling.enabled":        pitayaConfig.Tracing.ConnectionSampling.Enabled,
+		"pitaya.tracing.connectionsampling.rate":           pitayaConfig.Tracing.ConnectionSampling.Rate,
 		"pitaya.worker.concurrency":                        workerConfig.Concurrency,
 		"pitaya.worker.redis.pool":                         workerConfig.Redis.Pool,
 		"pitaya.worker.redis.url":                          workerConfig.Redis.ServerURL,
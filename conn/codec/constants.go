@@ -26,6 +26,11 @@ import "errors"
 const (
 	HeadLength    = 4
 	MaxPacketSize = 1 << 24 //16MB
+
+	// FlagsMarker is set in the packet type byte of the packets carrying
+	// flags, whose data is then preceded by FlagsLength bytes of flags
+	FlagsMarker = 0x80
+	FlagsLength = 1
 )
 
 // ErrPacketSizeExcced is the error used for encode/decode.
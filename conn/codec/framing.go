@@ -0,0 +1,66 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package codec
+
+import (
+	"github.com/topfreegames/pitaya/v2/conn/packet"
+)
+
+// PacketFraming is the wire format of the packets exchanged with the clients
+// of an acceptor. The connections read the header of each packet, of
+// HeaderLength bytes, and then the size of data ParseHeader returns for it,
+// the packets read are decoded by Decode and the ones sent to the clients
+// encoded by Encode, so framings with a fixed size header carrying the length
+// of the data, like the Pomelo one, can be used without changing the agent
+type PacketFraming interface {
+	PacketEncoder
+	PacketDecoder
+	// HeaderLength returns the length of the packet header
+	HeaderLength() int
+	// ParseHeader returns the length of the data following header and the
+	// type of the packet. header is shorter than HeaderLength if the
+	// connection was closed in the middle of it, which must be an error
+	ParseHeader(header []byte) (int, packet.Type, error)
+}
+
+// PomeloPacketFraming is the Pomelo packet framing, used by default
+type PomeloPacketFraming struct {
+	*PomeloPacketEncoder
+	*PomeloPacketDecoder
+}
+
+// NewPomeloPacketFraming ctor
+func NewPomeloPacketFraming() *PomeloPacketFraming {
+	return &PomeloPacketFraming{
+		PomeloPacketEncoder: NewPomeloPacketEncoder(),
+		PomeloPacketDecoder: NewPomeloPacketDecoder(),
+	}
+}
+
+// HeaderLength returns the length of the Pomelo packet header
+func (f *PomeloPacketFraming) HeaderLength() int {
+	return HeadLength
+}
+
+// ParseHeader parses a Pomelo packet header
+func (f *PomeloPacketFraming) ParseHeader(header []byte) (int, packet.Type, error) {
+	return ParseHeader(header)
+}
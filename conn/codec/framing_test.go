@@ -0,0 +1,49 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package codec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/conn/packet"
+)
+
+func TestPomeloPacketFraming(t *testing.T) {
+	framing := NewPomeloPacketFraming()
+	assert.Equal(t, HeadLength, framing.HeaderLength())
+
+	data, err := framing.Encode(packet.Data, []byte{0x01, 0x02})
+	assert.NoError(t, err)
+
+	size, typ, err := framing.ParseHeader(data[:framing.HeaderLength()])
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+	assert.Equal(t, packet.Type(packet.Data), typ)
+
+	_, _, err = framing.ParseHeader(data[:framing.HeaderLength()-1])
+	assert.Equal(t, packet.ErrInvalidPomeloHeader, err)
+
+	packets, err := framing.Decode(data)
+	assert.NoError(t, err)
+	assert.Len(t, packets, 1)
+	assert.Equal(t, []byte{0x01, 0x02}, packets[0].Data)
+}
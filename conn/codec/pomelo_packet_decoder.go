@@ -54,13 +54,17 @@ func (c *PomeloPacketDecoder) Decode(data []byte) ([]*packet.Packet, error) {
 	}
 
 	// first time
+	flagged := hasFlags(buf)
 	size, typ, err := c.forward(buf)
 	if err != nil {
 		return nil, err
 	}
 
 	for size <= buf.Len() {
-		p := &packet.Packet{Type: typ, Length: size, Data: buf.Next(size)}
+		p, err := newPacket(typ, flagged, buf.Next(size))
+		if err != nil {
+			return nil, err
+		}
 		packets = append(packets, p)
 
 		// if no more packets, break
@@ -68,6 +72,7 @@ func (c *PomeloPacketDecoder) Decode(data []byte) ([]*packet.Packet, error) {
 			break
 		}
 
+		flagged = hasFlags(buf)
 		size, typ, err = c.forward(buf)
 		if err != nil {
 			return nil, err
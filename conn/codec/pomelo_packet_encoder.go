@@ -40,20 +40,38 @@ func NewPomeloPacketEncoder() *PomeloPacketEncoder {
 // --------|------------------------|--------
 // 1 byte packet type, 3 bytes packet data length(big end), and data segment
 func (e *PomeloPacketEncoder) Encode(typ packet.Type, data []byte) ([]byte, error) {
+	return e.EncodeWithFlags(typ, 0, data)
+}
+
+// EncodeWithFlags encodes a packet like Encode, carrying flags along it. The
+// packets with flags have FlagsMarker set in their type byte and a flags byte
+// before their data, counted in the length, so peers unaware of flags can
+// still frame them. Packets without flags are encoded exactly as by Encode
+//
+// -<type|marker>-|--------<length>--------|-<flags>-|-<data>-
+func (e *PomeloPacketEncoder) EncodeWithFlags(typ packet.Type, flags packet.Flags, data []byte) ([]byte, error) {
 	if typ < packet.Handshake || typ > packet.Kick {
 		return nil, packet.ErrWrongPomeloPacketType
 	}
 
-	if len(data) > MaxPacketSize {
+	head := HeadLength
+	if flags != 0 {
+		head += FlagsLength
+	}
+	length := len(data) + head - HeadLength
+	if length > MaxPacketSize {
 		return nil, ErrPacketSizeExcced
 	}
 
-	p := &packet.Packet{Type: typ, Length: len(data)}
-	buf := make([]byte, p.Length+HeadLength)
-	buf[0] = byte(p.Type)
+	buf := make([]byte, len(data)+head)
+	buf[0] = byte(typ)
+	if flags != 0 {
+		buf[0] |= FlagsMarker
+		buf[HeadLength] = byte(flags)
+	}
 
-	copy(buf[1:HeadLength], IntToBytes(p.Length))
-	copy(buf[HeadLength:], data)
+	copy(buf[1:HeadLength], IntToBytes(length))
+	copy(buf[head:], data)
 
 	return buf, nil
 }
@@ -49,3 +49,73 @@ func TestEncode(t *testing.T) {
 		})
 	}
 }
+
+func TestEncodeWithFlags(t *testing.T) {
+	t.Parallel()
+
+	ppe := NewPomeloPacketEncoder()
+
+	encoded, err := ppe.EncodeWithFlags(packet.Data, packet.FlagCompressed|packet.FlagLastInBatch, []byte{0x01, 0x02})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{packet.Data | FlagsMarker, 0x00, 0x00, 0x03, 0x05, 0x01, 0x02}, encoded)
+
+	plain, err := ppe.Encode(packet.Data, []byte{0x01, 0x02})
+	assert.NoError(t, err)
+	encoded, err = ppe.EncodeWithFlags(packet.Data, 0, []byte{0x01, 0x02})
+	assert.NoError(t, err)
+	assert.Equal(t, plain, encoded)
+
+	_, err = ppe.EncodeWithFlags(packet.Data, packet.FlagEncrypted, make([]byte, MaxPacketSize))
+	assert.Equal(t, ErrPacketSizeExcced, err)
+}
+
+func TestEncodeWithFlagsRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	flagSets := []packet.Flags{
+		0,
+		packet.FlagCompressed,
+		packet.FlagEncrypted,
+		packet.FlagLastInBatch,
+		packet.FlagCompressed | packet.FlagEncrypted,
+		packet.FlagCompressed | packet.FlagEncrypted | packet.FlagLastInBatch,
+		0xff,
+	}
+	ppe := NewPomeloPacketEncoder()
+	ppd := NewPomeloPacketDecoder()
+
+	var stream []byte
+	var expected []*packet.Packet
+	for i, flags := range flagSets {
+		data := []byte{byte(i), 0xaa}
+		if i%2 == 0 {
+			data = []byte{}
+		}
+		encoded, err := ppe.EncodeWithFlags(packet.Data, flags, data)
+		assert.NoError(t, err)
+
+		size, typ, err := ParseHeader(encoded[:HeadLength])
+		assert.NoError(t, err)
+		assert.Equal(t, packet.Type(packet.Data), typ)
+		assert.Equal(t, len(encoded)-HeadLength, size)
+
+		stream = append(stream, encoded...)
+		expected = append(expected, &packet.Packet{Type: packet.Data, Length: len(data), Data: data, Flags: flags})
+	}
+
+	packets, err := ppd.Decode(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, packets)
+}
+
+func TestDecodeFlaggedPacketWithoutFlags(t *testing.T) {
+	t.Parallel()
+
+	ppd := NewPomeloPacketDecoder()
+
+	_, err := ppd.Decode([]byte{packet.Data | FlagsMarker, 0x00, 0x00, 0x01, 0x00})
+	assert.Equal(t, packet.ErrInvalidPacketFlags, err)
+
+	_, err = ppd.Decode([]byte{packet.Data | FlagsMarker, 0x00, 0x00, 0x00})
+	assert.Equal(t, packet.ErrInvalidPacketFlags, err)
+}
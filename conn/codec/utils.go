@@ -1,13 +1,17 @@
 package codec
 
-import "github.com/topfreegames/pitaya/v2/conn/packet"
+import (
+	"bytes"
+
+	"github.com/topfreegames/pitaya/v2/conn/packet"
+)
 
 // ParseHeader parses a packet header and returns its dataLen and packetType or an error
 func ParseHeader(header []byte) (int, packet.Type, error) {
 	if len(header) != HeadLength {
 		return 0, 0x00, packet.ErrInvalidPomeloHeader
 	}
-	typ := header[0]
+	typ := header[0] &^ FlagsMarker
 	if typ < packet.Handshake || typ > packet.Kick {
 		return 0, 0x00, packet.ErrWrongPomeloPacketType
 	}
@@ -21,6 +25,25 @@ func ParseHeader(header []byte) (int, packet.Type, error) {
 	return size, packet.Type(typ), nil
 }
 
+// hasFlags reports whether the packet header at the start of buf is marked as
+// carrying flags
+func hasFlags(buf *bytes.Buffer) bool {
+	return buf.Len() > 0 && buf.Bytes()[0]&FlagsMarker != 0
+}
+
+// newPacket builds a packet from its body, taking the flags off its start
+// when it carries them
+func newPacket(typ packet.Type, flagged bool, body []byte) (*packet.Packet, error) {
+	if !flagged {
+		return &packet.Packet{Type: typ, Length: len(body), Data: body}, nil
+	}
+	if len(body) < FlagsLength || body[0] == 0 {
+		return nil, packet.ErrInvalidPacketFlags
+	}
+	data := body[FlagsLength:]
+	return &packet.Packet{Type: typ, Length: len(data), Data: data, Flags: packet.Flags(body[0])}, nil
+}
+
 // BytesToInt decode packet data length byte to int(Big end)
 func BytesToInt(b []byte) int {
 	result := 0
@@ -21,6 +21,9 @@
 package message
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -39,6 +42,8 @@ const (
 )
 
 const (
+	idempotencyKeyMask   = 0x80
+	dryRunMask           = 0x40
 	errorMask            = 0x20
 	gzipMask             = 0x10
 	msgRouteCompressMask = 0x01
@@ -62,9 +67,10 @@ var (
 
 // Errors that could be occurred in message codec
 var (
-	ErrWrongMessageType  = errors.New("wrong message type")
-	ErrInvalidMessage    = errors.New("invalid message")
-	ErrRouteInfoNotFound = errors.New("route info not found in dictionary")
+	ErrWrongMessageType      = errors.New("wrong message type")
+	ErrInvalidMessage        = errors.New("invalid message")
+	ErrRouteInfoNotFound     = errors.New("route info not found in dictionary")
+	ErrIdempotencyKeyTooLong = errors.New("idempotency key longer than 255 bytes")
 )
 
 // Message represents a unmarshaled message or a message which to be marshaled
@@ -75,6 +81,10 @@ type Message struct {
 	Data       []byte // payload
 	compressed bool   // is message compressed
 	Err        bool   // is an error message
+	DryRun     bool   // is a request that must be validated without side effects
+	// IdempotencyKey is the key set by the client so retries of a request
+	// can be detected, empty if none was set
+	IdempotencyKey string
 }
 
 // New returns a new message instance
@@ -88,12 +98,14 @@ func New(err ...bool) *Message {
 
 // String, implementation of fmt.Stringer interface
 func (m *Message) String() string {
-	return fmt.Sprintf("Type: %s, ID: %d, Route: %s, Compressed: %t, Error: %t, Data: %v, BodyLength: %d",
+	return fmt.Sprintf("Type: %s, ID: %d, Route: %s, Compressed: %t, Error: %t, DryRun: %t, IdempotencyKey: %s, Data: %v, BodyLength: %d",
 		types[m.Type],
 		m.ID,
 		m.Route,
 		m.compressed,
 		m.Err,
+		m.DryRun,
+		m.IdempotencyKey,
 		m.Data,
 		len(m.Data))
 }
@@ -146,6 +158,16 @@ func GetDictionary() map[string]uint16 {
 	return dict
 }
 
+// GetDictionaryHash returns the hex encoded SHA-256 of the routes map JSON
+// with sorted keys, sent in the handshake instead of the routes map to the
+// clients that cache it
+func GetDictionaryHash() string {
+	// a map of strings to numbers always marshals
+	data, _ := json.Marshal(GetDictionary())
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 func (t *Type) String() string {
 	return types[*t]
 }
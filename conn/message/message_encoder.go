@@ -60,6 +60,10 @@ func (me *MessagesEncoder) IsCompressionEnabled() bool {
 // | push     |----011-|<route>             |
 // ------------------------------------------
 // The figure above indicates that the bit does not affect the type of message.
+// Besides the type, the flag field carries the route compression (bit 1), gzip
+// (bit 5), error (bit 6), dry run (bit 7) and idempotency key (bit 8) flags.
+// When the idempotency key flag is set the route is followed by the key length,
+// in one byte, and the key.
 // See ref: https://github.com/topfreegames/pitaya/v2/blob/master/docs/communication_protocol.md
 func (me *MessagesEncoder) Encode(message *Message) ([]byte, error) {
 	if invalidType(message.Type) {
@@ -80,6 +84,17 @@ func (me *MessagesEncoder) Encode(message *Message) ([]byte, error) {
 		flag |= errorMask
 	}
 
+	if message.DryRun {
+		flag |= dryRunMask
+	}
+
+	if message.IdempotencyKey != "" {
+		if len(message.IdempotencyKey) > 255 {
+			return nil, ErrIdempotencyKeyTooLong
+		}
+		flag |= idempotencyKeyMask
+	}
+
 	buf = append(buf, flag)
 
 	if message.Type == Request || message.Type == Response {
@@ -98,6 +113,7 @@ func (me *MessagesEncoder) Encode(message *Message) ([]byte, error) {
 	}
 
 	if routable(message.Type) {
+		countRouteUsage(message.Route, compressed)
 		if compressed {
 			buf = append(buf, byte((code>>8)&0xFF))
 			buf = append(buf, byte(code&0xFF))
@@ -107,6 +123,11 @@ func (me *MessagesEncoder) Encode(message *Message) ([]byte, error) {
 		}
 	}
 
+	if message.IdempotencyKey != "" {
+		buf = append(buf, byte(len(message.IdempotencyKey)))
+		buf = append(buf, []byte(message.IdempotencyKey)...)
+	}
+
 	if me.DataCompression {
 		d, err := compression.DeflateData(message.Data)
 		if err != nil {
@@ -160,6 +181,7 @@ func Decode(data []byte) (*Message, error) {
 	}
 
 	m.Err = flag&errorMask == errorMask
+	m.DryRun = flag&dryRunMask == dryRunMask
 
 	if routable(m.Type) {
 		if flag&msgRouteCompressMask == 1 {
@@ -180,6 +202,20 @@ func Decode(data []byte) (*Message, error) {
 			m.Route = string(data[offset:(offset + int(rl))])
 			offset += int(rl)
 		}
+		countRouteUsage(m.Route, m.compressed)
+	}
+
+	if flag&idempotencyKeyMask == idempotencyKeyMask {
+		if offset >= len(data) {
+			return nil, ErrInvalidMessage
+		}
+		kl := int(data[offset])
+		offset++
+		if offset+kl > len(data) {
+			return nil, ErrInvalidMessage
+		}
+		m.IdempotencyKey = string(data[offset:(offset + kl)])
+		offset += kl
 	}
 
 	m.Data = data[offset:]
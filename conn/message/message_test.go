@@ -1,10 +1,13 @@
 package message
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -143,6 +146,66 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestEncodeDecodeDryRun(t *testing.T) {
+	tables := []struct {
+		name   string
+		dryRun bool
+	}{
+		{"dry_run", true},
+		{"not_dry_run", false},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			message := &Message{Type: Request, ID: 1, Route: "a.b", Data: []byte("data"), DryRun: table.dryRun}
+			encoded, err := NewMessagesEncoder(false).Encode(message)
+			assert.NoError(t, err)
+			assert.Equal(t, table.dryRun, encoded[0]&dryRunMask == dryRunMask)
+
+			decoded, err := Decode(encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, message, decoded)
+		})
+	}
+}
+
+func TestEncodeDecodeIdempotencyKey(t *testing.T) {
+	tables := []struct {
+		name string
+		key  string
+	}{
+		{"with_key", "purchase-1234"},
+		{"without_key", ""},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			message := &Message{Type: Request, ID: 1, Route: "a.b", Data: []byte("data"), IdempotencyKey: table.key}
+			encoded, err := NewMessagesEncoder(false).Encode(message)
+			assert.NoError(t, err)
+			assert.Equal(t, table.key != "", encoded[0]&idempotencyKeyMask == idempotencyKeyMask)
+
+			decoded, err := Decode(encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, message, decoded)
+		})
+	}
+}
+
+func TestEncodeIdempotencyKeyTooLong(t *testing.T) {
+	message := &Message{Type: Request, ID: 1, Route: "a.b", IdempotencyKey: strings.Repeat("k", 256)}
+	_, err := NewMessagesEncoder(false).Encode(message)
+	assert.Equal(t, ErrIdempotencyKeyTooLong, err)
+}
+
+func TestDecodeTruncatedIdempotencyKey(t *testing.T) {
+	encoded, err := NewMessagesEncoder(false).Encode(&Message{Type: Notify, Route: "a.b", IdempotencyKey: "key"})
+	assert.NoError(t, err)
+
+	_, err = Decode(encoded[:len(encoded)-1])
+	assert.Equal(t, ErrInvalidMessage, err)
+}
+
 var dictTables = map[string]struct {
 	dicts  []map[string]uint16
 	routes map[string]uint16
@@ -209,3 +272,14 @@ func TestGetDictionary(t *testing.T) {
 	// make sure we're copying the routes maps
 	assert.NotEqual(t, fmt.Sprintf("%p", routes), fmt.Sprintf("%p", dict))
 }
+
+func TestGetDictionaryHash(t *testing.T) {
+	defer resetDicts(t)
+	assert.Nil(t, SetDictionary(map[string]uint16{"b": 2, "a": 1}))
+
+	sum := sha256.Sum256([]byte(`{"a":1,"b":2}`))
+	assert.Equal(t, hex.EncodeToString(sum[:]), GetDictionaryHash())
+
+	assert.Nil(t, SetDictionary(map[string]uint16{"c": 3}))
+	assert.NotEqual(t, hex.EncodeToString(sum[:]), GetDictionaryHash())
+}
@@ -0,0 +1,100 @@
+// Copyright (c) nano Author and TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package message
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// maxTrackedRoutes bounds the routes sent as full strings whose usage is
+// tracked, as clients can send any route. Dictionary routes are always tracked
+const maxTrackedRoutes = 1024
+
+var (
+	routeUsages        sync.Map // route to *routeUsage
+	trackedRoutesCount int64
+)
+
+type routeUsage struct {
+	compressed   uint64
+	uncompressed uint64
+}
+
+// RouteUsage tells how many messages encoded or decoded by the message codec
+// carried a route, either compressed with its dictionary code or as a full
+// string, showing how effective the dictionary is
+type RouteUsage struct {
+	Route        string `json:"route"`
+	InDictionary bool   `json:"inDictionary"`
+	Code         uint16 `json:"code"`
+	Compressed   uint64 `json:"compressed"`
+	Uncompressed uint64 `json:"uncompressed"`
+}
+
+// GetRouteUsage returns the usage of the dictionary routes, including the
+// unused ones, and of the routes sent as full strings, sorted by route
+func GetRouteUsage() []RouteUsage {
+	dict := GetDictionary()
+	usages := make([]RouteUsage, 0, len(dict))
+	for route, code := range dict {
+		usages = append(usages, RouteUsage{Route: route, InDictionary: true, Code: code})
+	}
+	routeUsages.Range(func(key, value interface{}) bool {
+		route := key.(string)
+		if _, ok := dict[route]; !ok {
+			usages = append(usages, RouteUsage{Route: route})
+		}
+		return true
+	})
+	for i := range usages {
+		if value, ok := routeUsages.Load(usages[i].Route); ok {
+			usage := value.(*routeUsage)
+			usages[i].Compressed = atomic.LoadUint64(&usage.compressed)
+			usages[i].Uncompressed = atomic.LoadUint64(&usage.uncompressed)
+		}
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Route < usages[j].Route
+	})
+	return usages
+}
+
+// countRouteUsage counts a message carrying route, compressed or not
+func countRouteUsage(route string, compressed bool) {
+	value, ok := routeUsages.Load(route)
+	if !ok {
+		if !compressed && atomic.LoadInt64(&trackedRoutesCount) >= maxTrackedRoutes {
+			return
+		}
+		var loaded bool
+		if value, loaded = routeUsages.LoadOrStore(route, &routeUsage{}); !loaded {
+			atomic.AddInt64(&trackedRoutesCount, 1)
+		}
+	}
+	usage := value.(*routeUsage)
+	if compressed {
+		atomic.AddUint64(&usage.compressed, 1)
+	} else {
+		atomic.AddUint64(&usage.uncompressed, 1)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) nano Author and TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package message
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func findRouteUsage(route string) (RouteUsage, bool) {
+	for _, usage := range GetRouteUsage() {
+		if usage.Route == route {
+			return usage, true
+		}
+	}
+	return RouteUsage{}, false
+}
+
+func TestGetRouteUsage(t *testing.T) {
+	dictRoute := uuid.New().String()
+	unusedRoute := uuid.New().String()
+	fullRoute := uuid.New().String()
+	assert.NoError(t, SetDictionary(map[string]uint16{dictRoute: 60001, unusedRoute: 60002}))
+	defer resetDicts(t)
+
+	usage, ok := findRouteUsage(unusedRoute)
+	assert.True(t, ok)
+	assert.Equal(t, RouteUsage{Route: unusedRoute, InDictionary: true, Code: 60002}, usage)
+	_, ok = findRouteUsage(fullRoute)
+	assert.False(t, ok)
+
+	encoder := NewMessagesEncoder(false)
+	for _, route := range []string{dictRoute, dictRoute, fullRoute} {
+		encoded, err := encoder.Encode(&Message{Type: Push, Route: route, Data: []byte("d")})
+		assert.NoError(t, err)
+		_, err = encoder.Decode(encoded)
+		assert.NoError(t, err)
+	}
+	_, err := encoder.Encode(&Message{Type: Response, ID: 1, Data: []byte("d")})
+	assert.NoError(t, err)
+
+	usage, _ = findRouteUsage(dictRoute)
+	assert.Equal(t, RouteUsage{Route: dictRoute, InDictionary: true, Code: 60001, Compressed: 4}, usage)
+	usage, _ = findRouteUsage(fullRoute)
+	assert.Equal(t, RouteUsage{Route: fullRoute, Uncompressed: 2}, usage)
+	usage, _ = findRouteUsage(unusedRoute)
+	assert.Equal(t, uint64(0), usage.Compressed+usage.Uncompressed)
+	_, ok = findRouteUsage("")
+	assert.False(t, ok)
+
+	usages := GetRouteUsage()
+	for i := 1; i < len(usages); i++ {
+		assert.True(t, usages[i-1].Route < usages[i].Route)
+	}
+}
+
+func TestCountRouteUsageBoundsFullStringRoutes(t *testing.T) {
+	for i := 0; i < maxTrackedRoutes; i++ {
+		countRouteUsage(uuid.New().String(), false)
+	}
+
+	untracked := uuid.New().String()
+	countRouteUsage(untracked, false)
+	_, ok := findRouteUsage(untracked)
+	assert.False(t, ok)
+
+	dictRoute := uuid.New().String()
+	assert.NoError(t, SetDictionary(map[string]uint16{dictRoute: 60003}))
+	defer resetDicts(t)
+	countRouteUsage(dictRoute, true)
+	usage, _ := findRouteUsage(dictRoute)
+	assert.Equal(t, uint64(1), usage.Compressed)
+}
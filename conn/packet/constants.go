@@ -43,8 +43,41 @@ const (
 	Kick = 0x05 // disconnect message from server
 )
 
+// Flags are per packet bits sent along the packet type, see the codec for
+// how they are written in the packet header
+type Flags byte
+
+const (
+	// FlagCompressed marks a packet whose data is compressed
+	FlagCompressed Flags = 1 << iota
+
+	// FlagEncrypted marks a packet whose data is encrypted
+	FlagEncrypted
+
+	// FlagLastInBatch marks the last packet of a batch
+	FlagLastInBatch
+)
+
+// Has reports whether all the bits of flag are set
+func (f Flags) Has(flag Flags) bool {
+	return f&flag == flag
+}
+
+// Set returns f with the bits of flag set
+func (f Flags) Set(flag Flags) Flags {
+	return f | flag
+}
+
+// Clear returns f with the bits of flag cleared
+func (f Flags) Clear(flag Flags) Flags {
+	return f &^ flag
+}
+
 // ErrWrongPomeloPacketType represents a wrong packet type.
 var ErrWrongPomeloPacketType = errors.New("wrong packet type")
 
 // ErrInvalidPomeloHeader represents an invalid header
 var ErrInvalidPomeloHeader = errors.New("invalid header")
+
+// ErrInvalidPacketFlags represents a packet marked as flagged without flags
+var ErrInvalidPacketFlags = errors.New("invalid packet flags")
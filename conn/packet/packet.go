@@ -29,6 +29,7 @@ type Packet struct {
 	Type   Type
 	Length int
 	Data   []byte
+	Flags  Flags
 }
 
 //New create a Packet instance.
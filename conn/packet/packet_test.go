@@ -53,3 +53,19 @@ func TestString(t *testing.T) {
 		})
 	}
 }
+
+func TestFlags(t *testing.T) {
+	var f Flags
+	assert.False(t, f.Has(FlagCompressed))
+
+	f = f.Set(FlagCompressed).Set(FlagLastInBatch)
+	assert.True(t, f.Has(FlagCompressed))
+	assert.True(t, f.Has(FlagLastInBatch))
+	assert.True(t, f.Has(FlagCompressed|FlagLastInBatch))
+	assert.False(t, f.Has(FlagEncrypted))
+	assert.False(t, f.Has(FlagCompressed|FlagEncrypted))
+
+	f = f.Clear(FlagCompressed)
+	assert.False(t, f.Has(FlagCompressed))
+	assert.Equal(t, FlagLastInBatch, f)
+}
@@ -41,11 +41,47 @@ const (
 
 	// KickRoute is the route used for kicking an user
 	KickRoute = "sys.kick"
+
+	// ShutdownRoute is the route used for notifying clients that the server is shutting down
+	ShutdownRoute = "sys.shutdown"
+
+	// CreditRoute is the route used by clients for granting flow control credit
+	CreditRoute = "sys.credit"
+
+	// BackgroundRoute is the route used by clients for notifying that they are
+	// going to the background and will not answer heartbeats for a while
+	BackgroundRoute = "sys.background"
+
+	// ProgressRoute is the route used for notifying clients of the progress
+	// of a request still being handled
+	ProgressRoute = "sys.progress"
+
+	// RTTRoute is the route used by clients for reporting their measured round trip time
+	RTTRoute = "sys.rtt"
+
+	// DisconnectRoute is the route used by clients for reporting why they are
+	// disconnecting right before closing the connection
+	DisconnectRoute = "sys.disconnect"
+
+	// DeprecationRoute is the route used for warning clients that they called
+	// a deprecated route
+	DeprecationRoute = "sys.deprecation"
+
+	// MaintenanceRoute is the route used for notifying clients that connected
+	// during a maintenance window of the server
+	MaintenanceRoute = "sys.maintenance"
 )
 
 // SessionCtxKey is the context key where the session will be set
 var SessionCtxKey = "session"
 
+// ProgressCtxKey is the context key where the progress handle of a request will be set
+var ProgressCtxKey = "progress"
+
+// IdempotencyStoreCtxKey is the context key where the store used to detect
+// retried requests will be set
+var IdempotencyStoreCtxKey = "idempotency-store"
+
 // LoggerCtxKey is the context key where the default logger will be set
 var LoggerCtxKey = "default-logger"
 
@@ -59,6 +95,10 @@ var PropagateCtxKey = propagateKey{}
 // the propagate key
 var SpanPropagateCtxKey = "opentracing-span"
 
+// OTelSpanPropagateCtxKey is the key holding the opentelemetry span carrier
+// inside the propagatable context
+var OTelSpanPropagateCtxKey = "otel-span"
+
 // PeerIDKey is the key holding the peer id to be sent over the context
 var PeerIDKey = "peer.id"
 
@@ -74,6 +114,22 @@ var RequestIDKey = "request.id"
 // RouteKey is the key holding the request route to be sent over the context
 var RouteKey = "req-route"
 
+// DryRunKey is the key holding whether the request is a dry run to be sent over the context
+var DryRunKey = "req-dry-run"
+
+// IdempotencyKeyKey is the key holding the idempotency key set by the client
+// on the request to be sent over the context
+var IdempotencyKeyKey = "req-idempotency-key"
+
+// ConnectionQualityKey is the key holding the quality of the connection of the
+// client that made the request to be sent over the context
+var ConnectionQualityKey = "conn-quality"
+
+// SerializerKey is the key holding the name of the serializer of the client
+// that made the request to be sent over the context, it is only set when the
+// client does not use the app serializer
+var SerializerKey = "serializer"
+
 // MetricTagsKey is the key holding request tags to be sent over the context
 // to be reported
 var MetricTagsKey = "metric-tags"
@@ -93,6 +149,10 @@ var GRPCExternalPortKey = "grpc-external-port"
 // RegionKey is the key to save the region server is on
 var RegionKey = "region"
 
+// AffinityServerIDKey is the session data key holding the id of the server a
+// reconnecting client presented a valid affinity token for
+const AffinityServerIDKey = "affinityServerID"
+
 // IP constants
 const (
 	IPVersionKey = "ipversion"
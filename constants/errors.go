@@ -37,8 +37,11 @@ var (
 	ErrEtcdLeaseNotFound              = errors.New("etcd lease not found in group")
 	ErrFrontSessionCantPushToFront    = errors.New("frontend session can't push to front")
 	ErrFrontendTypeNotSpecified       = errors.New("for using SendPushToUsers from a backend server you have to specify a valid frontendType")
+	ErrHandlerTimeout                 = errors.New("handler timed out")
+	ErrRouteQuotaExceeded             = errors.New("route quota exceeded")
 	ErrGroupAlreadyExists             = errors.New("group already exists")
 	ErrGroupNotFound                  = errors.New("group not found")
+	ErrInvalidRequestBody             = errors.New("request body does not match the route message type")
 	ErrIllegalUID                     = errors.New("illegal uid")
 	ErrInvalidCertificates            = errors.New("certificates must be exactly two")
 	ErrInvalidSpanCarrier             = errors.New("tracing: invalid span carrier")
@@ -72,17 +75,31 @@ var (
 	ErrReplyShouldBeNotNull           = errors.New("reply must not be null")
 	ErrReplyShouldBePtr               = errors.New("reply must be a pointer")
 	ErrRequestOnNotify                = errors.New("tried to request a notify route")
+	ErrRequestDeadlineExceeded        = errors.New("request deadline exceeded before the rpc was sent")
 	ErrRouterNotInitialized           = errors.New("router is not initialized")
 	ErrServerNotFound                 = errors.New("server not found")
+	ErrServerOverCapacity             = errors.New("server is over capacity, retry later")
+	ErrServerUnderMaintenance         = errors.New("server is under maintenance, retry later")
+	ErrServerWarmingUp                = errors.New("server is warming up, retry later")
 	ErrServiceDiscoveryNotInitialized = errors.New("service discovery client is not initialized")
 	ErrSessionAlreadyBound            = errors.New("session is already bound to an uid")
 	ErrSessionDuplication             = errors.New("session exists in the current group")
 	ErrSessionNotFound                = errors.New("session not found")
 	ErrSessionOnNotify                = errors.New("current session working on notify mode")
 	ErrTimeoutTerminatingBinaryModule = errors.New("timeout waiting to binary module to die")
+	ErrUnknownSerializer              = errors.New("serializer of the client is unknown to the server")
 	ErrWrongValueType                 = errors.New("protobuf: convert on wrong type value")
 	ErrRateLimitExceeded              = errors.New("rate limit exceeded")
 	ErrReceivedMsgSmallerThanExpected = errors.New("received less data than expected, EOF?")
 	ErrReceivedMsgBiggerThanExpected  = errors.New("received more data than expected")
 	ErrConnectionClosed               = errors.New("client connection closed")
+	ErrHandshakeTooLarge              = errors.New("handshake exceeds the max size")
+	ErrAgentClosed                    = errors.New("agent is closed")
+	ErrInvalidHandshakeData           = errors.New("handshake data has a value that can't be encoded")
+	ErrPacketReadTimeout              = errors.New("timed out reading the rest of a packet")
+	ErrUnknownErrorPayloadFormat      = errors.New("error payload format is unknown")
+	ErrAffinityTokenExpired           = errors.New("affinity token is expired")
+	ErrUnknownOverflowPolicy          = errors.New("overflow policy is unknown")
+	ErrInvalidProxyHeader             = errors.New("invalid PROXY protocol header")
+	ErrNilConn                        = errors.New("connection is nil")
 )
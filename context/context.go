@@ -43,6 +43,27 @@ func GetFromPropagateCtx(ctx context.Context, key string) interface{} {
 	return nil
 }
 
+// IsDryRun returns whether the request being handled is a dry run, in which
+// case the handler must only validate it, without side effects
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := GetFromPropagateCtx(ctx, constants.DryRunKey).(bool)
+	return dryRun
+}
+
+// GetIdempotencyKey returns the idempotency key the client set on the request
+// being handled, empty if none was set
+func GetIdempotencyKey(ctx context.Context) string {
+	key, _ := GetFromPropagateCtx(ctx, constants.IdempotencyKeyKey).(string)
+	return key
+}
+
+// GetConnectionQuality returns the quality label of the connection of the
+// client that made the request being handled, empty if unknown
+func GetConnectionQuality(ctx context.Context) string {
+	quality, _ := GetFromPropagateCtx(ctx, constants.ConnectionQualityKey).(string)
+	return quality
+}
+
 // ToMap returns the values that will be propagated through RPC calls in map[string]interface{} format
 func ToMap(ctx context.Context) map[string]interface{} {
 	if ctx == nil {
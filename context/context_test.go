@@ -91,6 +91,43 @@ func TestGetFromPropagateCtxReturnsNilIfNotFound(t *testing.T) {
 	assert.Nil(t, val)
 }
 
+func TestIsDryRun(t *testing.T) {
+	tables := []struct {
+		name   string
+		ctx    context.Context
+		dryRun bool
+	}{
+		{"dry_run", AddToPropagateCtx(context.Background(), constants.DryRunKey, true), true},
+		{"not_dry_run", AddToPropagateCtx(context.Background(), constants.DryRunKey, false), false},
+		{"no_key", context.Background(), false},
+		{"nil_ctx", nil, false},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.dryRun, IsDryRun(table.ctx))
+		})
+	}
+}
+
+func TestGetIdempotencyKey(t *testing.T) {
+	tables := []struct {
+		name string
+		ctx  context.Context
+		key  string
+	}{
+		{"key", AddToPropagateCtx(context.Background(), constants.IdempotencyKeyKey, "purchase-1234"), "purchase-1234"},
+		{"no_key", context.Background(), ""},
+		{"nil_ctx", nil, ""},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.key, GetIdempotencyKey(table.ctx))
+		})
+	}
+}
+
 func TestToMap(t *testing.T) {
 	tables := []struct {
 		name  string
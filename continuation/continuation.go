@@ -0,0 +1,127 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package continuation
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrInvalidToken error
+	ErrInvalidToken = errors.New("invalid continuation token")
+	// ErrMissingTokenKey error
+	ErrMissingTokenKey = errors.New("continuation token key must not be empty")
+	// ErrTokenRouteMismatch error
+	ErrTokenRouteMismatch = errors.New("continuation token was issued for another route")
+)
+
+// PartialResponse is the convention used by handlers that may not fit all their
+// results in a single response. When Partial is true the client is expected to
+// send the same request again echoing ContinuationToken to fetch the next part.
+type PartialResponse struct {
+	Data              interface{} `json:"data"`
+	Partial           bool        `json:"partial"`
+	ContinuationToken string      `json:"continuationToken,omitempty"`
+}
+
+type token struct {
+	Route  string          `json:"r"`
+	Cursor json.RawMessage `json:"c"`
+}
+
+// NewToken encodes a cursor into an opaque token bound to the given route and
+// signed with key, so that clients can't forge or tamper with it. The cursor
+// is not encrypted, so it must not hold data the client is not allowed to see
+func NewToken(key []byte, route string, cursor interface{}) (string, error) {
+	if len(key) == 0 {
+		return "", ErrMissingTokenKey
+	}
+	c, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(&token{Route: route, Cursor: c})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign(key, payload)), nil
+}
+
+// ParseToken decodes a token created by NewToken into cursor, failing if the
+// token was not signed with key or was issued for a different route
+func ParseToken(key []byte, route, encoded string, cursor interface{}) error {
+	if len(key) == 0 {
+		return ErrMissingTokenKey
+	}
+	parts := strings.Split(encoded, ".")
+	if len(parts) != 2 {
+		return ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, sign(key, parts[0])) {
+		return ErrInvalidToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	t := &token{}
+	if err := json.Unmarshal(b, t); err != nil {
+		return ErrInvalidToken
+	}
+	if t.Route != route {
+		return ErrTokenRouteMismatch
+	}
+	if err := json.Unmarshal(t.Cursor, cursor); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func sign(key []byte, payload string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// Partial returns a partial response carrying a token for the given cursor
+func Partial(key []byte, route string, data interface{}, cursor interface{}) (*PartialResponse, error) {
+	t, err := NewToken(key, route, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialResponse{
+		Data:              data,
+		Partial:           true,
+		ContinuationToken: t,
+	}, nil
+}
+
+// Complete returns a response holding the last part of the results
+func Complete(data interface{}) *PartialResponse {
+	return &PartialResponse{Data: data}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package continuation
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const queryRoute = "room.leaderboard.query"
+
+var tokenKey = []byte("secret")
+
+type queryCursor struct {
+	Offset int `json:"offset"`
+}
+
+// query simulates a handler that can return at most pageSize items per response
+func query(t *testing.T, items []int, pageSize int, tok string) *PartialResponse {
+	cursor := &queryCursor{}
+	if tok != "" {
+		assert.NoError(t, ParseToken(tokenKey, queryRoute, tok, cursor))
+	}
+	end := cursor.Offset + pageSize
+	if end >= len(items) {
+		return Complete(items[cursor.Offset:])
+	}
+	res, err := Partial(tokenKey, queryRoute, items[cursor.Offset:end], &queryCursor{Offset: end})
+	assert.NoError(t, err)
+	return res
+}
+
+func TestPartialResponsesStitchedByToken(t *testing.T) {
+	t.Parallel()
+	items := make([]int, 150)
+	for i := range items {
+		items[i] = i
+	}
+
+	var received []int
+	tok := ""
+	responses := 0
+	for {
+		// go through the wire as the client would see it
+		b, err := json.Marshal(query(t, items, 100, tok))
+		assert.NoError(t, err)
+		res := &struct {
+			Data              []int  `json:"data"`
+			Partial           bool   `json:"partial"`
+			ContinuationToken string `json:"continuationToken"`
+		}{}
+		assert.NoError(t, json.Unmarshal(b, res))
+
+		responses++
+		received = append(received, res.Data...)
+		if !res.Partial {
+			assert.Empty(t, res.ContinuationToken)
+			break
+		}
+		assert.NotEmpty(t, res.ContinuationToken)
+		tok = res.ContinuationToken
+	}
+
+	assert.Equal(t, 2, responses)
+	assert.Equal(t, items, received)
+}
+
+func TestParseToken(t *testing.T) {
+	t.Parallel()
+	tok, err := NewToken(tokenKey, queryRoute, &queryCursor{Offset: 42})
+	assert.NoError(t, err)
+	otherKeyTok, err := NewToken([]byte("other"), queryRoute, &queryCursor{Offset: 42})
+	assert.NoError(t, err)
+	parts := strings.Split(tok, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"r":"room.leaderboard.query","c":{"offset":1000}}`))
+
+	tables := []struct {
+		name  string
+		key   []byte
+		route string
+		token string
+		err   error
+	}{
+		{"success", tokenKey, queryRoute, tok, nil},
+		{"other_route", tokenKey, "room.leaderboard.other", tok, ErrTokenRouteMismatch},
+		{"missing_key", nil, queryRoute, tok, ErrMissingTokenKey},
+		{"other_key", tokenKey, queryRoute, otherKeyTok, ErrInvalidToken},
+		{"tampered_cursor", tokenKey, queryRoute, forged + "." + parts[1], ErrInvalidToken},
+		{"unsigned", tokenKey, queryRoute, parts[0], ErrInvalidToken},
+		{"not_base64", tokenKey, queryRoute, "%%%.%%%", ErrInvalidToken},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			cursor := &queryCursor{}
+			err := ParseToken(table.key, table.route, table.token, cursor)
+			assert.Equal(t, table.err, err)
+			if table.err == nil {
+				assert.Equal(t, 42, cursor.Offset)
+			}
+		})
+	}
+}
@@ -33,9 +33,18 @@ const ErrNotFoundCode = "PIT-404"
 // ErrBadRequestCode is a string code representing a bad request related error
 const ErrBadRequestCode = "PIT-400"
 
+// ErrTooManyRequestsCode is a string code representing a request over a quota
+const ErrTooManyRequestsCode = "PIT-429"
+
 // ErrClientClosedRequest is a string code representing the client closed request error
 const ErrClientClosedRequest = "PIT-499"
 
+// ErrUnavailableCode is a string code representing a temporarily unavailable server
+const ErrUnavailableCode = "PIT-503"
+
+// ErrTimeoutCode is a string code representing a timed out request
+const ErrTimeoutCode = "PIT-504"
+
 // Error is an error with a code, message and metadata
 type Error struct {
 	Code     string
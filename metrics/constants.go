@@ -28,4 +28,33 @@ var (
 	// ExceededRateLimiting reports the number of requests made in a connection
 	// after the rate limit was exceeded
 	ExceededRateLimiting = "exceeded_rate_limiting"
+	// SerializationFailures reports the number of messages whose payload failed
+	// to serialize and were sent to the client as an error payload instead
+	SerializationFailures = "serialization_failures"
+	// CompressionRatio reports the ratio between the compressed and original
+	// size of sampled message payloads
+	CompressionRatio = "compression_ratio"
+	// HandlersInFlight reports the number of handlers of a route that are
+	// currently executing
+	HandlersInFlight = "handlers_in_flight"
+	// Disconnections reports the number of clients disconnected, by the reason
+	// the server closed the connection for and the one the client reported
+	Disconnections = "disconnections"
+	// WriteScheduleDelay reports the time in nanoseconds between a packet
+	// being queued to be written to a client and the write loop of the agent
+	// dequeuing it
+	WriteScheduleDelay = "write_schedule_delay_ns"
+	// DeprecatedRouteCalls reports the number of calls clients made to
+	// deprecated routes
+	DeprecatedRouteCalls = "deprecated_route_calls"
+	// AcceptorConnections reports the number of connections open right now
+	// on an acceptor
+	AcceptorConnections = "acceptor_connections"
+	// AcceptorConnectionsTotal reports the number of connections accepted by
+	// an acceptor
+	AcceptorConnectionsTotal = "acceptor_connections_total"
+	// DroppedPushes reports the number of pushes dropped or refused because
+	// the queue of messages to send to the client was full, by the overflow
+	// policy of the push
+	DroppedPushes = "dropped_pushes"
 )
@@ -137,6 +137,32 @@ func (p *PrometheusReporter) registerMetrics(
 		append([]string{"route", "type"}, additionalLabelsKeys...),
 	)
 
+	// CompressionRatio summary
+	p.summaryReportersMap[CompressionRatio] = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:   "pitaya",
+			Subsystem:   "handler",
+			Name:        CompressionRatio,
+			Help:        "the ratio between the compressed and original size of sampled msg payloads",
+			Objectives:  map[float64]float64{0.7: 0.02, 0.95: 0.005, 0.99: 0.001},
+			ConstLabels: constLabels,
+		},
+		append([]string{"route"}, additionalLabelsKeys...),
+	)
+
+	// WriteScheduleDelay summary
+	p.summaryReportersMap[WriteScheduleDelay] = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:   "pitaya",
+			Subsystem:   "acceptor",
+			Name:        WriteScheduleDelay,
+			Help:        "the time between a packet being queued to be written to a client and the write loop dequeuing it in nanoseconds",
+			Objectives:  map[float64]float64{0.7: 0.02, 0.95: 0.005, 0.99: 0.001},
+			ConstLabels: constLabels,
+		},
+		additionalLabelsKeys,
+	)
+
 	// ConnectedClients gauge
 	p.gaugeReportersMap[ConnectedClients] = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -149,6 +175,17 @@ func (p *PrometheusReporter) registerMetrics(
 		additionalLabelsKeys,
 	)
 
+	p.gaugeReportersMap[AcceptorConnections] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   "pitaya",
+			Subsystem:   "acceptor",
+			Name:        AcceptorConnections,
+			Help:        "the number of connections open right now on the acceptor",
+			ConstLabels: constLabels,
+		},
+		append([]string{"acceptor"}, additionalLabelsKeys...),
+	)
+
 	p.gaugeReportersMap[CountServers] = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace:   "pitaya",
@@ -160,6 +197,17 @@ func (p *PrometheusReporter) registerMetrics(
 		append([]string{"type"}, additionalLabelsKeys...),
 	)
 
+	p.gaugeReportersMap[HandlersInFlight] = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   "pitaya",
+			Subsystem:   "handler",
+			Name:        HandlersInFlight,
+			Help:        "the number of handlers of the route that are currently executing",
+			ConstLabels: constLabels,
+		},
+		append([]string{"route"}, additionalLabelsKeys...),
+	)
+
 	p.gaugeReportersMap[ChannelCapacity] = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace:   "pitaya",
@@ -259,6 +307,61 @@ func (p *PrometheusReporter) registerMetrics(
 		additionalLabelsKeys,
 	)
 
+	p.countReportersMap[SerializationFailures] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   "pitaya",
+			Subsystem:   "handler",
+			Name:        SerializationFailures,
+			Help:        "the number of messages whose payload failed to serialize",
+			ConstLabels: constLabels,
+		},
+		append([]string{"route"}, additionalLabelsKeys...),
+	)
+
+	p.countReportersMap[Disconnections] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   "pitaya",
+			Subsystem:   "acceptor",
+			Name:        Disconnections,
+			Help:        "the number of clients disconnected by server and client reason",
+			ConstLabels: constLabels,
+		},
+		append([]string{"reason", "client_reason"}, additionalLabelsKeys...),
+	)
+
+	p.countReportersMap[DeprecatedRouteCalls] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   "pitaya",
+			Subsystem:   "handler",
+			Name:        DeprecatedRouteCalls,
+			Help:        "the number of calls clients made to deprecated routes",
+			ConstLabels: constLabels,
+		},
+		append([]string{"route"}, additionalLabelsKeys...),
+	)
+
+	p.countReportersMap[AcceptorConnectionsTotal] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   "pitaya",
+			Subsystem:   "acceptor",
+			Name:        AcceptorConnectionsTotal,
+			Help:        "the number of connections accepted by the acceptor",
+			ConstLabels: constLabels,
+		},
+		append([]string{"acceptor"}, additionalLabelsKeys...),
+	)
+
+	p.countReportersMap[DroppedPushes] = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   "pitaya",
+			Subsystem:   "acceptor",
+			Name:        DroppedPushes,
+			Help:        "the number of pushes dropped or refused because the client queue was full",
+			ConstLabels: constLabels,
+		},
+		append([]string{"policy"}, additionalLabelsKeys...),
+	)
+
 	toRegister := make([]prometheus.Collector, 0)
 	for _, c := range p.countReportersMap {
 		toRegister = append(toRegister, c)
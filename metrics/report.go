@@ -42,8 +42,11 @@ func ReportTimingFromCtx(ctx context.Context, reporters []Reporter, typ string,
 		status = "failed"
 	}
 	if len(reporters) > 0 {
-		startTime := pcontext.GetFromPropagateCtx(ctx, constants.StartTimeKey)
 		route := pcontext.GetFromPropagateCtx(ctx, constants.RouteKey)
+		if !routeSampler.shouldReport(ResponseTime, route.(string)) {
+			return
+		}
+		startTime := pcontext.GetFromPropagateCtx(ctx, constants.StartTimeKey)
 		elapsed := time.Since(time.Unix(0, startTime.(int64)))
 		tags := getTags(ctx, map[string]string{
 			"route":  route.(string),
@@ -60,9 +63,12 @@ func ReportTimingFromCtx(ctx context.Context, reporters []Reporter, typ string,
 // ReportMessageProcessDelayFromCtx reports the delay to process the messages
 func ReportMessageProcessDelayFromCtx(ctx context.Context, reporters []Reporter, typ string) {
 	if len(reporters) > 0 {
+		route := pcontext.GetFromPropagateCtx(ctx, constants.RouteKey)
+		if !routeSampler.shouldReport(ProcessDelay, route.(string)) {
+			return
+		}
 		startTime := pcontext.GetFromPropagateCtx(ctx, constants.StartTimeKey)
 		elapsed := time.Since(time.Unix(0, startTime.(int64)))
-		route := pcontext.GetFromPropagateCtx(ctx, constants.RouteKey)
 		tags := getTags(ctx, map[string]string{
 			"route": route.(string),
 			"type":  typ,
@@ -105,6 +111,77 @@ func ReportExceededRateLimiting(reporters []Reporter) {
 	}
 }
 
+// ReportSerializationFailure reports that a message payload sent on route
+// failed to serialize
+func ReportSerializationFailure(reporters []Reporter, route string) {
+	for _, r := range reporters {
+		r.ReportCount(SerializationFailures, map[string]string{"route": route}, 1)
+	}
+}
+
+// ReportCompressionRatio reports the ratio between the compressed and the
+// original size of a message payload sent on route
+func ReportCompressionRatio(reporters []Reporter, route string, ratio float64) {
+	for _, r := range reporters {
+		r.ReportSummary(CompressionRatio, map[string]string{"route": route}, ratio)
+	}
+}
+
+// ReportHandlersInFlight reports the number of handlers of route that are
+// currently executing
+func ReportHandlersInFlight(reporters []Reporter, route string, inFlight int64) {
+	for _, r := range reporters {
+		r.ReportGauge(HandlersInFlight, map[string]string{"route": route}, float64(inFlight))
+	}
+}
+
+// ReportDisconnection reports that a client disconnected, reason is why the
+// server closed the connection and clientReason why the client said it was
+// disconnecting, if it did
+func ReportDisconnection(reporters []Reporter, reason, clientReason string) {
+	for _, r := range reporters {
+		r.ReportCount(Disconnections, map[string]string{"reason": reason, "client_reason": clientReason}, 1)
+	}
+}
+
+// ReportWriteScheduleDelay reports the time a packet waited between being
+// queued to be written to a client and being dequeued by the agent write loop
+func ReportWriteScheduleDelay(reporters []Reporter, delay time.Duration) {
+	for _, r := range reporters {
+		r.ReportSummary(WriteScheduleDelay, map[string]string{}, float64(delay.Nanoseconds()))
+	}
+}
+
+// ReportDeprecatedRouteCall reports that a client called the deprecated route
+func ReportDeprecatedRouteCall(reporters []Reporter, route string) {
+	for _, r := range reporters {
+		r.ReportCount(DeprecatedRouteCalls, map[string]string{"route": route}, 1)
+	}
+}
+
+// ReportAcceptorConnections reports the number of connections open right
+// now on the acceptor
+func ReportAcceptorConnections(reporters []Reporter, acceptor string, active int64) {
+	for _, r := range reporters {
+		r.ReportGauge(AcceptorConnections, map[string]string{"acceptor": acceptor}, float64(active))
+	}
+}
+
+// ReportAcceptedConnection reports that the acceptor accepted a connection
+func ReportAcceptedConnection(reporters []Reporter, acceptor string) {
+	for _, r := range reporters {
+		r.ReportCount(AcceptorConnectionsTotal, map[string]string{"acceptor": acceptor}, 1)
+	}
+}
+
+// ReportDroppedPush reports that a push was dropped or refused by the
+// overflow policy because the queue of messages to send to a client was full
+func ReportDroppedPush(reporters []Reporter, policy string) {
+	for _, r := range reporters {
+		r.ReportCount(DroppedPushes, map[string]string{"policy": policy}, 1)
+	}
+}
+
 func tagsFromContext(ctx context.Context) map[string]string {
 	val := pcontext.GetFromPropagateCtx(ctx, constants.MetricTagsKey)
 	if val == nil {
@@ -0,0 +1,123 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/topfreegames/pitaya/v2/logger"
+)
+
+// ResilientReporter wraps a Reporter so that a slow or unreachable backend
+// never blocks nor fails the callers: metrics are queued and sent by a
+// background goroutine, dropped when the queue is full, and the errors of the
+// wrapped reporter are logged at most once per log interval
+type ResilientReporter struct {
+	reporter    Reporter
+	queue       chan func() error
+	logInterval time.Duration
+	lastLog     time.Time
+	suppressed  int
+	dropped     uint64
+	stop        chan struct{}
+}
+
+// NewResilientReporter returns a ResilientReporter that queues up to
+// bufferSize metrics for reporter and logs its errors at most once per
+// logInterval
+func NewResilientReporter(reporter Reporter, bufferSize int, logInterval time.Duration) *ResilientReporter {
+	r := &ResilientReporter{
+		reporter:    reporter,
+		queue:       make(chan func() error, bufferSize),
+		logInterval: logInterval,
+		stop:        make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// ReportCount queues a count metric, it never returns an error
+func (r *ResilientReporter) ReportCount(metric string, tags map[string]string, count float64) error {
+	r.enqueue(func() error {
+		return r.reporter.ReportCount(metric, tags, count)
+	})
+	return nil
+}
+
+// ReportSummary queues a summary metric, it never returns an error
+func (r *ResilientReporter) ReportSummary(metric string, tags map[string]string, value float64) error {
+	r.enqueue(func() error {
+		return r.reporter.ReportSummary(metric, tags, value)
+	})
+	return nil
+}
+
+// ReportGauge queues a gauge metric, it never returns an error
+func (r *ResilientReporter) ReportGauge(metric string, tags map[string]string, value float64) error {
+	r.enqueue(func() error {
+		return r.reporter.ReportGauge(metric, tags, value)
+	})
+	return nil
+}
+
+// Dropped returns the number of metrics dropped because the queue was full
+func (r *ResilientReporter) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// Close stops reporting, the metrics still queued are dropped
+func (r *ResilientReporter) Close() {
+	close(r.stop)
+}
+
+func (r *ResilientReporter) enqueue(report func() error) {
+	select {
+	case r.queue <- report:
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+	}
+}
+
+func (r *ResilientReporter) run() {
+	for {
+		select {
+		case report := <-r.queue:
+			if err := report(); err != nil {
+				r.logError(err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// logError is only called from run, so it needs no locking
+func (r *ResilientReporter) logError(err error) {
+	now := time.Now()
+	if now.Sub(r.lastLog) < r.logInterval {
+		r.suppressed++
+		return
+	}
+	logger.Log.Errorf("[metrics] failed to report metric: %s (%d errors suppressed since the last log)", err.Error(), r.suppressed)
+	r.lastLog = now
+	r.suppressed = 0
+}
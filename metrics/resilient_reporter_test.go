@@ -0,0 +1,112 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/constants"
+	pcontext "github.com/topfreegames/pitaya/v2/context"
+	"github.com/topfreegames/pitaya/v2/helpers"
+	"github.com/topfreegames/pitaya/v2/logger"
+	logruswrapper "github.com/topfreegames/pitaya/v2/logger/logrus"
+	"github.com/topfreegames/pitaya/v2/metrics/mocks"
+)
+
+func TestResilientReporterDoesNotBlockOnStuckReporter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	unblock := make(chan struct{})
+	mockMetricsReporter := mocks.NewMockReporter(ctrl)
+	mockMetricsReporter.EXPECT().ReportSummary(ResponseTime, gomock.Any(), gomock.Any()).DoAndReturn(
+		func(metric string, tags map[string]string, value float64) error {
+			<-unblock
+			return nil
+		},
+	).MaxTimes(3)
+
+	r := NewResilientReporter(mockMetricsReporter, 2, time.Hour)
+	defer r.Close()
+
+	ctx := pcontext.AddToPropagateCtx(context.Background(), constants.StartTimeKey, time.Now().UnixNano())
+	ctx = pcontext.AddToPropagateCtx(ctx, constants.RouteKey, "room.room.join")
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			ReportTimingFromCtx(ctx, []Reporter{r}, "handler", nil)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reporting blocked on the stuck reporter")
+	}
+	// one metric is held by the stuck reporter, two are queued and the rest dropped
+	assert.True(t, r.Dropped() >= 7)
+	close(unblock)
+}
+
+func TestResilientReporterRateLimitsErrorLogs(t *testing.T) {
+	defaultLogger := logger.Log
+	l, hook := logrustest.NewNullLogger()
+	l.Level = logrus.DebugLevel
+	logger.SetLogger(logruswrapper.NewWithLogger(l))
+	defer logger.SetLogger(defaultLogger)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	reported := make(chan struct{}, 100)
+	mockMetricsReporter := mocks.NewMockReporter(ctrl)
+	mockMetricsReporter.EXPECT().ReportCount(ExceededRateLimiting, gomock.Any(), float64(1)).DoAndReturn(
+		func(metric string, tags map[string]string, count float64) error {
+			reported <- struct{}{}
+			return errors.New("connection refused")
+		},
+	).Times(100)
+
+	r := NewResilientReporter(mockMetricsReporter, 100, time.Hour)
+	defer r.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, r.ReportCount(ExceededRateLimiting, map[string]string{}, 1))
+	}
+	for i := 0; i < 100; i++ {
+		helpers.ShouldEventuallyReceive(t, reported)
+	}
+
+	assert.Equal(t, uint64(0), r.Dropped())
+	helpers.ShouldEventuallyReturn(t, func() int { return len(hook.AllEntries()) }, 1)
+	helpers.ShouldAlwaysReturn(t, func() int { return len(hook.AllEntries()) }, 1, 10*time.Millisecond, 100*time.Millisecond)
+	assert.Equal(t, logrus.ErrorLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "connection refused")
+}
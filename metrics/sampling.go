@@ -0,0 +1,73 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var routeSampler = newSampler()
+
+type sampler struct {
+	mutex    sync.RWMutex
+	rates    map[string]uint64
+	counters *sync.Map // metric and route to *uint64
+}
+
+func newSampler() *sampler {
+	return &sampler{
+		rates:    map[string]uint64{},
+		counters: &sync.Map{},
+	}
+}
+
+// SetRouteSampleRates configures metrics sampling per route, a route that
+// has rate n only reports 1 in n of its timings, routes without a rate
+// report all of them
+func SetRouteSampleRates(rates map[string]int) {
+	routeSampler.setRates(rates)
+}
+
+func (s *sampler) setRates(rates map[string]int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rates = map[string]uint64{}
+	for route, rate := range rates {
+		if rate > 1 {
+			s.rates[route] = uint64(rate)
+		}
+	}
+	s.counters = &sync.Map{}
+}
+
+// shouldReport returns whether this occurrence of metric for route must be
+// reported, each metric is sampled independently
+func (s *sampler) shouldReport(metric, route string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	rate, ok := s.rates[route]
+	if !ok {
+		return true
+	}
+	counter, _ := s.counters.LoadOrStore(metric+route, new(uint64))
+	return (atomic.AddUint64(counter.(*uint64), 1)-1)%rate == 0
+}
@@ -0,0 +1,105 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/constants"
+	pcontext "github.com/topfreegames/pitaya/v2/context"
+	"github.com/topfreegames/pitaya/v2/metrics/mocks"
+)
+
+func TestSamplerShouldReport(t *testing.T) {
+	s := newSampler()
+	s.setRates(map[string]int{
+		"room.room.move": 100,
+		"room.room.chat": 3,
+		"room.room.join": 1,
+	})
+
+	tables := []struct {
+		route    string
+		calls    int
+		reported int
+	}{
+		{"room.room.move", 1000, 10},
+		{"room.room.chat", 10, 4},
+		{"room.room.join", 10, 10},
+		{"room.room.leave", 10, 10},
+	}
+
+	for _, table := range tables {
+		t.Run(table.route, func(t *testing.T) {
+			reported := 0
+			for i := 0; i < table.calls; i++ {
+				if s.shouldReport(ResponseTime, table.route) {
+					reported++
+				}
+			}
+			assert.Equal(t, table.reported, reported)
+		})
+	}
+}
+
+func TestSamplerShouldReportEachMetricIndependently(t *testing.T) {
+	s := newSampler()
+	s.setRates(map[string]int{"room.room.move": 2})
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, i%2 == 0, s.shouldReport(ResponseTime, "room.room.move"))
+		assert.Equal(t, i%2 == 0, s.shouldReport(ProcessDelay, "room.room.move"))
+	}
+}
+
+func TestReportTimingFromCtxWithSampling(t *testing.T) {
+	SetRouteSampleRates(map[string]int{"room.room.move": 10})
+	defer SetRouteSampleRates(nil)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockMetricsReporter := mocks.NewMockReporter(ctrl)
+
+	newCtx := func(route string) context.Context {
+		ctx := pcontext.AddToPropagateCtx(context.Background(), constants.StartTimeKey, time.Now().UnixNano())
+		return pcontext.AddToPropagateCtx(ctx, constants.RouteKey, route)
+	}
+
+	mockMetricsReporter.EXPECT().ReportSummary(ResponseTime, gomock.Any(), gomock.Any()).Do(
+		func(metric string, tags map[string]string, duration float64) {
+			assert.Equal(t, "room.room.move", tags["route"])
+		}).Times(3)
+	mockMetricsReporter.EXPECT().ReportSummary(ResponseTime, gomock.Any(), gomock.Any()).Do(
+		func(metric string, tags map[string]string, duration float64) {
+			assert.Equal(t, "room.room.join", tags["route"])
+		}).Times(5)
+
+	for i := 0; i < 30; i++ {
+		ReportTimingFromCtx(newCtx("room.room.move"), []Reporter{mockMetricsReporter}, "handler", nil)
+	}
+	for i := 0; i < 5; i++ {
+		ReportTimingFromCtx(newCtx("room.room.join"), []Reporter{mockMetricsReporter}, "handler", nil)
+	}
+}
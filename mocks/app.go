@@ -8,14 +8,18 @@ import (
 	context "context"
 	gomock "github.com/golang/mock/gomock"
 	proto "github.com/golang/protobuf/proto"
+	acceptor "github.com/topfreegames/pitaya/v2/acceptor"
 	cluster "github.com/topfreegames/pitaya/v2/cluster"
 	component "github.com/topfreegames/pitaya/v2/component"
 	config "github.com/topfreegames/pitaya/v2/config"
+	message "github.com/topfreegames/pitaya/v2/conn/message"
 	interfaces "github.com/topfreegames/pitaya/v2/interfaces"
 	metrics "github.com/topfreegames/pitaya/v2/metrics"
+	networkentity "github.com/topfreegames/pitaya/v2/networkentity"
 	router "github.com/topfreegames/pitaya/v2/router"
 	session "github.com/topfreegames/pitaya/v2/session"
 	worker "github.com/topfreegames/pitaya/v2/worker"
+	io "io"
 	reflect "reflect"
 	time "time"
 )
@@ -43,6 +47,20 @@ func (m *MockPitaya) EXPECT() *MockPitayaMockRecorder {
 	return m.recorder
 }
 
+// AcceptorConnections mocks base method
+func (m *MockPitaya) AcceptorConnections() map[string]acceptor.ConnectionCounts {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AcceptorConnections")
+	ret0, _ := ret[0].(map[string]acceptor.ConnectionCounts)
+	return ret0
+}
+
+// AcceptorConnections indicates an expected call of AcceptorConnections
+func (mr *MockPitayaMockRecorder) AcceptorConnections() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcceptorConnections", reflect.TypeOf((*MockPitaya)(nil).AcceptorConnections))
+}
+
 // AddRoute mocks base method
 func (m *MockPitaya) AddRoute(arg0 string, arg1 router.RoutingFunc) error {
 	m.ctrl.T.Helper()
@@ -72,6 +90,32 @@ func (mr *MockPitayaMockRecorder) Documentation(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Documentation", reflect.TypeOf((*MockPitaya)(nil).Documentation), arg0)
 }
 
+// DumpSessions mocks base method
+func (m *MockPitaya) DumpSessions(arg0 io.Writer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DumpSessions", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DumpSessions indicates an expected call of DumpSessions
+func (mr *MockPitayaMockRecorder) DumpSessions(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DumpSessions", reflect.TypeOf((*MockPitaya)(nil).DumpSessions), arg0)
+}
+
+// ForEachAgent mocks base method
+func (m *MockPitaya) ForEachAgent(arg0 func(networkentity.NetworkEntity, networkentity.Snapshot)) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "ForEachAgent", arg0)
+}
+
+// ForEachAgent indicates an expected call of ForEachAgent
+func (mr *MockPitayaMockRecorder) ForEachAgent(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ForEachAgent", reflect.TypeOf((*MockPitaya)(nil).ForEachAgent), arg0)
+}
+
 // GetDieChan mocks base method
 func (m *MockPitaya) GetDieChan() chan bool {
 	m.ctrl.T.Helper()
@@ -115,6 +159,20 @@ func (mr *MockPitayaMockRecorder) GetModule(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetModule", reflect.TypeOf((*MockPitaya)(nil).GetModule), arg0)
 }
 
+// GetRouteUsage mocks base method
+func (m *MockPitaya) GetRouteUsage() []message.RouteUsage {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRouteUsage")
+	ret0, _ := ret[0].([]message.RouteUsage)
+	return ret0
+}
+
+// GetRouteUsage indicates an expected call of GetRouteUsage
+func (mr *MockPitayaMockRecorder) GetRouteUsage() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRouteUsage", reflect.TypeOf((*MockPitaya)(nil).GetRouteUsage))
+}
+
 // GetServer mocks base method
 func (m *MockPitaya) GetServer() *cluster.Server {
 	m.ctrl.T.Helper()
@@ -358,6 +416,37 @@ func (mr *MockPitayaMockRecorder) GroupRenewTTL(arg0, arg1 interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GroupRenewTTL", reflect.TypeOf((*MockPitaya)(nil).GroupRenewTTL), arg0, arg1)
 }
 
+// HandlersInFlight mocks base method
+func (m *MockPitaya) HandlersInFlight() int64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandlersInFlight")
+	ret0, _ := ret[0].(int64)
+	return ret0
+}
+
+// HandlersInFlight indicates an expected call of HandlersInFlight
+func (mr *MockPitayaMockRecorder) HandlersInFlight() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandlersInFlight", reflect.TypeOf((*MockPitaya)(nil).HandlersInFlight))
+}
+
+// InvalidateResponseCache mocks base method
+func (m *MockPitaya) InvalidateResponseCache(arg0 string, arg1 ...string) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0}
+	for _, a := range arg1 {
+		varargs = append(varargs, a)
+	}
+	m.ctrl.Call(m, "InvalidateResponseCache", varargs...)
+}
+
+// InvalidateResponseCache indicates an expected call of InvalidateResponseCache
+func (mr *MockPitayaMockRecorder) InvalidateResponseCache(arg0 interface{}, arg1 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0}, arg1...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InvalidateResponseCache", reflect.TypeOf((*MockPitaya)(nil).InvalidateResponseCache), varargs...)
+}
+
 // IsRunning mocks base method
 func (m *MockPitaya) IsRunning() bool {
 	m.ctrl.T.Helper()
@@ -372,6 +461,30 @@ func (mr *MockPitayaMockRecorder) IsRunning() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsRunning", reflect.TypeOf((*MockPitaya)(nil).IsRunning))
 }
 
+// NotifyShutdown mocks base method
+func (m *MockPitaya) NotifyShutdown(arg0 time.Duration) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "NotifyShutdown", arg0)
+}
+
+// NotifyShutdown indicates an expected call of NotifyShutdown
+func (mr *MockPitayaMockRecorder) NotifyShutdown(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifyShutdown", reflect.TypeOf((*MockPitaya)(nil).NotifyShutdown), arg0)
+}
+
+// SetReady mocks base method
+func (m *MockPitaya) SetReady() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetReady")
+}
+
+// SetReady indicates an expected call of SetReady
+func (mr *MockPitayaMockRecorder) SetReady() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetReady", reflect.TypeOf((*MockPitaya)(nil).SetReady))
+}
+
 // RPC mocks base method
 func (m *MockPitaya) RPC(arg0 context.Context, arg1 string, arg2, arg3 proto.Message) error {
 	m.ctrl.T.Helper()
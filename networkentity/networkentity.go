@@ -3,8 +3,10 @@ package networkentity
 import (
 	"context"
 	"net"
+	"time"
 
 	"github.com/topfreegames/pitaya/v2/protos"
+	"github.com/topfreegames/pitaya/v2/serialize"
 )
 
 // NetworkEntity represent low-level network instance
@@ -16,3 +18,41 @@ type NetworkEntity interface {
 	RemoteAddr() net.Addr
 	SendRequest(ctx context.Context, serverID, route string, v interface{}) (*protos.Response, error)
 }
+
+// Flusher is implemented by network entities that queue the messages sent
+// to the client and can wait for them to be written
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// SerializerProvider is implemented by network entities that know the
+// serializer of the messages sent to the client
+type SerializerProvider interface {
+	GetSerializer() serialize.Serializer
+}
+
+// SerializerPusher is implemented by network entities that can push a
+// message serialized with a serializer other than the one of the client
+type SerializerPusher interface {
+	PushWith(ctx context.Context, serializer serialize.Serializer, route string, v interface{}) error
+}
+
+// Snapshot is a read-only view of the state of a client connection, e.g. for
+// admin endpoints listing the connected clients
+type Snapshot struct {
+	SessionID     int64     `json:"sessionId"`
+	UID           string    `json:"uid"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	Status        int32     `json:"status"`
+	LastAt        time.Time `json:"lastAt"`        // last time the client was heard from
+	PendingWrites int64     `json:"pendingWrites"` // messages queued for the client or being written
+	QueuedWrites  int       `json:"queuedWrites"`  // messages waiting in the send queue
+	QueueCapacity int       `json:"queueCapacity"` // size of the send queue
+}
+
+// StatusReporter is implemented by network entities that track the status
+// of the client connection and when the client was last heard from
+type StatusReporter interface {
+	GetStatus() int32
+	LastActivity() time.Time
+}
@@ -89,6 +89,24 @@ func (mr *MockPitayaClientMockRecorder) KickUser(ctx, in interface{}, opts ...in
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "KickUser", reflect.TypeOf((*MockPitayaClient)(nil).KickUser), varargs...)
 }
 
+// PushToUsers mocks base method
+func (m *MockPitayaClient) PushToUsers(ctx context.Context, in *protos.PushBatch, opts ...grpc.CallOption) (*protos.PushBatchAnswer, error) {
+	varargs := []interface{}{ctx, in}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "PushToUsers", varargs...)
+	ret0, _ := ret[0].(*protos.PushBatchAnswer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PushToUsers indicates an expected call of PushToUsers
+func (mr *MockPitayaClientMockRecorder) PushToUsers(ctx, in interface{}, opts ...interface{}) *gomock.Call {
+	varargs := append([]interface{}{ctx, in}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushToUsers", reflect.TypeOf((*MockPitayaClient)(nil).PushToUsers), varargs...)
+}
+
 // SessionBindRemote mocks base method
 func (m *MockPitayaClient) SessionBindRemote(ctx context.Context, in *protos.BindMsg, opts ...grpc.CallOption) (*protos.Response, error) {
 	varargs := []interface{}{ctx, in}
@@ -169,6 +187,19 @@ func (mr *MockPitayaServerMockRecorder) KickUser(arg0, arg1 interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "KickUser", reflect.TypeOf((*MockPitayaServer)(nil).KickUser), arg0, arg1)
 }
 
+// PushToUsers mocks base method
+func (m *MockPitayaServer) PushToUsers(arg0 context.Context, arg1 *protos.PushBatch) (*protos.PushBatchAnswer, error) {
+	ret := m.ctrl.Call(m, "PushToUsers", arg0, arg1)
+	ret0, _ := ret[0].(*protos.PushBatchAnswer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PushToUsers indicates an expected call of PushToUsers
+func (mr *MockPitayaServerMockRecorder) PushToUsers(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushToUsers", reflect.TypeOf((*MockPitayaServer)(nil).PushToUsers), arg0, arg1)
+}
+
 // SessionBindRemote mocks base method
 func (m *MockPitayaServer) SessionBindRemote(arg0 context.Context, arg1 *protos.BindMsg) (*protos.Response, error) {
 	ret := m.ctrl.Call(m, "SessionBindRemote", arg0, arg1)
@@ -39,6 +39,7 @@ type PitayaClient interface {
 	PushToUser(ctx context.Context, in *Push, opts ...grpc.CallOption) (*Response, error)
 	SessionBindRemote(ctx context.Context, in *BindMsg, opts ...grpc.CallOption) (*Response, error)
 	KickUser(ctx context.Context, in *KickMsg, opts ...grpc.CallOption) (*KickAnswer, error)
+	PushToUsers(ctx context.Context, in *PushBatch, opts ...grpc.CallOption) (*PushBatchAnswer, error)
 }
 
 type pitayaClient struct {
@@ -85,12 +86,22 @@ func (c *pitayaClient) KickUser(ctx context.Context, in *KickMsg, opts ...grpc.C
 	return out, nil
 }
 
+func (c *pitayaClient) PushToUsers(ctx context.Context, in *PushBatch, opts ...grpc.CallOption) (*PushBatchAnswer, error) {
+	out := new(PushBatchAnswer)
+	err := c.cc.Invoke(ctx, "/protos.Pitaya/PushToUsers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // PitayaServer is the server API for Pitaya service.
 type PitayaServer interface {
 	Call(context.Context, *Request) (*Response, error)
 	PushToUser(context.Context, *Push) (*Response, error)
 	SessionBindRemote(context.Context, *BindMsg) (*Response, error)
 	KickUser(context.Context, *KickMsg) (*KickAnswer, error)
+	PushToUsers(context.Context, *PushBatch) (*PushBatchAnswer, error)
 }
 
 func RegisterPitayaServer(s *grpc.Server, srv PitayaServer) {
@@ -169,6 +180,24 @@ func _Pitaya_KickUser_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Pitaya_PushToUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PushBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PitayaServer).PushToUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protos.Pitaya/PushToUsers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PitayaServer).PushToUsers(ctx, req.(*PushBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Pitaya_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "protos.Pitaya",
 	HandlerType: (*PitayaServer)(nil),
@@ -189,26 +218,31 @@ var _Pitaya_serviceDesc = grpc.ServiceDesc{
 			MethodName: "KickUser",
 			Handler:    _Pitaya_KickUser_Handler,
 		},
+		{
+			MethodName: "PushToUsers",
+			Handler:    _Pitaya_PushToUsers_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pitaya.proto",
 }
 
-func init() { proto.RegisterFile("pitaya.proto", fileDescriptor_pitaya_c66f1da1c2593b20) }
+func init() { proto.RegisterFile("pitaya.proto", fileDescriptor_pitaya_3d1a4c8dd5449b69) }
 
-var fileDescriptor_pitaya_c66f1da1c2593b20 = []byte{
-	// 199 bytes of a gzipped FileDescriptorProto
+var fileDescriptor_pitaya_3d1a4c8dd5449b69 = []byte{
+	// 218 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x29, 0xc8, 0x2c, 0x49,
 	0xac, 0x4c, 0xd4, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x03, 0x53, 0xc5, 0x52, 0xbc, 0x45,
 	0xa9, 0x85, 0xa5, 0xa9, 0xc5, 0x25, 0x10, 0x61, 0x29, 0xbe, 0xa2, 0xd4, 0xe2, 0x82, 0xfc, 0xbc,
 	0xe2, 0x54, 0x28, 0x9f, 0xab, 0xa0, 0xb4, 0x38, 0x03, 0xc6, 0x4e, 0xca, 0xcc, 0x4b, 0x81, 0xb1,
-	0xb3, 0x33, 0x93, 0xb3, 0x21, 0x6c, 0xa3, 0x4b, 0x8c, 0x5c, 0x6c, 0x01, 0x60, 0xb3, 0x85, 0xb4,
-	0xb9, 0x58, 0x9c, 0x13, 0x73, 0x72, 0x84, 0xf8, 0x21, 0x52, 0xc5, 0x7a, 0x41, 0x10, 0xd3, 0xa5,
-	0x04, 0x10, 0x02, 0x10, 0xf3, 0x95, 0x18, 0x84, 0xf4, 0xb8, 0xb8, 0x02, 0x4a, 0x8b, 0x33, 0x42,
-	0xf2, 0x43, 0x8b, 0x53, 0x8b, 0x84, 0x78, 0x60, 0x2a, 0x40, 0x62, 0x58, 0xd5, 0x5b, 0x70, 0x09,
-	0x06, 0xa7, 0x16, 0x17, 0x67, 0xe6, 0xe7, 0x39, 0x65, 0xe6, 0xa5, 0x04, 0xa5, 0xe6, 0xe6, 0x97,
-	0xa4, 0x22, 0x6c, 0x02, 0x89, 0xf9, 0x16, 0xa7, 0x63, 0xd5, 0x69, 0xc8, 0xc5, 0xe1, 0x9d, 0x99,
-	0x9c, 0x0d, 0xb6, 0x07, 0xae, 0x01, 0x24, 0x02, 0xd2, 0x20, 0x84, 0x2c, 0xe0, 0x98, 0x57, 0x5c,
-	0x9e, 0x5a, 0xa4, 0xc4, 0x90, 0x04, 0x09, 0x1f, 0x63, 0x40, 0x00, 0x00, 0x00, 0xff, 0xff, 0x70,
-	0x0c, 0x65, 0x3c, 0x36, 0x01, 0x00, 0x00,
+	0xb3, 0x33, 0x93, 0xb3, 0x21, 0x6c, 0xa3, 0x7e, 0x26, 0x2e, 0xb6, 0x00, 0xb0, 0xd9, 0x42, 0xda,
+	0x5c, 0x2c, 0xce, 0x89, 0x39, 0x39, 0x42, 0xfc, 0x10, 0xa9, 0x62, 0xbd, 0x20, 0x88, 0xe9, 0x52,
+	0x02, 0x08, 0x01, 0x88, 0xf9, 0x4a, 0x0c, 0x42, 0x7a, 0x5c, 0x5c, 0x01, 0xa5, 0xc5, 0x19, 0x21,
+	0xf9, 0xa1, 0xc5, 0xa9, 0x45, 0x42, 0x3c, 0x30, 0x15, 0x20, 0x31, 0xac, 0xea, 0x2d, 0xb8, 0x04,
+	0x83, 0x53, 0x8b, 0x8b, 0x33, 0xf3, 0xf3, 0x9c, 0x32, 0xf3, 0x52, 0x82, 0x52, 0x73, 0xf3, 0x4b,
+	0x52, 0x11, 0x36, 0x81, 0xc4, 0x7c, 0x8b, 0xd3, 0xb1, 0xea, 0x34, 0xe4, 0xe2, 0xf0, 0xce, 0x4c,
+	0xce, 0x06, 0xdb, 0x03, 0xd7, 0x00, 0x12, 0x01, 0x69, 0x10, 0x42, 0x16, 0x70, 0xcc, 0x2b, 0x2e,
+	0x4f, 0x2d, 0x52, 0x62, 0x10, 0xb2, 0xe6, 0xe2, 0x46, 0x38, 0xae, 0x58, 0x48, 0x10, 0xd9, 0x75,
+	0x4e, 0x89, 0x25, 0xc9, 0x19, 0x52, 0xe2, 0x18, 0x42, 0x30, 0xcd, 0x49, 0x90, 0xc0, 0x35, 0x06,
+	0x0c, 0x00, 0x4c, 0x62, 0xff, 0xb8, 0x73, 0x01, 0x00, 0x00,
 }
@@ -31,7 +31,7 @@ func (m *Push) Reset()         { *m = Push{} }
 func (m *Push) String() string { return proto.CompactTextString(m) }
 func (*Push) ProtoMessage()    {}
 func (*Push) Descriptor() ([]byte, []int) {
-	return fileDescriptor_push_77d28476f32095f7, []int{0}
+	return fileDescriptor_push_0f304e4902c49394, []int{0}
 }
 func (m *Push) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_Push.Unmarshal(m, b)
@@ -72,19 +72,101 @@ func (m *Push) GetData() []byte {
 	return nil
 }
 
+type PushBatch struct {
+	Pushes               []*Push  `protobuf:"bytes,1,rep,name=pushes" json:"pushes,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PushBatch) Reset()         { *m = PushBatch{} }
+func (m *PushBatch) String() string { return proto.CompactTextString(m) }
+func (*PushBatch) ProtoMessage()    {}
+func (*PushBatch) Descriptor() ([]byte, []int) {
+	return fileDescriptor_push_0f304e4902c49394, []int{1}
+}
+func (m *PushBatch) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PushBatch.Unmarshal(m, b)
+}
+func (m *PushBatch) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PushBatch.Marshal(b, m, deterministic)
+}
+func (dst *PushBatch) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PushBatch.Merge(dst, src)
+}
+func (m *PushBatch) XXX_Size() int {
+	return xxx_messageInfo_PushBatch.Size(m)
+}
+func (m *PushBatch) XXX_DiscardUnknown() {
+	xxx_messageInfo_PushBatch.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PushBatch proto.InternalMessageInfo
+
+func (m *PushBatch) GetPushes() []*Push {
+	if m != nil {
+		return m.Pushes
+	}
+	return nil
+}
+
+type PushBatchAnswer struct {
+	FailedUids           []string `protobuf:"bytes,1,rep,name=failedUids" json:"failedUids,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PushBatchAnswer) Reset()         { *m = PushBatchAnswer{} }
+func (m *PushBatchAnswer) String() string { return proto.CompactTextString(m) }
+func (*PushBatchAnswer) ProtoMessage()    {}
+func (*PushBatchAnswer) Descriptor() ([]byte, []int) {
+	return fileDescriptor_push_0f304e4902c49394, []int{2}
+}
+func (m *PushBatchAnswer) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PushBatchAnswer.Unmarshal(m, b)
+}
+func (m *PushBatchAnswer) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PushBatchAnswer.Marshal(b, m, deterministic)
+}
+func (dst *PushBatchAnswer) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PushBatchAnswer.Merge(dst, src)
+}
+func (m *PushBatchAnswer) XXX_Size() int {
+	return xxx_messageInfo_PushBatchAnswer.Size(m)
+}
+func (m *PushBatchAnswer) XXX_DiscardUnknown() {
+	xxx_messageInfo_PushBatchAnswer.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PushBatchAnswer proto.InternalMessageInfo
+
+func (m *PushBatchAnswer) GetFailedUids() []string {
+	if m != nil {
+		return m.FailedUids
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Push)(nil), "protos.Push")
+	proto.RegisterType((*PushBatch)(nil), "protos.PushBatch")
+	proto.RegisterType((*PushBatchAnswer)(nil), "protos.PushBatchAnswer")
 }
 
-func init() { proto.RegisterFile("push.proto", fileDescriptor_push_77d28476f32095f7) }
+func init() { proto.RegisterFile("push.proto", fileDescriptor_push_0f304e4902c49394) }
 
-var fileDescriptor_push_77d28476f32095f7 = []byte{
-	// 100 bytes of a gzipped FileDescriptorProto
+var fileDescriptor_push_0f304e4902c49394 = []byte{
+	// 164 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2a, 0x28, 0x2d, 0xce,
 	0xd0, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x03, 0x53, 0xc5, 0x4a, 0x4e, 0x5c, 0x2c, 0x01,
 	0xa5, 0xc5, 0x19, 0x42, 0x22, 0x5c, 0xac, 0x45, 0xf9, 0xa5, 0x25, 0xa9, 0x12, 0x8c, 0x0a, 0x8c,
 	0x1a, 0x9c, 0x41, 0x10, 0x8e, 0x90, 0x00, 0x17, 0x73, 0x69, 0x66, 0x8a, 0x04, 0x13, 0x58, 0x0c,
 	0xc4, 0x14, 0x12, 0xe2, 0x62, 0x49, 0x49, 0x2c, 0x49, 0x94, 0x60, 0x56, 0x60, 0xd4, 0xe0, 0x09,
-	0x02, 0xb3, 0x93, 0x20, 0x66, 0x19, 0x03, 0x02, 0x00, 0x00, 0xff, 0xff, 0x41, 0x79, 0x42, 0xe3,
-	0x60, 0x00, 0x00, 0x00,
+	0x02, 0xb3, 0x95, 0x0c, 0xb9, 0x38, 0x41, 0x66, 0x38, 0x25, 0x96, 0x24, 0x67, 0x08, 0xa9, 0x70,
+	0xb1, 0x81, 0xac, 0x49, 0x2d, 0x96, 0x60, 0x54, 0x60, 0xd6, 0xe0, 0x36, 0xe2, 0x81, 0x58, 0x58,
+	0xac, 0x07, 0x52, 0x12, 0x04, 0x95, 0x53, 0x32, 0xe4, 0xe2, 0x87, 0x6b, 0x71, 0xcc, 0x2b, 0x2e,
+	0x4f, 0x2d, 0x12, 0x92, 0xe3, 0xe2, 0x4a, 0x4b, 0xcc, 0xcc, 0x49, 0x4d, 0x09, 0xcd, 0x4c, 0x81,
+	0x68, 0xe6, 0x0c, 0x42, 0x12, 0x49, 0x82, 0xb8, 0xd8, 0x18, 0x30, 0x00, 0x96, 0x70, 0x97, 0xd1,
+	0xc6, 0x00, 0x00, 0x00,
 }
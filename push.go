@@ -40,6 +40,8 @@ func (app *App) SendPushToUsers(route string, v interface{}, uids []string, fron
 	}
 
 	var notPushedUids []string
+	var remotePushes []*protos.Push
+	batcher, batching := app.rpcClient.(cluster.PushBatcher)
 
 	logger.Log.Debugf("Type=PushToUsers Route=%s, Data=%+v, SvType=%s, #Users=%d", route, v, frontendType, len(uids))
 
@@ -56,6 +58,10 @@ func (app *App) SendPushToUsers(route string, v interface{}, uids []string, fron
 				Uid:   uid,
 				Data:  data,
 			}
+			if batching {
+				remotePushes = append(remotePushes, push)
+				continue
+			}
 			if err = app.rpcClient.SendPush(uid, &cluster.Server{Type: frontendType}, push); err != nil {
 				notPushedUids = append(notPushedUids, uid)
 				logger.Log.Errorf("RPCClient send message error, UID=%s, SvType=%s, Error=%s", uid, frontendType, err.Error())
@@ -65,6 +71,12 @@ func (app *App) SendPushToUsers(route string, v interface{}, uids []string, fron
 		}
 	}
 
+	// the pushes to the users connected to the same frontend server are sent
+	// in a single RPC
+	if len(remotePushes) > 0 {
+		notPushedUids = append(notPushedUids, batcher.SendPushes(&cluster.Server{Type: frontendType}, remotePushes)...)
+	}
+
 	if len(notPushedUids) != 0 {
 		return notPushedUids, constants.ErrPushingToUsers
 	}
@@ -27,6 +27,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/cluster"
 	clustermocks "github.com/topfreegames/pitaya/v2/cluster/mocks"
 	"github.com/topfreegames/pitaya/v2/config"
 	"github.com/topfreegames/pitaya/v2/constants"
@@ -166,3 +167,46 @@ func TestSendToUsersRemoteSession(t *testing.T) {
 		})
 	}
 }
+
+type pushBatchingRPCClient struct {
+	*clustermocks.MockRPCClient
+	frontendSv *cluster.Server
+	pushes     []*protos.Push
+	failed     []string
+}
+
+func (c *pushBatchingRPCClient) SendPushes(frontendSv *cluster.Server, pushes []*protos.Push) []string {
+	c.frontendSv = frontendSv
+	c.pushes = append(c.pushes, pushes...)
+	return c.failed
+}
+
+func TestSendToUsersRemoteSessionBatched(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	route := "some.route.bla"
+	data := []byte("hello")
+	uid1 := uuid.New().String()
+	uid2 := uuid.New().String()
+
+	mockSessionPool := sessionmocks.NewMockSessionPool(ctrl)
+	mockSessionPool.EXPECT().GetSessionByUID(uid1).Return(nil)
+	mockSessionPool.EXPECT().GetSessionByUID(uid2).Return(nil)
+	rpcClient := &pushBatchingRPCClient{MockRPCClient: clustermocks.NewMockRPCClient(ctrl), failed: []string{uid2}}
+
+	config := config.NewDefaultBuilderConfig()
+	builder := NewDefaultBuilder(true, "testtype", Cluster, map[string]string{}, *config)
+	builder.SessionPool = mockSessionPool
+	builder.RPCClient = rpcClient
+	app := builder.Build()
+
+	errArr, err := app.SendPushToUsers(route, data, []string{uid1, uid2}, "connector")
+	assert.Equal(t, constants.ErrPushingToUsers, err)
+	assert.Equal(t, []string{uid2}, errArr)
+	assert.Equal(t, &cluster.Server{Type: "connector"}, rpcClient.frontendSv)
+	assert.Equal(t, []*protos.Push{
+		{Route: route, Uid: uid1, Data: data},
+		{Route: route, Uid: uid2, Data: data},
+	}, rpcClient.pushes)
+}
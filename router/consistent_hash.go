@@ -0,0 +1,138 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/topfreegames/pitaya/v2/cluster"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/route"
+)
+
+// DefaultVirtualNodes is the number of points each server gets in the ring of
+// a ConsistentHashRouting when none is given
+const DefaultVirtualNodes = 100
+
+// ConsistentHashRouting routes the requests of the sessions with the same UID,
+// or the same value in a session key, to the same server by hashing it onto
+// a ring of the servers of the type. Each server is placed in the ring as
+// many virtual nodes, so only the keys of the servers that join or leave
+// move to other servers. The requests of sessions without the key are
+// routed to random servers
+type ConsistentHashRouting struct {
+	key          string
+	virtualNodes int
+	mutex        sync.Mutex
+	serverIDs    map[string]bool
+	ring         []uint32
+	owners       map[uint32]string
+}
+
+// NewConsistentHashRouting returns a ConsistentHashRouting hashing the session
+// UID, or the value of the session key key if it is not empty, onto a ring
+// with virtualNodes points per server, its Route method is meant to be added
+// with AddRoute, e.g.
+// app.AddRoute("match", router.NewConsistentHashRouting("", router.DefaultVirtualNodes).Route)
+func NewConsistentHashRouting(key string, virtualNodes int) *ConsistentHashRouting {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &ConsistentHashRouting{
+		key:          key,
+		virtualNodes: virtualNodes,
+	}
+}
+
+// Route is the RoutingFunc of the consistent hash routing
+func (c *ConsistentHashRouting) Route(
+	ctx context.Context,
+	route *route.Route,
+	payload []byte,
+	servers map[string]*cluster.Server,
+) (*cluster.Server, error) {
+	if len(servers) == 0 {
+		return nil, constants.ErrNoServersAvailableOfType
+	}
+	value, ok := sessionValue(ctx, c.key)
+	if !ok {
+		return randomServer(servers), nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.updateRing(servers)
+	h := hashKey(value)
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i] >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return servers[c.owners[c.ring[i]]], nil
+}
+
+// updateRing rebuilds the ring if the servers changed since it was built
+func (c *ConsistentHashRouting) updateRing(servers map[string]*cluster.Server) {
+	if len(servers) == len(c.serverIDs) {
+		changed := false
+		for id := range servers {
+			if !c.serverIDs[id] {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return
+		}
+	}
+
+	c.serverIDs = make(map[string]bool, len(servers))
+	c.ring = make([]uint32, 0, len(servers)*c.virtualNodes)
+	c.owners = make(map[uint32]string, len(servers)*c.virtualNodes)
+	for id := range servers {
+		c.serverIDs[id] = true
+		for i := 0; i < c.virtualNodes; i++ {
+			h := hashKey(id + "#" + strconv.Itoa(i))
+			// on collisions the smallest id wins, so the ring doesn't depend
+			// on the order of the map
+			if owner, ok := c.owners[h]; ok {
+				if owner < id {
+					continue
+				}
+			} else {
+				c.ring = append(c.ring, h)
+			}
+			c.owners[h] = id
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i] < c.ring[j] })
+}
+
+// hashKey hashes the key onto the ring, with md5 as fnv spreads the virtual
+// nodes of similar server ids unevenly
+func hashKey(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,116 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/cluster"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/session"
+)
+
+func newUIDCtx(uid string) context.Context {
+	s := session.NewSessionPool().NewSession(nil, true, uid)
+	return context.WithValue(context.Background(), constants.SessionCtxKey, s)
+}
+
+func newMatchServers(n int) map[string]*cluster.Server {
+	svs := make(map[string]*cluster.Server, n)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("match-%d", i)
+		svs[id] = cluster.NewServer(id, "match", false)
+	}
+	return svs
+}
+
+func routeUIDs(t *testing.T, c *ConsistentHashRouting, svs map[string]*cluster.Server) map[string]string {
+	routes := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		uid := fmt.Sprintf("uid-%d", i)
+		sv, err := c.Route(newUIDCtx(uid), nil, nil, svs)
+		assert.NoError(t, err)
+		routes[uid] = sv.ID
+	}
+	return routes
+}
+
+func TestNewConsistentHashRouting(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, DefaultVirtualNodes, NewConsistentHashRouting("", 0).virtualNodes)
+	assert.Equal(t, 10, NewConsistentHashRouting("", 10).virtualNodes)
+}
+
+func TestConsistentHashRouting(t *testing.T) {
+	t.Parallel()
+
+	c := NewConsistentHashRouting("", DefaultVirtualNodes)
+	svs := newMatchServers(4)
+	before := routeUIDs(t, c, svs)
+	assert.Equal(t, before, routeUIDs(t, c, svs))
+	assert.Equal(t, before, routeUIDs(t, NewConsistentHashRouting("", DefaultVirtualNodes), svs))
+
+	svs["match-4"] = cluster.NewServer("match-4", "match", false)
+	joined := routeUIDs(t, c, svs)
+	moved := 0
+	for uid, id := range joined {
+		if id != before[uid] {
+			assert.Equal(t, "match-4", id)
+			moved++
+		}
+	}
+	assert.True(t, moved > 0 && moved < 300, "moved %d keys", moved)
+
+	delete(svs, "match-4")
+	delete(svs, "match-0")
+	left := routeUIDs(t, c, svs)
+	for uid, id := range left {
+		if before[uid] != "match-0" {
+			assert.Equal(t, before[uid], id)
+		}
+		assert.NotEqual(t, "match-0", id)
+	}
+}
+
+func TestConsistentHashRoutingWithKey(t *testing.T) {
+	t.Parallel()
+
+	c := NewConsistentHashRouting("matchID", 10)
+	svs := newMatchServers(4)
+	sv, err := c.Route(newSessionCtx(t, map[string]interface{}{"matchID": 42}), nil, nil, svs)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		other, err := c.Route(newSessionCtx(t, map[string]interface{}{"matchID": 42}), nil, nil, svs)
+		assert.NoError(t, err)
+		assert.Equal(t, sv, other)
+	}
+
+	sv, err = c.Route(newUIDCtx(""), nil, nil, servers)
+	assert.NoError(t, err)
+	assert.Equal(t, server, sv)
+
+	_, err = c.Route(context.Background(), nil, nil, map[string]*cluster.Server{})
+	assert.Equal(t, constants.ErrNoServersAvailableOfType, err)
+}
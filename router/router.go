@@ -62,6 +62,11 @@ func (r *Router) SetServiceDiscovery(sd cluster.ServiceDiscovery) {
 func (r *Router) defaultRoute(
 	servers map[string]*cluster.Server,
 ) *cluster.Server {
+	return randomServer(servers)
+}
+
+// randomServer returns one of the servers at random
+func randomServer(servers map[string]*cluster.Server) *cluster.Server {
 	srvList := make([]*cluster.Server, 0)
 	s := rand.NewSource(time.Now().Unix())
 	rnd := rand.New(s)
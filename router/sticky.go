@@ -0,0 +1,104 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/topfreegames/pitaya/v2/cluster"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/route"
+	"github.com/topfreegames/pitaya/v2/session"
+)
+
+// StickyRouting routes the requests of the sessions with the same value in a
+// session key, e.g. a room id, to the same server. A value is pinned to the
+// server it is first routed to and is pinned again to another server when
+// that one goes away. The requests of sessions without the key are routed
+// to random servers
+type StickyRouting struct {
+	key   string
+	mutex sync.Mutex
+	pins  map[string]string
+}
+
+// NewStickyRouting returns a StickyRouting keyed by the session key key, its
+// Route method is meant to be added with AddRoute, e.g.
+// app.AddRoute("room", router.NewStickyRouting("roomID").Route)
+func NewStickyRouting(key string) *StickyRouting {
+	return &StickyRouting{
+		key:  key,
+		pins: make(map[string]string),
+	}
+}
+
+// Route is the RoutingFunc of the sticky routing
+func (s *StickyRouting) Route(
+	ctx context.Context,
+	route *route.Route,
+	payload []byte,
+	servers map[string]*cluster.Server,
+) (*cluster.Server, error) {
+	if len(servers) == 0 {
+		return nil, constants.ErrNoServersAvailableOfType
+	}
+	value, ok := sessionValue(ctx, s.key)
+	if !ok {
+		return randomServer(servers), nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if server, ok := servers[s.pins[value]]; ok {
+		return server, nil
+	}
+	server := randomServer(servers)
+	s.pins[value] = server.ID
+	return server, nil
+}
+
+// Unpin forgets the server the value is pinned to, it should be called when
+// the value is no longer used, e.g. when the room is closed
+func (s *StickyRouting) Unpin(value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.pins, value)
+}
+
+// sessionValue returns the value of the key in the session of the context, or
+// the session UID if the key is empty
+func sessionValue(ctx context.Context, key string) (string, bool) {
+	s, ok := ctx.Value(constants.SessionCtxKey).(session.Session)
+	if !ok || s == nil {
+		return "", false
+	}
+	if key == "" {
+		uid := s.UID()
+		return uid, uid != ""
+	}
+	value := s.Get(key)
+	if value == nil {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
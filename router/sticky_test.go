@@ -0,0 +1,86 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package router
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/cluster"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/session"
+)
+
+func newSessionCtx(t *testing.T, data map[string]interface{}) context.Context {
+	s := session.NewSessionPool().NewSession(nil, true)
+	assert.NoError(t, s.SetData(data))
+	return context.WithValue(context.Background(), constants.SessionCtxKey, s)
+}
+
+func TestStickyRouting(t *testing.T) {
+	t.Parallel()
+
+	sticky := NewStickyRouting("roomID")
+	svs := map[string]*cluster.Server{
+		"room-1": cluster.NewServer("room-1", "room", false),
+		"room-2": cluster.NewServer("room-2", "room", false),
+		"room-3": cluster.NewServer("room-3", "room", false),
+	}
+	ctx := newSessionCtx(t, map[string]interface{}{"roomID": "r1"})
+
+	pinned, err := sticky.Route(ctx, nil, nil, svs)
+	assert.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		sv, err := sticky.Route(newSessionCtx(t, map[string]interface{}{"roomID": "r1"}), nil, nil, svs)
+		assert.NoError(t, err)
+		assert.Equal(t, pinned, sv)
+	}
+
+	delete(svs, pinned.ID)
+	repinned, err := sticky.Route(ctx, nil, nil, svs)
+	assert.NoError(t, err)
+	assert.NotEqual(t, pinned, repinned)
+	svs[pinned.ID] = pinned
+	sv, err := sticky.Route(ctx, nil, nil, svs)
+	assert.NoError(t, err)
+	assert.Equal(t, repinned, sv)
+
+	sticky.Unpin("r1")
+	assert.NotContains(t, sticky.pins, "r1")
+}
+
+func TestStickyRoutingWithoutValue(t *testing.T) {
+	t.Parallel()
+
+	sticky := NewStickyRouting("roomID")
+
+	sv, err := sticky.Route(context.Background(), nil, nil, servers)
+	assert.NoError(t, err)
+	assert.Equal(t, server, sv)
+	sv, err = sticky.Route(newSessionCtx(t, map[string]interface{}{}), nil, nil, servers)
+	assert.NoError(t, err)
+	assert.Equal(t, server, sv)
+	assert.Empty(t, sticky.pins)
+
+	_, err = sticky.Route(context.Background(), nil, nil, map[string]*cluster.Server{})
+	assert.Equal(t, constants.ErrNoServersAvailableOfType, err)
+}
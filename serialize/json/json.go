@@ -21,26 +21,95 @@
 package json
 
 import (
+	"bytes"
 	"encoding/json"
 )
 
 // Serializer implements the serialize.Serializer interface
-type Serializer struct{}
+type Serializer struct {
+	deterministic      bool
+	largeIntsAsStrings bool
+}
+
+// Option used to customize the serializer
+type Option func(s *Serializer)
+
+// WithDeterministic makes the serializer marshal equal values to the same
+// bytes, with the keys of every object sorted, including the objects written
+// by json.Marshaler implementations, so the output can be hashed and compared
+func WithDeterministic() Option {
+	return func(s *Serializer) {
+		s.deterministic = true
+	}
+}
+
+// WithLargeIntsAsStrings makes the serializer marshal the integers out of the
+// range a JavaScript number holds exactly, beyond 2^53-1, as strings so web
+// clients don't lose precision, and accept them back as strings when
+// unmarshaling into integer fields
+func WithLargeIntsAsStrings() Option {
+	return func(s *Serializer) {
+		s.largeIntsAsStrings = true
+	}
+}
 
 // NewSerializer returns a new Serializer.
-func NewSerializer() *Serializer {
-	return &Serializer{}
+func NewSerializer(opts ...Option) *Serializer {
+	s := &Serializer{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // Marshal returns the JSON encoding of v.
 func (s *Serializer) Marshal(v interface{}) ([]byte, error) {
-	return json.Marshal(v)
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if s.deterministic {
+		if data, err = canonicalize(data); err != nil {
+			return nil, err
+		}
+	}
+	if s.largeIntsAsStrings {
+		data = quoteLargeInts(data)
+	}
+	return data, nil
+}
+
+// canonicalize re-encodes data through generic values, which encoding/json
+// writes with sorted object keys, keeping numbers as they were written
+func canonicalize(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return json.Marshal(generic)
 }
 
 // Unmarshal parses the JSON-encoded data and stores the result
 // in the value pointed to by v.
 func (s *Serializer) Unmarshal(data []byte, v interface{}) error {
-	return json.Unmarshal(data, v)
+	err := json.Unmarshal(data, v)
+	if !s.largeIntsAsStrings {
+		return err
+	}
+	// large integers come back as strings, as written by Marshal, so the
+	// strings rejected by integer fields are retried as numbers one by one
+	for retryData := data; ; {
+		typeErr, ok := err.(*json.UnmarshalTypeError)
+		if !ok || typeErr.Value != "string" {
+			return err
+		}
+		if retryData, ok = unquoteLargeIntAt(retryData, int(typeErr.Offset)); !ok {
+			return err
+		}
+		err = json.Unmarshal(retryData, v)
+	}
 }
 
 // GetName returns the name of the serializer.
@@ -75,6 +75,33 @@ func TestMarshal(t *testing.T) {
 	}
 }
 
+type unsortedMarshaler struct{}
+
+func (u unsortedMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`{"b": 1.50, "a": {"d": [2, {"f": 1, "e": 0}], "c": "x"}}`), nil
+}
+
+func TestMarshalDeterministic(t *testing.T) {
+	t.Parallel()
+
+	serializer := NewSerializer(WithDeterministic())
+	value := map[string]interface{}{
+		"z":         1,
+		"marshaler": unsortedMarshaler{},
+		"a":         []interface{}{"x", map[string]int{"k2": 2, "k1": 1}},
+	}
+	expected := []byte(`{"a":["x",{"k1":1,"k2":2}],"marshaler":{"a":{"c":"x","d":[2,{"e":0,"f":1}]},"b":1.50},"z":1}`)
+
+	for i := 0; i < 100; i++ {
+		result, err := serializer.Marshal(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, result)
+	}
+
+	_, err := serializer.Marshal(math.Inf(1))
+	assert.IsType(t, &json.UnsupportedValueError{}, err)
+}
+
 func TestUnmarshal(t *testing.T) {
 	t.Parallel()
 
@@ -114,3 +141,65 @@ func TestUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestMarshalLargeIntsAsStrings(t *testing.T) {
+	t.Parallel()
+
+	type MyStruct struct {
+		Small    int64
+		Signed   int64
+		Unsigned uint64
+		Float    float64
+		Text     string
+		Ints     map[string]int64
+	}
+	value := &MyStruct{
+		Small:    maxSafeInteger,
+		Signed:   -(1<<53 + 1),
+		Unsigned: math.MaxUint64,
+		Float:    1.5,
+		Text:     "9007199254740993",
+		Ints:     map[string]int64{"9007199254740993": math.MaxInt64},
+	}
+	serializer := NewSerializer(WithLargeIntsAsStrings())
+
+	result, err := serializer.Marshal(value)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Small":9007199254740991,"Signed":"-9007199254740993","Unsigned":"18446744073709551615","Float":1.5,"Text":"9007199254740993","Ints":{"9007199254740993":"9223372036854775807"}}`, string(result))
+
+	var roundTrip MyStruct
+	assert.NoError(t, serializer.Unmarshal(result, &roundTrip))
+	assert.Equal(t, value, &roundTrip)
+
+	var generic map[string]interface{}
+	assert.NoError(t, serializer.Unmarshal(result, &generic))
+	assert.Equal(t, "18446744073709551615", generic["Unsigned"])
+}
+
+func TestMarshalLargeIntsAsStringsDeterministic(t *testing.T) {
+	t.Parallel()
+
+	serializer := NewSerializer(WithDeterministic(), WithLargeIntsAsStrings())
+	result, err := serializer.Marshal(map[string]interface{}{"b": int64(1 << 60), "a": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1,"b":"1152921504606846976"}`, string(result))
+}
+
+func TestUnmarshalLargeIntsAsStringsKeepsStringErrors(t *testing.T) {
+	t.Parallel()
+
+	type MyStruct struct {
+		Number int64
+	}
+	serializer := NewSerializer(WithLargeIntsAsStrings())
+
+	var result MyStruct
+	err := serializer.Unmarshal([]byte(`{"Number":"abc"}`), &result)
+	assert.IsType(t, &json.UnmarshalTypeError{}, err)
+
+	err = serializer.Unmarshal([]byte(`{"Number":9007199254740993.5}`), &result)
+	assert.IsType(t, &json.UnmarshalTypeError{}, err)
+
+	err = NewSerializer().Unmarshal([]byte(`{"Number":"9007199254740993"}`), &result)
+	assert.IsType(t, &json.UnmarshalTypeError{}, err)
+}
@@ -0,0 +1,114 @@
+// Copyright (c) nano Author and TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package json
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// maxSafeInteger is the largest integer a JavaScript number holds exactly
+const maxSafeInteger = 1<<53 - 1
+
+// quoteLargeInts rewrites the integer literals of data that a JavaScript
+// number can't hold exactly as strings, data must be valid compact JSON
+func quoteLargeInts(data []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(data))
+	for i := 0; i < len(data); {
+		switch c := data[i]; {
+		case c == '"':
+			end := stringEnd(data, i)
+			out.Write(data[i:end])
+			i = end
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(data) && isNumberByte(data[end]) {
+				end++
+			}
+			if lit := data[i:end]; isLargeInt(lit) {
+				out.WriteByte('"')
+				out.Write(lit)
+				out.WriteByte('"')
+			} else {
+				out.Write(lit)
+			}
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.Bytes()
+}
+
+// unquoteLargeIntAt writes back as a number the string value of data ending
+// right before data[end], if it holds an integer a JavaScript number can't
+// hold exactly, reporting whether it did
+func unquoteLargeIntAt(data []byte, end int) ([]byte, bool) {
+	if end < 2 || end > len(data) || data[end-1] != '"' {
+		return nil, false
+	}
+	start := bytes.LastIndexByte(data[:end-1], '"')
+	if start < 0 || !isLargeInt(data[start+1:end-1]) {
+		return nil, false
+	}
+	out := make([]byte, 0, len(data)-2)
+	out = append(out, data[:start]...)
+	out = append(out, data[start+1:end-1]...)
+	return append(out, data[end:]...), true
+}
+
+// stringEnd returns the index right after the string starting at data[start]
+func stringEnd(data []byte, start int) int {
+	for i := start + 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+func isNumberByte(c byte) bool {
+	return (c >= '0' && c <= '9') || c == '-' || c == '+' || c == '.' || c == 'e' || c == 'E'
+}
+
+// isLargeInt reports whether lit is a JSON integer literal out of the range
+// a JavaScript number holds exactly
+func isLargeInt(lit []byte) bool {
+	digits := lit
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 || (digits[0] == '0' && len(digits) > 1) {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	n, err := strconv.ParseUint(string(digits), 10, 64)
+	return err != nil || n > maxSafeInteger
+}
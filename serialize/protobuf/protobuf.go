@@ -23,14 +23,34 @@ package protobuf
 import (
 	"github.com/golang/protobuf/proto"
 	"github.com/topfreegames/pitaya/v2/constants"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 // Serializer implements the serialize.Serializer interface
-type Serializer struct{}
+type Serializer struct {
+	deterministic bool
+}
+
+// Option used to customize the serializer
+type Option func(s *Serializer)
+
+// WithDeterministic makes the serializer marshal equal messages to the same
+// bytes, writing map fields sorted by key, so the output can be hashed and
+// compared. The output is only stable for a given build of the messages
+func WithDeterministic() Option {
+	return func(s *Serializer) {
+		s.deterministic = true
+	}
+}
 
 // NewSerializer returns a new Serializer.
-func NewSerializer() *Serializer {
-	return &Serializer{}
+func NewSerializer(opts ...Option) *Serializer {
+	s := &Serializer{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // Marshal returns the protobuf encoding of v.
@@ -39,6 +59,9 @@ func (s *Serializer) Marshal(v interface{}) ([]byte, error) {
 	if !ok {
 		return nil, constants.ErrWrongValueType
 	}
+	if s.deterministic {
+		return protov2.MarshalOptions{Deterministic: true}.Marshal(proto.MessageV2(pb))
+	}
 	return proto.Marshal(pb)
 }
 
@@ -56,3 +79,54 @@ func (s *Serializer) Unmarshal(data []byte, v interface{}) error {
 func (s *Serializer) GetName() string {
 	return "protobuf"
 }
+
+// HandshakeSerializer is a Serializer that also encodes the handshake
+// responses, as a google.protobuf.Struct, for clients that only speak
+// protobuf. It has the same name as Serializer.
+type HandshakeSerializer struct {
+	*Serializer
+}
+
+// NewHandshakeSerializer returns a new HandshakeSerializer.
+func NewHandshakeSerializer(opts ...Option) *HandshakeSerializer {
+	return &HandshakeSerializer{Serializer: NewSerializer(opts...)}
+}
+
+// MarshalHandshake returns the protobuf encoding of the handshake data as a
+// google.protobuf.Struct.
+func (s *HandshakeSerializer) MarshalHandshake(data map[string]interface{}) ([]byte, error) {
+	fields, err := structFields(data)
+	if err != nil {
+		return nil, err
+	}
+	return s.Marshal(&structpb.Struct{Fields: fields})
+}
+
+// structFields converts the handshake data to struct fields, the route
+// dictionary is the only value structpb can't convert by itself
+func structFields(data map[string]interface{}) (map[string]*structpb.Value, error) {
+	fields := make(map[string]*structpb.Value, len(data))
+	for key, value := range data {
+		var field *structpb.Value
+		var err error
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var nested map[string]*structpb.Value
+			nested, err = structFields(v)
+			field = structpb.NewStructValue(&structpb.Struct{Fields: nested})
+		case map[string]uint16:
+			nested := make(map[string]*structpb.Value, len(v))
+			for route, code := range v {
+				nested[route] = structpb.NewNumberValue(float64(code))
+			}
+			field = structpb.NewStructValue(&structpb.Struct{Fields: nested})
+		default:
+			field, err = structpb.NewValue(v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields[key] = field
+	}
+	return fields, nil
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/topfreegames/pitaya/v2/constants"
 	"github.com/topfreegames/pitaya/v2/helpers"
 	"github.com/topfreegames/pitaya/v2/protos"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 var update = flag.Bool("update", false, "update .golden files")
@@ -97,3 +98,67 @@ func TestUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestMarshalDeterministic(t *testing.T) {
+	t.Parallel()
+
+	serializer := NewSerializer(WithDeterministic())
+	newMessage := func(keys []string) *protos.Error {
+		metadata := map[string]string{}
+		for _, k := range keys {
+			metadata[k] = "value-" + k
+		}
+		return &protos.Error{Code: "code", Msg: "msg", Metadata: metadata}
+	}
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"}
+	reversed := make([]string, len(keys))
+	for i, k := range keys {
+		reversed[len(keys)-1-i] = k
+	}
+
+	expected, err := serializer.Marshal(newMessage(keys))
+	assert.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		result, err := serializer.Marshal(newMessage(reversed))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, result)
+	}
+
+	decoded := &protos.Error{}
+	assert.NoError(t, serializer.Unmarshal(expected, decoded))
+	assert.Equal(t, newMessage(keys).Metadata, decoded.Metadata)
+
+	_, err = serializer.Marshal("not a proto")
+	assert.Equal(t, constants.ErrWrongValueType, err)
+}
+
+func TestMarshalHandshake(t *testing.T) {
+	t.Parallel()
+
+	serializer := NewHandshakeSerializer()
+	assert.Equal(t, "protobuf", serializer.GetName())
+
+	data, err := serializer.MarshalHandshake(map[string]interface{}{
+		"code": 200,
+		"sys": map[string]interface{}{
+			"heartbeat":  30,
+			"dict":       map[string]uint16{"room.join": 1},
+			"serializer": "protobuf",
+		},
+	})
+	assert.NoError(t, err)
+
+	decoded := &structpb.Struct{}
+	assert.NoError(t, serializer.Unmarshal(data, decoded))
+	assert.Equal(t, map[string]interface{}{
+		"code": float64(200),
+		"sys": map[string]interface{}{
+			"heartbeat":  float64(30),
+			"dict":       map[string]interface{}{"room.join": float64(1)},
+			"serializer": "protobuf",
+		},
+	}, decoded.AsMap())
+
+	_, err = serializer.MarshalHandshake(map[string]interface{}{"invalid": make(chan int)})
+	assert.Error(t, err)
+}
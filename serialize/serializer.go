@@ -38,4 +38,11 @@ type (
 		Unmarshaler
 		GetName() string
 	}
+
+	// HandshakeMarshaler is implemented by the serializers that encode the
+	// handshake responses sent to their clients, which are encoded to JSON
+	// for the other serializers
+	HandshakeMarshaler interface {
+		MarshalHandshake(data map[string]interface{}) ([]byte, error)
+	}
 )
@@ -0,0 +1,77 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"sync"
+
+	"github.com/topfreegames/pitaya/v2/acceptor"
+	"github.com/topfreegames/pitaya/v2/metrics"
+)
+
+// acceptorConnections counts the connections of each acceptor, by name. The
+// zero value is ready to use
+type acceptorConnections struct {
+	mutex       sync.Mutex
+	connections map[string]*acceptor.ConnectionCounts
+}
+
+// opened counts a connection accepted by the acceptor and reports it
+func (c *acceptorConnections) opened(reporters []metrics.Reporter, name string) {
+	c.mutex.Lock()
+	if c.connections == nil {
+		c.connections = map[string]*acceptor.ConnectionCounts{}
+	}
+	conns, ok := c.connections[name]
+	if !ok {
+		conns = &acceptor.ConnectionCounts{}
+		c.connections[name] = conns
+	}
+	conns.Active++
+	conns.Total++
+	active := conns.Active
+	c.mutex.Unlock()
+
+	metrics.ReportAcceptedConnection(reporters, name)
+	metrics.ReportAcceptorConnections(reporters, name, active)
+}
+
+// closed counts a connection of the acceptor that was closed and reports it
+func (c *acceptorConnections) closed(reporters []metrics.Reporter, name string) {
+	c.mutex.Lock()
+	conns := c.connections[name]
+	conns.Active--
+	active := conns.Active
+	c.mutex.Unlock()
+
+	metrics.ReportAcceptorConnections(reporters, name, active)
+}
+
+// get returns a copy of the connection counts, by acceptor name
+func (c *acceptorConnections) get() map[string]acceptor.ConnectionCounts {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	counts := make(map[string]acceptor.ConnectionCounts, len(c.connections))
+	for name, conns := range c.connections {
+		counts[name] = *conns
+	}
+	return counts
+}
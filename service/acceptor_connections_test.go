@@ -0,0 +1,49 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/acceptor"
+)
+
+func TestAcceptorConnections(t *testing.T) {
+	t.Parallel()
+
+	var conns acceptorConnections
+	assert.Empty(t, conns.get())
+
+	conns.opened(nil, "game")
+	conns.opened(nil, "game")
+	conns.opened(nil, "admin")
+	conns.closed(nil, "game")
+	assert.Equal(t, map[string]acceptor.ConnectionCounts{
+		"game":  {Active: 1, Total: 2},
+		"admin": {Active: 1, Total: 1},
+	}, conns.get())
+
+	// the counts returned are a copy
+	counts := conns.get()
+	counts["game"] = acceptor.ConnectionCounts{}
+	assert.Equal(t, acceptor.ConnectionCounts{Active: 1, Total: 2}, conns.get()["game"])
+}
@@ -0,0 +1,66 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"time"
+
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/continuation"
+)
+
+// affinityTokenRoute binds the affinity tokens, so a token signed with the
+// same key for another purpose is not a valid affinity token
+const affinityTokenRoute = "sys.affinity"
+
+// affinityTokens issues and validates the affinity tokens handed to the
+// clients in the handshake response, which name the server they connected to
+type affinityTokens struct {
+	key []byte        // key the tokens are signed with
+	ttl time.Duration // time a token is valid for
+}
+
+// affinityCursor is the content of an affinity token
+type affinityCursor struct {
+	ServerID string `json:"s"`
+	Expires  int64  `json:"e"` // unix seconds
+}
+
+// issue returns a token naming serverID, valid until now plus the ttl
+func (t *affinityTokens) issue(serverID string, now time.Time) (string, error) {
+	return continuation.NewToken(t.key, affinityTokenRoute, &affinityCursor{
+		ServerID: serverID,
+		Expires:  now.Add(t.ttl).Unix(),
+	})
+}
+
+// validate returns the id of the server token names, failing if it was not
+// issued with the same key or is expired at now
+func (t *affinityTokens) validate(token string, now time.Time) (string, error) {
+	cursor := &affinityCursor{}
+	if err := continuation.ParseToken(t.key, affinityTokenRoute, token, cursor); err != nil {
+		return "", err
+	}
+	if now.Unix() >= cursor.Expires {
+		return "", constants.ErrAffinityTokenExpired
+	}
+	return cursor.ServerID, nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/continuation"
+)
+
+func TestAffinityTokens(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	tokens := &affinityTokens{key: []byte("key"), ttl: time.Hour}
+
+	token, err := tokens.issue("frontend-1", now)
+	assert.NoError(t, err)
+
+	serverID, err := tokens.validate(token, now.Add(59*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, "frontend-1", serverID)
+
+	_, err = tokens.validate(token, now.Add(time.Hour))
+	assert.Equal(t, constants.ErrAffinityTokenExpired, err)
+
+	_, err = (&affinityTokens{key: []byte("other"), ttl: time.Hour}).validate(token, now)
+	assert.Equal(t, continuation.ErrInvalidToken, err)
+
+	_, err = tokens.validate(token[:len(token)-2], now)
+	assert.Equal(t, continuation.ErrInvalidToken, err)
+}
+
+func TestAffinityTokensRejectOtherTokens(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	tokens := &affinityTokens{key: []byte("key"), ttl: time.Hour}
+
+	token, err := continuation.NewToken(tokens.key, "room.list", &affinityCursor{ServerID: "frontend-1", Expires: now.Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+
+	_, err = tokens.validate(token, now)
+	assert.Equal(t, continuation.ErrTokenRouteMismatch, err)
+}
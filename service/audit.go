@@ -0,0 +1,88 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"time"
+
+	e "github.com/topfreegames/pitaya/v2/errors"
+	"github.com/topfreegames/pitaya/v2/session"
+)
+
+// Audit outcomes
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// AuditRecord records who called an audited route, with which args, when and
+// with which outcome
+type AuditRecord struct {
+	Timestamp time.Time
+	UID       string
+	Route     string
+	// Args is the request payload as returned by the route sanitizer, nil if
+	// the route has none
+	Args    []byte
+	Outcome string
+	// ErrorCode is the code of the error the handler failed with, if any
+	ErrorCode string
+}
+
+// AuditSink receives the records of the audited routes, e.g. for writing them
+// to an append-only store apart from the server logs. Audit is called
+// synchronously after the handler returns so it must not block
+type AuditSink interface {
+	Audit(record *AuditRecord)
+}
+
+// AuditSanitizer returns the request payload to a route as it is recorded in
+// the audit log, e.g. without the payment tokens of a purchase
+type AuditSanitizer func(route string, data []byte) []byte
+
+// auditor emits the audit records of the audited routes to a sink
+type auditor struct {
+	sink   AuditSink
+	routes map[string]AuditSanitizer
+}
+
+// audit emits the record of a call of s to route with data that failed with
+// err, if route is audited
+func (a *auditor) audit(route string, s session.Session, data []byte, err error) {
+	sanitize, ok := a.routes[route]
+	if !ok {
+		return
+	}
+	record := &AuditRecord{
+		Timestamp: time.Now(),
+		UID:       s.UID(),
+		Route:     route,
+		Outcome:   AuditOutcomeSuccess,
+	}
+	if sanitize != nil {
+		record.Args = sanitize(route, data)
+	}
+	if err != nil {
+		record.Outcome = AuditOutcomeFailure
+		record.ErrorCode = e.CodeFromError(err)
+	}
+	a.sink.Audit(record)
+}
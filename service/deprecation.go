@@ -0,0 +1,51 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// deprecationWarning is the message pushed to the clients calling a
+// deprecated route
+type deprecationWarning struct {
+	Route   string `json:"route"`
+	Message string `json:"message"`
+	MID     uint   `json:"mid,omitempty"`
+}
+
+// newDeprecationWarning returns the warning of a call with mid to a
+// deprecated route for a client using the given serializer, protobuf clients
+// get a google.protobuf.Struct with the same fields
+func newDeprecationWarning(serializerName, route, msg string, mid uint) interface{} {
+	if serializerName != protobuf.NewSerializer().GetName() {
+		return &deprecationWarning{Route: route, Message: msg, MID: mid}
+	}
+	fields := map[string]*structpb.Value{
+		"route":   structpb.NewStringValue(route),
+		"message": structpb.NewStringValue(msg),
+	}
+	if mid > 0 {
+		fields["mid"] = structpb.NewNumberValue(float64(mid))
+	}
+	return &structpb.Struct{Fields: fields}
+}
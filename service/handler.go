@@ -25,6 +25,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/nats-io/nuid"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,6 +34,7 @@ import (
 	"github.com/topfreegames/pitaya/v2/pipeline"
 
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/topfreegames/pitaya/v2/agent"
 	"github.com/topfreegames/pitaya/v2/cluster"
 	"github.com/topfreegames/pitaya/v2/component"
@@ -70,6 +73,26 @@ type (
 		agentFactory     agent.AgentFactory
 		handlerPool      *HandlerPool
 		handlers         map[string]*component.Handler // all handler method
+		routeTimeouts    map[string]time.Duration      // max time each route handler can take
+		routeQuotas      *routeQuotas                  // calls each session can make to a route within a window
+		sessionPool      session.SessionPool           // counts the sessions for the soft capacity
+		softCapacity     int64                         // sessions over which handshakes are told to retry later, 0 disables it
+		retryAfter       time.Duration                 // time clients over the soft capacity are told to wait
+		responseCaches   *responseCaches               // responses cached for the routes with a cache
+		clientCodecs     map[string]PacketCodec        // packet codecs of the clients with a different framing, by protocol version
+		deprecations     map[string]string             // warning sent to the callers of each deprecated route
+		acceptorConns    acceptorConnections           // connection counts of each acceptor
+		maintenance      []MaintenanceWindow           // windows during which connecting clients are notified of the maintenance
+		rejectMaintained bool                          // if clients connecting during maintenance are rejected instead of notified
+		affinity         *affinityTokens               // issues the affinity tokens of the clients, nil if disabled
+	}
+
+	// PacketCodec is the packet encoder and decoder of the clients whose
+	// packet framing differs from the default one, a nil encoder or decoder
+	// keeps the default one
+	PacketCodec struct {
+		Encoder codec.PacketEncoder
+		Decoder codec.PacketDecoder
 	}
 
 	unhandledMessage struct {
@@ -78,6 +101,21 @@ type (
 		route *route.Route
 		msg   *message.Message
 	}
+
+	// creditMessage is the message sent by clients on the credit route
+	creditMessage struct {
+		Credit int64 `json:"credit"`
+	}
+
+	// rttMessage is the message sent by clients on the rtt route
+	rttMessage struct {
+		RTT int64 `json:"rtt"` // round trip time in milliseconds
+	}
+
+	// disconnectMessage is the message sent by clients on the disconnect route
+	disconnectMessage struct {
+		Reason string `json:"reason"`
+	}
 )
 
 // NewHandlerService creates and returns a new handler service
@@ -157,21 +195,162 @@ func (h *HandlerService) Register(comp component.Component, opts []component.Opt
 	for name, handler := range s.Handlers {
 		h.handlerPool.Register(s.Name, name, handler)
 	}
+	for name, handler := range s.NotifyHandlers {
+		h.handlerPool.RegisterNotify(s.Name, name, handler)
+	}
 	return nil
 }
 
 // Handle handles messages from a conn
 func (h *HandlerService) Handle(conn acceptor.PlayerConn) {
+	h.HandleWithSerializer(conn, nil)
+}
+
+// HandleWithSerializer handles messages from a conn, serializer is the default
+// serializer of the acceptor that received the conn and may be nil. It is only
+// used if the agent factory implements agent.SerializerAgentFactory
+func (h *HandlerService) HandleWithSerializer(conn acceptor.PlayerConn, serializer serialize.Serializer) {
+	h.handle(conn, acceptorOptions{serializer: serializer})
+}
+
+// HandleWithAcceptor handles messages from a conn of acc, with the default
+// serializer, the heartbeat interval, the packet rate limit and the packet
+// framing of acc if it has them. The conn is counted in the connections of acc if it has a name
+func (h *HandlerService) HandleWithAcceptor(conn acceptor.PlayerConn, acc acceptor.Acceptor) {
+	h.handle(conn, acceptorOptionsOf(acc))
+}
+
+// acceptorOptions are the settings of the acceptor a conn was received by
+// that apply to its agent
+type acceptorOptions struct {
+	name              string
+	framing           codec.PacketFraming
+	heartbeatInterval time.Duration
+	packetRateLimit   acceptor.PacketRateLimit
+	serializer        serialize.Serializer
+}
+
+// acceptorOptionsOf returns the settings of the providers acc implements, acc
+// may be nil
+func acceptorOptionsOf(acc acceptor.Acceptor) acceptorOptions {
+	var opts acceptorOptions
+	if p, ok := acc.(acceptor.SerializerProvider); ok {
+		opts.serializer = p.GetSerializer()
+	}
+	if p, ok := acc.(acceptor.PacketRateLimitProvider); ok {
+		opts.packetRateLimit = p.GetPacketRateLimit()
+	}
+	if p, ok := acc.(acceptor.NameProvider); ok {
+		opts.name = p.GetName()
+	}
+	if p, ok := acc.(acceptor.PacketFramingProvider); ok {
+		opts.framing = p.GetPacketFraming()
+	}
+	if p, ok := acc.(acceptor.HeartbeatIntervalProvider); ok {
+		opts.heartbeatInterval = p.GetHeartbeatInterval()
+	}
+	return opts
+}
+
+func (h *HandlerService) handle(conn acceptor.PlayerConn, opts acceptorOptions) {
+	if opts.name != "" {
+		h.acceptorConns.opened(h.metricsReporters, opts.name)
+		defer h.acceptorConns.closed(h.metricsReporters, opts.name)
+	}
+
 	// create a client agent and startup write goroutine
-	a := h.agentFactory.CreateAgent(conn)
+	var a agent.Agent
+	var err error
+	if f, ok := h.agentFactory.(agent.HeartbeatAgentFactory); ok && opts.heartbeatInterval > 0 {
+		a, err = f.CreateAgentWithHeartbeat(conn, opts.serializer, opts.heartbeatInterval)
+	} else if f, ok := h.agentFactory.(agent.SerializerAgentFactory); ok && opts.serializer != nil {
+		a, err = f.CreateAgentWithSerializer(conn, opts.serializer)
+	} else {
+		a, err = h.agentFactory.CreateAgent(conn)
+	}
+	if err != nil {
+		logger.Log.Errorf("Failed to create agent: %s", err.Error())
+		conn.Close()
+		return
+	}
+	if err := h.setupAgent(a, opts); err != nil {
+		conn.Close()
+		return
+	}
 
 	// startup agent goroutine
 	go a.Handle()
 
 	logger.Log.Debugf("New session established: %s", a.String())
 
+	// the decoder is the one of the acceptor framing or, if it has none,
+	// picked by the protocol version of the client once the handshake is
+	// processed
+	var decoder codec.PacketDecoder = h.decoder
+	if opts.framing != nil {
+		decoder = opts.framing
+	}
+	h.read(conn, a, decoder, opts.packetRateLimit.Rate > 0, opts.framing == nil)
+}
+
+// setupAgent applies the packet framing and the packet rate limit of opts to
+// a, if it has them
+func (h *HandlerService) setupAgent(a agent.Agent, opts acceptorOptions) error {
+	if opts.framing != nil {
+		if err := a.SetPacketEncoder(opts.framing); err != nil {
+			logger.Log.Errorf("Failed to set the packet framing of the agent: %s", err.Error())
+			return err
+		}
+	}
+	if opts.packetRateLimit.Rate > 0 {
+		a.SetPacketRateLimit(opts.packetRateLimit)
+	}
+	return nil
+}
+
+// HandleReconnect moves the client of a to conn, e.g. a connection the app
+// took over from a websocket upgrade once it recognized a client that lost
+// connectivity, and handles the messages read from conn like
+// HandleWithAcceptor, keeping the session of a and the messages queued for
+// it. acc is the acceptor conn was received by and may be nil. The read loop
+// of the previous connection stops without closing the session. It returns
+// once conn is closed, or right away with the error if a can't be moved
+func (h *HandlerService) HandleReconnect(conn acceptor.PlayerConn, a agent.Agent, acc acceptor.Acceptor) error {
+	if err := a.Reconnect(conn); err != nil {
+		return err
+	}
+	opts := acceptorOptionsOf(acc)
+	if opts.name != "" {
+		h.acceptorConns.opened(h.metricsReporters, opts.name)
+		defer h.acceptorConns.closed(h.metricsReporters, opts.name)
+	}
+	if err := h.setupAgent(a, opts); err != nil {
+		a.GetSession().Close()
+		return err
+	}
+	logger.Log.Debugf("Session reconnected: %s", a.String())
+
+	// the client already did the handshake, so the decoder is the one of
+	// its protocol version unless the acceptor has a framing
+	var decoder codec.PacketDecoder = h.packetDecoder(a)
+	if opts.framing != nil {
+		decoder = opts.framing
+	}
+	h.read(conn, a, decoder, opts.packetRateLimit.Rate > 0, false)
+	return nil
+}
+
+// read handles the packets read from conn, the connection of a, until it is
+// closed or fails, closing the session of a unless the client moved to
+// another connection meanwhile. The decoder is picked again by the protocol
+// version of the client once the handshake is processed if pickDecoder is set
+func (h *HandlerService) read(conn acceptor.PlayerConn, a agent.Agent, decoder codec.PacketDecoder, limitPackets, pickDecoder bool) {
 	// guarantee agent related resource is destroyed
 	defer func() {
+		if h.reconnected(conn, a) {
+			logger.Log.Debugf("Session moved to another connection, SessionID=%d, UID=%s", a.GetSession().ID(), a.GetSession().UID())
+			return
+		}
 		a.GetSession().Close()
 		logger.Log.Debugf("Session read goroutine exit, SessionID=%d, UID=%s", a.GetSession().ID(), a.GetSession().UID())
 	}()
@@ -180,16 +359,30 @@ func (h *HandlerService) Handle(conn acceptor.PlayerConn) {
 		msg, err := conn.GetNextMessage()
 
 		if err != nil {
-			if err != constants.ErrConnectionClosed {
+			if h.reconnected(conn, a) {
+				// the previous connection is closed once the client moves
+				return
+			}
+			if err == constants.ErrHandshakeTooLarge {
+				logger.Log.Errorf("Rejecting client: %s", err.Error())
+				a.SetCloseReason(session.DisconnectReasonProtocolError)
+			} else if err == constants.ErrPacketReadTimeout {
+				logger.Log.Errorf("Closing stalled client: %s", err.Error())
+				a.SetCloseReason(session.DisconnectReasonReadTimeout)
+			} else if err != constants.ErrConnectionClosed {
 				logger.Log.Errorf("Error reading next available message: %s", err.Error())
+				a.SetCloseReason(session.DisconnectReasonReadError)
+			} else {
+				a.SetCloseReason(session.DisconnectReasonConnectionClosed)
 			}
 
 			return
 		}
 
-		packets, err := h.decoder.Decode(msg)
+		packets, err := decoder.Decode(msg)
 		if err != nil {
 			logger.Log.Errorf("Failed to decode message: %s", err.Error())
+			a.SetCloseReason(session.DisconnectReasonProtocolError)
 			return
 		}
 
@@ -200,33 +393,116 @@ func (h *HandlerService) Handle(conn acceptor.PlayerConn) {
 
 		// process all packet
 		for i := range packets {
+			if limitPackets && packets[i].Type == packet.Data {
+				if err := a.AllowPacket(); err != nil {
+					if err == constants.ErrRateLimitExceeded {
+						logger.Log.Errorf("Closing client over the packet rate limit: %s", err.Error())
+						a.SetCloseReason(session.DisconnectReasonRateLimited)
+					}
+					return
+				}
+			}
 			if err := h.processPacket(a, packets[i]); err != nil {
 				logger.Log.Errorf("Failed to process packet: %s", err.Error())
+				if err == constants.ErrServerOverCapacity {
+					a.SetCloseReason(session.DisconnectReasonOverCapacity)
+				} else if err == constants.ErrServerUnderMaintenance {
+					a.SetCloseReason(session.DisconnectReasonMaintenance)
+				} else {
+					a.SetCloseReason(session.DisconnectReasonProtocolError)
+				}
 				return
 			}
+			if packets[i].Type == packet.Handshake && pickDecoder {
+				decoder = h.packetDecoder(a)
+			}
 		}
 	}
 }
 
+// reconnected returns whether the client of a moved from conn to another
+// connection
+func (h *HandlerService) reconnected(conn acceptor.PlayerConn, a agent.Agent) bool {
+	return a.Conn() != net.Conn(conn)
+}
+
 func (h *HandlerService) processPacket(a agent.Agent, p *packet.Packet) error {
 	switch p.Type {
 	case packet.Handshake:
 		logger.Log.Debug("Received handshake packet")
+
+		if h.overSoftCapacity() {
+			logger.Log.Warnf("Server over soft capacity, telling client to retry later, Id=%d", a.GetSession().ID())
+			if err := a.SendHandshakeRetryResponse(h.retryAfter); err != nil {
+				logger.Log.Errorf("Error sending handshake retry response: %s", err.Error())
+			}
+			return constants.ErrServerOverCapacity
+		}
+
+		if w, ok := maintenanceWindowAt(h.maintenance, time.Now()); ok && h.rejectMaintained {
+			logger.Log.Warnf("Server under maintenance, rejecting client, Id=%d", a.GetSession().ID())
+			if err := a.SendHandshakeMaintenanceResponse(time.Until(w.End), w.notice()); err != nil {
+				logger.Log.Errorf("Error sending handshake maintenance response: %s", err.Error())
+			}
+			return constants.ErrServerUnderMaintenance
+		}
+
+		// Parse the json sent with the handshake by the client, the heartbeat
+		// interval, dictionary reference and compression it asks for must be
+		// settled before the response is sent
+		handshakeData := &session.HandshakeData{}
+		err := json.Unmarshal(p.Data, handshakeData)
+		if c, ok := h.clientCodecs[handshakeData.Sys.ProtocolVersion]; err == nil && ok && c.Encoder != nil {
+			if nerr := a.SetPacketEncoder(c.Encoder); nerr != nil {
+				logger.Log.Errorf("Error setting the packet encoder of the client: %s", nerr.Error())
+			}
+		}
+		if err == nil && handshakeData.Sys.HeartbeatInterval > 0 {
+			interval := time.Duration(handshakeData.Sys.HeartbeatInterval * float64(time.Second))
+			if nerr := a.NegotiateHeartbeatInterval(interval); nerr != nil {
+				logger.Log.Errorf("Error negotiating heartbeat interval: %s", nerr.Error())
+			}
+		}
+		if err == nil && handshakeData.Sys.DictReference {
+			if nerr := a.NegotiateDictionaryReference(); nerr != nil {
+				logger.Log.Errorf("Error negotiating dictionary reference: %s", nerr.Error())
+			}
+		}
+		if err == nil && len(handshakeData.Sys.Compression) > 0 {
+			if nerr := a.NegotiateCompression(handshakeData.Sys.Compression); nerr != nil {
+				logger.Log.Errorf("Error negotiating compression: %s", nerr.Error())
+			}
+		}
+		if err == nil && handshakeData.Sys.TimestampedHeartbeat {
+			if nerr := a.NegotiateTimestampedHeartbeat(); nerr != nil {
+				logger.Log.Errorf("Error negotiating timestamped heartbeat: %s", nerr.Error())
+			}
+		}
+		if h.affinity != nil {
+			h.issueAffinityToken(a)
+		}
+
 		if err := a.SendHandshakeResponse(); err != nil {
 			logger.Log.Errorf("Error sending handshake response: %s", err.Error())
 			return err
 		}
 		logger.Log.Debugf("Session handshake Id=%d, Remote=%s", a.GetSession().ID(), a.RemoteAddr())
 
-		// Parse the json sent with the handshake by the client
-		handshakeData := &session.HandshakeData{}
-		err := json.Unmarshal(p.Data, handshakeData)
 		if err != nil {
 			a.SetStatus(constants.StatusClosed)
 			return fmt.Errorf("Invalid handshake data. Id=%d", a.GetSession().ID())
 		}
 
 		a.GetSession().SetHandshakeData(handshakeData)
+		if handshakeData.Sys.Credit > 0 {
+			a.GrantCredit(handshakeData.Sys.Credit)
+		}
+		if _, decided := a.GetTraceSampled(); decided && handshakeData.Sys.TraceSampled != nil {
+			a.SetTraceSampled(*handshakeData.Sys.TraceSampled)
+		}
+		if h.affinity != nil && handshakeData.Sys.AffinityToken != "" {
+			h.validateAffinityToken(a, handshakeData.Sys.AffinityToken)
+		}
 		a.SetStatus(constants.StatusHandshake)
 		err = a.GetSession().Set(constants.IPVersionKey, a.IPVersion())
 		if err != nil {
@@ -238,6 +514,9 @@ func (h *HandlerService) processPacket(a agent.Agent, p *packet.Packet) error {
 	case packet.HandshakeAck:
 		a.SetStatus(constants.StatusWorking)
 		logger.Log.Debugf("Receive handshake ACK Id=%d, Remote=%s", a.GetSession().ID(), a.RemoteAddr())
+		// run from the read loop, so before the first data packet is handled
+		a.HandshakeCompleted()
+		h.notifyMaintenance(a)
 
 	case packet.Data:
 		if a.GetStatus() < constants.StatusWorking {
@@ -249,21 +528,75 @@ func (h *HandlerService) processPacket(a agent.Agent, p *packet.Packet) error {
 		if err != nil {
 			return err
 		}
-		h.processMessage(a, msg)
+		switch msg.Route {
+		case constants.CreditRoute:
+			h.processCredit(a, msg)
+		case constants.BackgroundRoute:
+			a.SetBackgrounded()
+		case constants.RTTRoute:
+			h.processRTT(a, msg)
+		case constants.DisconnectRoute:
+			h.processDisconnect(a, msg)
+		default:
+			h.processMessage(a, msg)
+		}
 
 	case packet.Heartbeat:
-		// expected
+		// clients that negotiated timestamped heartbeats echo the time stamp
+		if len(p.Data) > 0 {
+			a.HandleHeartbeatEcho(p.Data)
+		}
 	}
 
 	a.SetLastAt()
 	return nil
 }
 
+// processCredit grants to the agent the credit sent by the client in a flow control message
+func (h *HandlerService) processCredit(a agent.Agent, msg *message.Message) {
+	credit := &creditMessage{}
+	if err := json.Unmarshal(msg.Data, credit); err != nil {
+		logger.Log.Warnf("Invalid credit message, ID=%d, UID=%s, Error=%s",
+			a.GetSession().ID(), a.GetSession().UID(), err.Error())
+		return
+	}
+	a.GrantCredit(credit.Credit)
+}
+
+// processRTT records the round trip time measured by the client
+func (h *HandlerService) processRTT(a agent.Agent, msg *message.Message) {
+	rtt := &rttMessage{}
+	if err := json.Unmarshal(msg.Data, rtt); err != nil {
+		logger.Log.Warnf("Invalid rtt message, ID=%d, UID=%s, Error=%s",
+			a.GetSession().ID(), a.GetSession().UID(), err.Error())
+		return
+	}
+	a.SetRTT(time.Duration(rtt.RTT) * time.Millisecond)
+}
+
+// processDisconnect records the reason the client reported for disconnecting
+func (h *HandlerService) processDisconnect(a agent.Agent, msg *message.Message) {
+	disconnect := &disconnectMessage{}
+	if err := json.Unmarshal(msg.Data, disconnect); err != nil {
+		logger.Log.Warnf("Invalid disconnect message, ID=%d, UID=%s, Error=%s",
+			a.GetSession().ID(), a.GetSession().UID(), err.Error())
+		return
+	}
+	a.SetClientCloseReason(disconnect.Reason)
+}
+
 func (h *HandlerService) processMessage(a agent.Agent, msg *message.Message) {
 	requestID := nuid.New()
 	ctx := pcontext.AddToPropagateCtx(context.Background(), constants.StartTimeKey, time.Now().UnixNano())
 	ctx = pcontext.AddToPropagateCtx(ctx, constants.RouteKey, msg.Route)
 	ctx = pcontext.AddToPropagateCtx(ctx, constants.RequestIDKey, requestID)
+	if msg.DryRun {
+		ctx = pcontext.AddToPropagateCtx(ctx, constants.DryRunKey, true)
+	}
+	if msg.IdempotencyKey != "" {
+		ctx = pcontext.AddToPropagateCtx(ctx, constants.IdempotencyKeyKey, msg.IdempotencyKey)
+	}
+	ctx = pcontext.AddToPropagateCtx(ctx, constants.ConnectionQualityKey, string(a.ConnectionQuality()))
 	tags := opentracing.Tags{
 		"local.id":   h.server.ID,
 		"span.kind":  "server",
@@ -271,8 +604,15 @@ func (h *HandlerService) processMessage(a agent.Agent, msg *message.Message) {
 		"user.id":    a.GetSession().UID(),
 		"request.id": requestID,
 	}
+	if sampled, decided := a.GetTraceSampled(); decided {
+		tags[string(ext.SamplingPriority)] = tracing.SamplingPriority(sampled)
+	}
 	ctx = tracing.StartSpan(ctx, msg.Route, tags)
-	ctx = context.WithValue(ctx, constants.SessionCtxKey, a.GetSession())
+	s := a.GetSession()
+	ctx = context.WithValue(ctx, constants.SessionCtxKey, s)
+	if msg.Type == message.Request {
+		ctx = context.WithValue(ctx, constants.ProgressCtxKey, session.NewProgress(s, msg.ID))
+	}
 
 	r, err := route.Decode(msg.Route)
 	if err != nil {
@@ -285,6 +625,19 @@ func (h *HandlerService) processMessage(a agent.Agent, msg *message.Message) {
 		r.SvType = h.server.Type
 	}
 
+	if err := h.checkQuota(s, r); err != nil {
+		logger.Log.Warnf("Route quota exceeded, ID=%d, UID=%s, Route=%s", s.ID(), s.UID(), msg.Route)
+		if msg.Type == message.Request {
+			a.AnswerWithError(ctx, msg.ID, err)
+		} else {
+			metrics.ReportTimingFromCtx(ctx, h.metricsReporters, handlerType, err)
+			tracing.FinishSpan(ctx, err)
+		}
+		return
+	}
+
+	h.warnDeprecation(a, msg, r)
+
 	message := unhandledMessage{
 		ctx:   ctx,
 		agent: a,
@@ -311,7 +664,7 @@ func (h *HandlerService) localProcess(ctx context.Context, a agent.Agent, route
 		mid = 0
 	}
 
-	ret, err := h.handlerPool.ProcessHandlerMessage(ctx, route, h.serializer, h.handlerHooks, a.GetSession(), msg.Data, msg.Type, false)
+	ret, err := h.processHandlerMessage(ctx, a, route, msg)
 	if msg.Type != message.Notify {
 		if err != nil {
 			logger.Log.Errorf("Failed to process handler message: %s", err.Error())
@@ -329,6 +682,283 @@ func (h *HandlerService) localProcess(ctx context.Context, a agent.Agent, route
 	}
 }
 
+// processHandlerMessage returns the response to msg cached for route, if
+// any, otherwise it runs the handler of route and caches its response if the
+// route has a cache. Dry run requests and notifies are never cached
+func (h *HandlerService) processHandlerMessage(ctx context.Context, a agent.Agent, route *route.Route, msg *message.Message) ([]byte, error) {
+	if h.responseCaches == nil || msg.Type != message.Request || msg.DryRun {
+		return h.runHandler(ctx, a, route, msg)
+	}
+	key, ok := h.responseCaches.key(ctx, route.Short(), a.GetSerializer().GetName(), msg.Data)
+	if !ok {
+		return h.runHandler(ctx, a, route, msg)
+	}
+	if ret, ok := h.responseCaches.get(key, time.Now()); ok {
+		return ret, nil
+	}
+
+	ret, err := h.runHandler(ctx, a, route, msg)
+	if err == nil {
+		h.responseCaches.set(key, ret, time.Now())
+	}
+	return ret, err
+}
+
+// runHandler runs the handler of route, if the route has a timeout and the
+// handler does not return in time a timeout error carrying the configured
+// duration in its metadata is returned instead of the handler result
+func (h *HandlerService) runHandler(ctx context.Context, a agent.Agent, route *route.Route, msg *message.Message) ([]byte, error) {
+	timeout, ok := h.routeTimeouts[route.Short()]
+	if !ok {
+		return h.handlerPool.ProcessHandlerMessage(ctx, route, a.GetSerializer(), h.handlerHooks, a.GetSession(), msg.Data, msg.Type, false)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type handlerResult struct {
+		ret []byte
+		err error
+	}
+	chResult := make(chan handlerResult, 1)
+	go func() {
+		ret, err := h.handlerPool.ProcessHandlerMessage(ctx, route, a.GetSerializer(), h.handlerHooks, a.GetSession(), msg.Data, msg.Type, false)
+		chResult <- handlerResult{ret: ret, err: err}
+	}()
+
+	select {
+	case res := <-chResult:
+		return res.ret, res.err
+	case <-ctx.Done():
+		return nil, e.NewError(constants.ErrHandlerTimeout, e.ErrTimeoutCode, map[string]string{
+			"timeoutMs": strconv.FormatInt(timeout.Milliseconds(), 10),
+		})
+	}
+}
+
+// SetSoftCapacity sets the number of sessions in sessionPool over which new
+// handshakes are answered with a response telling the client to reconnect
+// after retryAfter, after which the connection is closed. A capacity of 0
+// disables it. It must be called before the service starts handling clients
+func (h *HandlerService) SetSoftCapacity(sessionPool session.SessionPool, capacity int64, retryAfter time.Duration) {
+	h.sessionPool = sessionPool
+	h.softCapacity = capacity
+	h.retryAfter = retryAfter
+}
+
+// overSoftCapacity returns whether the server has more sessions than its
+// soft capacity, the session of the connection being handshaken included
+func (h *HandlerService) overSoftCapacity() bool {
+	return h.softCapacity > 0 && h.sessionPool != nil && h.sessionPool.GetSessionCount() > h.softCapacity
+}
+
+// SetMaintenanceWindows sets the windows during which the server is under
+// maintenance. Clients whose handshake falls in one of them are pushed its
+// notice on the maintenance route once the handshake is acknowledged or, if
+// reject is set, answered with a handshake response telling them to retry
+// once the window ends, after which the connection is closed. It must be
+// called before the service starts handling clients
+func (h *HandlerService) SetMaintenanceWindows(windows []MaintenanceWindow, reject bool) {
+	h.maintenance = windows
+	h.rejectMaintained = reject
+}
+
+// SetAffinityTokens makes the handshake response carry an affinity token
+// naming this server, signed with key and valid for ttl, that clients echo in
+// their handshake when they reconnect so a load balancer supporting token
+// stickiness can route them back to it. The id of the server named by a
+// valid token is stored in the session under constants.AffinityServerIDKey,
+// while stale or forged tokens are ignored. An empty key disables the tokens.
+// It must be called before the service starts handling clients
+func (h *HandlerService) SetAffinityTokens(key []byte, ttl time.Duration) {
+	if len(key) == 0 {
+		h.affinity = nil
+		return
+	}
+	h.affinity = &affinityTokens{key: key, ttl: ttl}
+}
+
+// issueAffinityToken makes the handshake response of the client carry an
+// affinity token naming this server
+func (h *HandlerService) issueAffinityToken(a agent.Agent) {
+	token, err := h.affinity.issue(h.server.ID, time.Now())
+	if err != nil {
+		logger.Log.Errorf("Error issuing affinity token: %s", err.Error())
+		return
+	}
+	if err := a.SetAffinityToken(token); err != nil {
+		logger.Log.Errorf("Error setting affinity token: %s", err.Error())
+	}
+}
+
+// validateAffinityToken stores in the session of the client the id of the
+// server named by the affinity token it presented, if the token is valid
+func (h *HandlerService) validateAffinityToken(a agent.Agent, token string) {
+	serverID, err := h.affinity.validate(token, time.Now())
+	if err != nil {
+		logger.Log.Debugf("Ignoring affinity token, Id=%d, Error=%s", a.GetSession().ID(), err.Error())
+		return
+	}
+	if serverID != h.server.ID {
+		logger.Log.Debugf("Client with affinity to server %s connected to %s, Id=%d", serverID, h.server.ID, a.GetSession().ID())
+	}
+	if err := a.GetSession().Set(constants.AffinityServerIDKey, serverID); err != nil {
+		logger.Log.Warnf("failed to save affinity server id on session: %s", err.Error())
+	}
+}
+
+// notifyMaintenance pushes the client of a the notice of the maintenance
+// window it connected in, if any
+func (h *HandlerService) notifyMaintenance(a agent.Agent) {
+	w, ok := maintenanceWindowAt(h.maintenance, time.Now())
+	if !ok {
+		return
+	}
+	s := a.GetSession()
+	notice, err := newMaintenanceNotice(s.SerializerName(), w)
+	if err == nil {
+		err = a.Push(constants.MaintenanceRoute, notice)
+	}
+	if err != nil {
+		logger.Log.Warnf("Failed to notify client of maintenance, ID=%d: %s", s.ID(), err.Error())
+	}
+}
+
+// SetClientCodecs sets the packet codecs of the clients whose packet framing
+// differs from the default one, by the protocol version they declare in the
+// handshake. The handshake of every client is decoded with the default
+// decoder, the codec of the client is used from its handshake response on
+func (h *HandlerService) SetClientCodecs(codecs map[string]PacketCodec) {
+	h.clientCodecs = codecs
+}
+
+// packetDecoder returns the packet decoder of the client of a, picked by the
+// protocol version it declared in the handshake
+func (h *HandlerService) packetDecoder(a agent.Agent) codec.PacketDecoder {
+	if len(h.clientCodecs) == 0 {
+		return h.decoder
+	}
+	handshakeData := a.GetSession().GetHandshakeData()
+	if handshakeData == nil {
+		return h.decoder
+	}
+	if c, ok := h.clientCodecs[handshakeData.Sys.ProtocolVersion]; ok && c.Decoder != nil {
+		return c.Decoder
+	}
+	return h.decoder
+}
+
+// SetRouteTimeouts sets the max time the handler of each route can take, the
+// routes are in the service.method format. When the timeout fires the client
+// is answered with an error and the handler result is discarded. It must be
+// called before the service starts handling clients
+func (h *HandlerService) SetRouteTimeouts(timeouts map[string]time.Duration) {
+	h.routeTimeouts = timeouts
+}
+
+// SetResponseCaches sets the routes whose responses are cached, in the
+// service.method format. While a response is cached the requests with the
+// same cache key are answered with it without running the handler nor its
+// hooks. It must be called before the service starts handling clients
+func (h *HandlerService) SetResponseCaches(caches map[string]ResponseCache) {
+	if len(caches) == 0 {
+		h.responseCaches = nil
+		return
+	}
+	h.responseCaches = newResponseCaches(caches)
+}
+
+// InvalidateResponseCache drops the responses of route cached under keys, or
+// every response of route if no key is given, so the next requests run the
+// handler again, e.g. after the shop catalog changes
+func (h *HandlerService) InvalidateResponseCache(route string, keys ...string) {
+	if h.responseCaches == nil {
+		return
+	}
+	h.responseCaches.invalidate(route, keys...)
+}
+
+// HandlersInFlight returns the number of handlers of every route executing
+// on the server
+func (h *HandlerService) HandlersInFlight() int64 {
+	return h.handlerPool.InFlight()
+}
+
+// AcceptorConnections returns the number of connections open right now and
+// accepted since the server started on each acceptor, by acceptor name
+func (h *HandlerService) AcceptorConnections() map[string]acceptor.ConnectionCounts {
+	return h.acceptorConns.get()
+}
+
+// ForEachAgent calls f for each live agent of the service, in no particular
+// order. It does nothing if the agent factory of the service does not keep
+// track of its agents
+func (h *HandlerService) ForEachAgent(f func(a agent.Agent)) {
+	if it, ok := h.agentFactory.(agent.AgentIterator); ok {
+		it.ForEachAgent(f)
+	}
+}
+
+// SetRouteQuotas sets the max number of calls a session can make to each
+// route within a sliding window, the routes are in the service.method format.
+// Requests over the quota are answered with an error carrying in its resetMs
+// metadata how long until another call is allowed. It must be called before
+// the service starts handling clients
+func (h *HandlerService) SetRouteQuotas(sessionPool session.SessionPool, quotas map[string]RouteQuota) {
+	if len(quotas) == 0 {
+		h.routeQuotas = nil
+		return
+	}
+	h.routeQuotas = newRouteQuotas(quotas)
+	routeQuotas := h.routeQuotas
+	sessionPool.OnSessionClose(func(s session.Session) {
+		routeQuotas.forget(s.ID())
+	})
+}
+
+// SetRouteDeprecations sets the deprecated routes, in the service.method
+// format, with the warning sent to their callers. Calls to them are still
+// handled, but each one is counted in the deprecated route calls metric and
+// its caller is pushed the warning before the response. It must be called
+// before the service starts handling clients
+func (h *HandlerService) SetRouteDeprecations(deprecations map[string]string) {
+	h.deprecations = deprecations
+}
+
+// warnDeprecation reports the call msg made to rt and warns the client if the
+// route is deprecated
+func (h *HandlerService) warnDeprecation(a agent.Agent, msg *message.Message, rt *route.Route) {
+	warning, ok := h.deprecations[rt.Short()]
+	if !ok {
+		return
+	}
+	metrics.ReportDeprecatedRouteCall(h.metricsReporters, rt.Short())
+	s := a.GetSession()
+	if err := a.Push(constants.DeprecationRoute, newDeprecationWarning(s.SerializerName(), rt.Short(), warning, msg.ID)); err != nil {
+		logger.Log.Warnf("Failed to warn client of deprecated route, ID=%d, UID=%s, Route=%s: %s", s.ID(), s.UID(), msg.Route, err.Error())
+	}
+}
+
+// checkQuota records a call of the session to rt, returning an error if the
+// session exhausted the route quota
+func (h *HandlerService) checkQuota(s session.Session, rt *route.Route) error {
+	if h.routeQuotas == nil {
+		return nil
+	}
+	reset, ok := h.routeQuotas.allow(s.ID(), rt.Short(), time.Now())
+	if ok {
+		return nil
+	}
+	return e.NewError(constants.ErrRouteQuotaExceeded, e.ErrTooManyRequestsCode, map[string]string{
+		"resetMs": strconv.FormatInt(reset.Milliseconds(), 10),
+	})
+}
+
+// SetReady signals that the server finished warming up, see HandlerPool.SetReady
+func (h *HandlerService) SetReady() {
+	h.handlerPool.SetReady()
+}
+
 // DumpServices outputs all registered services
 func (h *HandlerService) DumpServices() {
 	handlers := h.handlerPool.GetHandlers()
@@ -4,12 +4,15 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sync"
+	"sync/atomic"
 
 	"github.com/topfreegames/pitaya/v2/component"
 	"github.com/topfreegames/pitaya/v2/conn/message"
 	"github.com/topfreegames/pitaya/v2/constants"
 	e "github.com/topfreegames/pitaya/v2/errors"
 	"github.com/topfreegames/pitaya/v2/logger/interfaces"
+	"github.com/topfreegames/pitaya/v2/metrics"
 	"github.com/topfreegames/pitaya/v2/pipeline"
 	"github.com/topfreegames/pitaya/v2/route"
 	"github.com/topfreegames/pitaya/v2/serialize"
@@ -19,21 +22,87 @@ import (
 
 // HandlerPool ...
 type HandlerPool struct {
-	handlers map[string]*component.Handler // all handler method
+	handlers         map[string]*component.Handler // all handler method
+	notifyHandlers   map[string]*component.Handler // notify handlers of routes that also have a request handler
+	warmupRoutes     map[string]bool               // routes rejected until the server is ready
+	ready            int32
+	metricsReporters []metrics.Reporter
+	inFlight         sync.Map // *int64 handlers currently executing by route
+	totalInFlight    int64    // handlers currently executing of every route
+	auditor          *auditor // emits the audit records of the audited routes, nil if none is
+	idempotencyStore IdempotencyStore
 }
 
 // NewHandlerPool ...
 func NewHandlerPool() *HandlerPool {
 	return &HandlerPool{
-		handlers: make(map[string]*component.Handler),
+		handlers:       make(map[string]*component.Handler),
+		notifyHandlers: make(map[string]*component.Handler),
+		warmupRoutes:   make(map[string]bool),
 	}
 }
 
+// SetMetricsReporters sets the reporters the number of handlers in flight
+// of each route is reported to. It must be called before the server starts
+// handling messages
+func (h *HandlerPool) SetMetricsReporters(reporters []metrics.Reporter) {
+	h.metricsReporters = reporters
+}
+
+// SetWarmupRoutes sets the routes, in the service.method format, that are
+// answered with a warming up error until SetReady is called. It must be
+// called before the server starts handling messages
+func (h *HandlerPool) SetWarmupRoutes(routes []string) {
+	h.warmupRoutes = make(map[string]bool, len(routes))
+	for _, r := range routes {
+		h.warmupRoutes[r] = true
+	}
+}
+
+// SetAuditedRoutes sets the routes, in the service.method format, whose calls
+// are recorded to sink with the caller uid, the request payload as returned
+// by the route sanitizer and the outcome. Calls rejected before reaching the
+// handler are recorded as failures too. It must be called before the server
+// starts handling messages
+func (h *HandlerPool) SetAuditedRoutes(sink AuditSink, routes map[string]AuditSanitizer) {
+	if sink == nil || len(routes) == 0 {
+		h.auditor = nil
+		return
+	}
+	h.auditor = &auditor{sink: sink, routes: routes}
+}
+
+// SetIdempotencyStore sets the store handlers get from their context to
+// detect the retries of requests by their idempotency key. It must be called
+// before the server starts handling messages
+func (h *HandlerPool) SetIdempotencyStore(store IdempotencyStore) {
+	h.idempotencyStore = store
+}
+
+// SetReady signals that the server finished warming up, so the warmup
+// routes start being served
+func (h *HandlerPool) SetReady() {
+	atomic.StoreInt32(&h.ready, 1)
+}
+
+// isWarmingUp returns whether messages to rt must be rejected because the
+// server is not ready yet
+func (h *HandlerPool) isWarmingUp(rt *route.Route) bool {
+	return h.warmupRoutes[rt.Short()] && atomic.LoadInt32(&h.ready) == 0
+}
+
 // Register ...
 func (h *HandlerPool) Register(serviceName string, name string, handler *component.Handler) {
 	h.handlers[fmt.Sprintf("%s.%s", serviceName, name)] = handler
 }
 
+// RegisterNotify registers a notify handler for a route that also has a
+// request handler, notifies to the route are dispatched to it while requests
+// go to the handler registered with Register
+func (h *HandlerPool) RegisterNotify(serviceName string, name string, handler *component.Handler) {
+	h.notifyHandlers[fmt.Sprintf("%s.%s", serviceName, name)] = handler
+}
+
 // GetHandlers ...
 func (h *HandlerPool) GetHandlers() map[string]*component.Handler {
 	return h.handlers
@@ -49,21 +118,45 @@ func (h *HandlerPool) ProcessHandlerMessage(
 	data []byte,
 	msgTypeIface interface{},
 	remote bool,
+) ([]byte, error) {
+	ret, err := h.processHandlerMessage(ctx, rt, serializer, handlerHooks, session, data, msgTypeIface, remote)
+	if h.auditor != nil {
+		h.auditor.audit(rt.Short(), session, data, err)
+	}
+	return ret, err
+}
+
+func (h *HandlerPool) processHandlerMessage(
+	ctx context.Context,
+	rt *route.Route,
+	serializer serialize.Serializer,
+	handlerHooks *pipeline.HandlerHooks,
+	session session.Session,
+	data []byte,
+	msgTypeIface interface{},
+	remote bool,
 ) ([]byte, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
 	ctx = context.WithValue(ctx, constants.SessionCtxKey, session)
+	if h.idempotencyStore != nil {
+		ctx = context.WithValue(ctx, constants.IdempotencyStoreCtxKey, h.idempotencyStore)
+	}
 	ctx = util.CtxWithDefaultLogger(ctx, rt.String(), session.UID())
 
-	handler, err := h.getHandler(rt)
+	msgType, msgTypeErr := getMsgType(msgTypeIface)
+	handler, err := h.getHandler(rt, msgType)
 	if err != nil {
 		return nil, e.NewError(err, e.ErrNotFoundCode)
 	}
 
-	msgType, err := getMsgType(msgTypeIface)
-	if err != nil {
-		return nil, e.NewError(err, e.ErrInternalCode)
+	if h.isWarmingUp(rt) {
+		return nil, e.NewError(constants.ErrServerWarmingUp, e.ErrUnavailableCode)
+	}
+
+	if msgTypeErr != nil {
+		return nil, e.NewError(msgTypeErr, e.ErrInternalCode)
 	}
 
 	logger := ctx.Value(constants.LoggerCtxKey).(interfaces.Logger)
@@ -75,10 +168,13 @@ func (h *HandlerPool) ProcessHandlerMessage(
 	}
 
 	// First unmarshal the handler arg that will be passed to
-	// both handler and pipeline functions
+	// both handler and pipeline functions, a body that doesn't
+	// decode into the route message type never reaches the handler
 	arg, err := unmarshalHandlerArg(handler, serializer, data)
 	if err != nil {
-		return nil, e.NewError(err, e.ErrBadRequestCode)
+		return nil, e.NewError(constants.ErrInvalidRequestBody, e.ErrBadRequestCode, map[string]string{
+			"reason": err.Error(),
+		})
 	}
 
 	ctx, arg, err = handlerHooks.BeforeHandler.ExecuteBeforePipeline(ctx, arg)
@@ -92,7 +188,13 @@ func (h *HandlerPool) ProcessHandlerMessage(
 		args = append(args, reflect.ValueOf(arg))
 	}
 
-	resp, err := util.Pcall(handler.Method, args)
+	resp, err := h.callHandler(rt, handler, args)
+	if err == constants.ErrReplyShouldBeNotNull && msgType == message.Request {
+		// answered with an error so the client does not wait for a response
+		// that never comes
+		logger.Warnf("pitaya/handler: %s returned a nil response to a request", rt.String())
+		err = e.NewError(err, e.ErrInternalCode)
+	}
 	if remote && msgType == message.Notify {
 		// This is a special case and should only happen with nats rpc client
 		// because we used nats request we have to answer to it or else a timeout
@@ -115,7 +217,42 @@ func (h *HandlerPool) ProcessHandlerMessage(
 	return ret, nil
 }
 
-func (h *HandlerPool) getHandler(rt *route.Route) (*component.Handler, error) {
+// callHandler calls handler with args, counting it as in flight for rt until
+// it returns. Handlers that panic or outlive a route timeout are counted
+// until they actually return
+func (h *HandlerPool) callHandler(rt *route.Route, handler *component.Handler, args []reflect.Value) (interface{}, error) {
+	h.addInFlight(rt.String(), 1)
+	defer h.addInFlight(rt.String(), -1)
+	return util.Pcall(handler.Method, args)
+}
+
+// addInFlight adds delta to the handlers in flight of route and reports the
+// new value. No lock is held while reporting, so the reports of concurrent
+// updates of a route can reach the reporters out of order
+func (h *HandlerPool) addInFlight(route string, delta int64) {
+	counter, ok := h.inFlight.Load(route)
+	if !ok {
+		counter, _ = h.inFlight.LoadOrStore(route, new(int64))
+	}
+	inFlight := atomic.AddInt64(counter.(*int64), delta)
+	atomic.AddInt64(&h.totalInFlight, delta)
+	metrics.ReportHandlersInFlight(h.metricsReporters, route, inFlight)
+}
+
+// InFlight returns the number of handlers of every route currently executing
+func (h *HandlerPool) InFlight() int64 {
+	return atomic.LoadInt64(&h.totalInFlight)
+}
+
+// getHandler returns the handler of rt for messages of msgType, a route can
+// have a request and a notify handler and the one matching msgType is
+// preferred
+func (h *HandlerPool) getHandler(rt *route.Route, msgType message.Type) (*component.Handler, error) {
+	if msgType == message.Notify {
+		if handler, ok := h.notifyHandlers[rt.Short()]; ok {
+			return handler, nil
+		}
+	}
 	handler, ok := h.handlers[rt.Short()]
 	if !ok {
 		e := fmt.Errorf("pitaya/handler: %s not found", rt.String())
@@ -25,7 +25,9 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
@@ -33,11 +35,16 @@ import (
 	"github.com/topfreegames/pitaya/v2/component"
 	"github.com/topfreegames/pitaya/v2/conn/message"
 	"github.com/topfreegames/pitaya/v2/constants"
+	pcontext "github.com/topfreegames/pitaya/v2/context"
 	e "github.com/topfreegames/pitaya/v2/errors"
+	"github.com/topfreegames/pitaya/v2/metrics"
+	metricsmocks "github.com/topfreegames/pitaya/v2/metrics/mocks"
 	"github.com/topfreegames/pitaya/v2/pipeline"
 	"github.com/topfreegames/pitaya/v2/protos/test"
 	"github.com/topfreegames/pitaya/v2/route"
+	"github.com/topfreegames/pitaya/v2/serialize/json"
 	"github.com/topfreegames/pitaya/v2/serialize/mocks"
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
 	session_mocks "github.com/topfreegames/pitaya/v2/session/mocks"
 )
 
@@ -48,7 +55,7 @@ func TestGetHandlerExists(t *testing.T) {
 	handlerPool.handlers[rt.Short()] = expected
 	defer func() { delete(handlerPool.handlers, rt.Short()) }()
 
-	h, err := handlerPool.getHandler(rt)
+	h, err := handlerPool.getHandler(rt, message.Request)
 	assert.NoError(t, err)
 	assert.Equal(t, expected, h)
 }
@@ -56,7 +63,7 @@ func TestGetHandlerExists(t *testing.T) {
 func TestGetHandlerDoesntExist(t *testing.T) {
 	rt := route.NewRoute("", uuid.New().String(), uuid.New().String())
 	handlerPool := NewHandlerPool()
-	h, err := handlerPool.getHandler(rt)
+	h, err := handlerPool.getHandler(rt, message.Request)
 	assert.Nil(t, h)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), fmt.Sprintf("%s not found", rt.String()))
@@ -100,7 +107,7 @@ func TestProcessHandlerMessage(t *testing.T) {
 		{"invalid_route", route.NewRoute("", "no", "no"), nil, nil, nil, message.Request, nil, false, nil, e.NewError(errors.New("pitaya/handler: no.no not found"), e.ErrNotFoundCode)},
 		{"invalid_msg_type", rt, nil, nil, nil, message.Request, nil, false, nil, e.NewError(errInvalidMsg, e.ErrInternalCode)},
 		{"request_on_notify", rt, nil, nil, nil, message.Notify, message.Request, false, nil, e.NewError(constants.ErrRequestOnNotify, e.ErrBadRequestCode)},
-		{"failed_handle_args_unmarshal", rt, nil, errors.New("some error"), &test.SomeStruct{}, message.Request, message.Request, false, nil, e.NewError(errors.New("some error"), e.ErrBadRequestCode)},
+		{"failed_handle_args_unmarshal", rt, nil, errors.New("some error"), &test.SomeStruct{}, message.Request, message.Request, false, nil, e.NewError(constants.ErrInvalidRequestBody, e.ErrBadRequestCode, map[string]string{"reason": "some error"})},
 		{"failed_pcall", rtErr, nil, nil, &test.SomeStruct{A: 1, B: "ok"}, message.Request, message.Request, false, nil, errors.New("HandlerPointerErr")},
 		{"failed_serialize_return", rtSt, errors.New("ser ret error"), nil, &test.SomeStruct{A: 1, B: "ok"}, message.Request, message.Request, false, []byte("failed"), nil},
 		{"ok", rt, nil, nil, &test.SomeStruct{}, message.Request, message.Request, false, []byte("ok"), nil},
@@ -136,6 +143,309 @@ func TestProcessHandlerMessage(t *testing.T) {
 	}
 }
 
+type invokedComp struct {
+	component.Base
+	invoked bool
+}
+
+func (c *invokedComp) Handler(ctx context.Context, ss *test.SomeStruct) (*test.SomeStruct, error) {
+	c.invoked = true
+	return ss, nil
+}
+
+func TestProcessHandlerMessageMalformedProtobufBody(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	comp := &invokedComp{}
+	m, ok := reflect.TypeOf(comp).MethodByName("Handler")
+	assert.True(t, ok)
+	rt := route.NewRoute("", uuid.New().String(), uuid.New().String())
+	handlerPool := NewHandlerPool()
+	handlerPool.handlers[rt.Short()] = &component.Handler{Receiver: reflect.ValueOf(comp), Method: m, Type: m.Type.In(2), MessageType: message.Request}
+
+	ss := session_mocks.NewMockSession(ctrl)
+	ss.EXPECT().UID().Return("uid").AnyTimes()
+
+	out, err := handlerPool.ProcessHandlerMessage(nil, rt, protobuf.NewSerializer(), pipeline.NewHandlerHooks(), ss, []byte{0xff, 0xff}, message.Request, false)
+	assert.Nil(t, out)
+	assert.False(t, comp.invoked)
+
+	pErr, ok := err.(*e.Error)
+	assert.True(t, ok)
+	assert.Equal(t, e.ErrBadRequestCode, pErr.Code)
+	assert.Equal(t, constants.ErrInvalidRequestBody.Error(), pErr.Message)
+	assert.NotEmpty(t, pErr.Metadata["reason"])
+}
+
+type TypedComp struct {
+	component.Base
+	requested bool
+	notified  bool
+}
+
+func (c *TypedComp) Join(ctx context.Context, msg []byte) ([]byte, error) {
+	c.requested = true
+	return []byte("joined"), nil
+}
+
+func (c *TypedComp) JoinNotify(ctx context.Context, msg []byte) {
+	c.notified = true
+}
+
+func TestProcessHandlerMessageDispatchesByMessageType(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	comp := &TypedComp{}
+	svc := component.NewService(comp, []component.Option{
+		component.WithName("room"),
+		component.WithNameFunc(func(name string) string {
+			return strings.TrimSuffix(strings.ToLower(name), "notify")
+		}),
+	})
+	assert.NoError(t, svc.ExtractHandler())
+
+	handlerPool := NewHandlerPool()
+	for name, handler := range svc.Handlers {
+		handlerPool.Register(svc.Name, name, handler)
+	}
+	for name, handler := range svc.NotifyHandlers {
+		handlerPool.RegisterNotify(svc.Name, name, handler)
+	}
+
+	ss := session_mocks.NewMockSession(ctrl)
+	ss.EXPECT().UID().Return("uid").AnyTimes()
+	ss.EXPECT().ID().Return(int64(1)).AnyTimes()
+	rt := route.NewRoute("", "room", "join")
+	handlerHooks := pipeline.NewHandlerHooks()
+	serializer := json.NewSerializer()
+
+	_, err := handlerPool.ProcessHandlerMessage(nil, rt, serializer, handlerHooks, ss, []byte("{}"), message.Notify, false)
+	assert.NoError(t, err)
+	assert.True(t, comp.notified)
+	assert.False(t, comp.requested)
+
+	comp.notified = false
+	out, err := handlerPool.ProcessHandlerMessage(nil, rt, serializer, handlerHooks, ss, []byte("{}"), message.Request, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("joined"), out)
+	assert.True(t, comp.requested)
+	assert.False(t, comp.notified)
+}
+
+type InFlightComp struct {
+	component.Base
+	release chan struct{}
+}
+
+func (c *InFlightComp) Wait(ctx context.Context, msg []byte) ([]byte, error) {
+	<-c.release
+	return msg, nil
+}
+
+func (c *InFlightComp) Panic(ctx context.Context, msg []byte) ([]byte, error) {
+	panic("oh noes")
+}
+
+func TestProcessHandlerMessageReportsHandlersInFlight(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	comp := &InFlightComp{release: make(chan struct{})}
+	svc := component.NewService(comp, []component.Option{component.WithName("inflight")})
+	assert.NoError(t, svc.ExtractHandler())
+
+	mockReporter := metricsmocks.NewMockReporter(ctrl)
+	handlerPool := NewHandlerPool()
+	handlerPool.SetMetricsReporters([]metrics.Reporter{mockReporter})
+	for name, handler := range svc.Handlers {
+		handlerPool.Register(svc.Name, name, handler)
+	}
+
+	reported := make(chan float64, 10)
+	mockReporter.EXPECT().ReportGauge(metrics.HandlersInFlight, gomock.Any(), gomock.Any()).DoAndReturn(
+		func(metric string, tags map[string]string, value float64) error {
+			reported <- value
+			return nil
+		}).AnyTimes()
+
+	ss := session_mocks.NewMockSession(ctrl)
+	ss.EXPECT().UID().Return("uid").AnyTimes()
+	ss.EXPECT().ID().Return(int64(1)).AnyTimes()
+	handlerHooks := pipeline.NewHandlerHooks()
+	serializer := json.NewSerializer()
+
+	waitRoute := route.NewRoute("", "inflight", "Wait")
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := handlerPool.ProcessHandlerMessage(nil, waitRoute, serializer, handlerHooks, ss, []byte("ok"), message.Request, false)
+			assert.NoError(t, err)
+			done <- struct{}{}
+		}()
+	}
+	assert.Equal(t, float64(1), <-reported)
+	assert.Equal(t, float64(2), <-reported)
+	assert.Equal(t, int64(2), handlerPool.InFlight())
+
+	close(comp.release)
+	<-done
+	<-done
+	assert.Equal(t, float64(1), <-reported)
+	assert.Equal(t, float64(0), <-reported)
+	assert.Equal(t, int64(0), handlerPool.InFlight())
+
+	panicRoute := route.NewRoute("", "inflight", "Panic")
+	_, err := handlerPool.ProcessHandlerMessage(nil, panicRoute, serializer, handlerHooks, ss, []byte("ok"), message.Request, false)
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), <-reported)
+	assert.Equal(t, float64(0), <-reported)
+}
+
+func TestProcessHandlerMessageWarmup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tObj := &TestType{}
+	m, ok := reflect.TypeOf(tObj).MethodByName("HandlerRaw")
+	assert.True(t, ok)
+	gatedRoute := route.NewRoute("", uuid.New().String(), uuid.New().String())
+	openRoute := route.NewRoute("", uuid.New().String(), uuid.New().String())
+	handlerPool := NewHandlerPool()
+	handlerPool.handlers[gatedRoute.Short()] = &component.Handler{Receiver: reflect.ValueOf(tObj), Method: m, IsRawArg: true, MessageType: message.Notify}
+	handlerPool.handlers[openRoute.Short()] = &component.Handler{Receiver: reflect.ValueOf(tObj), Method: m, IsRawArg: true, MessageType: message.Notify}
+	handlerPool.SetWarmupRoutes([]string{gatedRoute.Short()})
+
+	ss := session_mocks.NewMockSession(ctrl)
+	ss.EXPECT().UID().Return("uid").AnyTimes()
+	ss.EXPECT().ID().Return(int64(1)).AnyTimes()
+	handlerHooks := pipeline.NewHandlerHooks()
+	serializer := json.NewSerializer()
+
+	_, err := handlerPool.ProcessHandlerMessage(nil, gatedRoute, serializer, handlerHooks, ss, []byte("ok"), message.Notify, false)
+	assert.Equal(t, e.NewError(constants.ErrServerWarmingUp, e.ErrUnavailableCode), err)
+
+	_, err = handlerPool.ProcessHandlerMessage(nil, openRoute, serializer, handlerHooks, ss, []byte("ok"), message.Notify, false)
+	assert.NoError(t, err)
+
+	handlerPool.SetReady()
+	_, err = handlerPool.ProcessHandlerMessage(nil, gatedRoute, serializer, handlerHooks, ss, []byte("ok"), message.Notify, false)
+	assert.NoError(t, err)
+}
+
+type auditRecorder struct {
+	records []*AuditRecord
+}
+
+func (a *auditRecorder) Audit(record *AuditRecord) {
+	a.records = append(a.records, record)
+}
+
+func TestProcessHandlerMessageAudit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tObj := &TestType{}
+	okMethod, ok := reflect.TypeOf(tObj).MethodByName("HandlerPointerRaw")
+	assert.True(t, ok)
+	errMethod, ok := reflect.TypeOf(tObj).MethodByName("HandlerPointerErr")
+	assert.True(t, ok)
+	purchaseRoute := route.NewRoute("", "shop", "purchase")
+	refundRoute := route.NewRoute("", "shop", "refund")
+	catalogRoute := route.NewRoute("", "shop", "catalog")
+	handlerPool := NewHandlerPool()
+	handlerPool.handlers[purchaseRoute.Short()] = &component.Handler{Receiver: reflect.ValueOf(tObj), Method: okMethod, Type: okMethod.Type.In(2)}
+	handlerPool.handlers[refundRoute.Short()] = &component.Handler{Receiver: reflect.ValueOf(tObj), Method: errMethod, Type: errMethod.Type.In(2)}
+	handlerPool.handlers[catalogRoute.Short()] = &component.Handler{Receiver: reflect.ValueOf(tObj), Method: okMethod, Type: okMethod.Type.In(2)}
+
+	sink := &auditRecorder{}
+	handlerPool.SetAuditedRoutes(sink, map[string]AuditSanitizer{
+		purchaseRoute.Short(): func(route string, data []byte) []byte { return []byte(route + ":redacted") },
+		refundRoute.Short():   nil,
+	})
+
+	ss := session_mocks.NewMockSession(ctrl)
+	ss.EXPECT().UID().Return("uid").AnyTimes()
+	ss.EXPECT().ID().Return(int64(1)).AnyTimes()
+	handlerHooks := pipeline.NewHandlerHooks()
+	serializer := json.NewSerializer()
+	data := []byte(`{"A":1,"B":"card"}`)
+
+	start := time.Now()
+	_, err := handlerPool.ProcessHandlerMessage(nil, purchaseRoute, serializer, handlerHooks, ss, data, message.Request, false)
+	assert.NoError(t, err)
+	_, err = handlerPool.ProcessHandlerMessage(nil, refundRoute, serializer, handlerHooks, ss, data, message.Request, true)
+	assert.Error(t, err)
+	_, err = handlerPool.ProcessHandlerMessage(nil, catalogRoute, serializer, handlerHooks, ss, data, message.Request, false)
+	assert.NoError(t, err)
+
+	assert.Len(t, sink.records, 2)
+	for _, record := range sink.records {
+		assert.False(t, record.Timestamp.Before(start))
+		record.Timestamp = time.Time{}
+	}
+	assert.Equal(t, &AuditRecord{UID: "uid", Route: "shop.purchase", Args: []byte("shop.purchase:redacted"), Outcome: AuditOutcomeSuccess}, sink.records[0])
+	assert.Equal(t, &AuditRecord{UID: "uid", Route: "shop.refund", Outcome: AuditOutcomeFailure, ErrorCode: e.ErrUnknownCode}, sink.records[1])
+}
+
+type IdempotentComp struct {
+	component.Base
+	keys []string
+}
+
+func (c *IdempotentComp) Purchase(ctx context.Context, msg []byte) ([]byte, error) {
+	key := pcontext.GetIdempotencyKey(ctx)
+	c.keys = append(c.keys, key)
+	store, ok := ctx.Value(constants.IdempotencyStoreCtxKey).(IdempotencyStore)
+	if !ok {
+		return nil, errors.New("no idempotency store")
+	}
+	duplicate, err := store.MarkSeen(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if duplicate {
+		return []byte("duplicate"), nil
+	}
+	return []byte("purchased"), nil
+}
+
+func TestProcessHandlerMessageIdempotencyKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	comp := &IdempotentComp{}
+	m, ok := reflect.TypeOf(comp).MethodByName("Purchase")
+	assert.True(t, ok)
+	rt := route.NewRoute("", "shop", "purchase")
+	handlerPool := NewHandlerPool()
+	handlerPool.handlers[rt.Short()] = &component.Handler{Receiver: reflect.ValueOf(comp), Method: m, Type: m.Type.In(2), IsRawArg: true}
+	handlerPool.SetIdempotencyStore(NewMemoryIdempotencyStore(time.Minute))
+
+	ss := session_mocks.NewMockSession(ctrl)
+	ss.EXPECT().UID().Return("uid").AnyTimes()
+	ss.EXPECT().ID().Return(int64(1)).AnyTimes()
+	handlerHooks := pipeline.NewHandlerHooks()
+	serializer := json.NewSerializer()
+	ctx := pcontext.AddToPropagateCtx(context.Background(), constants.IdempotencyKeyKey, "purchase-1")
+
+	out, err := handlerPool.ProcessHandlerMessage(ctx, rt, serializer, handlerHooks, ss, []byte("{}"), message.Request, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("purchased"), out)
+
+	out, err = handlerPool.ProcessHandlerMessage(ctx, rt, serializer, handlerHooks, ss, []byte("{}"), message.Request, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("duplicate"), out)
+
+	ctx = pcontext.AddToPropagateCtx(context.Background(), constants.IdempotencyKeyKey, "purchase-2")
+	out, err = handlerPool.ProcessHandlerMessage(ctx, rt, serializer, handlerHooks, ss, []byte("{}"), message.Request, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("purchased"), out)
+
+	assert.Equal(t, []string{"purchase-1", "purchase-1", "purchase-2"}, comp.keys)
+}
+
 func TestProcessHandlerMessageBrokenBeforePipeline(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	rt := route.NewRoute("", uuid.New().String(), uuid.New().String())
@@ -22,15 +22,26 @@ package service
 
 import (
 	"context"
+	"encoding/binary"
 	encjson "encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/acceptor"
+	"github.com/topfreegames/pitaya/v2/agent"
 	agentmocks "github.com/topfreegames/pitaya/v2/agent/mocks"
 	"github.com/topfreegames/pitaya/v2/cluster"
 	"github.com/topfreegames/pitaya/v2/component"
@@ -39,17 +50,23 @@ import (
 	"github.com/topfreegames/pitaya/v2/conn/packet"
 	"github.com/topfreegames/pitaya/v2/constants"
 	pcontext "github.com/topfreegames/pitaya/v2/context"
+	e "github.com/topfreegames/pitaya/v2/errors"
 	"github.com/topfreegames/pitaya/v2/helpers"
+	"github.com/topfreegames/pitaya/v2/logger"
+	logruswrapper "github.com/topfreegames/pitaya/v2/logger/logrus"
 	"github.com/topfreegames/pitaya/v2/metrics"
 	metricsmocks "github.com/topfreegames/pitaya/v2/metrics/mocks"
 	connmock "github.com/topfreegames/pitaya/v2/mocks"
 	"github.com/topfreegames/pitaya/v2/pipeline"
 	"github.com/topfreegames/pitaya/v2/protos"
 	"github.com/topfreegames/pitaya/v2/route"
+	"github.com/topfreegames/pitaya/v2/serialize"
 	"github.com/topfreegames/pitaya/v2/serialize/json"
 	serializemocks "github.com/topfreegames/pitaya/v2/serialize/mocks"
 	"github.com/topfreegames/pitaya/v2/session"
 	"github.com/topfreegames/pitaya/v2/session/mocks"
+	jaeger "github.com/uber/jaeger-client-go"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 var (
@@ -180,6 +197,8 @@ func TestHandlerServiceProcessMessage(t *testing.T) {
 			mockSession.EXPECT().UID().Return("uid").Times(1)
 			mockAgent := agentmocks.NewMockAgent(ctrl)
 			mockAgent.EXPECT().GetSession().Return(mockSession).Times(2)
+			mockAgent.EXPECT().GetTraceSampled().Return(false, false).Times(1)
+			mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityGood)
 
 			if table.err != nil {
 				mockAgent.EXPECT().AnswerWithError(gomock.Any(), table.msg.ID, gomock.Any()).Times(1)
@@ -202,6 +221,49 @@ func TestHandlerServiceProcessMessage(t *testing.T) {
 	}
 }
 
+func TestHandlerServiceProcessMessageTraceSampling(t *testing.T) {
+	tables := []struct {
+		name    string
+		sampled bool
+		decided bool
+		spans   int
+	}{
+		{"undecided_uses_tracer_sampler", false, false, 0},
+		{"sampled_connection", true, true, 1},
+		{"not_sampled_connection", false, true, 0},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			reporter := jaeger.NewInMemoryReporter()
+			tracer, closer := jaeger.NewTracer("svc", jaeger.NewConstSampler(false), reporter)
+			defer closer.Close()
+			previousTracer := opentracing.GlobalTracer()
+			opentracing.SetGlobalTracer(tracer)
+			defer opentracing.SetGlobalTracer(previousTracer)
+
+			handlerPool := NewHandlerPool()
+			svc := NewHandlerService(nil, nil, 1, 1, &cluster.Server{}, &RemoteService{}, nil, nil, nil, handlerPool)
+
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().UID().Return("uid").Times(1)
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetSession().Return(mockSession).Times(2)
+			mockAgent.EXPECT().GetTraceSampled().Return(table.sampled, table.decided).Times(1)
+			mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityGood)
+
+			svc.processMessage(mockAgent, &message.Message{ID: 1, Route: "k.k"})
+			recvMsg := helpers.ShouldEventuallyReceive(t, svc.chLocalProcess).(unhandledMessage)
+			opentracing.SpanFromContext(recvMsg.ctx).Finish()
+
+			assert.Len(t, reporter.GetSpans(), table.spans)
+		})
+	}
+}
+
 func TestHandlerServiceLocalProcess(t *testing.T) {
 	tObj := &MyComp{}
 	m, ok := reflect.TypeOf(tObj).MethodByName("HandlerRawRaw")
@@ -230,6 +292,7 @@ func TestHandlerServiceLocalProcess(t *testing.T) {
 
 			mockAgent := agentmocks.NewMockAgent(ctrl)
 			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().GetSerializer().Return(nil).AnyTimes()
 
 			svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), handlerPool)
 
@@ -247,189 +310,1136 @@ func TestHandlerServiceLocalProcess(t *testing.T) {
 	}
 }
 
-func TestHandlerServiceProcessPacketHandshake(t *testing.T) {
+type MyNilComp struct {
+	component.Base
+}
+
+func (m *MyNilComp) Handler(ctx context.Context, b []byte) ([]byte, error) {
+	return nil, nil
+}
+
+func TestHandlerServiceLocalProcessNilResponse(t *testing.T) {
+	defaultLogger := logger.Log
+	l, hook := logrustest.NewNullLogger()
+	logger.SetLogger(logruswrapper.NewWithLogger(l))
+	defer logger.SetLogger(defaultLogger)
+
+	comp := &MyNilComp{}
+	m, ok := reflect.TypeOf(comp).MethodByName("Handler")
+	assert.True(t, ok)
+	rt := route.NewRoute("", "nil", "handler")
+	handlerPool := NewHandlerPool()
+	handlerPool.handlers[rt.Short()] = &component.Handler{Receiver: reflect.ValueOf(comp), Method: m, Type: m.Type.In(2), IsRawArg: true}
+
 	tables := []struct {
-		name         string
-		packet       *packet.Packet
-		socketStatus int32
-		errStr       string
+		name    string
+		msgType message.Type
 	}{
-		{"invalid_handshake_data", &packet.Packet{Type: packet.Handshake, Data: []byte("asiodjasd")}, constants.StatusClosed, "Invalid handshake data"},
-		{"valid_handshake_data", &packet.Packet{Type: packet.Handshake, Data: []byte(`{"sys":{"platform":"mac"}}`)}, constants.StatusHandshake, ""},
+		{"request", message.Request},
+		{"notify", message.Notify},
 	}
 	for _, table := range tables {
 		t.Run(table.name, func(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			defer ctrl.Finish()
+			hook.Reset()
 
 			mockSession := mocks.NewMockSession(ctrl)
-			mockSession.EXPECT().ID().Return(int64(1)).Times(1)
+			mockSession.EXPECT().UID().Return("uid")
+			mockSession.EXPECT().ID().Return(int64(1))
 
 			mockAgent := agentmocks.NewMockAgent(ctrl)
-			mockAgent.EXPECT().GetSession().Return(mockSession).Times(1)
-			mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
-			mockAgent.EXPECT().SetStatus(table.socketStatus).Times(1)
-			mockAgent.EXPECT().SendHandshakeResponse().Return(nil).Times(1)
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().GetSerializer().Return(nil).AnyTimes()
 
-			if table.errStr == "" {
-				handshakeData := &session.HandshakeData{}
-				_ = encjson.Unmarshal(table.packet.Data, handshakeData)
-				mockAgent.EXPECT().GetSession().Return(mockSession).Times(2)
-				mockAgent.EXPECT().IPVersion().Return(constants.IPv4).Times(1)
-				mockSession.EXPECT().SetHandshakeData(handshakeData).Times(1)
-				mockSession.EXPECT().Set(constants.IPVersionKey, constants.IPv4).Times(1)
-				mockAgent.EXPECT().SetLastAt().Times(1)
-			} else {
-				mockAgent.EXPECT().GetSession().Return(mockSession).Times(1)
-				mockSession.EXPECT().ID().Return(int64(1)).Times(1)
+			msg := &message.Message{ID: 1, Type: table.msgType, Data: []byte(`["ok"]`)}
+			if table.msgType == message.Notify {
+				msg.ID = 0
+			}
+			if table.msgType == message.Request {
+				mockAgent.EXPECT().AnswerWithError(gomock.Any(), uint(1), gomock.Any()).Do(func(ctx context.Context, mid uint, err error) {
+					assert.Equal(t, e.NewError(constants.ErrReplyShouldBeNotNull, e.ErrInternalCode), err)
+				})
 			}
 
-			handlerPool := NewHandlerPool()
 			svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), handlerPool)
-			err := svc.processPacket(mockAgent, table.packet)
-			if table.errStr == "" {
-				assert.Nil(t, err)
-			} else {
-				assert.NotNil(t, err)
-				assert.Contains(t, err.Error(), table.errStr)
+			svc.localProcess(context.Background(), mockAgent, rt, msg)
+
+			var warned bool
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, rt.String()) {
+					warned = true
+				}
 			}
+			assert.Equal(t, table.msgType == message.Request, warned)
 		})
 	}
 }
 
-func TestHandlerServiceProcessPacketHandshakeAck(t *testing.T) {
+type MyDryRunComp struct {
+	component.Base
+	dryRun bool
+}
+
+func (m *MyDryRunComp) Handler(ctx context.Context, b []byte) ([]byte, error) {
+	m.dryRun = pcontext.IsDryRun(ctx)
+	return b, nil
+}
+
+func TestHandlerServiceProcessMessageDryRun(t *testing.T) {
+	tables := []struct {
+		name   string
+		dryRun bool
+	}{
+		{"dry_run", true},
+		{"not_dry_run", false},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			comp := &MyDryRunComp{}
+			method, ok := reflect.TypeOf(comp).MethodByName("Handler")
+			assert.True(t, ok)
+			rt := route.NewRoute("", "dryrun", "handler")
+			handlerPool := NewHandlerPool()
+			handlerPool.handlers[rt.Short()] = &component.Handler{Receiver: reflect.ValueOf(comp), Method: method, Type: method.Type.In(2), IsRawArg: true}
+
+			sv := &cluster.Server{}
+			svc := NewHandlerService(nil, nil, 1, 1, sv, &RemoteService{}, nil, nil, pipeline.NewHandlerHooks(), handlerPool)
+
+			msg := &message.Message{ID: 1, Type: message.Request, Route: rt.Short(), Data: []byte(`["ok"]`), DryRun: table.dryRun}
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().UID().Return("uid").AnyTimes()
+			mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+			mockSession.EXPECT().ResponseMID(gomock.Any(), msg.ID, msg.Data, gomock.Any()).Return(nil)
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().GetSerializer().Return(nil).AnyTimes()
+			mockAgent.EXPECT().GetTraceSampled().Return(false, false).Times(1)
+			mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityGood)
+
+			svc.processMessage(mockAgent, msg)
+			recvMsg := helpers.ShouldEventuallyReceive(t, svc.chLocalProcess).(unhandledMessage)
+			svc.localProcess(recvMsg.ctx, recvMsg.agent, recvMsg.route, recvMsg.msg)
+			assert.Equal(t, table.dryRun, comp.dryRun)
+		})
+	}
+}
+
+func TestHandlerServiceProcessMessageIdempotencyKey(t *testing.T) {
+	tables := []struct {
+		name string
+		key  string
+	}{
+		{"with_key", "purchase-1"},
+		{"without_key", ""},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			rt := route.NewRoute("", "shop", "purchase")
+			sv := &cluster.Server{}
+			svc := NewHandlerService(nil, nil, 1, 1, sv, &RemoteService{}, nil, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+
+			msg := &message.Message{ID: 1, Type: message.Request, Route: rt.Short(), Data: []byte(`["ok"]`), IdempotencyKey: table.key}
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().UID().Return("uid").AnyTimes()
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().GetTraceSampled().Return(false, false).Times(1)
+			mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityGood)
+
+			svc.processMessage(mockAgent, msg)
+			recvMsg := helpers.ShouldEventuallyReceive(t, svc.chLocalProcess).(unhandledMessage)
+			assert.Equal(t, table.key, pcontext.GetIdempotencyKey(recvMsg.ctx))
+		})
+	}
+}
+
+type MyProgressComp struct {
+	component.Base
+}
+
+func (m *MyProgressComp) Handler(ctx context.Context, b []byte) ([]byte, error) {
+	progress := ctx.Value(constants.ProgressCtxKey).(*session.Progress)
+	for i := 1; i <= 3; i++ {
+		if err := progress.Report(map[string]int{"step": i}); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func TestHandlerServiceProgressPrecedesResponse(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
+	comp := &MyProgressComp{}
+	method, ok := reflect.TypeOf(comp).MethodByName("Handler")
+	assert.True(t, ok)
+	rt := route.NewRoute("", "progress", "handler")
+	handlerPool := NewHandlerPool()
+	handlerPool.handlers[rt.Short()] = &component.Handler{Receiver: reflect.ValueOf(comp), Method: method, Type: method.Type.In(2), IsRawArg: true}
+
+	sv := &cluster.Server{}
+	svc := NewHandlerService(nil, nil, 1, 1, sv, &RemoteService{}, nil, nil, pipeline.NewHandlerHooks(), handlerPool)
+
+	msg := &message.Message{ID: 7, Type: message.Request, Route: rt.Short(), Data: []byte(`["ok"]`)}
 	mockSession := mocks.NewMockSession(ctrl)
-	mockSession.EXPECT().ID().Return(int64(1)).Times(1)
+	mockSession.EXPECT().UID().Return("uid").AnyTimes()
+	mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+	mockSession.EXPECT().SerializerName().Return("json").AnyTimes()
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+	mockAgent.EXPECT().GetSerializer().Return(nil).AnyTimes()
+	mockAgent.EXPECT().GetTraceSampled().Return(false, false)
+	mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityGood)
+
+	var calls []*gomock.Call
+	for i := 1; i <= 3; i++ {
+		notification := fmt.Sprintf(`{"mid":%d,"data":{"step":%d}}`, msg.ID, i)
+		calls = append(calls, mockSession.EXPECT().Push(constants.ProgressRoute, gomock.Any()).Do(func(route string, v interface{}) {
+			b, err := json.NewSerializer().Marshal(v)
+			assert.NoError(t, err)
+			assert.JSONEq(t, notification, string(b))
+		}).Return(nil))
+	}
+	calls = append(calls, mockSession.EXPECT().ResponseMID(gomock.Any(), msg.ID, msg.Data, gomock.Any()).Return(nil))
+	gomock.InOrder(calls...)
 
-	handlerPool := NewHandlerPool()
-	svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, nil, handlerPool)
+	svc.processMessage(mockAgent, msg)
+	recvMsg := helpers.ShouldEventuallyReceive(t, svc.chLocalProcess).(unhandledMessage)
+	svc.localProcess(recvMsg.ctx, recvMsg.agent, recvMsg.route, recvMsg.msg)
+}
+
+func TestHandlerServiceProcessMessageNotifyHasNoProgress(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sv := &cluster.Server{}
+	svc := NewHandlerService(nil, nil, 1, 1, sv, &RemoteService{}, nil, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
 
+	msg := &message.Message{Type: message.Notify, Route: "progress.handler"}
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().UID().Return("uid").AnyTimes()
 	mockAgent := agentmocks.NewMockAgent(ctrl)
-	mockAgent.EXPECT().GetSession().Return(mockSession).Times(1)
-	mockAgent.EXPECT().SetStatus(constants.StatusWorking).Times(1)
-	mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
-	mockAgent.EXPECT().SetLastAt()
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+	mockAgent.EXPECT().GetTraceSampled().Return(false, false)
+	mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityGood)
 
-	err := svc.processPacket(mockAgent, &packet.Packet{Type: packet.HandshakeAck})
-	assert.NoError(t, err)
+	svc.processMessage(mockAgent, msg)
+	recvMsg := helpers.ShouldEventuallyReceive(t, svc.chLocalProcess).(unhandledMessage)
+	assert.Nil(t, recvMsg.ctx.Value(constants.ProgressCtxKey))
 }
 
-func TestHandlerServiceProcessPacketHeartbeat(t *testing.T) {
+func TestHandlerServiceProcessMessagePropagatesConnectionQuality(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
+	sv := &cluster.Server{}
+	svc := NewHandlerService(nil, nil, 1, 1, sv, &RemoteService{}, nil, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+
+	msg := &message.Message{Type: message.Notify, Route: "quality.handler"}
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().UID().Return("uid").AnyTimes()
 	mockAgent := agentmocks.NewMockAgent(ctrl)
-	mockAgent.EXPECT().SetLastAt()
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+	mockAgent.EXPECT().GetTraceSampled().Return(false, false)
+	mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityPoor)
 
-	handlerPool := NewHandlerPool()
-	svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, nil, handlerPool)
+	svc.processMessage(mockAgent, msg)
+	recvMsg := helpers.ShouldEventuallyReceive(t, svc.chLocalProcess).(unhandledMessage)
+	assert.Equal(t, string(agent.ConnectionQualityPoor), pcontext.GetConnectionQuality(recvMsg.ctx))
+}
 
-	err := svc.processPacket(mockAgent, &packet.Packet{Type: packet.Heartbeat})
-	assert.NoError(t, err)
+func TestHandlerServiceProcessMessageRouteQuota(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sv := &cluster.Server{}
+	svc := NewHandlerService(nil, nil, 10, 1, sv, &RemoteService{}, nil, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+	mockSessionPool := mocks.NewMockSessionPool(ctrl)
+	mockSessionPool.EXPECT().OnSessionClose(gomock.Any())
+	svc.SetRouteQuotas(mockSessionPool, map[string]RouteQuota{
+		"leaderboard.refresh": {Limit: 5, Window: time.Minute},
+	})
+
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+	mockSession.EXPECT().UID().Return("uid").AnyTimes()
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+	mockAgent.EXPECT().GetTraceSampled().Return(false, false).Times(6)
+	mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityGood).Times(6)
+
+	for i := 0; i < 5; i++ {
+		msg := &message.Message{ID: uint(i + 1), Type: message.Request, Route: "leaderboard.refresh"}
+		svc.processMessage(mockAgent, msg)
+		recvMsg := helpers.ShouldEventuallyReceive(t, svc.chLocalProcess).(unhandledMessage)
+		assert.Equal(t, msg, recvMsg.msg)
+	}
+
+	msg := &message.Message{ID: 6, Type: message.Request, Route: "leaderboard.refresh"}
+	mockAgent.EXPECT().AnswerWithError(gomock.Any(), msg.ID, gomock.Any()).Do(func(ctx context.Context, mid uint, err error) {
+		pErr, ok := err.(*e.Error)
+		assert.True(t, ok)
+		assert.Equal(t, e.ErrTooManyRequestsCode, pErr.Code)
+		assert.Equal(t, constants.ErrRouteQuotaExceeded.Error(), pErr.Message)
+		resetMs, err := strconv.ParseInt(pErr.Metadata["resetMs"], 10, 64)
+		assert.NoError(t, err)
+		assert.True(t, resetMs > 0 && resetMs <= time.Minute.Milliseconds())
+	})
+	svc.processMessage(mockAgent, msg)
+	assert.Len(t, svc.chLocalProcess, 0)
 }
 
-func TestHandlerServiceProcessPacketData(t *testing.T) {
-	msgID := uint(1)
-	msg := &message.Message{Type: message.Request, ID: msgID, Data: []byte("ok")}
-	messageEncoder := message.NewMessagesEncoder(false)
-	encodedMsg, err := messageEncoder.Encode(msg)
-	assert.NoError(t, err)
+func TestHandlerServiceProcessMessageRouteDeprecation(t *testing.T) {
 	tables := []struct {
-		name         string
-		packet       *packet.Packet
-		socketStatus int32
-		errStr       string
+		name       string
+		route      string
+		serializer string
+		warning    interface{}
 	}{
-		{"not_acked_socket", &packet.Packet{Type: packet.Data, Data: []byte("ok")}, constants.StatusStart, "not yet ACK"},
-		{"failed_decode", &packet.Packet{Type: packet.Data, Data: []byte("ok")}, constants.StatusWorking, "wrong message type"},
-		{"success", &packet.Packet{Type: packet.Data, Data: encodedMsg}, constants.StatusWorking, ""},
+		{"not_deprecated", "shop.buy", "json", nil},
+		{"deprecated_json_client", "shop.oldbuy", "json", &deprecationWarning{Route: "shop.oldbuy", Message: "use shop.buy", MID: 1}},
+		{"deprecated_protobuf_client", "shop.oldbuy", "protobuf", &structpb.Struct{Fields: map[string]*structpb.Value{
+			"route":   structpb.NewStringValue("shop.oldbuy"),
+			"message": structpb.NewStringValue("use shop.buy"),
+			"mid":     structpb.NewNumberValue(1),
+		}}},
 	}
+
 	for _, table := range tables {
 		t.Run(table.name, func(t *testing.T) {
 			ctrl := gomock.NewController(t)
 			defer ctrl.Finish()
 
-			mockSession := mocks.NewMockSession(ctrl)
+			mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+			sv := &cluster.Server{}
+			svc := NewHandlerService(nil, nil, 10, 1, sv, &RemoteService{}, nil, []metrics.Reporter{mockMetricsReporter}, pipeline.NewHandlerHooks(), NewHandlerPool())
+			svc.SetRouteDeprecations(map[string]string{"shop.oldbuy": "use shop.buy"})
 
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+			mockSession.EXPECT().UID().Return("uid").AnyTimes()
+			mockSession.EXPECT().SerializerName().Return(table.serializer).AnyTimes()
 			mockAgent := agentmocks.NewMockAgent(ctrl)
-
-			mockAgent.EXPECT().GetStatus().Return(table.socketStatus)
-			if table.socketStatus < constants.StatusWorking {
-				mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
-			} else {
-				if table.errStr == "" {
-					mockAgent.EXPECT().GetSession().Return(mockSession).Times(2)
-					mockSession.EXPECT().UID().Return("uid").Times(1)
-
-					mockAgent.EXPECT().AnswerWithError(gomock.Any(), msgID, gomock.Any()).Times(1)
-					mockAgent.EXPECT().SetLastAt().Times(1)
-				}
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().GetTraceSampled().Return(false, false)
+			mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityGood)
+			if table.warning != nil {
+				mockMetricsReporter.EXPECT().ReportCount(metrics.DeprecatedRouteCalls, map[string]string{"route": table.route}, float64(1))
+				mockAgent.EXPECT().Push(constants.DeprecationRoute, table.warning)
 			}
 
-			handlerPool := NewHandlerPool()
-			svc := NewHandlerService(nil, nil, 1, 1, &cluster.Server{}, nil, nil, nil, nil, handlerPool)
-			err := svc.processPacket(mockAgent, table.packet)
-			if table.errStr != "" {
-				assert.Contains(t, err.Error(), table.errStr)
-			}
+			// the call to a deprecated route is still handled
+			msg := &message.Message{ID: 1, Type: message.Request, Route: table.route}
+			svc.processMessage(mockAgent, msg)
+			recvMsg := helpers.ShouldEventuallyReceive(t, svc.chLocalProcess).(unhandledMessage)
+			assert.Equal(t, msg, recvMsg.msg)
 		})
 	}
 }
 
-func TestHandlerServiceHandle(t *testing.T) {
+func TestHandlerServiceProcessMessageRouteQuotaNotify(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	packetEncoder := codec.NewPomeloPacketEncoder()
-	packetDecoder := codec.NewPomeloPacketDecoder()
-	handshakeBuffer := `{"sys":{"platform":"mac","libVersion":"0.3.5-release","clientBuildNumber":"20","clientVersion":"2.1"},"user":{"age":30}}`
-	bbb, err := packetEncoder.Encode(packet.Handshake, []byte(handshakeBuffer))
-	assert.NoError(t, err)
-
-	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	reporter := jaeger.NewInMemoryReporter()
+	tracer, closer := jaeger.NewTracer("svc", jaeger.NewConstSampler(true), reporter)
+	defer closer.Close()
+	previousTracer := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(previousTracer)
 
-	mockConn := connmock.NewMockPlayerConn(ctrl)
+	mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+	svc := NewHandlerService(nil, nil, 10, 1, &cluster.Server{}, &RemoteService{}, nil, []metrics.Reporter{mockMetricsReporter}, pipeline.NewHandlerHooks(), NewHandlerPool())
+	mockSessionPool := mocks.NewMockSessionPool(ctrl)
+	mockSessionPool.EXPECT().OnSessionClose(gomock.Any())
+	svc.SetRouteQuotas(mockSessionPool, map[string]RouteQuota{
+		"leaderboard.refresh": {Limit: 1, Window: time.Minute},
+	})
 
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+	mockSession.EXPECT().UID().Return("uid").AnyTimes()
 	mockAgent := agentmocks.NewMockAgent(ctrl)
-	mockAgentFactory := agentmocks.NewMockAgentFactory(ctrl)
-	mockAgentFactory.EXPECT().CreateAgent(mockConn).Return(mockAgent).Times(1)
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+	mockAgent.EXPECT().GetTraceSampled().Return(false, false).Times(2)
+	mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityGood).Times(2)
+
+	msg := &message.Message{Type: message.Notify, Route: "leaderboard.refresh"}
+	svc.processMessage(mockAgent, msg)
+	helpers.ShouldEventuallyReceive(t, svc.chLocalProcess)
+	assert.Len(t, reporter.GetSpans(), 0)
+
+	// notifies over the quota are not answered, their span and timing are
+	// reported right away
+	mockMetricsReporter.EXPECT().ReportSummary(metrics.ResponseTime, gomock.Any(), gomock.Any()).Do(
+		func(metric string, tags map[string]string, value float64) {
+			assert.Equal(t, "failed", tags["status"])
+			assert.Equal(t, e.ErrTooManyRequestsCode, tags["code"])
+		})
+	svc.processMessage(mockAgent, msg)
+	assert.Len(t, svc.chLocalProcess, 0)
+	assert.Len(t, reporter.GetSpans(), 1)
+}
 
-	var wg sync.WaitGroup
-	wg.Add(4)
-	defer wg.Wait()
+type MySlowComp struct {
+	component.Base
+}
 
-	mockAgent.EXPECT().Handle().Do(func() {
-		wg.Done()
-	})
+func (m *MySlowComp) HandlerSlow(ctx context.Context, b []byte) ([]byte, error) {
+	<-ctx.Done()
+	return b, nil
+}
 
-	mockAgent.EXPECT().SendHandshakeResponse().Return(nil)
+func TestHandlerServiceLocalProcessWithRouteTimeout(t *testing.T) {
+	slowComp := &MySlowComp{}
+	slowMethod, ok := reflect.TypeOf(slowComp).MethodByName("HandlerSlow")
+	assert.True(t, ok)
+	comp := &MyComp{}
+	method, ok := reflect.TypeOf(comp).MethodByName("HandlerRawRaw")
+	assert.True(t, ok)
 
-	mockSession := mocks.NewMockSession(ctrl)
-	mockSession.EXPECT().SetHandshakeData(gomock.Any()).Times(1)
-	mockSession.EXPECT().UID().Return("uid").Times(1)
-	mockSession.EXPECT().ID().Return(int64(1)).Times(2)
-	mockSession.EXPECT().Set(constants.IPVersionKey, constants.IPv4)
-	mockSession.EXPECT().Close()
+	slowRoute := route.NewRoute("", "slow", "handler")
+	rt := route.NewRoute("", "comp", "handler")
+	handlerPool := NewHandlerPool()
+	handlerPool.handlers[slowRoute.Short()] = &component.Handler{Receiver: reflect.ValueOf(slowComp), Method: slowMethod, Type: slowMethod.Type.In(2), IsRawArg: true}
+	handlerPool.handlers[rt.Short()] = &component.Handler{Receiver: reflect.ValueOf(comp), Method: method, Type: method.Type.In(2), IsRawArg: true}
 
-	mockAgent.EXPECT().String().Return("")
-	mockAgent.EXPECT().SetStatus(constants.StatusHandshake)
-	mockAgent.EXPECT().GetSession().Return(mockSession).Times(6)
-	mockAgent.EXPECT().IPVersion().Return(constants.IPv4)
-	mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{}).AnyTimes()
-	mockAgent.EXPECT().SetLastAt().Do(func() {
-		wg.Done()
-	})
+	tables := []struct {
+		name     string
+		rt       *route.Route
+		timedOut bool
+	}{
+		{"handler_times_out", slowRoute, true},
+		{"handler_returns_in_time", rt, false},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
 
-	firstCall := mockConn.EXPECT().GetNextMessage().Return(bbb, nil).Do(func() {
-		wg.Done()
-	})
+			msg := &message.Message{ID: 1, Type: message.Request, Data: []byte(`["ok"]`)}
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().UID().Return("uid").AnyTimes()
+			mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
 
-	mockConn.EXPECT().GetNextMessage().Return(nil, errors.New("die")).Do(func() {
-		wg.Done()
-	}).After(firstCall)
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().GetSerializer().Return(nil).AnyTimes()
+
+			svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), handlerPool)
+			svc.SetRouteTimeouts(map[string]time.Duration{
+				slowRoute.Short(): 10 * time.Millisecond,
+				rt.Short():        time.Second,
+			})
+
+			ctx := context.Background()
+			if table.timedOut {
+				mockAgent.EXPECT().AnswerWithError(ctx, msg.ID, gomock.Any()).Do(func(ctx context.Context, mid uint, err error) {
+					pErr, ok := err.(*e.Error)
+					assert.True(t, ok)
+					assert.Equal(t, e.ErrTimeoutCode, pErr.Code)
+					assert.Equal(t, constants.ErrHandlerTimeout.Error(), pErr.Message)
+					assert.Equal(t, map[string]string{"timeoutMs": "10"}, pErr.Metadata)
+				})
+			} else {
+				mockSession.EXPECT().ResponseMID(ctx, msg.ID, msg.Data, gomock.Any()).Return(nil)
+			}
+
+			svc.localProcess(ctx, mockAgent, table.rt, msg)
+		})
+	}
+}
+
+type MyCountingComp struct {
+	component.Base
+	calls int
+}
+
+func (m *MyCountingComp) HandlerCount(ctx context.Context, b []byte) ([]byte, error) {
+	m.calls++
+	return []byte(fmt.Sprintf("%s-%d", b, m.calls)), nil
+}
+
+func TestHandlerServiceLocalProcessWithResponseCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	comp := &MyCountingComp{}
+	method, ok := reflect.TypeOf(comp).MethodByName("HandlerCount")
+	assert.True(t, ok)
+	rt := route.NewRoute("", "shop", "catalog")
+	handlerPool := NewHandlerPool()
+	handlerPool.handlers[rt.Short()] = &component.Handler{Receiver: reflect.ValueOf(comp), Method: method, Type: method.Type.In(2), IsRawArg: true}
+
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().UID().Return("uid").AnyTimes()
+	mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+	mockAgent.EXPECT().GetSerializer().Return(json.NewSerializer()).AnyTimes()
+
+	ttl := 50 * time.Millisecond
+	svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), handlerPool)
+	svc.SetResponseCaches(map[string]ResponseCache{
+		rt.Short(): {TTL: ttl, Key: func(ctx context.Context, data []byte) string { return string(data) }},
+	})
+
+	request := func(data string, expected string) {
+		msg := &message.Message{ID: 1, Type: message.Request, Data: []byte(data)}
+		mockSession.EXPECT().ResponseMID(gomock.Any(), msg.ID, []byte(expected), gomock.Any()).Return(nil)
+		svc.localProcess(context.Background(), mockAgent, rt, msg)
+	}
+
+	request("en", "en-1")
+	// served from the cache within the ttl, per cache key
+	request("en", "en-1")
+	request("pt", "pt-2")
+	request("pt", "pt-2")
+
+	// dry runs are never cached
+	dryRun := &message.Message{ID: 1, Type: message.Request, Data: []byte("en"), DryRun: true}
+	mockSession.EXPECT().ResponseMID(gomock.Any(), dryRun.ID, []byte("en-3"), gomock.Any()).Return(nil)
+	svc.localProcess(context.Background(), mockAgent, rt, dryRun)
+
+	svc.InvalidateResponseCache(rt.Short(), "pt")
+	request("en", "en-1")
+	request("pt", "pt-4")
+
+	// the handler runs again once the ttl expires
+	time.Sleep(ttl)
+	request("en", "en-5")
+	request("en", "en-5")
+	assert.Equal(t, 5, comp.calls)
+}
+
+func TestHandlerServiceProcessPacketHandshake(t *testing.T) {
+	tables := []struct {
+		name         string
+		packet       *packet.Packet
+		socketStatus int32
+		errStr       string
+	}{
+		{"invalid_handshake_data", &packet.Packet{Type: packet.Handshake, Data: []byte("asiodjasd")}, constants.StatusClosed, "Invalid handshake data"},
+		{"valid_handshake_data", &packet.Packet{Type: packet.Handshake, Data: []byte(`{"sys":{"platform":"mac"}}`)}, constants.StatusHandshake, ""},
+		{"valid_handshake_data_with_credit", &packet.Packet{Type: packet.Handshake, Data: []byte(`{"sys":{"platform":"mac","credit":10}}`)}, constants.StatusHandshake, ""},
+		{"valid_handshake_data_with_heartbeat_interval", &packet.Packet{Type: packet.Handshake, Data: []byte(`{"sys":{"platform":"mac","heartbeatInterval":60}}`)}, constants.StatusHandshake, ""},
+		{"valid_handshake_data_with_dict_reference", &packet.Packet{Type: packet.Handshake, Data: []byte(`{"sys":{"platform":"mac","dictReference":true}}`)}, constants.StatusHandshake, ""},
+		{"valid_handshake_data_with_compression", &packet.Packet{Type: packet.Handshake, Data: []byte(`{"sys":{"platform":"mac","compression":["gzip","zlib"]}}`)}, constants.StatusHandshake, ""},
+		{"valid_handshake_data_with_timestamped_heartbeat", &packet.Packet{Type: packet.Handshake, Data: []byte(`{"sys":{"platform":"mac","timestampedHeartbeat":true}}`)}, constants.StatusHandshake, ""},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().ID().Return(int64(1)).Times(1)
+
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetSession().Return(mockSession).Times(1)
+			mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
+			mockAgent.EXPECT().SetStatus(table.socketStatus).Times(1)
+			mockAgent.EXPECT().SendHandshakeResponse().Return(nil).Times(1)
+
+			if table.errStr == "" {
+				handshakeData := &session.HandshakeData{}
+				_ = encjson.Unmarshal(table.packet.Data, handshakeData)
+				mockAgent.EXPECT().GetSession().Return(mockSession).Times(2)
+				mockAgent.EXPECT().IPVersion().Return(constants.IPv4).Times(1)
+				mockSession.EXPECT().SetHandshakeData(handshakeData).Times(1)
+				mockSession.EXPECT().Set(constants.IPVersionKey, constants.IPv4).Times(1)
+				mockAgent.EXPECT().SetLastAt().Times(1)
+				mockAgent.EXPECT().GetTraceSampled().Return(false, false).Times(1)
+				if handshakeData.Sys.Credit > 0 {
+					mockAgent.EXPECT().GrantCredit(handshakeData.Sys.Credit).Times(1)
+				}
+				if handshakeData.Sys.HeartbeatInterval > 0 {
+					mockAgent.EXPECT().NegotiateHeartbeatInterval(time.Duration(handshakeData.Sys.HeartbeatInterval) * time.Second).Return(nil).Times(1)
+				}
+				if handshakeData.Sys.DictReference {
+					mockAgent.EXPECT().NegotiateDictionaryReference().Return(nil).Times(1)
+				}
+				if len(handshakeData.Sys.Compression) > 0 {
+					mockAgent.EXPECT().NegotiateCompression(handshakeData.Sys.Compression).Return(nil).Times(1)
+				}
+				if handshakeData.Sys.TimestampedHeartbeat {
+					mockAgent.EXPECT().NegotiateTimestampedHeartbeat().Return(nil).Times(1)
+				}
+			} else {
+				mockAgent.EXPECT().GetSession().Return(mockSession).Times(1)
+				mockSession.EXPECT().ID().Return(int64(1)).Times(1)
+			}
+
+			handlerPool := NewHandlerPool()
+			svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), handlerPool)
+			err := svc.processPacket(mockAgent, table.packet)
+			if table.errStr == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), table.errStr)
+			}
+		})
+	}
+}
+
+func TestHandlerServiceProcessPacketHandshakeTraceSampled(t *testing.T) {
+	tables := []struct {
+		name     string
+		data     []byte
+		decided  bool
+		override bool
+	}{
+		{"no_upstream_decision", []byte(`{"sys":{"platform":"mac"}}`), true, false},
+		{"upstream_decision", []byte(`{"sys":{"platform":"mac","traceSampled":true}}`), true, true},
+		{"connection_sampling_disabled", []byte(`{"sys":{"platform":"mac","traceSampled":true}}`), false, false},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().ID().Return(int64(1)).Times(1)
+			mockSession.EXPECT().SetHandshakeData(gomock.Any()).Times(1)
+			mockSession.EXPECT().Set(constants.IPVersionKey, constants.IPv4).Times(1)
+
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetSession().Return(mockSession).Times(3)
+			mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
+			mockAgent.EXPECT().SendHandshakeResponse().Return(nil).Times(1)
+			mockAgent.EXPECT().SetStatus(constants.StatusHandshake).Times(1)
+			mockAgent.EXPECT().IPVersion().Return(constants.IPv4).Times(1)
+			mockAgent.EXPECT().SetLastAt().Times(1)
+			mockAgent.EXPECT().GetTraceSampled().Return(false, table.decided).Times(1)
+			if table.override {
+				mockAgent.EXPECT().SetTraceSampled(true).Times(1)
+			}
+
+			handlerPool := NewHandlerPool()
+			svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), handlerPool)
+			err := svc.processPacket(mockAgent, &packet.Packet{Type: packet.Handshake, Data: table.data})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestHandlerServiceProcessPacketHandshakeAffinity(t *testing.T) {
+	key := []byte("affinity-key")
+	now := time.Now()
+	issuer := &affinityTokens{key: key, ttl: time.Hour}
+	sameServer, err := issuer.issue("frontend-1", now)
+	assert.NoError(t, err)
+	otherServer, err := issuer.issue("frontend-2", now)
+	assert.NoError(t, err)
+	expired, err := issuer.issue("frontend-1", now.Add(-2*time.Hour))
+	assert.NoError(t, err)
+	forged, err := (&affinityTokens{key: []byte("other-key"), ttl: time.Hour}).issue("frontend-1", now)
+	assert.NoError(t, err)
+
+	tables := []struct {
+		name     string
+		token    string
+		serverID string
+	}{
+		{"no_token", "", ""},
+		{"same_server", sameServer, "frontend-1"},
+		{"other_server", otherServer, "frontend-2"},
+		{"expired", expired, ""},
+		{"forged", forged, ""},
+		{"malformed", "not-a-token", ""},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+			mockSession.EXPECT().SetHandshakeData(gomock.Any()).Times(1)
+			mockSession.EXPECT().Set(constants.IPVersionKey, constants.IPv4).Times(1)
+			if table.serverID != "" {
+				mockSession.EXPECT().Set(constants.AffinityServerIDKey, table.serverID).Times(1)
+			}
+
+			var issued string
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
+			mockAgent.EXPECT().SetAffinityToken(gomock.Any()).Do(func(token string) { issued = token }).Return(nil).Times(1)
+			mockAgent.EXPECT().SendHandshakeResponse().Return(nil).Times(1)
+			mockAgent.EXPECT().SetStatus(constants.StatusHandshake).Times(1)
+			mockAgent.EXPECT().IPVersion().Return(constants.IPv4).Times(1)
+			mockAgent.EXPECT().SetLastAt().Times(1)
+			mockAgent.EXPECT().GetTraceSampled().Return(false, false).Times(1)
+
+			handlerPool := NewHandlerPool()
+			svc := NewHandlerService(nil, nil, 1, 1, &cluster.Server{ID: "frontend-1"}, nil, nil, nil, pipeline.NewHandlerHooks(), handlerPool)
+			svc.SetAffinityTokens(key, time.Hour)
+			data := []byte(fmt.Sprintf(`{"sys":{"platform":"mac","affinityToken":%q}}`, table.token))
+			err := svc.processPacket(mockAgent, &packet.Packet{Type: packet.Handshake, Data: data})
+			assert.NoError(t, err)
+
+			serverID, err := issuer.validate(issued, time.Now())
+			assert.NoError(t, err)
+			assert.Equal(t, "frontend-1", serverID)
+		})
+	}
+}
+
+func TestHandlerServiceSetAffinityTokensEmptyKey(t *testing.T) {
+	svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+	svc.SetAffinityTokens([]byte("key"), time.Hour)
+	assert.NotNil(t, svc.affinity)
+	svc.SetAffinityTokens(nil, time.Hour)
+	assert.Nil(t, svc.affinity)
+}
+
+func TestHandlerServiceProcessPacketHandshakeOverSoftCapacity(t *testing.T) {
+	tables := []struct {
+		name     string
+		sessions int
+		capacity int64
+		retry    bool
+	}{
+		{"disabled", 3, 0, false},
+		{"at_capacity", 2, 2, false},
+		{"over_capacity", 3, 2, true},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			sessionPool := session.NewSessionPool()
+			for i := 0; i < table.sessions; i++ {
+				sessionPool.NewSession(nil, true)
+			}
+
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			if table.retry {
+				mockAgent.EXPECT().SendHandshakeRetryResponse(10 * time.Second).Return(nil)
+			} else {
+				mockSession.EXPECT().SetHandshakeData(gomock.Any())
+				mockSession.EXPECT().Set(constants.IPVersionKey, constants.IPv4)
+				mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
+				mockAgent.EXPECT().SendHandshakeResponse().Return(nil)
+				mockAgent.EXPECT().SetStatus(constants.StatusHandshake)
+				mockAgent.EXPECT().IPVersion().Return(constants.IPv4)
+				mockAgent.EXPECT().SetLastAt()
+				mockAgent.EXPECT().GetTraceSampled().Return(false, false)
+			}
+
+			svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+			svc.SetSoftCapacity(sessionPool, table.capacity, 10*time.Second)
+			err := svc.processPacket(mockAgent, &packet.Packet{Type: packet.Handshake, Data: []byte(`{"sys":{"platform":"mac"}}`)})
+			if table.retry {
+				assert.Equal(t, constants.ErrServerOverCapacity, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestHandlerServiceProcessPacketHandshakeMaintenance(t *testing.T) {
+	now := time.Now()
+	current := MaintenanceWindow{Start: now.Add(-time.Minute), End: now.Add(time.Hour), Message: "scheduled maintenance"}
+	past := MaintenanceWindow{Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour), Message: "done"}
+
+	tables := []struct {
+		name    string
+		windows []MaintenanceWindow
+		reject  bool
+		err     error
+	}{
+		{"no_window", nil, true, nil},
+		{"outside_window", []MaintenanceWindow{past}, true, nil},
+		{"notify_in_window", []MaintenanceWindow{current}, false, nil},
+		{"reject_in_window", []MaintenanceWindow{past, current}, true, constants.ErrServerUnderMaintenance},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			if table.err != nil {
+				mockAgent.EXPECT().SendHandshakeMaintenanceResponse(gomock.Any(), current.notice()).DoAndReturn(
+					func(retryAfter time.Duration, maintenance map[string]interface{}) error {
+						assert.True(t, retryAfter > 59*time.Minute && retryAfter <= time.Hour)
+						return nil
+					})
+			} else {
+				mockSession.EXPECT().SetHandshakeData(gomock.Any())
+				mockSession.EXPECT().Set(constants.IPVersionKey, constants.IPv4)
+				mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
+				mockAgent.EXPECT().SendHandshakeResponse().Return(nil)
+				mockAgent.EXPECT().SetStatus(constants.StatusHandshake)
+				mockAgent.EXPECT().IPVersion().Return(constants.IPv4)
+				mockAgent.EXPECT().SetLastAt()
+				mockAgent.EXPECT().GetTraceSampled().Return(false, false)
+			}
+
+			svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+			svc.SetMaintenanceWindows(table.windows, table.reject)
+			err := svc.processPacket(mockAgent, &packet.Packet{Type: packet.Handshake, Data: []byte(`{"sys":{"platform":"mac"}}`)})
+			assert.Equal(t, table.err, err)
+		})
+	}
+}
+
+func TestHandlerServiceProcessPacketHandshakeAckMaintenance(t *testing.T) {
+	now := time.Now()
+	current := MaintenanceWindow{Start: now.Add(-time.Minute), End: now.Add(time.Hour), Message: "scheduled maintenance"}
+
+	tables := []struct {
+		name       string
+		windows    []MaintenanceWindow
+		serializer string
+		notified   bool
+	}{
+		{"no_window", nil, "json", false},
+		{"json", []MaintenanceWindow{current}, "json", true},
+		{"protobuf", []MaintenanceWindow{current}, "protobuf", true},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().SetStatus(constants.StatusWorking)
+			mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
+			mockAgent.EXPECT().SetLastAt()
+			handshakeCompleted := mockAgent.EXPECT().HandshakeCompleted()
+			if table.notified {
+				expected, err := newMaintenanceNotice(table.serializer, current)
+				assert.NoError(t, err)
+				mockSession.EXPECT().SerializerName().Return(table.serializer)
+				mockAgent.EXPECT().Push(constants.MaintenanceRoute, expected).Return(nil).After(handshakeCompleted)
+			}
+
+			svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, nil, NewHandlerPool())
+			svc.SetMaintenanceWindows(table.windows, false)
+			err := svc.processPacket(mockAgent, &packet.Packet{Type: packet.HandshakeAck})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestHandlerServiceProcessPacketHandshakeAck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().ID().Return(int64(1)).Times(1)
+
+	handlerPool := NewHandlerPool()
+	svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, nil, handlerPool)
+
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgent.EXPECT().GetSession().Return(mockSession).Times(1)
+	gomock.InOrder(
+		mockAgent.EXPECT().SetStatus(constants.StatusWorking).Times(1),
+		mockAgent.EXPECT().HandshakeCompleted().Times(1),
+	)
+	mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
+	mockAgent.EXPECT().SetLastAt()
+
+	err := svc.processPacket(mockAgent, &packet.Packet{Type: packet.HandshakeAck})
+	assert.NoError(t, err)
+}
+
+func TestHandlerServiceProcessPacketHeartbeat(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgent.EXPECT().SetLastAt()
+
+	handlerPool := NewHandlerPool()
+	svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, nil, handlerPool)
+
+	err := svc.processPacket(mockAgent, &packet.Packet{Type: packet.Heartbeat})
+	assert.NoError(t, err)
+}
+
+func TestHandlerServiceProcessPacketHeartbeatEcho(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	stamp := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	gomock.InOrder(
+		mockAgent.EXPECT().HandleHeartbeatEcho(stamp),
+		mockAgent.EXPECT().SetLastAt(),
+	)
+
+	svc := NewHandlerService(nil, nil, 1, 1, nil, nil, nil, nil, nil, NewHandlerPool())
+	err := svc.processPacket(mockAgent, &packet.Packet{Type: packet.Heartbeat, Data: stamp})
+	assert.NoError(t, err)
+}
+
+func TestHandlerServiceProcessPacketData(t *testing.T) {
+	msgID := uint(1)
+	msg := &message.Message{Type: message.Request, ID: msgID, Data: []byte("ok")}
+	messageEncoder := message.NewMessagesEncoder(false)
+	encodedMsg, err := messageEncoder.Encode(msg)
+	assert.NoError(t, err)
+	tables := []struct {
+		name         string
+		packet       *packet.Packet
+		socketStatus int32
+		errStr       string
+	}{
+		{"not_acked_socket", &packet.Packet{Type: packet.Data, Data: []byte("ok")}, constants.StatusStart, "not yet ACK"},
+		{"failed_decode", &packet.Packet{Type: packet.Data, Data: []byte("ok")}, constants.StatusWorking, "wrong message type"},
+		{"success", &packet.Packet{Type: packet.Data, Data: encodedMsg}, constants.StatusWorking, ""},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockSession := mocks.NewMockSession(ctrl)
+
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+
+			mockAgent.EXPECT().GetStatus().Return(table.socketStatus)
+			if table.socketStatus < constants.StatusWorking {
+				mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
+			} else {
+				if table.errStr == "" {
+					mockAgent.EXPECT().GetSession().Return(mockSession).Times(2)
+					mockSession.EXPECT().UID().Return("uid").Times(1)
+					mockAgent.EXPECT().GetTraceSampled().Return(false, false).Times(1)
+					mockAgent.EXPECT().ConnectionQuality().Return(agent.ConnectionQualityGood)
+
+					mockAgent.EXPECT().AnswerWithError(gomock.Any(), msgID, gomock.Any()).Times(1)
+					mockAgent.EXPECT().SetLastAt().Times(1)
+				}
+			}
+
+			handlerPool := NewHandlerPool()
+			svc := NewHandlerService(nil, nil, 1, 1, &cluster.Server{}, nil, nil, nil, nil, handlerPool)
+			err := svc.processPacket(mockAgent, table.packet)
+			if table.errStr != "" {
+				assert.Contains(t, err.Error(), table.errStr)
+			}
+		})
+	}
+}
+
+func TestHandlerServiceProcessPacketCredit(t *testing.T) {
+	messageEncoder := message.NewMessagesEncoder(false)
+	tables := []struct {
+		name   string
+		data   []byte
+		credit int64
+	}{
+		{"valid_credit", []byte(`{"credit":10}`), 10},
+		{"invalid_credit", []byte(`credit`), 0},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			msg := &message.Message{Type: message.Notify, Route: constants.CreditRoute, Data: table.data}
+			encodedMsg, err := messageEncoder.Encode(msg)
+			assert.NoError(t, err)
+
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetStatus().Return(constants.StatusWorking)
+			mockAgent.EXPECT().SetLastAt()
+			if table.credit > 0 {
+				mockAgent.EXPECT().GrantCredit(table.credit)
+			} else {
+				mockSession := mocks.NewMockSession(ctrl)
+				mockSession.EXPECT().ID().Return(int64(1))
+				mockSession.EXPECT().UID().Return("uid")
+				mockAgent.EXPECT().GetSession().Return(mockSession).Times(2)
+			}
+
+			handlerPool := NewHandlerPool()
+			svc := NewHandlerService(nil, nil, 1, 1, &cluster.Server{}, nil, nil, nil, nil, handlerPool)
+			err = svc.processPacket(mockAgent, &packet.Packet{Type: packet.Data, Data: encodedMsg})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestHandlerServiceProcessPacketDisconnect(t *testing.T) {
+	messageEncoder := message.NewMessagesEncoder(false)
+	tables := []struct {
+		name   string
+		data   []byte
+		reason string
+	}{
+		{"valid_disconnect", []byte(`{"reason":"logout"}`), "logout"},
+		{"invalid_disconnect", []byte(`reason`), ""},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			msg := &message.Message{Type: message.Notify, Route: constants.DisconnectRoute, Data: table.data}
+			encodedMsg, err := messageEncoder.Encode(msg)
+			assert.NoError(t, err)
+
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetStatus().Return(constants.StatusWorking)
+			mockAgent.EXPECT().SetLastAt()
+			if table.reason != "" {
+				mockAgent.EXPECT().SetClientCloseReason(table.reason)
+			} else {
+				mockSession := mocks.NewMockSession(ctrl)
+				mockSession.EXPECT().ID().Return(int64(1))
+				mockSession.EXPECT().UID().Return("uid")
+				mockAgent.EXPECT().GetSession().Return(mockSession).Times(2)
+			}
+
+			handlerPool := NewHandlerPool()
+			svc := NewHandlerService(nil, nil, 1, 1, &cluster.Server{}, nil, nil, nil, nil, handlerPool)
+			err = svc.processPacket(mockAgent, &packet.Packet{Type: packet.Data, Data: encodedMsg})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestHandlerServiceProcessPacketRTT(t *testing.T) {
+	messageEncoder := message.NewMessagesEncoder(false)
+	tables := []struct {
+		name string
+		data []byte
+		rtt  time.Duration
+	}{
+		{"valid_rtt", []byte(`{"rtt":120}`), 120 * time.Millisecond},
+		{"invalid_rtt", []byte(`rtt`), 0},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			msg := &message.Message{Type: message.Notify, Route: constants.RTTRoute, Data: table.data}
+			encodedMsg, err := messageEncoder.Encode(msg)
+			assert.NoError(t, err)
+
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgent.EXPECT().GetStatus().Return(constants.StatusWorking)
+			mockAgent.EXPECT().SetLastAt()
+			if table.rtt > 0 {
+				mockAgent.EXPECT().SetRTT(table.rtt)
+			} else {
+				mockSession := mocks.NewMockSession(ctrl)
+				mockSession.EXPECT().ID().Return(int64(1))
+				mockSession.EXPECT().UID().Return("uid")
+				mockAgent.EXPECT().GetSession().Return(mockSession).Times(2)
+			}
+
+			handlerPool := NewHandlerPool()
+			svc := NewHandlerService(nil, nil, 1, 1, &cluster.Server{}, nil, nil, nil, nil, handlerPool)
+			err = svc.processPacket(mockAgent, &packet.Packet{Type: packet.Data, Data: encodedMsg})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestHandlerServiceProcessPacketBackground(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	msg := &message.Message{Type: message.Notify, Route: constants.BackgroundRoute}
+	encodedMsg, err := message.NewMessagesEncoder(false).Encode(msg)
+	assert.NoError(t, err)
+
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgent.EXPECT().GetStatus().Return(constants.StatusWorking)
+	mockAgent.EXPECT().SetBackgrounded()
+	mockAgent.EXPECT().SetLastAt()
+
+	handlerPool := NewHandlerPool()
+	svc := NewHandlerService(nil, nil, 1, 1, &cluster.Server{}, nil, nil, nil, nil, handlerPool)
+	err = svc.processPacket(mockAgent, &packet.Packet{Type: packet.Data, Data: encodedMsg})
+	assert.NoError(t, err)
+}
+
+func TestHandlerServiceHandle(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	packetEncoder := codec.NewPomeloPacketEncoder()
+	packetDecoder := codec.NewPomeloPacketDecoder()
+	handshakeBuffer := `{"sys":{"platform":"mac","libVersion":"0.3.5-release","clientBuildNumber":"20","clientVersion":"2.1"},"user":{"age":30}}`
+	bbb, err := packetEncoder.Encode(packet.Handshake, []byte(handshakeBuffer))
+	assert.NoError(t, err)
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+
+	mockConn := connmock.NewMockPlayerConn(ctrl)
+
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgentFactory := agentmocks.NewMockAgentFactory(ctrl)
+	mockAgentFactory.EXPECT().CreateAgent(mockConn).Return(mockAgent, nil).Times(1)
+	mockAgent.EXPECT().Conn().Return(mockConn).AnyTimes()
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	defer wg.Wait()
+
+	mockAgent.EXPECT().Handle().Do(func() {
+		wg.Done()
+	})
+
+	mockAgent.EXPECT().SendHandshakeResponse().Return(nil)
+
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().SetHandshakeData(gomock.Any()).Times(1)
+	mockSession.EXPECT().UID().Return("uid").Times(1)
+	mockSession.EXPECT().ID().Return(int64(1)).Times(2)
+	mockSession.EXPECT().Set(constants.IPVersionKey, constants.IPv4)
+	mockSession.EXPECT().Close()
+
+	mockAgent.EXPECT().String().Return("")
+	mockAgent.EXPECT().SetStatus(constants.StatusHandshake)
+	mockAgent.EXPECT().GetSession().Return(mockSession).Times(6)
+	mockAgent.EXPECT().IPVersion().Return(constants.IPv4)
+	mockAgent.EXPECT().GetTraceSampled().Return(false, false)
+	mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{}).AnyTimes()
+	mockAgent.EXPECT().SetLastAt().Do(func() {
+		wg.Done()
+	})
+
+	firstCall := mockConn.EXPECT().GetNextMessage().Return(bbb, nil).Do(func() {
+		wg.Done()
+	})
+
+	mockConn.EXPECT().GetNextMessage().Return(nil, errors.New("die")).Do(func() {
+		wg.Done()
+	}).After(firstCall)
+	mockAgent.EXPECT().SetCloseReason(session.DisconnectReasonReadError)
 
 	mockConn.EXPECT().Close().MaxTimes(1)
 
@@ -437,3 +1447,517 @@ func TestHandlerServiceHandle(t *testing.T) {
 	svc := NewHandlerService(packetDecoder, mockSerializer, 1, 1, nil, nil, mockAgentFactory, nil, pipeline.NewHandlerHooks(), handlerPool)
 	svc.Handle(mockConn)
 }
+
+func TestHandlerServiceHandleAgentCreationFailure(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := connmock.NewMockPlayerConn(ctrl)
+	mockAgentFactory := agentmocks.NewMockAgentFactory(ctrl)
+	mockAgentFactory.EXPECT().CreateAgent(mockConn).Return(nil, constants.ErrInvalidHandshakeData)
+	// no message is read from the connection, it is closed right away
+	mockConn.EXPECT().Close()
+
+	svc := NewHandlerService(codec.NewPomeloPacketDecoder(), nil, 1, 1, nil, nil, mockAgentFactory, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+	svc.Handle(mockConn)
+}
+
+func TestHandlerServiceHandleReadErrors(t *testing.T) {
+	tables := []struct {
+		name        string
+		err         error
+		closeReason string
+	}{
+		{"connection_closed", constants.ErrConnectionClosed, session.DisconnectReasonConnectionClosed},
+		{"handshake_too_large", constants.ErrHandshakeTooLarge, session.DisconnectReasonProtocolError},
+		{"stalled_packet", constants.ErrPacketReadTimeout, session.DisconnectReasonReadTimeout},
+		{"read_error", errors.New("connection reset by peer"), session.DisconnectReasonReadError},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockConn := connmock.NewMockPlayerConn(ctrl)
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgentFactory := agentmocks.NewMockAgentFactory(ctrl)
+			mockAgentFactory.EXPECT().CreateAgent(mockConn).Return(mockAgent, nil)
+			mockAgent.EXPECT().Conn().Return(mockConn).AnyTimes()
+
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().UID().Return("uid")
+			mockSession.EXPECT().ID().Return(int64(1))
+			mockSession.EXPECT().Close()
+
+			handled := make(chan bool, 1)
+			mockAgent.EXPECT().Handle().Do(func() {
+				handled <- true
+			})
+			mockAgent.EXPECT().String().Return("")
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().SetCloseReason(table.closeReason)
+
+			mockConn.EXPECT().GetNextMessage().Return(nil, table.err)
+
+			svc := NewHandlerService(codec.NewPomeloPacketDecoder(), nil, 1, 1, nil, nil, mockAgentFactory, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+			svc.Handle(mockConn)
+			helpers.ShouldEventuallyReceive(t, handled)
+		})
+	}
+}
+
+func TestHandlerServiceHandleMovedToAnotherConnection(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := connmock.NewMockPlayerConn(ctrl)
+	newConn := connmock.NewMockPlayerConn(ctrl)
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgentFactory := agentmocks.NewMockAgentFactory(ctrl)
+	mockAgentFactory.EXPECT().CreateAgent(mockConn).Return(mockAgent, nil)
+	mockAgent.EXPECT().Conn().Return(newConn).AnyTimes()
+
+	// the session is not closed once the client moved
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().UID().Return("uid")
+	mockSession.EXPECT().ID().Return(int64(1))
+
+	handled := make(chan bool, 1)
+	mockAgent.EXPECT().Handle().Do(func() {
+		handled <- true
+	})
+	mockAgent.EXPECT().String().Return("")
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+
+	mockConn.EXPECT().GetNextMessage().Return(nil, constants.ErrConnectionClosed)
+
+	svc := NewHandlerService(codec.NewPomeloPacketDecoder(), nil, 1, 1, nil, nil, mockAgentFactory, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+	svc.Handle(mockConn)
+	helpers.ShouldEventuallyReceive(t, handled)
+}
+
+func TestHandlerServiceHandleReconnect(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	heartbeat, err := codec.NewPomeloPacketEncoder().Encode(packet.Heartbeat, nil)
+	assert.NoError(t, err)
+
+	mockConn := connmock.NewMockPlayerConn(ctrl)
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgent.EXPECT().Reconnect(mockConn).Return(nil)
+	mockAgent.EXPECT().Conn().Return(mockConn).AnyTimes()
+	mockAgent.EXPECT().String().Return("")
+	mockAgent.EXPECT().SetLastAt()
+	mockAgent.EXPECT().SetCloseReason(session.DisconnectReasonConnectionClosed)
+
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().UID().Return("uid")
+	mockSession.EXPECT().ID().Return(int64(1))
+	mockSession.EXPECT().Close()
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+
+	first := mockConn.EXPECT().GetNextMessage().Return(heartbeat, nil)
+	mockConn.EXPECT().GetNextMessage().Return(nil, constants.ErrConnectionClosed).After(first)
+
+	svc := NewHandlerService(codec.NewPomeloPacketDecoder(), nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+	assert.NoError(t, svc.HandleReconnect(mockConn, mockAgent, nil))
+}
+
+func TestHandlerServiceHandleReconnectClosedAgent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockConn := connmock.NewMockPlayerConn(ctrl)
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	closedErr := e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest)
+	mockAgent.EXPECT().Reconnect(mockConn).Return(closedErr)
+
+	svc := NewHandlerService(codec.NewPomeloPacketDecoder(), nil, 1, 1, nil, nil, nil, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+	assert.Equal(t, closedErr, svc.HandleReconnect(mockConn, mockAgent, nil))
+}
+
+func TestHandlerServiceHandleReconnectWithAcceptor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	limit := acceptor.PacketRateLimit{Rate: 10, Burst: 5}
+	game := acceptor.NewTCPAcceptor("0.0.0.0:0")
+	game.SetName("game")
+	game.SetPacketRateLimit(limit)
+
+	data, err := codec.NewPomeloPacketEncoder().Encode(packet.Data, []byte{0x00, 0x01, 0x00})
+	assert.NoError(t, err)
+
+	mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+	mockConn := connmock.NewMockPlayerConn(ctrl)
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgent.EXPECT().Reconnect(mockConn).Return(nil)
+	mockAgent.EXPECT().Conn().Return(mockConn).AnyTimes()
+	mockAgent.EXPECT().String().Return("")
+	mockAgent.EXPECT().SetPacketRateLimit(limit)
+	mockAgent.EXPECT().AllowPacket().Return(constants.ErrRateLimitExceeded)
+	mockAgent.EXPECT().SetCloseReason(session.DisconnectReasonRateLimited)
+
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().UID().Return("uid")
+	mockSession.EXPECT().ID().Return(int64(1))
+	mockSession.EXPECT().Close()
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+
+	svc := NewHandlerService(codec.NewPomeloPacketDecoder(), nil, 1, 1, nil, nil, nil, []metrics.Reporter{mockMetricsReporter}, pipeline.NewHandlerHooks(), NewHandlerPool())
+
+	// the connection is counted in the game acceptor while it is open
+	mockMetricsReporter.EXPECT().ReportCount(metrics.AcceptorConnectionsTotal, map[string]string{"acceptor": "game"}, float64(1))
+	mockMetricsReporter.EXPECT().ReportGauge(metrics.AcceptorConnections, map[string]string{"acceptor": "game"}, float64(1))
+	mockConn.EXPECT().GetNextMessage().DoAndReturn(func() ([]byte, error) {
+		assert.Equal(t, map[string]acceptor.ConnectionCounts{"game": {Active: 1, Total: 1}}, svc.AcceptorConnections())
+		mockMetricsReporter.EXPECT().ReportGauge(metrics.AcceptorConnections, map[string]string{"acceptor": "game"}, float64(0))
+		return data, nil
+	})
+
+	assert.NoError(t, svc.HandleReconnect(mockConn, mockAgent, game))
+	assert.Equal(t, map[string]acceptor.ConnectionCounts{"game": {Active: 0, Total: 1}}, svc.AcceptorConnections())
+}
+
+// heartbeatAgentFactory creates its agent with the heartbeat interval it is
+// given
+type heartbeatAgentFactory struct {
+	agent.AgentFactory
+	a        agent.Agent
+	interval time.Duration
+}
+
+func (f *heartbeatAgentFactory) CreateAgentWithHeartbeat(conn net.Conn, serializer serialize.Serializer, heartbeatInterval time.Duration) (agent.Agent, error) {
+	f.interval = heartbeatInterval
+	return f.a, nil
+}
+
+func TestHandlerServiceHandleWithAcceptorHeartbeatInterval(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	turnBased := acceptor.NewTCPAcceptor("0.0.0.0:0")
+	turnBased.SetHeartbeatInterval(time.Minute)
+
+	mockConn := connmock.NewMockPlayerConn(ctrl)
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgent.EXPECT().Conn().Return(mockConn).AnyTimes()
+	handled := make(chan bool, 1)
+	mockAgent.EXPECT().Handle().Do(func() {
+		handled <- true
+	})
+	mockAgent.EXPECT().String().Return("")
+	mockAgent.EXPECT().SetCloseReason(session.DisconnectReasonConnectionClosed)
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().UID().Return("uid")
+	mockSession.EXPECT().ID().Return(int64(1))
+	mockSession.EXPECT().Close()
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+	mockConn.EXPECT().GetNextMessage().Return(nil, constants.ErrConnectionClosed)
+
+	factory := &heartbeatAgentFactory{AgentFactory: agentmocks.NewMockAgentFactory(ctrl), a: mockAgent}
+	svc := NewHandlerService(codec.NewPomeloPacketDecoder(), nil, 1, 1, nil, nil, factory, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+	svc.HandleWithAcceptor(mockConn, turnBased)
+	helpers.ShouldEventuallyReceive(t, handled)
+	assert.Equal(t, time.Minute, factory.interval)
+}
+
+func TestHandlerServiceHandleWithAcceptorCountsConnections(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	game := acceptor.NewTCPAcceptor("0.0.0.0:0")
+	game.SetName("game")
+
+	mockMetricsReporter := metricsmocks.NewMockReporter(ctrl)
+	mockConn := connmock.NewMockPlayerConn(ctrl)
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgentFactory := agentmocks.NewMockAgentFactory(ctrl)
+	mockAgentFactory.EXPECT().CreateAgent(mockConn).Return(mockAgent, nil)
+	mockAgent.EXPECT().Conn().Return(mockConn).AnyTimes()
+
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().UID().Return("uid")
+	mockSession.EXPECT().ID().Return(int64(1))
+	mockSession.EXPECT().Close()
+	handled := make(chan bool, 1)
+	mockAgent.EXPECT().Handle().Do(func() {
+		handled <- true
+	})
+	mockAgent.EXPECT().String().Return("")
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+	mockAgent.EXPECT().SetCloseReason(session.DisconnectReasonConnectionClosed)
+
+	svc := NewHandlerService(codec.NewPomeloPacketDecoder(), nil, 1, 1, nil, nil, mockAgentFactory, []metrics.Reporter{mockMetricsReporter}, pipeline.NewHandlerHooks(), NewHandlerPool())
+
+	// the connection is counted in the game acceptor while it is open
+	mockMetricsReporter.EXPECT().ReportCount(metrics.AcceptorConnectionsTotal, map[string]string{"acceptor": "game"}, float64(1))
+	mockMetricsReporter.EXPECT().ReportGauge(metrics.AcceptorConnections, map[string]string{"acceptor": "game"}, float64(1))
+	mockConn.EXPECT().GetNextMessage().DoAndReturn(func() ([]byte, error) {
+		assert.Equal(t, map[string]acceptor.ConnectionCounts{"game": {Active: 1, Total: 1}}, svc.AcceptorConnections())
+		mockMetricsReporter.EXPECT().ReportGauge(metrics.AcceptorConnections, map[string]string{"acceptor": "game"}, float64(0))
+		return nil, constants.ErrConnectionClosed
+	})
+
+	assert.Empty(t, svc.AcceptorConnections())
+	svc.HandleWithAcceptor(mockConn, game)
+	helpers.ShouldEventuallyReceive(t, handled)
+	assert.Equal(t, map[string]acceptor.ConnectionCounts{"game": {Active: 0, Total: 1}}, svc.AcceptorConnections())
+}
+
+func TestHandlerServiceHandleWithAcceptorPacketRateLimit(t *testing.T) {
+	tables := []struct {
+		name        string
+		allowErr    error
+		closeReason string
+	}{
+		{"over_limit", constants.ErrRateLimitExceeded, session.DisconnectReasonRateLimited},
+		{"under_limit", nil, session.DisconnectReasonProtocolError},
+		{"closed_while_throttled", e.NewError(constants.ErrAgentClosed, e.ErrClientClosedRequest), ""},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			data, err := codec.NewPomeloPacketEncoder().Encode(packet.Data, []byte{0x00, 0x01, 0x00})
+			assert.NoError(t, err)
+
+			limit := acceptor.PacketRateLimit{Rate: 10, Burst: 5, Close: table.allowErr != nil}
+			acc := acceptor.NewTCPAcceptor("0.0.0.0:0")
+			acc.SetPacketRateLimit(limit)
+
+			mockConn := connmock.NewMockPlayerConn(ctrl)
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgentFactory := agentmocks.NewMockAgentFactory(ctrl)
+			mockAgentFactory.EXPECT().CreateAgent(mockConn).Return(mockAgent, nil)
+			mockAgent.EXPECT().Conn().Return(mockConn).AnyTimes()
+
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().UID().Return("uid")
+			mockSession.EXPECT().ID().Return(int64(1))
+			mockSession.EXPECT().Close()
+
+			handled := make(chan bool, 1)
+			mockAgent.EXPECT().Handle().Do(func() {
+				handled <- true
+			})
+			mockAgent.EXPECT().String().Return("")
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().SetPacketRateLimit(limit)
+			mockAgent.EXPECT().AllowPacket().Return(table.allowErr)
+			if table.allowErr == nil {
+				// the packet is handled, and rejected before the handshake
+				mockAgent.EXPECT().GetStatus().Return(constants.StatusStart)
+				mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{})
+			}
+			if table.closeReason != "" {
+				mockAgent.EXPECT().SetCloseReason(table.closeReason)
+			}
+
+			mockConn.EXPECT().GetNextMessage().Return(data, nil)
+
+			svc := NewHandlerService(codec.NewPomeloPacketDecoder(), nil, 1, 1, nil, nil, mockAgentFactory, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+			svc.HandleWithAcceptor(mockConn, acc)
+			helpers.ShouldEventuallyReceive(t, handled)
+		})
+	}
+}
+
+// recordingPacketDecoder records the data it decodes
+type recordingPacketDecoder struct {
+	codec.PacketDecoder
+	decoded [][]byte
+}
+
+func (d *recordingPacketDecoder) Decode(data []byte) ([]*packet.Packet, error) {
+	d.decoded = append(d.decoded, data)
+	return d.PacketDecoder.Decode(data)
+}
+
+func TestHandlerServiceHandleClientCodecs(t *testing.T) {
+	tables := []struct {
+		name            string
+		protocolVersion string
+		legacy          bool
+	}{
+		{"legacy_client", "1.0", true},
+		{"modern_client", "2.0", false},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			packetEncoder := codec.NewPomeloPacketEncoder()
+			handshake, err := packetEncoder.Encode(packet.Handshake, []byte(`{"sys":{"platform":"mac","protocolVersion":"`+table.protocolVersion+`"}}`))
+			assert.NoError(t, err)
+			heartbeat, err := packetEncoder.Encode(packet.Heartbeat, nil)
+			assert.NoError(t, err)
+
+			defaultDecoder := &recordingPacketDecoder{PacketDecoder: codec.NewPomeloPacketDecoder()}
+			legacyDecoder := &recordingPacketDecoder{PacketDecoder: codec.NewPomeloPacketDecoder()}
+			legacyEncoder := codec.NewPomeloPacketEncoder()
+
+			mockConn := connmock.NewMockPlayerConn(ctrl)
+			mockAgent := agentmocks.NewMockAgent(ctrl)
+			mockAgentFactory := agentmocks.NewMockAgentFactory(ctrl)
+			mockAgentFactory.EXPECT().CreateAgent(mockConn).Return(mockAgent, nil)
+			mockAgent.EXPECT().Conn().Return(mockConn).AnyTimes()
+
+			var handshakeData *session.HandshakeData
+			mockSession := mocks.NewMockSession(ctrl)
+			mockSession.EXPECT().SetHandshakeData(gomock.Any()).Do(func(data *session.HandshakeData) {
+				handshakeData = data
+			})
+			mockSession.EXPECT().GetHandshakeData().DoAndReturn(func() *session.HandshakeData {
+				return handshakeData
+			})
+			mockSession.EXPECT().UID().Return("uid")
+			mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+			mockSession.EXPECT().Set(constants.IPVersionKey, constants.IPv4)
+			mockSession.EXPECT().Close()
+
+			handled := make(chan bool, 1)
+			mockAgent.EXPECT().Handle().Do(func() {
+				handled <- true
+			})
+			mockAgent.EXPECT().String().Return("")
+			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().SendHandshakeResponse().Return(nil)
+			mockAgent.EXPECT().SetStatus(constants.StatusHandshake)
+			mockAgent.EXPECT().IPVersion().Return(constants.IPv4)
+			mockAgent.EXPECT().GetTraceSampled().Return(false, false)
+			mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{}).AnyTimes()
+			mockAgent.EXPECT().SetLastAt().AnyTimes()
+			mockAgent.EXPECT().SetCloseReason(session.DisconnectReasonConnectionClosed)
+			if table.legacy {
+				mockAgent.EXPECT().SetPacketEncoder(legacyEncoder).Return(nil)
+			}
+
+			first := mockConn.EXPECT().GetNextMessage().Return(handshake, nil)
+			second := mockConn.EXPECT().GetNextMessage().Return(heartbeat, nil).After(first)
+			mockConn.EXPECT().GetNextMessage().Return(nil, constants.ErrConnectionClosed).After(second)
+
+			svc := NewHandlerService(defaultDecoder, nil, 1, 1, nil, nil, mockAgentFactory, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+			svc.SetClientCodecs(map[string]PacketCodec{
+				"1.0": {Encoder: legacyEncoder, Decoder: legacyDecoder},
+			})
+			svc.Handle(mockConn)
+			helpers.ShouldEventuallyReceive(t, handled)
+
+			// the handshake is always decoded with the default decoder
+			if table.legacy {
+				assert.Equal(t, [][]byte{handshake}, defaultDecoder.decoded)
+				assert.Equal(t, [][]byte{heartbeat}, legacyDecoder.decoded)
+			} else {
+				assert.Equal(t, [][]byte{handshake, heartbeat}, defaultDecoder.decoded)
+				assert.Empty(t, legacyDecoder.decoded)
+			}
+		})
+	}
+}
+
+// lengthPrefixedFraming frames the packets with their type followed by the
+// length of their data in 4 bytes, recording the data it decodes
+type lengthPrefixedFraming struct {
+	decoded [][]byte
+}
+
+func (f *lengthPrefixedFraming) HeaderLength() int {
+	return 5
+}
+
+func (f *lengthPrefixedFraming) ParseHeader(header []byte) (int, packet.Type, error) {
+	if len(header) != f.HeaderLength() {
+		return 0, 0, packet.ErrInvalidPomeloHeader
+	}
+	return int(binary.BigEndian.Uint32(header[1:])), packet.Type(header[0]), nil
+}
+
+func (f *lengthPrefixedFraming) Encode(typ packet.Type, data []byte) ([]byte, error) {
+	buf := make([]byte, f.HeaderLength(), f.HeaderLength()+len(data))
+	buf[0] = byte(typ)
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(data)))
+	return append(buf, data...), nil
+}
+
+func (f *lengthPrefixedFraming) Decode(data []byte) ([]*packet.Packet, error) {
+	f.decoded = append(f.decoded, data)
+	var packets []*packet.Packet
+	for len(data) > 0 {
+		size, typ, err := f.ParseHeader(data[:f.HeaderLength()])
+		if err != nil {
+			return nil, err
+		}
+		body := data[f.HeaderLength() : f.HeaderLength()+size]
+		packets = append(packets, &packet.Packet{Type: typ, Length: size, Data: body})
+		data = data[f.HeaderLength()+size:]
+	}
+	return packets, nil
+}
+
+func TestHandlerServiceHandleWithAcceptorPacketFraming(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	framing := &lengthPrefixedFraming{}
+	handshake, err := framing.Encode(packet.Handshake, []byte(`{"sys":{"platform":"mac","protocolVersion":"1.0"}}`))
+	assert.NoError(t, err)
+	heartbeat, err := framing.Encode(packet.Heartbeat, nil)
+	assert.NoError(t, err)
+
+	acc := acceptor.NewTCPAcceptor("0.0.0.0:0")
+	acc.SetPacketFraming(framing)
+	defaultDecoder := &recordingPacketDecoder{PacketDecoder: codec.NewPomeloPacketDecoder()}
+	legacyDecoder := &recordingPacketDecoder{PacketDecoder: codec.NewPomeloPacketDecoder()}
+
+	mockConn := connmock.NewMockPlayerConn(ctrl)
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgentFactory := agentmocks.NewMockAgentFactory(ctrl)
+	mockAgentFactory.EXPECT().CreateAgent(mockConn).Return(mockAgent, nil)
+	mockAgent.EXPECT().Conn().Return(mockConn).AnyTimes()
+
+	mockSession := mocks.NewMockSession(ctrl)
+	mockSession.EXPECT().SetHandshakeData(gomock.Any())
+	mockSession.EXPECT().UID().Return("uid")
+	mockSession.EXPECT().ID().Return(int64(1)).AnyTimes()
+	mockSession.EXPECT().Set(constants.IPVersionKey, constants.IPv4)
+	mockSession.EXPECT().Close()
+
+	handled := make(chan bool, 1)
+	mockAgent.EXPECT().SetPacketEncoder(framing).Return(nil)
+	mockAgent.EXPECT().Handle().Do(func() {
+		handled <- true
+	})
+	mockAgent.EXPECT().String().Return("")
+	mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+	mockAgent.EXPECT().SendHandshakeResponse().Return(nil)
+	mockAgent.EXPECT().SetStatus(constants.StatusHandshake)
+	mockAgent.EXPECT().IPVersion().Return(constants.IPv4)
+	mockAgent.EXPECT().GetTraceSampled().Return(false, false)
+	mockAgent.EXPECT().RemoteAddr().Return(&mockAddr{}).AnyTimes()
+	mockAgent.EXPECT().SetLastAt().AnyTimes()
+	mockAgent.EXPECT().SetCloseReason(session.DisconnectReasonConnectionClosed)
+
+	first := mockConn.EXPECT().GetNextMessage().Return(handshake, nil)
+	second := mockConn.EXPECT().GetNextMessage().Return(heartbeat, nil).After(first)
+	mockConn.EXPECT().GetNextMessage().Return(nil, constants.ErrConnectionClosed).After(second)
+
+	svc := NewHandlerService(defaultDecoder, nil, 1, 1, nil, nil, mockAgentFactory, nil, pipeline.NewHandlerHooks(), NewHandlerPool())
+	// the decoder of the protocol version is not used by the clients of an
+	// acceptor with a framing
+	svc.SetClientCodecs(map[string]PacketCodec{
+		"1.0": {Decoder: legacyDecoder},
+	})
+	svc.HandleWithAcceptor(mockConn, acc)
+	helpers.ShouldEventuallyReceive(t, handled)
+
+	assert.Equal(t, [][]byte{handshake, heartbeat}, framing.decoded)
+	assert.Empty(t, defaultDecoder.decoded)
+	assert.Empty(t, legacyDecoder.decoded)
+}
@@ -0,0 +1,76 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// IdempotencyStore records the idempotency keys of the requests handled, so
+// handlers can detect the retries of a request and run it exactly once. It
+// is shared by every handler, so implementations must be safe for
+// concurrent use
+type IdempotencyStore interface {
+	// MarkSeen records key and returns whether it was already recorded
+	MarkSeen(ctx context.Context, key string) (bool, error)
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore that keeps the keys in
+// memory, so retries are only detected if they reach the same server
+type MemoryIdempotencyStore struct {
+	sync.Mutex
+	ttl       time.Duration
+	keys      map[string]time.Time // expiration of each key
+	nextSweep time.Time
+}
+
+// NewMemoryIdempotencyStore returns a MemoryIdempotencyStore that forgets
+// the keys ttl after they are recorded
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ttl:  ttl,
+		keys: map[string]time.Time{},
+	}
+}
+
+// MarkSeen records key and returns whether it was already recorded within
+// the store ttl, dropping the expired keys at most once per ttl
+func (s *MemoryIdempotencyStore) MarkSeen(ctx context.Context, key string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if !now.Before(s.nextSweep) {
+		for k, expiresAt := range s.keys {
+			if !now.Before(expiresAt) {
+				delete(s.keys, k)
+			}
+		}
+		s.nextSweep = now.Add(s.ttl)
+	}
+	if expiresAt, ok := s.keys[key]; ok && now.Before(expiresAt) {
+		return true, nil
+	}
+	s.keys[key] = now.Add(s.ttl)
+	return false, nil
+}
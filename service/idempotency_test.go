@@ -0,0 +1,67 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryIdempotencyStoreMarkSeen(t *testing.T) {
+	store := NewMemoryIdempotencyStore(time.Minute)
+	ctx := context.Background()
+
+	duplicate, err := store.MarkSeen(ctx, "uid/purchase-1")
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+
+	duplicate, err = store.MarkSeen(ctx, "uid/purchase-1")
+	assert.NoError(t, err)
+	assert.True(t, duplicate)
+
+	duplicate, err = store.MarkSeen(ctx, "uid/purchase-2")
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+}
+
+func TestMemoryIdempotencyStoreExpiresKeys(t *testing.T) {
+	store := NewMemoryIdempotencyStore(time.Minute)
+	ctx := context.Background()
+
+	duplicate, err := store.MarkSeen(ctx, "uid/purchase-1")
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+
+	store.keys["uid/purchase-1"] = time.Now().Add(-time.Second)
+	store.nextSweep = time.Time{}
+	duplicate, err = store.MarkSeen(ctx, "uid/purchase-2")
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+	assert.NotContains(t, store.keys, "uid/purchase-1")
+
+	store.keys["uid/purchase-2"] = time.Now().Add(-time.Second)
+	duplicate, err = store.MarkSeen(ctx, "uid/purchase-2")
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"time"
+
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// MaintenanceWindow is a period during which the server is under
+// maintenance, with the message sent to the clients connecting in it
+type MaintenanceWindow struct {
+	Start   time.Time
+	End     time.Time
+	Message string
+}
+
+// maintenanceWindowAt returns the window of windows now falls in, if any
+func maintenanceWindowAt(windows []MaintenanceWindow, now time.Time) (MaintenanceWindow, bool) {
+	for _, w := range windows {
+		if !now.Before(w.Start) && now.Before(w.End) {
+			return w, true
+		}
+	}
+	return MaintenanceWindow{}, false
+}
+
+// notice returns the maintenance notice sent to the clients connecting during
+// w, with the start and end of the window in unix seconds
+func (w MaintenanceWindow) notice() map[string]interface{} {
+	return map[string]interface{}{
+		"message": w.Message,
+		"start":   w.Start.Unix(),
+		"end":     w.End.Unix(),
+	}
+}
+
+// newMaintenanceNotice returns the notice of w pushed to a client using the
+// given serializer, protobuf clients get a google.protobuf.Struct with the
+// same fields
+func newMaintenanceNotice(serializerName string, w MaintenanceWindow) (interface{}, error) {
+	if serializerName != protobuf.NewSerializer().GetName() {
+		return w.notice(), nil
+	}
+	return structpb.NewStruct(w.notice())
+}
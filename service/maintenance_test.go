@@ -0,0 +1,83 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestMaintenanceWindowAt(t *testing.T) {
+	start := time.Date(2026, 11, 2, 3, 0, 0, 0, time.UTC)
+	windows := []MaintenanceWindow{
+		{Start: start, End: start.Add(time.Hour), Message: "first"},
+		{Start: start.Add(2 * time.Hour), End: start.Add(3 * time.Hour), Message: "second"},
+	}
+
+	tables := []struct {
+		name    string
+		now     time.Time
+		message string
+		ok      bool
+	}{
+		{"before", start.Add(-time.Second), "", false},
+		{"start", start, "first", true},
+		{"inside", start.Add(30 * time.Minute), "first", true},
+		{"end", start.Add(time.Hour), "", false},
+		{"between", start.Add(90 * time.Minute), "", false},
+		{"second", start.Add(150 * time.Minute), "second", true},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			w, ok := maintenanceWindowAt(windows, table.now)
+			assert.Equal(t, table.ok, ok)
+			assert.Equal(t, table.message, w.Message)
+		})
+	}
+
+	_, ok := maintenanceWindowAt(nil, start)
+	assert.False(t, ok)
+}
+
+func TestNewMaintenanceNotice(t *testing.T) {
+	start := time.Date(2026, 11, 2, 3, 0, 0, 0, time.UTC)
+	w := MaintenanceWindow{Start: start, End: start.Add(time.Hour), Message: "scheduled maintenance"}
+
+	notice, err := newMaintenanceNotice("json", w)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"message": "scheduled maintenance",
+		"start":   start.Unix(),
+		"end":     start.Add(time.Hour).Unix(),
+	}, notice)
+
+	notice, err = newMaintenanceNotice("protobuf", w)
+	assert.NoError(t, err)
+	s, ok := notice.(*structpb.Struct)
+	assert.True(t, ok)
+	assert.Equal(t, "scheduled maintenance", s.Fields["message"].GetStringValue())
+	assert.Equal(t, float64(start.Unix()), s.Fields["start"].GetNumberValue())
+	assert.Equal(t, float64(start.Add(time.Hour).Unix()), s.Fields["end"].GetNumberValue())
+}
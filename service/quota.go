@@ -0,0 +1,83 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// RouteQuota is the max number of calls a session can make to a route within
+// a sliding time window
+type RouteQuota struct {
+	Limit  int
+	Window time.Duration
+}
+
+// routeQuotas tracks the calls each session made to the routes with a quota
+type routeQuotas struct {
+	quotas   map[string]RouteQuota
+	sessions sync.Map // session id -> *sessionCalls
+}
+
+type sessionCalls struct {
+	sync.Mutex
+	calls map[string][]time.Time // times of the calls in the window, oldest first
+}
+
+func newRouteQuotas(quotas map[string]RouteQuota) *routeQuotas {
+	return &routeQuotas{quotas: quotas}
+}
+
+// allow records a call the session made to route at now if it is within the
+// route quota, otherwise it returns how long until the oldest call in the
+// window expires and another one is allowed
+func (q *routeQuotas) allow(sessionID int64, route string, now time.Time) (time.Duration, bool) {
+	quota, ok := q.quotas[route]
+	if !ok || quota.Limit <= 0 {
+		return 0, true
+	}
+
+	value, _ := q.sessions.LoadOrStore(sessionID, &sessionCalls{calls: map[string][]time.Time{}})
+	s := value.(*sessionCalls)
+	s.Lock()
+	defer s.Unlock()
+
+	calls := s.calls[route]
+	windowStart := now.Add(-quota.Window)
+	expired := 0
+	for expired < len(calls) && !calls[expired].After(windowStart) {
+		expired++
+	}
+	calls = calls[expired:]
+
+	if len(calls) >= quota.Limit {
+		s.calls[route] = calls
+		return calls[0].Add(quota.Window).Sub(now), false
+	}
+	s.calls[route] = append(calls, now)
+	return 0, true
+}
+
+// forget drops the calls of a session, it is called when the session closes
+func (q *routeQuotas) forget(sessionID int64) {
+	q.sessions.Delete(sessionID)
+}
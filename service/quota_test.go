@@ -0,0 +1,73 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteQuotasAllow(t *testing.T) {
+	quotas := newRouteQuotas(map[string]RouteQuota{
+		"leaderboard.refresh": {Limit: 5, Window: time.Minute},
+	})
+	start := time.Now()
+
+	for i := 0; i < 5; i++ {
+		_, ok := quotas.allow(1, "leaderboard.refresh", start.Add(time.Duration(i)*time.Second))
+		assert.True(t, ok)
+	}
+
+	reset, ok := quotas.allow(1, "leaderboard.refresh", start.Add(10*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 50*time.Second, reset)
+
+	// other sessions and routes have quotas of their own
+	_, ok = quotas.allow(2, "leaderboard.refresh", start.Add(10*time.Second))
+	assert.True(t, ok)
+	_, ok = quotas.allow(1, "leaderboard.get", start.Add(10*time.Second))
+	assert.True(t, ok)
+
+	// the window slides, the first call expires after a minute
+	_, ok = quotas.allow(1, "leaderboard.refresh", start.Add(time.Minute))
+	assert.True(t, ok)
+	reset, ok = quotas.allow(1, "leaderboard.refresh", start.Add(time.Minute))
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, reset)
+}
+
+func TestRouteQuotasForget(t *testing.T) {
+	quotas := newRouteQuotas(map[string]RouteQuota{
+		"leaderboard.refresh": {Limit: 1, Window: time.Minute},
+	})
+	now := time.Now()
+
+	_, ok := quotas.allow(1, "leaderboard.refresh", now)
+	assert.True(t, ok)
+	_, ok = quotas.allow(1, "leaderboard.refresh", now)
+	assert.False(t, ok)
+
+	quotas.forget(1)
+	_, ok = quotas.allow(1, "leaderboard.refresh", now)
+	assert.True(t, ok)
+}
@@ -34,6 +34,7 @@ import (
 	"github.com/topfreegames/pitaya/v2/conn/codec"
 	"github.com/topfreegames/pitaya/v2/conn/message"
 	"github.com/topfreegames/pitaya/v2/constants"
+	pcontext "github.com/topfreegames/pitaya/v2/context"
 	"github.com/topfreegames/pitaya/v2/docgenerator"
 	e "github.com/topfreegames/pitaya/v2/errors"
 	"github.com/topfreegames/pitaya/v2/logger"
@@ -42,6 +43,8 @@ import (
 	"github.com/topfreegames/pitaya/v2/route"
 	"github.com/topfreegames/pitaya/v2/router"
 	"github.com/topfreegames/pitaya/v2/serialize"
+	"github.com/topfreegames/pitaya/v2/serialize/json"
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
 	"github.com/topfreegames/pitaya/v2/session"
 	"github.com/topfreegames/pitaya/v2/tracing"
 	"github.com/topfreegames/pitaya/v2/util"
@@ -62,7 +65,8 @@ type RemoteService struct {
 	remoteBindingListeners []cluster.RemoteBindingListener
 	sessionPool            session.SessionPool
 	handlerPool            *HandlerPool
-	remotes                map[string]*component.Remote // all remote method
+	remotes                map[string]*component.Remote    // all remote method
+	serializers            map[string]serialize.Serializer // serializers of the clients by name
 }
 
 // NewRemoteService creates and return a new RemoteService
@@ -93,8 +97,12 @@ func NewRemoteService(
 		sessionPool:            sessionPool,
 		handlerPool:            handlerPool,
 		remotes:                make(map[string]*component.Remote),
+		serializers:            make(map[string]serialize.Serializer),
 	}
 
+	remote.AddSerializer(json.NewSerializer())
+	remote.AddSerializer(protobuf.NewSerializer())
+
 	remote.handlerHooks = handlerHooks
 
 	return remote
@@ -107,6 +115,10 @@ func (r *RemoteService) remoteProcess(
 	route *route.Route,
 	msg *message.Message,
 ) {
+	// the backend server must use the serializer of the client
+	if name := a.GetSerializer().GetName(); name != r.serializer.GetName() {
+		ctx = pcontext.AddToPropagateCtx(ctx, constants.SerializerKey, name)
+	}
 	res, err := r.remoteCall(ctx, server, protos.RPCType_Sys, route, a.GetSession(), msg)
 	switch msg.Type {
 	case message.Request:
@@ -131,6 +143,27 @@ func (r *RemoteService) remoteProcess(
 	}
 }
 
+// AddSerializer makes the server able to handle the requests of the clients
+// that use serializer, forwarded by frontend servers whose acceptors have a
+// serializer of their own. The JSON and Protobuf serializers are added by
+// default, it must be called before the server starts
+func (r *RemoteService) AddSerializer(serializer serialize.Serializer) {
+	r.serializers[serializer.GetName()] = serializer
+}
+
+// getSerializer returns the serializer of the client that made the request
+func (r *RemoteService) getSerializer(ctx context.Context) (serialize.Serializer, error) {
+	name, _ := pcontext.GetFromPropagateCtx(ctx, constants.SerializerKey).(string)
+	if name == "" {
+		return r.serializer, nil
+	}
+	serializer, ok := r.serializers[name]
+	if !ok {
+		return nil, constants.ErrUnknownSerializer
+	}
+	return serializer, nil
+}
+
 // AddRemoteBindingListener adds a listener
 func (r *RemoteService) AddRemoteBindingListener(bindingListener cluster.RemoteBindingListener) {
 	r.remoteBindingListeners = append(r.remoteBindingListeners, bindingListener)
@@ -186,6 +219,19 @@ func (r *RemoteService) PushToUser(ctx context.Context, push *protos.Push) (*pro
 	return nil, constants.ErrSessionNotFound
 }
 
+// PushToUsers sends each push of a batch to its user, it answers with the
+// uids of the users whose push failed
+func (r *RemoteService) PushToUsers(ctx context.Context, batch *protos.PushBatch) (*protos.PushBatchAnswer, error) {
+	answer := &protos.PushBatchAnswer{}
+	for _, push := range batch.GetPushes() {
+		if _, err := r.PushToUser(ctx, push); err != nil {
+			logger.Log.Errorf("Session push message error, UID=%s, Error=%s", push.GetUid(), err.Error())
+			answer.FailedUids = append(answer.FailedUids, push.GetUid())
+		}
+	}
+	return answer, nil
+}
+
 // KickUser sends a kick to user
 func (r *RemoteService) KickUser(ctx context.Context, kick *protos.KickMsg) (*protos.KickAnswer, error) {
 	logger.Log.Debugf("sending kick to user %s", kick.GetUserId())
@@ -387,13 +433,23 @@ func (r *RemoteService) handleRPCUser(ctx context.Context, req *protos.Request,
 func (r *RemoteService) handleRPCSys(ctx context.Context, req *protos.Request, rt *route.Route) *protos.Response {
 	reply := req.GetMsg().GetReply()
 	response := &protos.Response{}
+	serializer, err := r.getSerializer(ctx)
+	if err != nil {
+		logger.Log.Warnf("pitaya/handler: %s", err.Error())
+		return &protos.Response{
+			Error: &protos.Error{
+				Code: e.ErrInternalCode,
+				Msg:  err.Error(),
+			},
+		}
+	}
 	// (warning) a new agent is created for every new request
 	a, err := agent.NewRemote(
 		req.GetSession(),
 		reply,
 		r.rpcClient,
 		r.encoder,
-		r.serializer,
+		serializer,
 		r.serviceDiscovery,
 		req.FrontendID,
 		r.messageEncoder,
@@ -410,7 +466,7 @@ func (r *RemoteService) handleRPCSys(ctx context.Context, req *protos.Request, r
 		return response
 	}
 
-	ret, err := r.handlerPool.ProcessHandlerMessage(ctx, rt, r.serializer, r.handlerHooks, a.Session, req.GetMsg().GetData(), req.GetMsg().GetType(), true)
+	ret, err := r.handlerPool.ProcessHandlerMessage(ctx, rt, serializer, r.handlerHooks, a.Session, req.GetMsg().GetData(), req.GetMsg().GetType(), true)
 	if err != nil {
 		logger.Log.Warnf(err.Error())
 		response = &protos.Response{
@@ -39,13 +39,16 @@ import (
 	"github.com/topfreegames/pitaya/v2/conn/message"
 	messagemocks "github.com/topfreegames/pitaya/v2/conn/message/mocks"
 	"github.com/topfreegames/pitaya/v2/constants"
+	pcontext "github.com/topfreegames/pitaya/v2/context"
 	e "github.com/topfreegames/pitaya/v2/errors"
 	"github.com/topfreegames/pitaya/v2/pipeline"
 	"github.com/topfreegames/pitaya/v2/protos"
 	"github.com/topfreegames/pitaya/v2/protos/test"
 	"github.com/topfreegames/pitaya/v2/route"
 	"github.com/topfreegames/pitaya/v2/router"
+	"github.com/topfreegames/pitaya/v2/serialize/json"
 	serializemocks "github.com/topfreegames/pitaya/v2/serialize/mocks"
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
 	"github.com/topfreegames/pitaya/v2/session"
 	sessionmocks "github.com/topfreegames/pitaya/v2/session/mocks"
 )
@@ -199,6 +202,28 @@ func TestRemoteServicePushToUser(t *testing.T) {
 	}
 }
 
+func TestRemoteServicePushToUsers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSession := sessionmocks.NewMockSession(ctrl)
+	mockSessionPool := sessionmocks.NewMockSessionPool(ctrl)
+	mockSessionPool.EXPECT().GetSessionByUID("uid1").Return(mockSession)
+	mockSessionPool.EXPECT().GetSessionByUID("uid2").Return(nil)
+	mockSessionPool.EXPECT().GetSessionByUID("uid3").Return(mockSession)
+	mockSession.EXPECT().Push("sv.svc.mth", []byte{0x01})
+	mockSession.EXPECT().Push("sv.svc.mth", []byte{0x03}).Return(constants.ErrAgentClosed)
+	svc := NewRemoteService(nil, nil, nil, nil, nil, nil, nil, nil, mockSessionPool, nil, nil)
+
+	answer, err := svc.PushToUsers(context.Background(), &protos.PushBatch{Pushes: []*protos.Push{
+		{Route: "sv.svc.mth", Uid: "uid1", Data: []byte{0x01}},
+		{Route: "sv.svc.mth", Uid: "uid2", Data: []byte{0x02}},
+		{Route: "sv.svc.mth", Uid: "uid3", Data: []byte{0x03}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"uid2", "uid3"}, answer.FailedUids)
+}
+
 func TestRemoteServiceKickUser(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockSessionPool := sessionmocks.NewMockSessionPool(ctrl)
@@ -421,6 +446,34 @@ func TestRemoteServiceHandleRPCSys(t *testing.T) {
 	}
 }
 
+func TestRemoteServiceHandleRPCSysClientSerializer(t *testing.T) {
+	tObj := &TestType{}
+	m, ok := reflect.TypeOf(tObj).MethodByName("HandlerPointerRaw")
+	assert.True(t, ok)
+	rt := route.NewRoute("", uuid.New().String(), uuid.New().String())
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	appSerializer := serializemocks.NewMockSerializer(ctrl)
+	clientSerializer := serializemocks.NewMockSerializer(ctrl)
+	clientSerializer.EXPECT().GetName().Return("xml").AnyTimes()
+	clientSerializer.EXPECT().Unmarshal([]byte("ok"), gomock.Any()).Return(nil)
+
+	handlerPool := NewHandlerPool()
+	handlerPool.handlers[rt.Short()] = &component.Handler{Receiver: reflect.ValueOf(tObj), Method: m, Type: m.Type.In(2)}
+	svc := NewRemoteService(nil, nil, nil, codec.NewPomeloPacketEncoder(), appSerializer, router.New(), message.NewMessagesEncoder(false), &cluster.Server{}, session.NewSessionPool(), pipeline.NewHandlerHooks(), handlerPool)
+
+	ctx := pcontext.AddToPropagateCtx(context.Background(), constants.SerializerKey, "xml")
+	req := &protos.Request{Msg: &protos.Msg{Data: []byte("ok")}}
+	res := svc.handleRPCSys(ctx, req, rt)
+	assert.Equal(t, constants.ErrUnknownSerializer.Error(), res.Error.GetMsg())
+
+	svc.AddSerializer(clientSerializer)
+	res = svc.handleRPCSys(ctx, req, rt)
+	assert.Nil(t, res.Error)
+	assert.Equal(t, []byte("ok"), res.Data)
+}
+
 func TestRemoteServiceRemoteProcess(t *testing.T) {
 	sv := &cluster.Server{}
 	rt := route.NewRoute("sv", "svc", "method")
@@ -462,6 +515,8 @@ func TestRemoteServiceRemoteProcess(t *testing.T) {
 
 			mockAgent := agentmocks.NewMockAgent(ctrl)
 			mockAgent.EXPECT().GetSession().Return(mockSession).AnyTimes()
+			mockAgent.EXPECT().GetSerializer().Return(mockSerializer)
+			mockSerializer.EXPECT().GetName().Return("json").AnyTimes()
 
 			mockRPCClient.EXPECT().Call(ctx, protos.RPCType_Sys, rt, gomock.Any(), expectedMsg, gomock.Any()).Return(&protos.Response{Data: []byte("ok")}, table.remoteCallErr)
 
@@ -481,6 +536,28 @@ func TestRemoteServiceRemoteProcess(t *testing.T) {
 	}
 }
 
+func TestRemoteServiceRemoteProcessSendsClientSerializer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sv := &cluster.Server{}
+	rt := route.NewRoute("sv", "svc", "method")
+	msg := &message.Message{Type: message.Notify, Route: rt.Short(), Data: []byte("ok")}
+
+	mockAgent := agentmocks.NewMockAgent(ctrl)
+	mockAgent.EXPECT().GetSession().Return(sessionmocks.NewMockSession(ctrl)).AnyTimes()
+	mockAgent.EXPECT().GetSerializer().Return(protobuf.NewSerializer())
+	mockRPCClient := clustermocks.NewMockRPCClient(ctrl)
+	mockRPCClient.EXPECT().Call(gomock.Any(), protos.RPCType_Sys, rt, gomock.Any(), msg, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, rpcType protos.RPCType, route *route.Route, session session.Session, msg *message.Message, server *cluster.Server) (*protos.Response, error) {
+			assert.Equal(t, "protobuf", pcontext.GetFromPropagateCtx(ctx, constants.SerializerKey))
+			return &protos.Response{}, nil
+		})
+
+	svc := NewRemoteService(mockRPCClient, nil, nil, codec.NewPomeloPacketEncoder(), json.NewSerializer(), router.New(), message.NewMessagesEncoder(false), &cluster.Server{}, session.NewSessionPool(), pipeline.NewHandlerHooks(), nil)
+	svc.remoteProcess(context.Background(), sv, mockAgent, rt, msg)
+}
+
 func TestRemoteServiceRPC(t *testing.T) {
 	rt := route.NewRoute("sv", "svc", "method")
 	tables := []struct {
@@ -0,0 +1,140 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ResponseCacheKeyFunc returns the key the response to a request is cached
+// under, from the request context and payload, e.g. the locale of the client
+// for a catalog route. Requests whose key is empty are not cached
+type ResponseCacheKeyFunc func(ctx context.Context, data []byte) string
+
+// ResponseCache configures the caching of the responses of a route, the
+// responses are cached for TTL under the key returned by Key, or a single
+// response is cached for every client if Key is nil
+type ResponseCache struct {
+	TTL time.Duration
+	Key ResponseCacheKeyFunc
+}
+
+// responseCaches holds the cached responses of the routes with a cache
+type responseCaches struct {
+	sync.Mutex
+	caches    map[string]ResponseCache
+	entries   map[responseCacheKey]cachedResponse
+	nextSweep time.Time
+}
+
+type responseCacheKey struct {
+	route      string
+	serializer string // responses are cached already serialized
+	key        string
+}
+
+type cachedResponse struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+func newResponseCaches(caches map[string]ResponseCache) *responseCaches {
+	return &responseCaches{
+		caches:  caches,
+		entries: map[responseCacheKey]cachedResponse{},
+	}
+}
+
+// key returns the key the response to a request to route is cached under and
+// whether it is cached at all
+func (c *responseCaches) key(ctx context.Context, route, serializer string, data []byte) (responseCacheKey, bool) {
+	cache, ok := c.caches[route]
+	if !ok || cache.TTL <= 0 {
+		return responseCacheKey{}, false
+	}
+	key := responseCacheKey{route: route, serializer: serializer}
+	if cache.Key != nil {
+		key.key = cache.Key(ctx, data)
+		if key.key == "" {
+			return responseCacheKey{}, false
+		}
+	}
+	return key, true
+}
+
+// get returns the response cached under key if it did not expire at now
+func (c *responseCaches) get(key responseCacheKey, now time.Time) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.data, true
+}
+
+// set caches data under key until the route TTL elapses, dropping the
+// expired responses of every route at most once per TTL
+func (c *responseCaches) set(key responseCacheKey, data []byte, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	ttl := c.caches[key.route].TTL
+	if !now.Before(c.nextSweep) {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(ttl)
+	}
+	c.entries[key] = cachedResponse{data: data, expiresAt: now.Add(ttl)}
+}
+
+// invalidate drops the responses of route cached under keys, or every
+// response of route if no key is given
+func (c *responseCaches) invalidate(route string, keys ...string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(keys) == 0 {
+		for k := range c.entries {
+			if k.route == route {
+				delete(c.entries, k)
+			}
+		}
+		return
+	}
+	for _, key := range keys {
+		for k := range c.entries {
+			if k.route == route && k.key == key {
+				delete(c.entries, k)
+			}
+		}
+	}
+}
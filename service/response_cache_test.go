@@ -0,0 +1,119 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseCachesKey(t *testing.T) {
+	caches := newResponseCaches(map[string]ResponseCache{
+		"shop.catalog": {TTL: time.Minute, Key: func(ctx context.Context, data []byte) string { return string(data) }},
+		"shop.banner":  {TTL: time.Minute},
+		"shop.offers":  {},
+	})
+	ctx := context.Background()
+
+	key, ok := caches.key(ctx, "shop.catalog", "json", []byte("en"))
+	assert.True(t, ok)
+	assert.Equal(t, responseCacheKey{route: "shop.catalog", serializer: "json", key: "en"}, key)
+
+	// requests with an empty key are not cached
+	_, ok = caches.key(ctx, "shop.catalog", "json", nil)
+	assert.False(t, ok)
+
+	// without a key func a single response is cached for every client
+	key, ok = caches.key(ctx, "shop.banner", "json", []byte("en"))
+	assert.True(t, ok)
+	assert.Equal(t, responseCacheKey{route: "shop.banner", serializer: "json"}, key)
+
+	_, ok = caches.key(ctx, "shop.offers", "json", nil)
+	assert.False(t, ok)
+	_, ok = caches.key(ctx, "shop.buy", "json", nil)
+	assert.False(t, ok)
+}
+
+func TestResponseCachesGetSet(t *testing.T) {
+	caches := newResponseCaches(map[string]ResponseCache{
+		"shop.catalog": {TTL: time.Minute},
+	})
+	key := responseCacheKey{route: "shop.catalog", serializer: "json"}
+	now := time.Now()
+
+	_, ok := caches.get(key, now)
+	assert.False(t, ok)
+
+	caches.set(key, []byte("catalog"), now)
+	data, ok := caches.get(key, now.Add(59*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("catalog"), data)
+
+	// responses are cached per serializer
+	_, ok = caches.get(responseCacheKey{route: "shop.catalog", serializer: "protos"}, now)
+	assert.False(t, ok)
+
+	_, ok = caches.get(key, now.Add(time.Minute))
+	assert.False(t, ok)
+	assert.Empty(t, caches.entries)
+}
+
+func TestResponseCachesSetSweepsExpired(t *testing.T) {
+	caches := newResponseCaches(map[string]ResponseCache{
+		"shop.catalog": {TTL: time.Minute, Key: func(ctx context.Context, data []byte) string { return string(data) }},
+	})
+	now := time.Now()
+
+	caches.set(responseCacheKey{route: "shop.catalog", key: "en"}, []byte("en"), now)
+	caches.set(responseCacheKey{route: "shop.catalog", key: "pt"}, []byte("pt"), now.Add(30*time.Second))
+	assert.Len(t, caches.entries, 2)
+
+	caches.set(responseCacheKey{route: "shop.catalog", key: "es"}, []byte("es"), now.Add(time.Minute))
+	assert.Len(t, caches.entries, 2)
+	assert.NotContains(t, caches.entries, responseCacheKey{route: "shop.catalog", key: "en"})
+}
+
+func TestResponseCachesInvalidate(t *testing.T) {
+	caches := newResponseCaches(map[string]ResponseCache{
+		"shop.catalog": {TTL: time.Minute},
+		"shop.banner":  {TTL: time.Minute},
+	})
+	now := time.Now()
+
+	caches.set(responseCacheKey{route: "shop.catalog", key: "en"}, []byte("en"), now)
+	caches.set(responseCacheKey{route: "shop.catalog", key: "pt"}, []byte("pt"), now)
+	caches.set(responseCacheKey{route: "shop.banner"}, []byte("banner"), now)
+
+	caches.invalidate("shop.catalog", "pt")
+	_, ok := caches.get(responseCacheKey{route: "shop.catalog", key: "pt"}, now)
+	assert.False(t, ok)
+	_, ok = caches.get(responseCacheKey{route: "shop.catalog", key: "en"}, now)
+	assert.True(t, ok)
+
+	caches.invalidate("shop.catalog")
+	_, ok = caches.get(responseCacheKey{route: "shop.catalog", key: "en"}, now)
+	assert.False(t, ok)
+	_, ok = caches.get(responseCacheKey{route: "shop.banner"}, now)
+	assert.True(t, ok)
+}
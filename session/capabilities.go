@@ -0,0 +1,64 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import "time"
+
+// Capabilities is the feature set negotiated with the client on the
+// handshake, for handlers to tailor their behavior to what the client
+// supports
+type Capabilities struct {
+	// Serializer is the name of the serializer of the messages
+	Serializer string
+	// Compression is whether the messages data is compressed
+	Compression bool
+	// Encryption is whether the connection is over TLS
+	Encryption bool
+	// ProtocolVersion is the protocol version the client declared, if any
+	ProtocolVersion string
+	// Subprotocol is the websocket subprotocol agreed with the client, if any
+	Subprotocol string
+	// HeartbeatInterval is the heartbeat interval agreed with the client
+	HeartbeatInterval time.Duration
+	// FlowControl is whether the client grants credit for the messages it
+	// receives
+	FlowControl bool
+	// TimestampedHeartbeat is whether the heartbeats carry their send time
+	// stamp for the client to echo
+	TimestampedHeartbeat bool
+}
+
+// capabilitiesProvider is implemented by network entities that know the
+// capabilities negotiated with their client
+type capabilitiesProvider interface {
+	Capabilities() Capabilities
+}
+
+// Capabilities returns the capabilities negotiated with the client. They are
+// read from the connection every time, so they reflect changes made after
+// the handshake, e.g. the client granting credit. It is the zero value on
+// backend sessions
+func (s *sessionImpl) Capabilities() Capabilities {
+	if p, ok := s.entity.(capabilitiesProvider); ok {
+		return p.Capabilities()
+	}
+	return Capabilities{}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"encoding/json"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// DataCodec encodes and decodes session data so it can be migrated
+// between servers or persisted in a consistent format
+type DataCodec interface {
+	Encode(data map[string]interface{}) ([]byte, error)
+	Decode(encoded []byte) (map[string]interface{}, error)
+}
+
+// JSONDataCodec encodes session data as json
+type JSONDataCodec struct{}
+
+// NewJSONDataCodec returns a new JSONDataCodec
+func NewJSONDataCodec() *JSONDataCodec {
+	return &JSONDataCodec{}
+}
+
+// Encode encodes data as json
+func (c *JSONDataCodec) Encode(data map[string]interface{}) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+// Decode decodes json encoded data
+func (c *JSONDataCodec) Decode(encoded []byte) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal(encoded, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ProtobufDataCodec encodes session data as a google.protobuf.Struct
+type ProtobufDataCodec struct{}
+
+// NewProtobufDataCodec returns a new ProtobufDataCodec
+func NewProtobufDataCodec() *ProtobufDataCodec {
+	return &ProtobufDataCodec{}
+}
+
+// Encode encodes data as a google.protobuf.Struct, numbers are
+// encoded as doubles like in json
+func (c *ProtobufDataCodec) Encode(data map[string]interface{}) ([]byte, error) {
+	s, err := structpb.NewStruct(data)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(s)
+}
+
+// Decode decodes data encoded as a google.protobuf.Struct
+func (c *ProtobufDataCodec) Decode(encoded []byte) (map[string]interface{}, error) {
+	s := &structpb.Struct{}
+	if err := proto.Unmarshal(encoded, s); err != nil {
+		return nil, err
+	}
+	return s.AsMap(), nil
+}
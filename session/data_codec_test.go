@@ -0,0 +1,92 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var complexSessionData = map[string]interface{}{
+	"name":   "player",
+	"level":  float64(42),
+	"active": true,
+	"guild":  nil,
+	"inventory": []interface{}{
+		map[string]interface{}{"item": "sword", "count": float64(1)},
+		map[string]interface{}{"item": "potion", "count": float64(5), "tags": []interface{}{"heal", "small"}},
+	},
+	"position": map[string]interface{}{
+		"x": 1.5,
+		"y": -2.25,
+		"map": map[string]interface{}{
+			"id":    "forest",
+			"layer": float64(3),
+		},
+	},
+}
+
+func TestDataCodecRoundTrip(t *testing.T) {
+	tables := []struct {
+		name  string
+		codec DataCodec
+	}{
+		{"json", NewJSONDataCodec()},
+		{"protobuf", NewProtobufDataCodec()},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			encoded, err := table.codec.Encode(complexSessionData)
+			assert.NoError(t, err)
+
+			decoded, err := table.codec.Decode(encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, complexSessionData, decoded)
+		})
+	}
+}
+
+func TestDataCodecDecodeInvalidData(t *testing.T) {
+	tables := []struct {
+		name  string
+		codec DataCodec
+	}{
+		{"json", NewJSONDataCodec()},
+		{"protobuf", NewProtobufDataCodec()},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			decoded, err := table.codec.Decode([]byte{0xff, 0x01, 0x02})
+			assert.Error(t, err)
+			assert.Nil(t, decoded)
+		})
+	}
+}
+
+func TestProtobufDataCodecEncodeInvalidData(t *testing.T) {
+	codec := NewProtobufDataCodec()
+	encoded, err := codec.Encode(map[string]interface{}{"invalid": struct{}{}})
+	assert.Error(t, err)
+	assert.Nil(t, encoded)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import "bytes"
+
+// DedupPushes makes the pushes sent on route to the client of the session be
+// skipped when their payload is byte-identical to the previous push on that
+// route, for routes that push the same state over and over. Routes whose
+// every push matters, such as events, must not be deduped. It only has
+// effect on frontend sessions
+func (s *sessionImpl) DedupPushes(route string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.dedupedPushes == nil {
+		s.dedupedPushes = map[string][]byte{}
+	}
+	if _, ok := s.dedupedPushes[route]; !ok {
+		s.dedupedPushes[route] = nil
+	}
+}
+
+// StopDedupPushes makes every push on route be sent again
+func (s *sessionImpl) StopDedupPushes(route string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.dedupedPushes, route)
+}
+
+// IsDuplicatePush reports whether a push of payload on route must be skipped
+// for being identical to the previous one, remembering payload otherwise. It
+// is always false for the routes not deduped
+func (s *sessionImpl) IsDuplicatePush(route string, payload []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	last, ok := s.dedupedPushes[route]
+	if !ok {
+		return false
+	}
+	if last != nil && bytes.Equal(last, payload) {
+		return true
+	}
+	s.dedupedPushes[route] = append(make([]byte, 0, len(payload)), payload...)
+	return false
+}
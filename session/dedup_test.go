@@ -0,0 +1,57 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsDuplicatePush(t *testing.T) {
+	t.Parallel()
+
+	ss := NewSessionPool().NewSession(nil, true)
+	assert.False(t, ss.IsDuplicatePush("room.state", []byte("s1")))
+	assert.False(t, ss.IsDuplicatePush("room.state", []byte("s1")))
+
+	ss.DedupPushes("room.state")
+	ss.DedupPushes("room.empty")
+	assert.False(t, ss.IsDuplicatePush("room.state", []byte("s1")))
+	assert.True(t, ss.IsDuplicatePush("room.state", []byte("s1")))
+	assert.False(t, ss.IsDuplicatePush("room.other", []byte("s1")))
+	assert.False(t, ss.IsDuplicatePush("room.other", []byte("s1")))
+	assert.False(t, ss.IsDuplicatePush("room.empty", []byte{}))
+	assert.True(t, ss.IsDuplicatePush("room.empty", nil))
+
+	payload := []byte("s2")
+	assert.False(t, ss.IsDuplicatePush("room.state", payload))
+	payload[1] = '1'
+	assert.False(t, ss.IsDuplicatePush("room.state", payload))
+
+	// enabling again keeps the last payload
+	ss.DedupPushes("room.state")
+	assert.True(t, ss.IsDuplicatePush("room.state", []byte("s1")))
+
+	ss.StopDedupPushes("room.state")
+	assert.False(t, ss.IsDuplicatePush("room.state", []byte("s1")))
+	assert.False(t, ss.IsDuplicatePush("room.state", []byte("s1")))
+}
@@ -0,0 +1,86 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+// Reasons for which the server closes the connection of a client
+const (
+	// DisconnectReasonClosed is the reason of the sessions closed by the
+	// server application, e.g. kicked or closed on shutdown
+	DisconnectReasonClosed = "closed"
+	// DisconnectReasonConnectionClosed is the reason of the sessions whose
+	// client closed the connection
+	DisconnectReasonConnectionClosed = "connection_closed"
+	// DisconnectReasonReadError is the reason of the sessions whose connection
+	// failed to be read
+	DisconnectReasonReadError = "read_error"
+	// DisconnectReasonProtocolError is the reason of the sessions whose client
+	// sent invalid packets
+	DisconnectReasonProtocolError = "protocol_error"
+	// DisconnectReasonOverCapacity is the reason of the sessions told to
+	// retry later because the server is over its soft capacity
+	DisconnectReasonOverCapacity = "over_capacity"
+	// DisconnectReasonMaintenance is the reason of the sessions rejected
+	// because they connected during a maintenance window of the server
+	DisconnectReasonMaintenance = "maintenance"
+	// DisconnectReasonHeartbeatTimeout is the reason of the sessions whose
+	// client stopped answering heartbeats
+	DisconnectReasonHeartbeatTimeout = "heartbeat_timeout"
+	// DisconnectReasonWriteError is the reason of the sessions whose
+	// connection failed to be written
+	DisconnectReasonWriteError = "write_error"
+	// DisconnectReasonWriteTimeout is the reason of the sessions whose
+	// connection took too long to be written
+	DisconnectReasonWriteTimeout = "write_timeout"
+	// DisconnectReasonCreditTimeout is the reason of the sessions whose client
+	// took too long to grant flow control credit
+	DisconnectReasonCreditTimeout = "credit_timeout"
+	// DisconnectReasonReadTimeout is the reason of the sessions whose client
+	// started sending a packet and stalled before finishing it
+	DisconnectReasonReadTimeout = "read_timeout"
+	// DisconnectReasonRateLimited is the reason of the sessions whose client
+	// sent data packets over the packet rate limit of its acceptor
+	DisconnectReasonRateLimited = "rate_limited"
+)
+
+// DisconnectReason tells why the client of a session disconnected
+type DisconnectReason struct {
+	// Server is the reason the server closed the connection for, it is empty
+	// while the session is open
+	Server string
+	// Client is the reason the client reported before closing the
+	// connection, e.g. logout, it is empty if the client did not report one
+	Client string
+}
+
+// disconnectReasonProvider is implemented by network entities that know why
+// their client disconnected
+type disconnectReasonProvider interface {
+	DisconnectReason() DisconnectReason
+}
+
+// DisconnectReason returns why the client of the session disconnected, for
+// the session close callbacks. It is the zero value on backend sessions
+func (s *sessionImpl) DisconnectReason() DisconnectReason {
+	if p, ok := s.entity.(disconnectReasonProvider); ok {
+		return p.DisconnectReason()
+	}
+	return DisconnectReason{}
+}
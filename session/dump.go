@@ -0,0 +1,111 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/networkentity"
+)
+
+// Snapshot is the state of a session at the time of a dump, the values of
+// the session data are left out since they may hold sensitive information
+type Snapshot struct {
+	ID           int64      `json:"id"`
+	UID          string     `json:"uid"`
+	Frontend     bool       `json:"frontend"`
+	DataKeys     []string   `json:"dataKeys"`
+	RemoteAddr   string     `json:"remoteAddr,omitempty"`
+	Status       string     `json:"status,omitempty"`
+	LastActivity *time.Time `json:"lastActivity,omitempty"`
+}
+
+// DumpSessions writes a snapshot of every session in the pool to w, one JSON
+// object per line sorted by session ID. Sessions are snapshotted one at a
+// time, so it can be called under load without blocking the pool
+func (pool *sessionPoolImpl) DumpSessions(w io.Writer) error {
+	var snapshots []*Snapshot
+	pool.sessionsByID.Range(func(_, value interface{}) bool {
+		if s, ok := value.(*sessionImpl); ok {
+			snapshots = append(snapshots, s.snapshot())
+		}
+		return true
+	})
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID < snapshots[j].ID
+	})
+
+	encoder := json.NewEncoder(w)
+	for _, snapshot := range snapshots {
+		if err := encoder.Encode(snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sessionImpl) snapshot() *Snapshot {
+	s.RLock()
+	snapshot := &Snapshot{
+		ID:       s.id,
+		UID:      s.uid,
+		Frontend: s.IsFrontend,
+		DataKeys: make([]string, 0, len(s.data)),
+	}
+	for k := range s.data {
+		snapshot.DataKeys = append(snapshot.DataKeys, k)
+	}
+	entity := s.entity
+	s.RUnlock()
+	sort.Strings(snapshot.DataKeys)
+
+	if entity == nil {
+		return snapshot
+	}
+	if addr := entity.RemoteAddr(); addr != nil {
+		snapshot.RemoteAddr = addr.String()
+	}
+	if reporter, ok := entity.(networkentity.StatusReporter); ok {
+		snapshot.Status = statusName(reporter.GetStatus())
+		lastActivity := reporter.LastActivity()
+		snapshot.LastActivity = &lastActivity
+	}
+	return snapshot
+}
+
+func statusName(status int32) string {
+	switch status {
+	case constants.StatusStart:
+		return "start"
+	case constants.StatusHandshake:
+		return "handshake"
+	case constants.StatusWorking:
+		return "working"
+	case constants.StatusClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
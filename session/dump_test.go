@@ -0,0 +1,121 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/networkentity/mocks"
+)
+
+type statusEntity struct {
+	*mocks.MockNetworkEntity
+	status       int32
+	lastActivity time.Time
+}
+
+func (e *statusEntity) GetStatus() int32 {
+	return e.status
+}
+
+func (e *statusEntity) LastActivity() time.Time {
+	return e.lastActivity
+}
+
+func TestDumpSessions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lastActivity := time.Unix(1600000000, 0).UTC()
+	entity := &statusEntity{
+		MockNetworkEntity: mocks.NewMockNetworkEntity(ctrl),
+		status:            constants.StatusWorking,
+		lastActivity:      lastActivity,
+	}
+	entity.EXPECT().RemoteAddr().Return(&mockAddr{}).AnyTimes()
+	plainEntity := mocks.NewMockNetworkEntity(ctrl)
+	plainEntity.EXPECT().RemoteAddr().Return(nil).AnyTimes()
+	plainEntity.EXPECT().Close().AnyTimes()
+
+	sessionPool := NewSessionPool()
+	bound := sessionPool.NewSession(entity, true)
+	assert.NoError(t, bound.Bind(context.Background(), "uid1"))
+	assert.NoError(t, bound.Set("level", 3))
+	assert.NoError(t, bound.Set("coins", 10))
+	anonymous := sessionPool.NewSession(plainEntity, true)
+	closed := sessionPool.NewSession(plainEntity, true)
+	closed.Close()
+
+	var buf bytes.Buffer
+	err := sessionPool.DumpSessions(&buf)
+	assert.NoError(t, err)
+
+	var snapshots []Snapshot
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var snapshot Snapshot
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &snapshot))
+		snapshots = append(snapshots, snapshot)
+	}
+
+	assert.Equal(t, []Snapshot{
+		{
+			ID:           bound.ID(),
+			UID:          "uid1",
+			Frontend:     true,
+			DataKeys:     []string{"coins", "level"},
+			RemoteAddr:   "192.0.2.1:25",
+			Status:       "working",
+			LastActivity: &lastActivity,
+		},
+		{
+			ID:       anonymous.ID(),
+			Frontend: true,
+			DataKeys: []string{},
+		},
+	}, snapshots)
+}
+
+func TestDumpSessionsWhileSessionsChange(t *testing.T) {
+	sessionPool := NewSessionPool()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s := sessionPool.NewSession(nil, false)
+			s.Set("key", i)
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		assert.NoError(t, sessionPool.DumpSessions(&buf))
+	}
+	<-done
+}
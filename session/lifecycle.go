@@ -0,0 +1,79 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"time"
+)
+
+// LifecycleEventType is the type of a session lifecycle event
+type LifecycleEventType string
+
+const (
+	// LifecycleEventConnect is published when the frontend server accepts the
+	// handshake of a client
+	LifecycleEventConnect LifecycleEventType = "connect"
+	// LifecycleEventBind is published when a session is bound to an UID
+	LifecycleEventBind LifecycleEventType = "bind"
+	// LifecycleEventUnbind is published when a bound session releases its UID,
+	// which happens when it is closed
+	LifecycleEventUnbind LifecycleEventType = "unbind"
+	// LifecycleEventClose is published when a session that published the
+	// connect event is closed
+	LifecycleEventClose LifecycleEventType = "close"
+)
+
+// LifecycleEvent holds the session metadata at the moment of a lifecycle event
+type LifecycleEvent struct {
+	Type          LifecycleEventType
+	Timestamp     time.Time
+	SessionID     int64
+	UID           string
+	HandshakeData *HandshakeData
+}
+
+// LifecycleEventSink receives the lifecycle events of the frontend sessions,
+// e.g. for publishing them to a message bus. Publish is called synchronously
+// from the session operations so it must not block
+type LifecycleEventSink interface {
+	Publish(event *LifecycleEvent)
+}
+
+// noopLifecycleEventSink is the default sink, it discards all events
+type noopLifecycleEventSink struct{}
+
+// Publish discards the event
+func (noopLifecycleEventSink) Publish(event *LifecycleEvent) {}
+
+// publishLifecycleEvent publishes an event of type typ for s, only frontend
+// sessions publish events since backend sessions are copies of them
+func (s *sessionImpl) publishLifecycleEvent(typ LifecycleEventType) {
+	if !s.IsFrontend {
+		return
+	}
+	s.pool.lifecycleSink.Publish(&LifecycleEvent{
+		Type:          typ,
+		Timestamp:     time.Now(),
+		SessionID:     s.ID(),
+		UID:           s.UID(),
+		HandshakeData: s.GetHandshakeData(),
+	})
+}
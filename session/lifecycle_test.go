@@ -0,0 +1,127 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/networkentity/mocks"
+)
+
+type fakeLifecycleEventSink struct {
+	events []*LifecycleEvent
+}
+
+func (f *fakeLifecycleEventSink) Publish(event *LifecycleEvent) {
+	f.events = append(f.events, event)
+}
+
+func TestSessionLifecycleEvents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sink := &fakeLifecycleEventSink{}
+	sessionPool := NewSessionPool()
+	sessionPool.SetLifecycleEventSink(sink)
+
+	mockEntity := mocks.NewMockNetworkEntity(ctrl)
+	ss := sessionPool.NewSession(mockEntity, true)
+	handshakeData := &HandshakeData{Sys: HandshakeClientData{Platform: "mac"}}
+	ss.SetHandshakeData(handshakeData)
+	err := ss.Bind(context.Background(), "uid")
+	assert.NoError(t, err)
+	mockEntity.EXPECT().Close()
+	ss.Close()
+
+	expected := []struct {
+		typ           LifecycleEventType
+		uid           string
+		handshakeData *HandshakeData
+	}{
+		{LifecycleEventConnect, "", handshakeData},
+		{LifecycleEventBind, "uid", handshakeData},
+		{LifecycleEventUnbind, "uid", handshakeData},
+		{LifecycleEventClose, "uid", handshakeData},
+	}
+	assert.Len(t, sink.events, len(expected))
+	for i, event := range sink.events {
+		assert.Equal(t, expected[i].typ, event.Type)
+		assert.Equal(t, expected[i].uid, event.UID)
+		assert.Equal(t, expected[i].handshakeData, event.HandshakeData)
+		assert.Equal(t, ss.ID(), event.SessionID)
+		assert.False(t, event.Timestamp.IsZero())
+	}
+}
+
+func TestSessionLifecycleEventsUnboundClose(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sink := &fakeLifecycleEventSink{}
+	sessionPool := NewSessionPool()
+	sessionPool.SetLifecycleEventSink(sink)
+
+	mockEntity := mocks.NewMockNetworkEntity(ctrl)
+	ss := sessionPool.NewSession(mockEntity, true)
+	ss.SetHandshakeData(&HandshakeData{})
+	ss.SetHandshakeData(&HandshakeData{})
+	mockEntity.EXPECT().Close()
+	ss.Close()
+
+	assert.Len(t, sink.events, 2)
+	assert.Equal(t, LifecycleEventConnect, sink.events[0].Type)
+	assert.Equal(t, LifecycleEventClose, sink.events[1].Type)
+}
+
+func TestSessionLifecycleEventsNotPublishedWithoutHandshake(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sink := &fakeLifecycleEventSink{}
+	sessionPool := NewSessionPool()
+	sessionPool.SetLifecycleEventSink(sink)
+
+	// e.g. a client told to retry later because the server is over capacity
+	mockEntity := mocks.NewMockNetworkEntity(ctrl)
+	ss := sessionPool.NewSession(mockEntity, true)
+	mockEntity.EXPECT().Close()
+	ss.Close()
+
+	assert.Empty(t, sink.events)
+}
+
+func TestSessionLifecycleEventsNotPublishedByBackendSessions(t *testing.T) {
+	sink := &fakeLifecycleEventSink{}
+	sessionPool := NewSessionPool()
+	sessionPool.SetLifecycleEventSink(sink)
+
+	sessionPool.NewSession(nil, false, "uid")
+	assert.Empty(t, sink.events)
+}
+
+func TestSetLifecycleEventSinkNil(t *testing.T) {
+	sessionPool := NewSessionPool().(*sessionPoolImpl)
+	sessionPool.SetLifecycleEventSink(nil)
+	assert.Equal(t, noopLifecycleEventSink{}, sessionPool.lifecycleSink)
+}
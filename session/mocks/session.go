@@ -9,9 +9,12 @@ import (
 	gomock "github.com/golang/mock/gomock"
 	nats "github.com/nats-io/nats.go"
 	networkentity "github.com/topfreegames/pitaya/v2/networkentity"
+	serialize "github.com/topfreegames/pitaya/v2/serialize"
 	session "github.com/topfreegames/pitaya/v2/session"
+	io "io"
 	net "net"
 	reflect "reflect"
+	time "time"
 )
 
 // MockSession is a mock of Session interface
@@ -37,6 +40,33 @@ func (m *MockSession) EXPECT() *MockSessionMockRecorder {
 	return m.recorder
 }
 
+// AddOutboundTransform mocks base method
+func (m *MockSession) AddOutboundTransform(arg0 string, arg1 session.OutboundTransform) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "AddOutboundTransform", arg0, arg1)
+}
+
+// AddOutboundTransform indicates an expected call of AddOutboundTransform
+func (mr *MockSessionMockRecorder) AddOutboundTransform(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddOutboundTransform", reflect.TypeOf((*MockSession)(nil).AddOutboundTransform), arg0, arg1)
+}
+
+// ApplyOutboundTransforms mocks base method
+func (m *MockSession) ApplyOutboundTransforms(arg0 string, arg1 []byte) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ApplyOutboundTransforms", arg0, arg1)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ApplyOutboundTransforms indicates an expected call of ApplyOutboundTransforms
+func (mr *MockSessionMockRecorder) ApplyOutboundTransforms(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ApplyOutboundTransforms", reflect.TypeOf((*MockSession)(nil).ApplyOutboundTransforms), arg0, arg1)
+}
+
 // Bind mocks base method
 func (m *MockSession) Bind(arg0 context.Context, arg1 string) error {
 	m.ctrl.T.Helper()
@@ -51,6 +81,20 @@ func (mr *MockSessionMockRecorder) Bind(arg0, arg1 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Bind", reflect.TypeOf((*MockSession)(nil).Bind), arg0, arg1)
 }
 
+// Capabilities mocks base method
+func (m *MockSession) Capabilities() session.Capabilities {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Capabilities")
+	ret0, _ := ret[0].(session.Capabilities)
+	return ret0
+}
+
+// Capabilities indicates an expected call of Capabilities
+func (mr *MockSessionMockRecorder) Capabilities() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Capabilities", reflect.TypeOf((*MockSession)(nil).Capabilities))
+}
+
 // Clear mocks base method
 func (m *MockSession) Clear() {
 	m.ctrl.T.Helper()
@@ -75,6 +119,47 @@ func (mr *MockSessionMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockSession)(nil).Close))
 }
 
+// DedupPushes mocks base method
+func (m *MockSession) DedupPushes(arg0 string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "DedupPushes", arg0)
+}
+
+// DedupPushes indicates an expected call of DedupPushes
+func (mr *MockSessionMockRecorder) DedupPushes(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DedupPushes", reflect.TypeOf((*MockSession)(nil).DedupPushes), arg0)
+}
+
+// DisconnectReason mocks base method
+func (m *MockSession) DisconnectReason() session.DisconnectReason {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DisconnectReason")
+	ret0, _ := ret[0].(session.DisconnectReason)
+	return ret0
+}
+
+// DisconnectReason indicates an expected call of DisconnectReason
+func (mr *MockSessionMockRecorder) DisconnectReason() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DisconnectReason", reflect.TypeOf((*MockSession)(nil).DisconnectReason))
+}
+
+// ExportData mocks base method
+func (m *MockSession) ExportData() ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExportData")
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExportData indicates an expected call of ExportData
+func (mr *MockSessionMockRecorder) ExportData() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExportData", reflect.TypeOf((*MockSession)(nil).ExportData))
+}
+
 // Float32 mocks base method
 func (m *MockSession) Float32(arg0 string) float32 {
 	m.ctrl.T.Helper()
@@ -103,6 +188,20 @@ func (mr *MockSessionMockRecorder) Float64(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Float64", reflect.TypeOf((*MockSession)(nil).Float64), arg0)
 }
 
+// Flush mocks base method
+func (m *MockSession) Flush(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Flush", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Flush indicates an expected call of Flush
+func (mr *MockSessionMockRecorder) Flush(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Flush", reflect.TypeOf((*MockSession)(nil).Flush), arg0)
+}
+
 // Get mocks base method
 func (m *MockSession) Get(arg0 string) interface{} {
 	m.ctrl.T.Helper()
@@ -229,6 +328,20 @@ func (mr *MockSessionMockRecorder) ID() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ID", reflect.TypeOf((*MockSession)(nil).ID))
 }
 
+// ImportData mocks base method
+func (m *MockSession) ImportData(arg0 []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ImportData", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ImportData indicates an expected call of ImportData
+func (mr *MockSessionMockRecorder) ImportData(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ImportData", reflect.TypeOf((*MockSession)(nil).ImportData), arg0)
+}
+
 // Int mocks base method
 func (m *MockSession) Int(arg0 string) int {
 	m.ctrl.T.Helper()
@@ -299,6 +412,20 @@ func (mr *MockSessionMockRecorder) Int8(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Int8", reflect.TypeOf((*MockSession)(nil).Int8), arg0)
 }
 
+// IsDuplicatePush mocks base method
+func (m *MockSession) IsDuplicatePush(arg0 string, arg1 []byte) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsDuplicatePush", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsDuplicatePush indicates an expected call of IsDuplicatePush
+func (mr *MockSessionMockRecorder) IsDuplicatePush(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsDuplicatePush", reflect.TypeOf((*MockSession)(nil).IsDuplicatePush), arg0, arg1)
+}
+
 // Kick mocks base method
 func (m *MockSession) Kick(arg0 context.Context) error {
 	m.ctrl.T.Helper()
@@ -341,7 +468,20 @@ func (mr *MockSessionMockRecorder) Push(arg0, arg1 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Push", reflect.TypeOf((*MockSession)(nil).Push), arg0, arg1)
 }
 
-// PushToFront mocks base method
+// PushWith mocks base method
+func (m *MockSession) PushWith(arg0 context.Context, arg1 serialize.Serializer, arg2 string, arg3 interface{}) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PushWith", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PushWith indicates an expected call of PushWith
+func (mr *MockSessionMockRecorder) PushWith(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushWith", reflect.TypeOf((*MockSession)(nil).PushWith), arg0, arg1, arg2, arg3)
+}
+
 func (m *MockSession) PushToFront(arg0 context.Context) error {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "PushToFront", arg0)
@@ -369,6 +509,34 @@ func (mr *MockSessionMockRecorder) RemoteAddr() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoteAddr", reflect.TypeOf((*MockSession)(nil).RemoteAddr))
 }
 
+// RemoteIP mocks base method
+func (m *MockSession) RemoteIP() net.IP {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoteIP")
+	ret0, _ := ret[0].(net.IP)
+	return ret0
+}
+
+// RemoteIP indicates an expected call of RemoteIP
+func (mr *MockSessionMockRecorder) RemoteIP() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoteIP", reflect.TypeOf((*MockSession)(nil).RemoteIP))
+}
+
+// RemotePort mocks base method
+func (m *MockSession) RemotePort() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemotePort")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// RemotePort indicates an expected call of RemotePort
+func (mr *MockSessionMockRecorder) RemotePort() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemotePort", reflect.TypeOf((*MockSession)(nil).RemotePort))
+}
+
 // Remove mocks base method
 func (m *MockSession) Remove(arg0 string) error {
 	m.ctrl.T.Helper()
@@ -383,6 +551,18 @@ func (mr *MockSessionMockRecorder) Remove(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Remove", reflect.TypeOf((*MockSession)(nil).Remove), arg0)
 }
 
+// RemoveOutboundTransform mocks base method
+func (m *MockSession) RemoveOutboundTransform(arg0 string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "RemoveOutboundTransform", arg0)
+}
+
+// RemoveOutboundTransform indicates an expected call of RemoveOutboundTransform
+func (mr *MockSessionMockRecorder) RemoveOutboundTransform(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveOutboundTransform", reflect.TypeOf((*MockSession)(nil).RemoveOutboundTransform), arg0)
+}
+
 // ResponseMID mocks base method
 func (m *MockSession) ResponseMID(arg0 context.Context, arg1 uint, arg2 interface{}, arg3 ...bool) error {
 	m.ctrl.T.Helper()
@@ -402,6 +582,34 @@ func (mr *MockSessionMockRecorder) ResponseMID(arg0, arg1, arg2 interface{}, arg
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResponseMID", reflect.TypeOf((*MockSession)(nil).ResponseMID), varargs...)
 }
 
+// SchedulePeriodicPush mocks base method
+func (m *MockSession) SchedulePeriodicPush(arg0 time.Duration, arg1 string, arg2 func() interface{}) func() {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SchedulePeriodicPush", arg0, arg1, arg2)
+	ret0, _ := ret[0].(func())
+	return ret0
+}
+
+// SchedulePeriodicPush indicates an expected call of SchedulePeriodicPush
+func (mr *MockSessionMockRecorder) SchedulePeriodicPush(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SchedulePeriodicPush", reflect.TypeOf((*MockSession)(nil).SchedulePeriodicPush), arg0, arg1, arg2)
+}
+
+// SerializerName mocks base method
+func (m *MockSession) SerializerName() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SerializerName")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// SerializerName indicates an expected call of SerializerName
+func (mr *MockSessionMockRecorder) SerializerName() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SerializerName", reflect.TypeOf((*MockSession)(nil).SerializerName))
+}
+
 // Set mocks base method
 func (m *MockSession) Set(arg0 string, arg1 interface{}) error {
 	m.ctrl.T.Helper()
@@ -504,6 +712,18 @@ func (mr *MockSessionMockRecorder) SetSubscriptions(arg0 interface{}) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSubscriptions", reflect.TypeOf((*MockSession)(nil).SetSubscriptions), arg0)
 }
 
+// StopDedupPushes mocks base method
+func (m *MockSession) StopDedupPushes(arg0 string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "StopDedupPushes", arg0)
+}
+
+// StopDedupPushes indicates an expected call of StopDedupPushes
+func (mr *MockSessionMockRecorder) StopDedupPushes(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StopDedupPushes", reflect.TypeOf((*MockSession)(nil).StopDedupPushes), arg0)
+}
+
 // String mocks base method
 func (m *MockSession) String(arg0 string) string {
 	m.ctrl.T.Helper()
@@ -651,6 +871,60 @@ func (mr *MockSessionPoolMockRecorder) CloseAll() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseAll", reflect.TypeOf((*MockSessionPool)(nil).CloseAll))
 }
 
+// DumpSessions mocks base method
+func (m *MockSessionPool) DumpSessions(arg0 io.Writer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DumpSessions", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DumpSessions indicates an expected call of DumpSessions
+func (mr *MockSessionPoolMockRecorder) DumpSessions(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DumpSessions", reflect.TypeOf((*MockSessionPool)(nil).DumpSessions), arg0)
+}
+
+// ForEachSession mocks base method
+func (m *MockSessionPool) ForEachSession(arg0 func(session.Session)) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "ForEachSession", arg0)
+}
+
+// ForEachSession indicates an expected call of ForEachSession
+func (mr *MockSessionPoolMockRecorder) ForEachSession(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ForEachSession", reflect.TypeOf((*MockSessionPool)(nil).ForEachSession), arg0)
+}
+
+// GetDataCodec mocks base method
+func (m *MockSessionPool) GetDataCodec() session.DataCodec {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDataCodec")
+	ret0, _ := ret[0].(session.DataCodec)
+	return ret0
+}
+
+// GetDataCodec indicates an expected call of GetDataCodec
+func (mr *MockSessionPoolMockRecorder) GetDataCodec() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDataCodec", reflect.TypeOf((*MockSessionPool)(nil).GetDataCodec))
+}
+
+// GetHandshakeCallbacks mocks base method
+func (m *MockSessionPool) GetHandshakeCallbacks() []func(session.Session) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetHandshakeCallbacks")
+	ret0, _ := ret[0].([]func(session.Session))
+	return ret0
+}
+
+// GetHandshakeCallbacks indicates an expected call of GetHandshakeCallbacks
+func (mr *MockSessionPoolMockRecorder) GetHandshakeCallbacks() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetHandshakeCallbacks", reflect.TypeOf((*MockSessionPool)(nil).GetHandshakeCallbacks))
+}
+
 // GetSessionByID mocks base method
 func (m *MockSessionPool) GetSessionByID(arg0 int64) session.Session {
 	m.ctrl.T.Helper()
@@ -738,6 +1012,18 @@ func (mr *MockSessionPoolMockRecorder) OnAfterSessionBind(arg0 interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OnAfterSessionBind", reflect.TypeOf((*MockSessionPool)(nil).OnAfterSessionBind), arg0)
 }
 
+// OnHandshake mocks base method
+func (m *MockSessionPool) OnHandshake(arg0 func(session.Session)) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "OnHandshake", arg0)
+}
+
+// OnHandshake indicates an expected call of OnHandshake
+func (mr *MockSessionPoolMockRecorder) OnHandshake(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OnHandshake", reflect.TypeOf((*MockSessionPool)(nil).OnHandshake), arg0)
+}
+
 // OnSessionBind mocks base method
 func (m *MockSessionPool) OnSessionBind(arg0 func(context.Context, session.Session) error) {
 	m.ctrl.T.Helper()
@@ -761,3 +1047,27 @@ func (mr *MockSessionPoolMockRecorder) OnSessionClose(arg0 interface{}) *gomock.
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OnSessionClose", reflect.TypeOf((*MockSessionPool)(nil).OnSessionClose), arg0)
 }
+
+// SetDataCodec mocks base method
+func (m *MockSessionPool) SetDataCodec(arg0 session.DataCodec) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetDataCodec", arg0)
+}
+
+// SetDataCodec indicates an expected call of SetDataCodec
+func (mr *MockSessionPoolMockRecorder) SetDataCodec(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDataCodec", reflect.TypeOf((*MockSessionPool)(nil).SetDataCodec), arg0)
+}
+
+// SetLifecycleEventSink mocks base method
+func (m *MockSessionPool) SetLifecycleEventSink(arg0 session.LifecycleEventSink) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetLifecycleEventSink", arg0)
+}
+
+// SetLifecycleEventSink indicates an expected call of SetLifecycleEventSink
+func (mr *MockSessionPoolMockRecorder) SetLifecycleEventSink(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetLifecycleEventSink", reflect.TypeOf((*MockSessionPool)(nil).SetLifecycleEventSink), arg0)
+}
@@ -0,0 +1,77 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+// OutboundTransform transforms the serialized payload of a message sent to
+// the client, e.g. to redact fields. route is empty for responses
+type OutboundTransform func(route string, payload []byte) ([]byte, error)
+
+type namedOutboundTransform struct {
+	name      string
+	transform OutboundTransform
+}
+
+// AddOutboundTransform adds a transform applied to the messages sent to the
+// client of the session from now on, transforms run in the order they were
+// added. Adding a transform with the name of an existing one replaces it in
+// place. It only has effect on frontend sessions
+func (s *sessionImpl) AddOutboundTransform(name string, transform OutboundTransform) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i := range s.outboundTransforms {
+		if s.outboundTransforms[i].name == name {
+			s.outboundTransforms[i].transform = transform
+			return
+		}
+	}
+	s.outboundTransforms = append(s.outboundTransforms, namedOutboundTransform{name: name, transform: transform})
+}
+
+// RemoveOutboundTransform removes the transform added with name, if any
+func (s *sessionImpl) RemoveOutboundTransform(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i := range s.outboundTransforms {
+		if s.outboundTransforms[i].name == name {
+			s.outboundTransforms = append(s.outboundTransforms[:i], s.outboundTransforms[i+1:]...)
+			return
+		}
+	}
+}
+
+// ApplyOutboundTransforms applies the session transforms to the payload of a
+// message sent to the client on route, stopping at the first error
+func (s *sessionImpl) ApplyOutboundTransforms(route string, payload []byte) ([]byte, error) {
+	s.RLock()
+	transforms := append([]namedOutboundTransform(nil), s.outboundTransforms...)
+	s.RUnlock()
+
+	var err error
+	for _, t := range transforms {
+		payload, err = t.transform(route, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
@@ -0,0 +1,97 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendTransform(suffix string) OutboundTransform {
+	return func(route string, payload []byte) ([]byte, error) {
+		return append(append([]byte{}, payload...), suffix...), nil
+	}
+}
+
+func TestApplyOutboundTransforms(t *testing.T) {
+	t.Parallel()
+	expectedErr := errors.New("transform failed")
+
+	tables := []struct {
+		name     string
+		setup    func(s *sessionImpl)
+		expected []byte
+		err      error
+	}{
+		{"no_transforms", func(s *sessionImpl) {}, []byte("p"), nil},
+		{"in_order", func(s *sessionImpl) {
+			s.AddOutboundTransform("a", appendTransform("a"))
+			s.AddOutboundTransform("b", appendTransform("b"))
+		}, []byte("pab"), nil},
+		{"replace_in_place", func(s *sessionImpl) {
+			s.AddOutboundTransform("a", appendTransform("a"))
+			s.AddOutboundTransform("b", appendTransform("b"))
+			s.AddOutboundTransform("a", appendTransform("c"))
+		}, []byte("pcb"), nil},
+		{"remove", func(s *sessionImpl) {
+			s.AddOutboundTransform("a", appendTransform("a"))
+			s.AddOutboundTransform("b", appendTransform("b"))
+			s.RemoveOutboundTransform("a")
+			s.RemoveOutboundTransform("unknown")
+		}, []byte("pb"), nil},
+		{"error", func(s *sessionImpl) {
+			s.AddOutboundTransform("a", func(route string, payload []byte) ([]byte, error) {
+				return nil, expectedErr
+			})
+			s.AddOutboundTransform("b", appendTransform("b"))
+		}, nil, expectedErr},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			sessionPool := NewSessionPool()
+			ss := sessionPool.NewSession(nil, true).(*sessionImpl)
+			table.setup(ss)
+
+			payload, err := ss.ApplyOutboundTransforms("some.route", []byte("p"))
+			assert.Equal(t, table.err, err)
+			assert.Equal(t, table.expected, payload)
+		})
+	}
+}
+
+func TestApplyOutboundTransformsReceivesRoute(t *testing.T) {
+	t.Parallel()
+	sessionPool := NewSessionPool()
+	ss := sessionPool.NewSession(nil, true)
+
+	var route string
+	ss.AddOutboundTransform("route", func(r string, payload []byte) ([]byte, error) {
+		route = r
+		return payload, nil
+	})
+
+	_, err := ss.ApplyOutboundTransforms("some.route", []byte("p"))
+	assert.NoError(t, err)
+	assert.Equal(t, "some.route", route)
+}
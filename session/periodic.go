@@ -0,0 +1,102 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"sync"
+	"time"
+
+	"github.com/topfreegames/pitaya/v2/logger"
+)
+
+type periodicPush struct {
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (p *periodicPush) stop() {
+	p.stopOnce.Do(func() { close(p.done) })
+}
+
+// SchedulePeriodicPush pushes to the client of the session, on route, the
+// payload built by provider every interval, e.g. for HUD timers. Pushes stop
+// when the returned cancel is called or the session is closed, and failed
+// pushes are logged without stopping the next ones. It only has effect on
+// frontend sessions
+func (s *sessionImpl) SchedulePeriodicPush(interval time.Duration, route string, provider func() interface{}) (cancel func()) {
+	p := &periodicPush{done: make(chan struct{})}
+	cancel = func() {
+		s.Lock()
+		delete(s.periodicPushes, p)
+		s.Unlock()
+		p.stop()
+	}
+
+	if !s.IsFrontend || interval <= 0 {
+		logger.Log.Warnf("Periodic push not scheduled, ID=%d, Route=%s, Interval=%s", s.ID(), route, interval)
+		p.stop()
+		return cancel
+	}
+
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		p.stop()
+		return cancel
+	}
+	if s.periodicPushes == nil {
+		s.periodicPushes = map[*periodicPush]struct{}{}
+	}
+	s.periodicPushes[p] = struct{}{}
+	s.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				if err := s.Push(route, provider()); err != nil {
+					logger.Log.Warnf("Failed to push periodically, ID=%d, UID=%s, Route=%s, Error=%s",
+						s.ID(), s.UID(), route, err.Error())
+				}
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// stopPeriodicPushes stops the pushes scheduled on the session and prevents
+// new ones from being scheduled
+func (s *sessionImpl) stopPeriodicPushes() {
+	s.Lock()
+	pushes := s.periodicPushes
+	s.periodicPushes = nil
+	s.closed = true
+	s.Unlock()
+
+	for p := range pushes {
+		p.stop()
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/networkentity/mocks"
+)
+
+func TestSchedulePeriodicPush(t *testing.T) {
+	t.Parallel()
+
+	interval := 20 * time.Millisecond
+	tables := map[string]struct {
+		stop func(ss Session, cancel func(), entity *mocks.MockNetworkEntity)
+	}{
+		"test_cancel": {
+			stop: func(ss Session, cancel func(), entity *mocks.MockNetworkEntity) {
+				cancel()
+			},
+		},
+		"test_session_close": {
+			stop: func(ss Session, cancel func(), entity *mocks.MockNetworkEntity) {
+				entity.EXPECT().Close()
+				ss.Close()
+				// cancelling after the session is closed is harmless
+				cancel()
+			},
+		},
+	}
+
+	for name, table := range tables {
+		table := table
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			entity := mocks.NewMockNetworkEntity(ctrl)
+			ss := NewSessionPool().NewSession(entity, true)
+
+			pushes := make(chan interface{}, 10)
+			entity.EXPECT().Push("hud.timer", gomock.Any()).DoAndReturn(func(route string, v interface{}) error {
+				pushes <- v
+				return errors.New("push failed")
+			}).AnyTimes()
+
+			tick := 0
+			start := time.Now()
+			cancel := ss.SchedulePeriodicPush(interval, "hud.timer", func() interface{} {
+				tick++
+				return tick
+			})
+
+			// failed pushes do not stop the next ones
+			for i := 1; i <= 3; i++ {
+				select {
+				case v := <-pushes:
+					assert.Equal(t, i, v)
+				case <-time.After(10 * interval):
+					t.Fatal("push not sent")
+				}
+			}
+			assert.True(t, time.Since(start) >= 3*interval)
+
+			table.stop(ss, cancel, entity)
+			// a tick may have been pushed while stopping
+			time.Sleep(interval)
+			for len(pushes) > 0 {
+				<-pushes
+			}
+			time.Sleep(3 * interval)
+			assert.Len(t, pushes, 0)
+		})
+	}
+}
+
+func TestSchedulePeriodicPushNotScheduled(t *testing.T) {
+	t.Parallel()
+
+	tables := map[string]struct {
+		session  func(ctrl *gomock.Controller) Session
+		interval time.Duration
+	}{
+		"test_backend_session": {
+			session: func(ctrl *gomock.Controller) Session {
+				return NewSessionPool().NewSession(mocks.NewMockNetworkEntity(ctrl), false)
+			},
+			interval: time.Millisecond,
+		},
+		"test_invalid_interval": {
+			session: func(ctrl *gomock.Controller) Session {
+				return NewSessionPool().NewSession(mocks.NewMockNetworkEntity(ctrl), true)
+			},
+			interval: 0,
+		},
+		"test_closed_session": {
+			session: func(ctrl *gomock.Controller) Session {
+				entity := mocks.NewMockNetworkEntity(ctrl)
+				entity.EXPECT().Close()
+				ss := NewSessionPool().NewSession(entity, true)
+				ss.Close()
+				return ss
+			},
+			interval: time.Millisecond,
+		},
+	}
+
+	for name, table := range tables {
+		table := table
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			// the entity mock fails the test on any push
+			ss := table.session(ctrl)
+			cancel := ss.SchedulePeriodicPush(table.interval, "hud.timer", func() interface{} { return nil })
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"encoding/base64"
+
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Progress sends progress notifications of a request still being handled to
+// the client that made it. Notifications are pushed on the sys.progress route
+// carrying the request mid, so the client can associate them with the request
+type Progress struct {
+	session Session
+	mid     uint
+}
+
+type progressNotification struct {
+	MID  uint        `json:"mid"`
+	Data interface{} `json:"data"`
+}
+
+// NewProgress returns a progress handle for the request with mid of session s
+func NewProgress(s Session, mid uint) *Progress {
+	return &Progress{
+		session: s,
+		mid:     mid,
+	}
+}
+
+// MID returns the mid of the request the progress is reported for
+func (p *Progress) MID() uint {
+	return p.mid
+}
+
+// Report pushes v as a progress notification of the request. Notifications
+// reported before the handler returns are sent before its response
+func (p *Progress) Report(v interface{}) error {
+	notification, err := newProgressNotification(p.session.SerializerName(), p.mid, v)
+	if err != nil {
+		return err
+	}
+	return p.session.Push(constants.ProgressRoute, notification)
+}
+
+// newProgressNotification returns the progress notification for a client
+// using the given serializer, protobuf clients get a google.protobuf.Struct
+// with the marshaled v base64 encoded in data
+func newProgressNotification(serializerName string, mid uint, v interface{}) (interface{}, error) {
+	serializer := protobuf.NewSerializer()
+	if serializerName != serializer.GetName() {
+		return &progressNotification{MID: mid, Data: v}, nil
+	}
+
+	data, err := serializer.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &structpb.Struct{Fields: map[string]*structpb.Value{
+		"mid":  structpb.NewNumberValue(float64(mid)),
+		"data": structpb.NewStringValue(base64.StdEncoding.EncodeToString(data)),
+	}}, nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/constants"
+	"github.com/topfreegames/pitaya/v2/networkentity/mocks"
+	"github.com/topfreegames/pitaya/v2/protos"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestProgressReport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	entity := mocks.NewMockNetworkEntity(ctrl)
+	sessionPool := NewSessionPool()
+	ss := sessionPool.NewSession(entity, true)
+	progress := NewProgress(ss, 3)
+	assert.Equal(t, uint(3), progress.MID())
+
+	entity.EXPECT().Push(constants.ProgressRoute, &progressNotification{MID: 3, Data: "half"})
+	err := progress.Report("half")
+	assert.NoError(t, err)
+}
+
+func TestNewProgressNotificationProtobuf(t *testing.T) {
+	t.Parallel()
+	v := &protos.Error{Code: "some-code"}
+	notification, err := newProgressNotification("protobuf", 3, v)
+	assert.NoError(t, err)
+
+	st, ok := notification.(*structpb.Struct)
+	assert.True(t, ok)
+	assert.Equal(t, float64(3), st.Fields["mid"].GetNumberValue())
+	data, err := base64.StdEncoding.DecodeString(st.Fields["data"].GetStringValue())
+	assert.NoError(t, err)
+	decoded := &protos.Error{}
+	assert.NoError(t, proto.Unmarshal(data, decoded))
+	assert.Equal(t, v.Code, decoded.Code)
+
+	_, err = newProgressNotification("protobuf", 3, "not a proto")
+	assert.Equal(t, constants.ErrWrongValueType, err)
+}
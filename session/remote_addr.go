@@ -0,0 +1,85 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RemoteIP returns the ip of the client of the session, nil if unknown, e.g.
+// on backend servers. IPv4 addresses are returned in their 4 bytes form
+func (s *sessionImpl) RemoteIP() net.IP {
+	s.parseRemoteAddr()
+	return s.remoteIP
+}
+
+// RemotePort returns the port of the client of the session, 0 if unknown,
+// e.g. on backend servers
+func (s *sessionImpl) RemotePort() int {
+	s.parseRemoteAddr()
+	return s.remotePort
+}
+
+// parseRemoteAddr parses the remote address of the session entity the first
+// time it is called
+func (s *sessionImpl) parseRemoteAddr() {
+	s.remoteAddrOnce.Do(func() {
+		if s.entity == nil {
+			return
+		}
+		s.remoteIP, s.remotePort = parseAddr(s.entity.RemoteAddr())
+	})
+}
+
+// parseAddr returns the ip and port of addr. Addresses other than TCP and UDP
+// ones, e.g. the websocket ones of custom acceptors, are parsed from their
+// host:port string
+func parseAddr(addr net.Addr) (net.IP, int) {
+	var (
+		ip   net.IP
+		port int
+	)
+	switch a := addr.(type) {
+	case nil:
+		return nil, 0
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		host, p, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil, 0
+		}
+		if zone := strings.IndexByte(host, '%'); zone >= 0 {
+			host = host[:zone]
+		}
+		ip = net.ParseIP(host)
+		port, _ = strconv.Atoi(p)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip, port
+}
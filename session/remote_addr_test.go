@@ -0,0 +1,82 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package session
+
+import (
+	"net"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/networkentity/mocks"
+)
+
+// customAddr is an address of a type other than the TCP and UDP ones, like
+// the ones of custom acceptors
+type customAddr struct {
+	addr string
+}
+
+func (a *customAddr) Network() string { return "custom" }
+func (a *customAddr) String() string  { return a.addr }
+
+func TestSessionRemoteIPAndPort(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name string
+		addr net.Addr
+		ip   net.IP
+		port int
+	}{
+		{"ipv4", &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 41000}, net.IPv4(203, 0, 113, 7).To4(), 41000},
+		{"ipv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 41001, Zone: "eth0"}, net.ParseIP("2001:db8::1"), 41001},
+		{"udp", &net.UDPAddr{IP: net.ParseIP("203.0.113.8"), Port: 41002}, net.IPv4(203, 0, 113, 8).To4(), 41002},
+		{"custom_ipv4", &customAddr{"198.51.100.4:52000"}, net.IPv4(198, 51, 100, 4).To4(), 52000},
+		{"custom_ipv6", &customAddr{"[2001:db8::2%eth0]:52001"}, net.ParseIP("2001:db8::2"), 52001},
+		{"unparseable", &customAddr{"unix-socket"}, nil, 0},
+		{"unknown", nil, nil, 0},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockEntity := mocks.NewMockNetworkEntity(ctrl)
+			ss := NewSessionPool().NewSession(mockEntity, true)
+
+			// the address is parsed once
+			mockEntity.EXPECT().RemoteAddr().Return(table.addr).Times(1)
+			assert.Equal(t, table.ip, ss.RemoteIP())
+			assert.Equal(t, table.port, ss.RemotePort())
+			assert.Equal(t, table.ip, ss.RemoteIP())
+		})
+	}
+}
+
+func TestSessionRemoteIPWithoutEntity(t *testing.T) {
+	t.Parallel()
+
+	ss := NewSessionPool().NewSession(nil, false)
+	assert.Nil(t, ss.RemoteIP())
+	assert.Equal(t, 0, ss.RemotePort())
+}
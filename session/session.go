@@ -23,6 +23,7 @@ package session
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"net"
 	"reflect"
 	"sync"
@@ -35,6 +36,8 @@ import (
 	"github.com/topfreegames/pitaya/v2/logger"
 	"github.com/topfreegames/pitaya/v2/networkentity"
 	"github.com/topfreegames/pitaya/v2/protos"
+	"github.com/topfreegames/pitaya/v2/serialize"
+	"github.com/topfreegames/pitaya/v2/util"
 )
 
 type sessionPoolImpl struct {
@@ -42,9 +45,12 @@ type sessionPoolImpl struct {
 	afterBindCallbacks   []func(ctx context.Context, s Session) error
 	// SessionCloseCallbacks contains global session close callbacks
 	SessionCloseCallbacks []func(s Session)
+	handshakeCallbacks    []func(s Session)
 	sessionsByUID         sync.Map
 	sessionsByID          sync.Map
 	sessionIDSvc          *sessionIDService
+	dataCodec             DataCodec
+	lifecycleSink         LifecycleEventSink
 	// SessionCount keeps the current number of sessions
 	SessionCount int64
 }
@@ -54,12 +60,19 @@ type SessionPool interface {
 	NewSession(entity networkentity.NetworkEntity, frontend bool, UID ...string) Session
 	GetSessionCount() int64
 	GetSessionCloseCallbacks() []func(s Session)
+	GetHandshakeCallbacks() []func(s Session)
 	GetSessionByUID(uid string) Session
 	GetSessionByID(id int64) Session
 	OnSessionBind(f func(ctx context.Context, s Session) error)
 	OnAfterSessionBind(f func(ctx context.Context, s Session) error)
 	OnSessionClose(f func(s Session))
+	OnHandshake(f func(s Session))
 	CloseAll()
+	ForEachSession(f func(s Session))
+	SetDataCodec(codec DataCodec)
+	GetDataCodec() DataCodec
+	SetLifecycleEventSink(sink LifecycleEventSink)
+	DumpSessions(w io.Writer) error
 }
 
 // HandshakeClientData represents information about the client sent on the handshake.
@@ -68,6 +81,29 @@ type HandshakeClientData struct {
 	LibVersion  string `json:"libVersion"`
 	BuildNumber string `json:"clientBuildNumber"`
 	Version     string `json:"clientVersion"`
+	// Credit is the number of messages the client can initially receive,
+	// if it is set the server only sends messages while the client has credit
+	Credit int64 `json:"credit,omitempty"`
+	// TraceSampled is the trace sampling decision made upstream of the server,
+	// e.g. by a gateway. It overrides the decision made when the client connected
+	TraceSampled *bool `json:"traceSampled,omitempty"`
+	// HeartbeatInterval is the heartbeat interval in seconds the client asks
+	// for, the server clamps it to the range it allows
+	HeartbeatInterval float64 `json:"heartbeatInterval,omitempty"`
+	// ProtocolVersion is the version of the protocol spoken by the client
+	ProtocolVersion string `json:"protocolVersion,omitempty"`
+	// DictReference tells the client caches the route dictionary, so it can
+	// get the dictionary hash in the handshake response instead
+	DictReference bool `json:"dictReference,omitempty"`
+	// Compression lists the compression algorithms the client can inflate
+	// the message data with, in order of preference
+	Compression []string `json:"compression,omitempty"`
+	// TimestampedHeartbeat tells the client echoes the send time stamp the
+	// server heartbeats carry, so the server measures the round trip time
+	TimestampedHeartbeat bool `json:"timestampedHeartbeat,omitempty"`
+	// AffinityToken is the affinity token a reconnecting client got in the
+	// handshake response of the server it was connected to
+	AffinityToken string `json:"affinityToken,omitempty"`
 }
 
 // HandshakeData represents information about the handshake sent by the client.
@@ -93,6 +129,17 @@ type sessionImpl struct {
 	frontendSessionID int64                       // the id of the session on the frontend server
 	Subscriptions     []*nats.Subscription        // subscription created on bind when using nats rpc server
 	pool              *sessionPoolImpl
+	// transforms applied to the messages sent to the client
+	outboundTransforms []namedOutboundTransform
+	// last payload pushed on each route whose consecutive duplicates are skipped
+	dedupedPushes map[string][]byte
+	// pushes scheduled to be sent periodically until the session is closed
+	periodicPushes map[*periodicPush]struct{}
+	closed         bool
+	// ip and port of the client, parsed from the entity remote address once
+	remoteAddrOnce sync.Once
+	remoteIP       net.IP
+	remotePort     int
 }
 
 // Session represents a client session, which can store data during the connection.
@@ -108,6 +155,7 @@ type Session interface {
 	SetSubscriptions(subscriptions []*nats.Subscription)
 
 	Push(route string, v interface{}) error
+	PushWith(ctx context.Context, serializer serialize.Serializer, route string, v interface{}) error
 	ResponseMID(ctx context.Context, mid uint, v interface{}, err ...bool) error
 	ID() int64
 	UID() string
@@ -115,12 +163,18 @@ type Session interface {
 	SetData(data map[string]interface{}) error
 	GetDataEncoded() []byte
 	SetDataEncoded(encodedData []byte) error
+	ExportData() ([]byte, error)
+	ImportData(exported []byte) error
 	SetFrontendData(frontendID string, frontendSessionID int64)
 	Bind(ctx context.Context, uid string) error
 	Kick(ctx context.Context) error
 	OnClose(c func()) error
 	Close()
+	Flush(ctx context.Context) error
 	RemoteAddr() net.Addr
+	RemoteIP() net.IP
+	RemotePort() int
+	SerializerName() string
 	Remove(key string) error
 	Set(key string, value interface{}) error
 	HasKey(key string) bool
@@ -143,6 +197,15 @@ type Session interface {
 	Clear()
 	SetHandshakeData(data *HandshakeData)
 	GetHandshakeData() *HandshakeData
+	Capabilities() Capabilities
+	DisconnectReason() DisconnectReason
+	AddOutboundTransform(name string, transform OutboundTransform)
+	RemoveOutboundTransform(name string)
+	ApplyOutboundTransforms(route string, payload []byte) ([]byte, error)
+	DedupPushes(route string)
+	StopDedupPushes(route string)
+	IsDuplicatePush(route string, payload []byte) bool
+	SchedulePeriodicPush(interval time.Duration, route string, provider func() interface{}) (cancel func())
 }
 
 type sessionIDService struct {
@@ -189,7 +252,10 @@ func NewSessionPool() SessionPool {
 		sessionBindCallbacks:  make([]func(ctx context.Context, s Session) error, 0),
 		afterBindCallbacks:    make([]func(ctx context.Context, s Session) error, 0),
 		SessionCloseCallbacks: make([]func(s Session), 0),
+		handshakeCallbacks:    make([]func(s Session), 0),
 		sessionIDSvc:          newSessionIDService(),
+		dataCodec:             NewJSONDataCodec(),
+		lifecycleSink:         noopLifecycleEventSink{},
 	}
 }
 
@@ -201,6 +267,10 @@ func (pool *sessionPoolImpl) GetSessionCloseCallbacks() []func(s Session) {
 	return pool.SessionCloseCallbacks
 }
 
+func (pool *sessionPoolImpl) GetHandshakeCallbacks() []func(s Session) {
+	return pool.handshakeCallbacks
+}
+
 // GetSessionByUID return a session bound to an user id
 func (pool *sessionPoolImpl) GetSessionByUID(uid string) Session {
 	// TODO: Block this operation in backend servers
@@ -258,6 +328,21 @@ func (pool *sessionPoolImpl) OnSessionClose(f func(s Session)) {
 	pool.SessionCloseCallbacks = append(pool.SessionCloseCallbacks, f)
 }
 
+// OnHandshake adds a method that will be called when every client completes
+// the handshake, before its first data packet is handled, e.g. to preload the
+// data its first request needs. The session has its handshake data set but
+// is usually not bound to an UID yet
+func (pool *sessionPoolImpl) OnHandshake(f func(s Session)) {
+	sf1 := reflect.ValueOf(f)
+	for _, fun := range pool.handshakeCallbacks {
+		sf2 := reflect.ValueOf(fun)
+		if sf1.Pointer() == sf2.Pointer() {
+			return
+		}
+	}
+	pool.handshakeCallbacks = append(pool.handshakeCallbacks, f)
+}
+
 // CloseAll calls Close on all sessions
 func (pool *sessionPoolImpl) CloseAll() {
 	logger.Log.Debugf("closing all sessions, %d sessions", pool.SessionCount)
@@ -269,6 +354,33 @@ func (pool *sessionPoolImpl) CloseAll() {
 	logger.Log.Debug("finished closing sessions")
 }
 
+// SetDataCodec sets the codec used for exporting and importing session data
+func (pool *sessionPoolImpl) SetDataCodec(codec DataCodec) {
+	pool.dataCodec = codec
+}
+
+// GetDataCodec returns the codec used for exporting and importing session data
+func (pool *sessionPoolImpl) GetDataCodec() DataCodec {
+	return pool.dataCodec
+}
+
+// SetLifecycleEventSink sets the sink that receives the connect, bind, unbind
+// and close events of the frontend sessions, a nil sink discards them
+func (pool *sessionPoolImpl) SetLifecycleEventSink(sink LifecycleEventSink) {
+	if sink == nil {
+		sink = noopLifecycleEventSink{}
+	}
+	pool.lifecycleSink = sink
+}
+
+// ForEachSession calls f for every session bound to this frontend server
+func (pool *sessionPoolImpl) ForEachSession(f func(s Session)) {
+	pool.sessionsByID.Range(func(_, value interface{}) bool {
+		f(value.(Session))
+		return true
+	})
+}
+
 func (s *sessionImpl) updateEncodedData() error {
 	var b []byte
 	b, err := json.Marshal(s.data)
@@ -314,6 +426,24 @@ func (s *sessionImpl) Push(route string, v interface{}) error {
 	return s.entity.Push(route, v)
 }
 
+// PushWith pushes a message to the client serializing v with serializer
+// instead of the one of the client, a nil serializer behaves like Push.
+// Network entities that can't override the serializer, e.g. on backend
+// servers, receive the message already serialized
+func (s *sessionImpl) PushWith(ctx context.Context, serializer serialize.Serializer, route string, v interface{}) error {
+	if p, ok := s.entity.(networkentity.SerializerPusher); ok {
+		return p.PushWith(ctx, serializer, route, v)
+	}
+	if serializer == nil {
+		return s.entity.Push(route, v)
+	}
+	data, err := util.SerializeOrRaw(serializer, v)
+	if err != nil {
+		return err
+	}
+	return s.entity.Push(route, data)
+}
+
 // ResponseMID responses message to client, mid is
 // request message ID
 func (s *sessionImpl) ResponseMID(ctx context.Context, mid uint, v interface{}, err ...bool) error {
@@ -352,6 +482,26 @@ func (s *sessionImpl) GetDataEncoded() []byte {
 	return s.encodedData
 }
 
+// ExportData returns the session data encoded with the pool data codec
+func (s *sessionImpl) ExportData() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.pool.dataCodec.Encode(s.data)
+}
+
+// ImportData sets the whole session data from data exported with the
+// pool data codec
+func (s *sessionImpl) ImportData(exported []byte) error {
+	data, err := s.pool.dataCodec.Decode(exported)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	return s.SetData(data)
+}
+
 // SetDataEncoded sets the whole session data from an encoded value
 func (s *sessionImpl) SetDataEncoded(encodedData []byte) error {
 	if len(encodedData) == 0 {
@@ -401,6 +551,7 @@ func (s *sessionImpl) Bind(ctx context.Context, uid string) error {
 	// if code running on frontend server
 	if s.IsFrontend {
 		s.pool.sessionsByUID.Store(uid, s)
+		s.publishLifecycleEvent(LifecycleEventBind)
 	} else {
 		// If frontentID is set this means it is a remote call and the current server
 		// is not the frontend server that received the user request
@@ -439,6 +590,13 @@ func (s *sessionImpl) Close() {
 	atomic.AddInt64(&s.pool.SessionCount, -1)
 	s.pool.sessionsByID.Delete(s.ID())
 	s.pool.sessionsByUID.Delete(s.UID())
+	if s.UID() != "" {
+		s.publishLifecycleEvent(LifecycleEventUnbind)
+	}
+	if s.GetHandshakeData() != nil {
+		s.publishLifecycleEvent(LifecycleEventClose)
+	}
+	s.stopPeriodicPushes()
 	// TODO: this logic should be moved to nats rpc server
 	if s.IsFrontend && s.Subscriptions != nil && len(s.Subscriptions) > 0 {
 		// if the user is bound to an userid and nats rpc server is being used we need to unsubscribe
@@ -459,6 +617,32 @@ func (s *sessionImpl) RemoteAddr() net.Addr {
 	return s.entity.RemoteAddr()
 }
 
+// Flush waits until the messages pushed to the session are written to the
+// client or ctx is done, it returns right away if the session network entity
+// doesn't queue messages, e.g. on backend servers
+func (s *sessionImpl) Flush(ctx context.Context) error {
+	if f, ok := s.entity.(networkentity.Flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// SerializerName returns the name of the serializer negotiated with the
+// client, or an empty string if the network entity of the session does not
+// know it. Backend sessions return the serializer of the client that made
+// the request being handled
+func (s *sessionImpl) SerializerName() string {
+	p, ok := s.entity.(networkentity.SerializerProvider)
+	if !ok {
+		return ""
+	}
+	serializer := p.GetSerializer()
+	if serializer == nil {
+		return ""
+	}
+	return serializer.GetName()
+}
+
 // Remove delete data associated with the key from session storage
 func (s *sessionImpl) Remove(key string) error {
 	s.Lock()
@@ -752,9 +936,15 @@ func (s *sessionImpl) Clear() {
 // SetHandshakeData sets the handshake data received by the client.
 func (s *sessionImpl) SetHandshakeData(data *HandshakeData) {
 	s.Lock()
-	defer s.Unlock()
-
+	connected := s.handshakeData == nil && data != nil
 	s.handshakeData = data
+	s.Unlock()
+
+	// the handshake data is only set once the handshake is accepted, which
+	// is when the client is considered connected
+	if connected {
+		s.publishLifecycleEvent(LifecycleEventConnect)
+	}
 }
 
 // GetHandshakeData gets the handshake data received by the client.
@@ -38,8 +38,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/topfreegames/pitaya/v2/constants"
 	"github.com/topfreegames/pitaya/v2/helpers"
+	"github.com/topfreegames/pitaya/v2/networkentity"
 	"github.com/topfreegames/pitaya/v2/networkentity/mocks"
 	"github.com/topfreegames/pitaya/v2/protos"
+	"github.com/topfreegames/pitaya/v2/serialize"
+	serializemocks "github.com/topfreegames/pitaya/v2/serialize/mocks"
 )
 
 var update = flag.Bool("update", false, "update .golden files")
@@ -124,6 +127,27 @@ func TestCloseAll(t *testing.T) {
 	}
 }
 
+func TestForEachSession(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	entity := mocks.NewMockNetworkEntity(ctrl)
+	sessionPool := NewSessionPool()
+	expected := map[int64]bool{}
+	for i := 0; i < 3; i++ {
+		s := sessionPool.NewSession(entity, true, uuid.New().String())
+		expected[s.ID()] = true
+	}
+	// backend sessions are not kept by the pool
+	sessionPool.NewSession(entity, false)
+
+	visited := map[int64]bool{}
+	sessionPool.ForEachSession(func(s Session) {
+		visited[s.ID()] = true
+	})
+	assert.Equal(t, expected, visited)
+}
+
 func TestNew(t *testing.T) {
 	tables := []struct {
 		name     string
@@ -672,6 +696,76 @@ func TestSessionRemoteAddr(t *testing.T) {
 	assert.Equal(t, expectedAddr, addr)
 }
 
+type serializerEntity struct {
+	networkentity.NetworkEntity
+	serializer serialize.Serializer
+}
+
+func (e *serializerEntity) GetSerializer() serialize.Serializer {
+	return e.serializer
+}
+
+func TestSessionSerializerName(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sessionPool := NewSessionPool()
+	assert.Equal(t, "", sessionPool.NewSession(nil, false).SerializerName())
+
+	assert.Equal(t, "", sessionPool.NewSession(mocks.NewMockNetworkEntity(ctrl), true).SerializerName())
+	assert.Equal(t, "", sessionPool.NewSession(&serializerEntity{}, true).SerializerName())
+
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+	mockSerializer.EXPECT().GetName().Return("json")
+	entity := &serializerEntity{serializer: mockSerializer}
+	assert.Equal(t, "json", sessionPool.NewSession(entity, true).SerializerName())
+}
+
+type serializerPusherEntity struct {
+	networkentity.NetworkEntity
+	serializer serialize.Serializer
+	route      string
+	v          interface{}
+}
+
+func (e *serializerPusherEntity) PushWith(ctx context.Context, serializer serialize.Serializer, route string, v interface{}) error {
+	e.serializer = serializer
+	e.route = route
+	e.v = v
+	return nil
+}
+
+func TestSessionPushWith(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sessionPool := NewSessionPool()
+	mockSerializer := serializemocks.NewMockSerializer(ctrl)
+
+	pusher := &serializerPusherEntity{}
+	err := sessionPool.NewSession(pusher, true).PushWith(context.Background(), mockSerializer, "debug.state", "state")
+	assert.NoError(t, err)
+	assert.Equal(t, mockSerializer, pusher.serializer)
+	assert.Equal(t, "debug.state", pusher.route)
+	assert.Equal(t, "state", pusher.v)
+
+	entity := mocks.NewMockNetworkEntity(ctrl)
+	ss := sessionPool.NewSession(entity, false)
+	mockSerializer.EXPECT().Marshal("state").Return([]byte(`"state"`), nil)
+	entity.EXPECT().Push("debug.state", []byte(`"state"`))
+	assert.NoError(t, ss.PushWith(context.Background(), mockSerializer, "debug.state", "state"))
+
+	entity.EXPECT().Push("debug.state", "state")
+	assert.NoError(t, ss.PushWith(context.Background(), nil, "debug.state", "state"))
+
+	mockSerializer.EXPECT().Marshal("state").Return(nil, errors.New("marshal failed"))
+	assert.EqualError(t, ss.PushWith(context.Background(), mockSerializer, "debug.state", "state"), "marshal failed")
+}
+
 func TestSessionSet(t *testing.T) {
 	t.Parallel()
 
@@ -749,6 +843,23 @@ func TestOnSessionBind(t *testing.T) {
 	assert.True(t, expected)
 }
 
+func TestOnHandshake(t *testing.T) {
+	calls := 0
+	f := func(Session) { calls++ }
+	sessionPool := NewSessionPool().(*sessionPoolImpl)
+	sessionPool.OnHandshake(f)
+	// the same function is only added once
+	sessionPool.OnHandshake(f)
+	sessionPool.OnHandshake(func(Session) { calls++ })
+
+	callbacks := sessionPool.GetHandshakeCallbacks()
+	assert.Len(t, callbacks, 2)
+	for _, cb := range callbacks {
+		cb(nil)
+	}
+	assert.Equal(t, 2, calls)
+}
+
 func TestSessionHasKey(t *testing.T) {
 	t.Parallel()
 
@@ -1448,3 +1559,83 @@ func TestSessionSetHandshakeData(t *testing.T) {
 		})
 	}
 }
+
+type capabilitiesEntity struct {
+	networkentity.NetworkEntity
+	capabilities Capabilities
+}
+
+func (e *capabilitiesEntity) Capabilities() Capabilities {
+	return e.capabilities
+}
+
+func TestSessionCapabilities(t *testing.T) {
+	t.Parallel()
+
+	ss := NewSessionPool().NewSession(nil, false)
+	assert.Equal(t, Capabilities{}, ss.Capabilities())
+
+	capabilities := Capabilities{
+		Serializer:        "protos",
+		Compression:       true,
+		Encryption:        true,
+		ProtocolVersion:   "2",
+		Subprotocol:       "pitaya.v2",
+		HeartbeatInterval: 30 * time.Second,
+		FlowControl:       true,
+	}
+	entity := &capabilitiesEntity{capabilities: capabilities}
+	ss = NewSessionPool().NewSession(entity, true)
+	assert.Equal(t, capabilities, ss.Capabilities())
+
+	entity.capabilities.FlowControl = false
+	assert.False(t, ss.Capabilities().FlowControl)
+}
+
+func TestSessionExportImportData(t *testing.T) {
+	tables := []struct {
+		name  string
+		codec DataCodec
+	}{
+		{"json", NewJSONDataCodec()},
+		{"protobuf", NewProtobufDataCodec()},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			sourcePool := NewSessionPool()
+			sourcePool.SetDataCodec(table.codec)
+			assert.Equal(t, table.codec, sourcePool.GetDataCodec())
+			source := sourcePool.NewSession(nil, false)
+			err := source.SetData(complexSessionData)
+			assert.NoError(t, err)
+
+			exported, err := source.ExportData()
+			assert.NoError(t, err)
+
+			targetPool := NewSessionPool()
+			targetPool.SetDataCodec(table.codec)
+			target := targetPool.NewSession(nil, false)
+			err = target.ImportData(exported)
+			assert.NoError(t, err)
+			assert.Equal(t, complexSessionData, target.GetData())
+			assert.Equal(t, source.GetDataEncoded(), target.GetDataEncoded())
+		})
+	}
+}
+
+func TestSessionImportDataFailsWithOtherCodec(t *testing.T) {
+	sourcePool := NewSessionPool()
+	source := sourcePool.NewSession(nil, false)
+	err := source.Set("key", "value")
+	assert.NoError(t, err)
+	exported, err := source.ExportData()
+	assert.NoError(t, err)
+
+	targetPool := NewSessionPool()
+	targetPool.SetDataCodec(NewProtobufDataCodec())
+	target := targetPool.NewSession(nil, false)
+	err = target.ImportData(exported)
+	assert.Error(t, err)
+	assert.Empty(t, target.GetData())
+}
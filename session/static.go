@@ -32,6 +32,12 @@ func OnSessionClose(f func(s Session)) {
 	DefaultSessionPool.OnSessionClose(f)
 }
 
+// OnHandshake adds a method that will be called when every client completes
+// the handshake
+func OnHandshake(f func(s Session)) {
+	DefaultSessionPool.OnHandshake(f)
+}
+
 // CloseAll calls Close on all sessions
 func CloseAll() {
 	DefaultSessionPool.CloseAll()
@@ -22,15 +22,19 @@ package pitaya
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/spf13/viper"
+	"github.com/topfreegames/pitaya/v2/acceptor"
 	"github.com/topfreegames/pitaya/v2/cluster"
 	"github.com/topfreegames/pitaya/v2/component"
 	"github.com/topfreegames/pitaya/v2/config"
+	"github.com/topfreegames/pitaya/v2/conn/message"
 	"github.com/topfreegames/pitaya/v2/interfaces"
 	"github.com/topfreegames/pitaya/v2/metrics"
+	"github.com/topfreegames/pitaya/v2/networkentity"
 	"github.com/topfreegames/pitaya/v2/router"
 	"github.com/topfreegames/pitaya/v2/session"
 	"github.com/topfreegames/pitaya/v2/worker"
@@ -105,6 +109,10 @@ func SetDictionary(dict map[string]uint16) error {
 	return DefaultApp.SetDictionary(dict)
 }
 
+func GetRouteUsage() []message.RouteUsage {
+	return DefaultApp.GetRouteUsage()
+}
+
 func AddRoute(serverType string, routingFunction router.RoutingFunc) error {
 	return DefaultApp.AddRoute(serverType, routingFunction)
 }
@@ -113,6 +121,34 @@ func Shutdown() {
 	DefaultApp.Shutdown()
 }
 
+func NotifyShutdown(eta time.Duration) {
+	DefaultApp.NotifyShutdown(eta)
+}
+
+func DumpSessions(w io.Writer) error {
+	return DefaultApp.DumpSessions(w)
+}
+
+func InvalidateResponseCache(route string, keys ...string) {
+	DefaultApp.InvalidateResponseCache(route, keys...)
+}
+
+func HandlersInFlight() int64 {
+	return DefaultApp.HandlersInFlight()
+}
+
+func AcceptorConnections() map[string]acceptor.ConnectionCounts {
+	return DefaultApp.AcceptorConnections()
+}
+
+func ForEachAgent(f func(a networkentity.NetworkEntity, snapshot networkentity.Snapshot)) {
+	DefaultApp.ForEachAgent(f)
+}
+
+func SetReady() {
+	DefaultApp.SetReady()
+}
+
 func StartWorker() {
 	DefaultApp.StartWorker()
 }
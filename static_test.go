@@ -256,6 +256,26 @@ func TestStaticShutdown(t *testing.T) {
 	Shutdown()
 }
 
+func TestStaticNotifyShutdown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	app := mocks.NewMockPitaya(ctrl)
+	app.EXPECT().NotifyShutdown(time.Minute)
+
+	DefaultApp = app
+	NotifyShutdown(time.Minute)
+}
+
+func TestStaticSetReady(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	app := mocks.NewMockPitaya(ctrl)
+	app.EXPECT().SetReady()
+
+	DefaultApp = app
+	SetReady()
+}
+
 func TestStaticStartWorker(t *testing.T) {
 	ctrl := gomock.NewController(t)
 
@@ -0,0 +1,219 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package otel
+
+import (
+	"context"
+	"sync"
+
+	"github.com/topfreegames/pitaya/v2/constants"
+	pcontext "github.com/topfreegames/pitaya/v2/context"
+	"github.com/topfreegames/pitaya/v2/errors"
+	"github.com/topfreegames/pitaya/v2/logger"
+	"github.com/topfreegames/pitaya/v2/pipeline"
+	"github.com/topfreegames/pitaya/v2/session"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// instrumentationName is the name of the tracer of the spans
+	instrumentationName = "github.com/topfreegames/pitaya/v2"
+	// connectionSpanName is the name of the span covering a client connection
+	connectionSpanName = "pitaya.connection"
+)
+
+// Span attribute keys
+const (
+	SessionIDKey = attribute.Key("pitaya.session.id")
+	UIDKey       = attribute.Key("pitaya.uid")
+	PlatformKey  = attribute.Key("pitaya.platform")
+	RouteKey     = attribute.Key("pitaya.route")
+	StatusKey    = attribute.Key("pitaya.status")
+	ErrorCodeKey = attribute.Key("pitaya.error.code")
+)
+
+// Values of the status attribute of the request spans
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// Tracer creates OpenTelemetry spans from the session lifecycle events and the
+// handler hooks: a span covering each client connection, from the handshake
+// until the session is closed, and a span for each request handled, child of
+// the span propagated in the request metadata if any and of the connection
+// span of the session otherwise
+type Tracer struct {
+	tracer      trace.Tracer
+	propagator  propagation.TextMapPropagator
+	next        session.LifecycleEventSink
+	mutex       sync.Mutex
+	connections map[int64]trace.Span // connection span of each session, by session id
+}
+
+// NewTracer returns a tracer creating its spans with provider. The spans are
+// propagated to the RPCs in the W3C trace context format. The lifecycle
+// events are forwarded to next once handled, next may be nil
+func NewTracer(provider trace.TracerProvider, next session.LifecycleEventSink) *Tracer {
+	return &Tracer{
+		tracer:      provider.Tracer(instrumentationName),
+		propagator:  propagation.TraceContext{},
+		next:        next,
+		connections: map[int64]trace.Span{},
+	}
+}
+
+// Register makes the tracer receive the lifecycle events of the sessions of
+// pool and run before and after the handlers of hooks. It must be called
+// before the app starts
+func (t *Tracer) Register(pool session.SessionPool, hooks *pipeline.HandlerHooks) {
+	pool.SetLifecycleEventSink(t)
+	hooks.BeforeHandler.PushFront(t.BeforeHandler)
+	hooks.AfterHandler.PushBack(t.AfterHandler)
+}
+
+// Publish starts the connection span of a session on its connect event, sets
+// its uid on the bind event and ends it on the close event
+func (t *Tracer) Publish(event *session.LifecycleEvent) {
+	switch event.Type {
+	case session.LifecycleEventConnect:
+		attrs := []attribute.KeyValue{SessionIDKey.Int64(event.SessionID)}
+		if event.HandshakeData != nil && event.HandshakeData.Sys.Platform != "" {
+			attrs = append(attrs, PlatformKey.String(event.HandshakeData.Sys.Platform))
+		}
+		_, span := t.tracer.Start(context.Background(), connectionSpanName,
+			trace.WithTimestamp(event.Timestamp),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...),
+		)
+		t.mutex.Lock()
+		t.connections[event.SessionID] = span
+		t.mutex.Unlock()
+	case session.LifecycleEventBind:
+		if span := t.connection(event.SessionID); span != nil {
+			span.SetAttributes(UIDKey.String(event.UID))
+		}
+	case session.LifecycleEventClose:
+		t.mutex.Lock()
+		span := t.connections[event.SessionID]
+		delete(t.connections, event.SessionID)
+		t.mutex.Unlock()
+		if span != nil {
+			span.End(trace.WithTimestamp(event.Timestamp))
+		}
+	}
+	if t.next != nil {
+		t.next.Publish(event)
+	}
+}
+
+func (t *Tracer) connection(sessionID int64) trace.Span {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.connections[sessionID]
+}
+
+// BeforeHandler starts the span of a request, named after its route, and
+// propagates it to the RPCs made by the handler
+func (t *Tracer) BeforeHandler(ctx context.Context, in interface{}) (context.Context, interface{}, error) {
+	parent := t.Extract(ctx)
+	s, _ := ctx.Value(constants.SessionCtxKey).(session.Session)
+	if !trace.SpanContextFromContext(parent).IsValid() && s != nil {
+		if span := t.connection(s.ID()); span != nil {
+			parent = trace.ContextWithSpan(parent, span)
+		}
+	}
+
+	route, _ := pcontext.GetFromPropagateCtx(ctx, constants.RouteKey).(string)
+	attrs := []attribute.KeyValue{RouteKey.String(route)}
+	if s != nil {
+		attrs = append(attrs, SessionIDKey.Int64(s.ID()))
+		if uid := s.UID(); uid != "" {
+			attrs = append(attrs, UIDKey.String(uid))
+		}
+	}
+	_, span := t.tracer.Start(parent, route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+	ctx = trace.ContextWithSpan(ctx, span)
+	return t.Inject(ctx), in, nil
+}
+
+// AfterHandler ends the span of a request, with its status and the code of
+// the error returned by the handler, if any
+func (t *Tracer) AfterHandler(ctx context.Context, out interface{}, err error) (interface{}, error) {
+	span := trace.SpanFromContext(ctx)
+	if !span.SpanContext().IsValid() {
+		return out, err
+	}
+	if err != nil {
+		span.SetAttributes(StatusKey.String(StatusError), ErrorCodeKey.String(errors.CodeFromError(err)))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(StatusKey.String(StatusOK))
+	}
+	span.End()
+	return out, err
+}
+
+// Inject adds the span of ctx to its propagatable content, so the RPCs made
+// with it carry the span to the servers handling them
+func (t *Tracer) Inject(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{}
+	t.propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return pcontext.AddToPropagateCtx(ctx, constants.OTelSpanPropagateCtxKey, map[string]string(carrier))
+}
+
+// Extract returns a context holding the span propagated in the request
+// metadata of ctx, or a context without span if there is none
+func (t *Tracer) Extract(ctx context.Context) context.Context {
+	val := pcontext.GetFromPropagateCtx(ctx, constants.OTelSpanPropagateCtxKey)
+	if val == nil {
+		return context.Background()
+	}
+	carrier := propagation.MapCarrier{}
+	switch v := val.(type) {
+	case map[string]string:
+		for k, s := range v {
+			carrier[k] = s
+		}
+	case map[string]interface{}:
+		// the propagated content is decoded from JSON on the servers the
+		// RPCs are sent to
+		for k, s := range v {
+			if str, ok := s.(string); ok {
+				carrier[k] = str
+			}
+		}
+	default:
+		logger.Log.Warnf("invalid opentelemetry span carrier: %+v", val)
+		return context.Background()
+	}
+	return t.propagator.Extract(context.Background(), carrier)
+}
@@ -0,0 +1,170 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package otel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/constants"
+	pcontext "github.com/topfreegames/pitaya/v2/context"
+	"github.com/topfreegames/pitaya/v2/errors"
+	"github.com/topfreegames/pitaya/v2/networkentity/mocks"
+	"github.com/topfreegames/pitaya/v2/pipeline"
+	"github.com/topfreegames/pitaya/v2/session"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type fakeLifecycleEventSink struct {
+	events []*session.LifecycleEvent
+}
+
+func (f *fakeLifecycleEventSink) Publish(event *session.LifecycleEvent) {
+	f.events = append(f.events, event)
+}
+
+func newTestTracer(next session.LifecycleEventSink) (*Tracer, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return NewTracer(provider, next), exporter
+}
+
+func attributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func handle(tracer *Tracer, ctx context.Context, route string, err error) {
+	ctx = pcontext.AddToPropagateCtx(ctx, constants.RouteKey, route)
+	ctx, _, _ = tracer.BeforeHandler(ctx, nil)
+	_, _ = tracer.AfterHandler(ctx, nil, err)
+}
+
+func TestTracerConnectionAndRequestSpans(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sink := &fakeLifecycleEventSink{}
+	tracer, exporter := newTestTracer(sink)
+	sessionPool := session.NewSessionPool()
+	hooks := pipeline.NewHandlerHooks()
+	tracer.Register(sessionPool, hooks)
+	assert.Len(t, hooks.BeforeHandler.Handlers, 1)
+	assert.Len(t, hooks.AfterHandler.Handlers, 1)
+
+	mockEntity := mocks.NewMockNetworkEntity(ctrl)
+	ss := sessionPool.NewSession(mockEntity, true)
+	ss.SetHandshakeData(&session.HandshakeData{Sys: session.HandshakeClientData{Platform: "mac"}})
+	assert.NoError(t, ss.Bind(context.Background(), "uid"))
+
+	ctx := context.WithValue(context.Background(), constants.SessionCtxKey, ss)
+	handle(tracer, ctx, "room.room.join", nil)
+	handle(tracer, ctx, "room.room.leave", errors.NewError(assert.AnError, "GAME-404"))
+
+	mockEntity.EXPECT().Close()
+	ss.Close()
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 3)
+	join, leave, connection := spans[0], spans[1], spans[2]
+
+	assert.Equal(t, "pitaya.connection", connection.Name)
+	assert.False(t, connection.Parent.IsValid())
+	connAttrs := attributes(connection)
+	assert.Equal(t, ss.ID(), connAttrs[SessionIDKey].AsInt64())
+	assert.Equal(t, "mac", connAttrs[PlatformKey].AsString())
+	assert.Equal(t, "uid", connAttrs[UIDKey].AsString())
+
+	assert.Equal(t, "room.room.join", join.Name)
+	assert.Equal(t, trace.SpanKindServer, join.SpanKind)
+	assert.Equal(t, connection.SpanContext.SpanID(), join.Parent.SpanID())
+	assert.Equal(t, connection.SpanContext.TraceID(), join.SpanContext.TraceID())
+	joinAttrs := attributes(join)
+	assert.Equal(t, "room.room.join", joinAttrs[RouteKey].AsString())
+	assert.Equal(t, "uid", joinAttrs[UIDKey].AsString())
+	assert.Equal(t, StatusOK, joinAttrs[StatusKey].AsString())
+
+	assert.Equal(t, connection.SpanContext.SpanID(), leave.Parent.SpanID())
+	leaveAttrs := attributes(leave)
+	assert.Equal(t, StatusError, leaveAttrs[StatusKey].AsString())
+	assert.Equal(t, "GAME-404", leaveAttrs[ErrorCodeKey].AsString())
+	assert.Equal(t, codes.Error, leave.Status.Code)
+
+	assert.Len(t, sink.events, 4)
+}
+
+func TestTracerPropagatesSpanInRequestMetadata(t *testing.T) {
+	frontend, frontendExporter := newTestTracer(nil)
+	backend, backendExporter := newTestTracer(nil)
+
+	ctx := pcontext.AddToPropagateCtx(context.Background(), constants.RouteKey, "connector.entry")
+	ctx, _, err := frontend.BeforeHandler(ctx, nil)
+	assert.NoError(t, err)
+	carrier := pcontext.GetFromPropagateCtx(ctx, constants.OTelSpanPropagateCtxKey)
+	assert.NotNil(t, carrier)
+
+	// the propagated content reaches the backend decoded from JSON
+	remote := map[string]interface{}{}
+	for k, v := range carrier.(map[string]string) {
+		remote[k] = v
+	}
+	backendCtx := pcontext.AddToPropagateCtx(context.Background(), constants.OTelSpanPropagateCtxKey, remote)
+	handle(backend, backendCtx, "room.room.join", nil)
+	_, _ = frontend.AfterHandler(ctx, nil, nil)
+
+	entry := frontendExporter.GetSpans()
+	join := backendExporter.GetSpans()
+	assert.Len(t, entry, 1)
+	assert.Len(t, join, 1)
+	assert.True(t, join[0].Parent.IsRemote())
+	assert.Equal(t, entry[0].SpanContext.SpanID(), join[0].Parent.SpanID())
+	assert.Equal(t, entry[0].SpanContext.TraceID(), join[0].SpanContext.TraceID())
+}
+
+func TestTracerRequestWithoutSessionOrParent(t *testing.T) {
+	tracer, exporter := newTestTracer(nil)
+
+	handle(tracer, context.Background(), "room.room.join", nil)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	assert.False(t, spans[0].Parent.IsValid())
+	_, ok := attributes(spans[0])[UIDKey]
+	assert.False(t, ok)
+}
+
+func TestTracerAfterHandlerWithoutSpan(t *testing.T) {
+	tracer, exporter := newTestTracer(nil)
+
+	out, err := tracer.AfterHandler(context.Background(), "out", assert.AnError)
+	assert.Equal(t, "out", out)
+	assert.Equal(t, assert.AnError, err)
+	assert.Empty(t, exporter.GetSpans())
+}
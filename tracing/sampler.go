@@ -0,0 +1,56 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tracing
+
+import (
+	"math/rand"
+)
+
+// ConnectionSampler decides, when a client connects, whether all the
+// requests made through the connection are traced
+type ConnectionSampler interface {
+	Sample() bool
+}
+
+// ProbabilisticConnectionSampler samples connections with a fixed probability
+type ProbabilisticConnectionSampler struct {
+	rate float64
+}
+
+// NewProbabilisticConnectionSampler returns a sampler that samples a connection
+// with probability rate, which goes from 0 to 1
+func NewProbabilisticConnectionSampler(rate float64) *ProbabilisticConnectionSampler {
+	return &ProbabilisticConnectionSampler{rate: rate}
+}
+
+// Sample returns whether the connection is sampled
+func (s *ProbabilisticConnectionSampler) Sample() bool {
+	return rand.Float64() < s.rate
+}
+
+// SamplingPriority returns the value of the sampling.priority span tag
+// that forces the given sampling decision on the tracer
+func SamplingPriority(sampled bool) uint16 {
+	if sampled {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,190 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package util
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/topfreegames/pitaya/v2/constants"
+	e "github.com/topfreegames/pitaya/v2/errors"
+	"github.com/topfreegames/pitaya/v2/serialize"
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ErrorPayloadFormat is the format of the error payloads sent to the clients
+type ErrorPayloadFormat string
+
+const (
+	// ErrorPayloadFormatDefault encodes the errors as a protos.Error with
+	// their code, message and metadata
+	ErrorPayloadFormatDefault ErrorPayloadFormat = "default"
+	// ErrorPayloadFormatProblem encodes the errors as RFC 7807 problem details
+	ErrorPayloadFormatProblem ErrorPayloadFormat = "problem"
+)
+
+// problemTypePrefix is the prefix of the type of the problem details of an
+// error, which is followed by the error code
+const problemTypePrefix = "urn:pitaya:error:"
+
+// problemInstanceKey is the metadata key of an error holding the instance of
+// its problem details
+const problemInstanceKey = "instance"
+
+var errorPayloadFormat atomic.Value // ErrorPayloadFormat
+
+// SetErrorPayloadFormat sets the format of the error payloads created by
+// GetErrorPayload and read by GetErrorFromPayload. It applies to the whole
+// process, an empty format is the default one
+func SetErrorPayloadFormat(format ErrorPayloadFormat) error {
+	switch format {
+	case "":
+		format = ErrorPayloadFormatDefault
+	case ErrorPayloadFormatDefault, ErrorPayloadFormatProblem:
+	default:
+		return constants.ErrUnknownErrorPayloadFormat
+	}
+	errorPayloadFormat.Store(format)
+	return nil
+}
+
+// GetErrorPayloadFormat returns the format of the error payloads
+func GetErrorPayloadFormat() ErrorPayloadFormat {
+	if format, ok := errorPayloadFormat.Load().(ErrorPayloadFormat); ok {
+		return format
+	}
+	return ErrorPayloadFormatDefault
+}
+
+// ProblemDetails is an error in the RFC 7807 problem details format, with the
+// pitaya error code and metadata as extension members
+type ProblemDetails struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Code     string            `json:"code"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// NewProblemDetails returns the problem details of err. The status of the
+// PIT-4xx and PIT-5xx codes is the HTTP status in them and 500 for the other
+// codes, the title is the text of the status and the instance is the
+// instance metadata of err, if any
+func NewProblemDetails(err error) *ProblemDetails {
+	code := e.ErrUnknownCode
+	var metadata map[string]string
+	if val, ok := err.(*e.Error); ok {
+		code = val.Code
+		metadata = val.Metadata
+	}
+	status := problemStatus(code)
+	title := http.StatusText(status)
+	if title == "" {
+		title = code
+	}
+	problem := &ProblemDetails{
+		Type:   problemTypePrefix + code,
+		Title:  title,
+		Status: status,
+		Detail: err.Error(),
+		Code:   code,
+	}
+	if len(metadata) > 0 {
+		problem.Instance = metadata[problemInstanceKey]
+		problem.Metadata = metadata
+	}
+	return problem
+}
+
+// problemStatus returns the HTTP status of the problem details of an error
+// with code
+func problemStatus(code string) int {
+	if !strings.HasPrefix(code, "PIT-") {
+		return http.StatusInternalServerError
+	}
+	status, err := strconv.Atoi(strings.TrimPrefix(code, "PIT-"))
+	if err != nil || status < 400 || status > 599 {
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// getProblemPayload serializes the problem details of err, protobuf clients
+// get a google.protobuf.Struct with the same fields
+func getProblemPayload(serializer serialize.Serializer, err error) ([]byte, error) {
+	problem := NewProblemDetails(err)
+	if _, ok := serializer.(*protobuf.Serializer); !ok {
+		return SerializeOrRaw(serializer, problem)
+	}
+	fields := map[string]interface{}{
+		"type":   problem.Type,
+		"title":  problem.Title,
+		"status": problem.Status,
+		"code":   problem.Code,
+	}
+	if problem.Detail != "" {
+		fields["detail"] = problem.Detail
+	}
+	if problem.Instance != "" {
+		fields["instance"] = problem.Instance
+	}
+	if len(problem.Metadata) > 0 {
+		metadata := make(map[string]interface{}, len(problem.Metadata))
+		for key, value := range problem.Metadata {
+			metadata[key] = value
+		}
+		fields["metadata"] = metadata
+	}
+	s, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, err
+	}
+	return serializer.Marshal(s)
+}
+
+// getErrorFromProblemPayload returns the error whose problem details are in
+// payload
+func getErrorFromProblemPayload(serializer serialize.Serializer, payload []byte) error {
+	problem := &ProblemDetails{}
+	if _, ok := serializer.(*protobuf.Serializer); ok {
+		s := &structpb.Struct{}
+		_ = serializer.Unmarshal(payload, s)
+		problem.Code = s.Fields["code"].GetStringValue()
+		problem.Detail = s.Fields["detail"].GetStringValue()
+		if metadata := s.Fields["metadata"].GetStructValue(); metadata != nil {
+			problem.Metadata = make(map[string]string, len(metadata.Fields))
+			for key, value := range metadata.Fields {
+				problem.Metadata[key] = value.GetStringValue()
+			}
+		}
+	} else {
+		_ = serializer.Unmarshal(payload, problem)
+	}
+	if problem.Code == "" {
+		problem.Code = e.ErrUnknownCode
+	}
+	return &e.Error{Code: problem.Code, Message: problem.Detail, Metadata: problem.Metadata}
+}
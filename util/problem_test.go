@@ -0,0 +1,141 @@
+// Copyright (c) TFG Co. All Rights Reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package util
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/topfreegames/pitaya/v2/constants"
+	e "github.com/topfreegames/pitaya/v2/errors"
+	"github.com/topfreegames/pitaya/v2/serialize/json"
+	"github.com/topfreegames/pitaya/v2/serialize/protobuf"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestSetErrorPayloadFormat(t *testing.T) {
+	defer SetErrorPayloadFormat(ErrorPayloadFormatDefault)
+
+	assert.Equal(t, ErrorPayloadFormatDefault, GetErrorPayloadFormat())
+	assert.NoError(t, SetErrorPayloadFormat(ErrorPayloadFormatProblem))
+	assert.Equal(t, ErrorPayloadFormatProblem, GetErrorPayloadFormat())
+	assert.Equal(t, constants.ErrUnknownErrorPayloadFormat, SetErrorPayloadFormat("xml"))
+	assert.Equal(t, ErrorPayloadFormatProblem, GetErrorPayloadFormat())
+	assert.NoError(t, SetErrorPayloadFormat(""))
+	assert.Equal(t, ErrorPayloadFormatDefault, GetErrorPayloadFormat())
+}
+
+func TestNewProblemDetails(t *testing.T) {
+	tables := []struct {
+		name     string
+		err      error
+		expected *ProblemDetails
+	}{
+		{"not_found", e.NewError(errors.New("room not found"), e.ErrNotFoundCode, map[string]string{"instance": "/rooms/42"}), &ProblemDetails{
+			Type:     "urn:pitaya:error:PIT-404",
+			Title:    "Not Found",
+			Status:   404,
+			Detail:   "room not found",
+			Instance: "/rooms/42",
+			Code:     "PIT-404",
+			Metadata: map[string]string{"instance": "/rooms/42"},
+		}},
+		{"too_many_requests", e.NewError(errors.New("quota exceeded"), e.ErrTooManyRequestsCode, map[string]string{"resetMs": "100"}), &ProblemDetails{
+			Type:     "urn:pitaya:error:PIT-429",
+			Title:    "Too Many Requests",
+			Status:   429,
+			Detail:   "quota exceeded",
+			Code:     "PIT-429",
+			Metadata: map[string]string{"resetMs": "100"},
+		}},
+		{"status_without_text", e.NewError(errors.New("client closed"), e.ErrClientClosedRequest), &ProblemDetails{
+			Type:   "urn:pitaya:error:PIT-499",
+			Title:  "PIT-499",
+			Status: 499,
+			Detail: "client closed",
+			Code:   "PIT-499",
+		}},
+		{"app_code", e.NewError(errors.New("not enough gold"), "GAME-001"), &ProblemDetails{
+			Type:   "urn:pitaya:error:GAME-001",
+			Title:  "Internal Server Error",
+			Status: 500,
+			Detail: "not enough gold",
+			Code:   "GAME-001",
+		}},
+		{"unknown_error", errors.New("boom"), &ProblemDetails{
+			Type:   "urn:pitaya:error:PIT-000",
+			Title:  "Internal Server Error",
+			Status: 500,
+			Detail: "boom",
+			Code:   "PIT-000",
+		}},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			assert.Equal(t, table.expected, NewProblemDetails(table.err))
+		})
+	}
+}
+
+func TestGetErrorPayloadProblem(t *testing.T) {
+	assert.NoError(t, SetErrorPayloadFormat(ErrorPayloadFormatProblem))
+	defer SetErrorPayloadFormat(ErrorPayloadFormatDefault)
+
+	err := e.NewError(errors.New("room not found"), e.ErrNotFoundCode, map[string]string{"instance": "/rooms/42"})
+
+	t.Run("json", func(t *testing.T) {
+		serializer := json.NewSerializer()
+		payload, perr := GetErrorPayload(serializer, err)
+		assert.NoError(t, perr)
+		assert.JSONEq(t, `{
+			"type": "urn:pitaya:error:PIT-404",
+			"title": "Not Found",
+			"status": 404,
+			"detail": "room not found",
+			"instance": "/rooms/42",
+			"code": "PIT-404",
+			"metadata": {"instance": "/rooms/42"}
+		}`, string(payload))
+		assert.Equal(t, err, GetErrorFromPayload(serializer, payload))
+	})
+
+	t.Run("protobuf", func(t *testing.T) {
+		serializer := protobuf.NewSerializer()
+		payload, perr := GetErrorPayload(serializer, err)
+		assert.NoError(t, perr)
+		s := &structpb.Struct{}
+		assert.NoError(t, serializer.Unmarshal(payload, s))
+		assert.Equal(t, "urn:pitaya:error:PIT-404", s.Fields["type"].GetStringValue())
+		assert.Equal(t, "Not Found", s.Fields["title"].GetStringValue())
+		assert.Equal(t, float64(404), s.Fields["status"].GetNumberValue())
+		assert.Equal(t, "room not found", s.Fields["detail"].GetStringValue())
+		assert.Equal(t, "/rooms/42", s.Fields["instance"].GetStringValue())
+		assert.Equal(t, "PIT-404", s.Fields["code"].GetStringValue())
+		assert.Equal(t, err, GetErrorFromPayload(serializer, payload))
+	})
+
+	t.Run("unreadable_payload", func(t *testing.T) {
+		readErr := GetErrorFromPayload(json.NewSerializer(), []byte("not json"))
+		assert.Equal(t, &e.Error{Code: e.ErrUnknownCode}, readErr)
+	})
+}
@@ -124,6 +124,9 @@ func FileExists(filename string) bool {
 
 // GetErrorFromPayload gets the error from payload
 func GetErrorFromPayload(serializer serialize.Serializer, payload []byte) error {
+	if GetErrorPayloadFormat() == ErrorPayloadFormatProblem {
+		return getErrorFromProblemPayload(serializer, payload)
+	}
 	err := &e.Error{Code: e.ErrUnknownCode}
 	switch serializer.(type) {
 	case *json.Serializer:
@@ -136,8 +139,12 @@ func GetErrorFromPayload(serializer serialize.Serializer, payload []byte) error
 	return err
 }
 
-// GetErrorPayload creates and serializes an error payload
+// GetErrorPayload creates and serializes an error payload in the format set
+// with SetErrorPayloadFormat
 func GetErrorPayload(serializer serialize.Serializer, err error) ([]byte, error) {
+	if GetErrorPayloadFormat() == ErrorPayloadFormatProblem {
+		return getProblemPayload(serializer, err)
+	}
 	code := e.ErrUnknownCode
 	msg := err.Error()
 	metadata := map[string]string{}